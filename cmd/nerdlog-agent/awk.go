@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/benhoyt/goawk/interp"
+	"github.com/benhoyt/goawk/parser"
+	"github.com/juju/errors"
+)
+
+// awkTimeExprs are the awk expressions which extract the time components from
+// a log line; they're given by the client in the --awktime-* flags, and the
+// defaults are for the traditional syslog format, like "Apr  5 11:07:46".
+//
+// NOTE: the year expression may use the already-computed month, as "month".
+type awkTimeExprs struct {
+	month     string
+	year      string
+	day       string
+	hhmm      string
+	minuteKey string
+}
+
+func defaultAWKTimeExprs() awkTimeExprs {
+	return awkTimeExprs{
+		month:     `monthByName[substr($0, 1, 3)]`,
+		year:      `yearByMonth[month]`,
+		day:       `(substr($0, 5, 1) == " ") ? "0" substr($0, 6, 1) : substr($0, 5, 2)`,
+		hhmm:      `substr($0, 8, 5)`,
+		minuteKey: `substr($0, 1, 12)`,
+	}
+}
+
+var monthNames = []string{
+	"Jan", "Feb", "Mar", "Apr", "May", "Jun",
+	"Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+}
+
+// awkVarsBegin returns the BEGIN-block code which sets up the monthByName and
+// yearByMonth arrays, which are used by the default time expressions.
+func (ag *agent) awkVarsBegin() string {
+	var sb strings.Builder
+
+	for i, name := range monthNames {
+		month := i + 1
+		fmt.Fprintf(&sb, "monthByName[%q] = \"%02d\";\n", name, month)
+		fmt.Fprintf(
+			&sb, "yearByMonth[\"%02d\"] = \"%d\";\n",
+			month, inferYear(month, ag.curYear, ag.curMonth),
+		)
+	}
+
+	return sb.String()
+}
+
+// inferYear returns the year of a log line with the given month, since the
+// traditional syslog timestamps don't have it.
+func inferYear(logMonth, curYear, curMonth int) int {
+	delta := logMonth - curMonth
+
+	switch {
+	case delta <= -11:
+		// Log month is Jan, current is Dec -> next year
+		return curYear + 1
+	case delta >= 8:
+		// Log month is Sep-Dec, current is Jan -> previous year
+		return curYear - 1
+	default:
+		return curYear
+	}
+}
+
+// runAWK parses and runs the given awk program on the input, with the given
+// native functions available to it. The program's own output goes to stderr,
+// since stdout is reserved for the agent's protocol.
+func (ag *agent) runAWK(src string, funcs map[string]interface{}, input io.Reader) error {
+	prog, err := parser.ParseProgram([]byte(src), &parser.ParserConfig{
+		Funcs: funcs,
+	})
+	if err != nil {
+		return errors.Annotatef(err, "parsing awk program")
+	}
+
+	status, err := interp.ExecProgram(prog, &interp.Config{
+		Stdin:   input,
+		Output:  ag.stderr,
+		Error:   ag.stderr,
+		Funcs:   funcs,
+		Environ: []string{},
+		// The user patterns are not supposed to do any of that.
+		NoExec:       true,
+		NoFileWrites: true,
+		NoFileReads:  true,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if status != 0 {
+		return errors.Errorf("awk exited with status %d", status)
+	}
+
+	return nil
+}
+
+// isAWKFalse returns whether the input line would be false in awk: either
+// empty, or looking like a number which is zero (like "0" or "0.0").
+func isAWKFalse(s string) bool {
+	s = strings.Trim(s, " \t\n")
+	if s == "" {
+		return true
+	}
+
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !strings.ContainsRune("0123456789.+-eE", r)
+	}) >= 0 {
+		return false
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	return err == nil && v == 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// cleanup deletes (or with --dry-run, only lists) all the nerdlog files of the
+// current user in the work dir: the agents (and their temporary copies during
+// the upload), the index files, the query output chunks left after an
+// interrupted query, and the dummy empty log file which older versions of the
+// agents used to create. The agent itself is kept, unless --all is given.
+func (ag *agent) cleanup() error {
+	fnames, err := ag.listOwnFiles(func(name string) bool {
+		return strings.HasPrefix(name, "nerdlog_agent_") || name == emptyFileName
+	})
+	if err != nil {
+		// Just like find(1) in the shell agent, ignore the errors; there's just
+		// nothing to clean up.
+		return nil
+	}
+
+	for _, fname := range fnames {
+		if !ag.cleanupAll && fname == ag.argv0 {
+			continue
+		}
+
+		// Another logstream on the same host might have deleted it already.
+		stat, err := os.Stat(fname)
+		if err != nil {
+			continue
+		}
+
+		if ag.dryRun {
+			fmt.Fprintf(ag.stdout, "file:%d:%s\n", stat.Size(), fname)
+		} else if err := os.Remove(fname); err == nil {
+			fmt.Fprintf(ag.stdout, "deleted:%d:%s\n", stat.Size(), fname)
+		} else if fileExists(fname) {
+			fmt.Fprintf(ag.stdout, "%serror:failed to delete %s\n", ag.markerPrefix, fname)
+		}
+	}
+
+	return nil
+}
+
+// deleteStaleIndexFiles deletes the index files of the current user which
+// weren't modified for more than --index-ttl-days days, except our own ones.
+func (ag *agent) deleteStaleIndexFiles() {
+	fnames, err := ag.listOwnFiles(func(name string) bool {
+		return strings.HasPrefix(name, "nerdlog_agent_index_")
+	})
+	if err != nil {
+		return
+	}
+
+	ownIndexFile := filepath.Clean(ag.indexFile)
+	ownMembersFile := filepath.Clean(ag.membersFile())
+
+	now := time.Now()
+	for _, fname := range fnames {
+		if fname == ownIndexFile || fname == ownMembersFile {
+			continue
+		}
+
+		stat, err := os.Stat(fname)
+		if err != nil {
+			continue
+		}
+
+		// Same as "find -mtime +N": the age is rounded down to whole days.
+		ageDays := int(now.Sub(stat.ModTime()) / (24 * time.Hour))
+		if ageDays > ag.indexTTLDays {
+			os.Remove(fname)
+		}
+	}
+}
+
+// listOwnFiles returns the paths to the files in the work dir which belong to
+// the current user and have names accepted by the filter.
+func (ag *agent) listOwnFiles(filter func(name string) bool) ([]string, error) {
+	entries, err := os.ReadDir(ag.workDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret []string
+	for _, entry := range entries {
+		if !filter(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !isOwnFile(info) {
+			continue
+		}
+
+		ret = append(ret, filepath.Join(ag.workDir, entry.Name()))
+	}
+
+	return ret, nil
+}
+
+func touchFile(fname string) {
+	now := time.Now()
+	os.Chtimes(fname, now, now)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The compressed rotated log files can't be indexed or queried by offsets
+// directly, so for every one of them, the member cache file keeps the number
+// of lines, the decompressed size, and the index lines relative to the
+// beginning of the decompressed file. The format is the same as the one of
+// the shell agent:
+//
+//	member	1234567:1741600800	12345	780011
+//	member_idx	1234567:1741600800	2025-03-08-06:00	1	1
+//	...
+//
+// The key is the inode and the modification time, which don't change when the
+// logs get rotated further (only the names do), so every compressed file is
+// only decompressed once to index it, even when the index is rebuilt.
+const (
+	memberCacheKeyMember = "member"
+	memberCacheKeyIdx    = "member_idx"
+)
+
+// memberInfo is what the member cache keeps about a compressed log file,
+// except the index lines.
+type memberInfo struct {
+	numLines int64
+	size     int64
+}
+
+// decompressorName returns the command which the shell agent uses to
+// decompress the given log file, or an empty string if it's not compressed.
+func decompressorName(fname string) string {
+	switch {
+	case strings.HasSuffix(fname, ".gz"):
+		return "zcat"
+	case strings.HasSuffix(fname, ".zst"):
+		return "zstdcat"
+	default:
+		return ""
+	}
+}
+
+// openLogfile opens the log file for reading; the compressed ones are
+// decompressed on the fly.
+func openLogfile(fname string) (io.ReadCloser, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch decompressorName(fname) {
+	case "zcat":
+		zr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotatef(err, "decompressing %s", fname)
+		}
+
+		return &decompressingReader{Reader: zr, closers: []io.Closer{zr, f}}, nil
+
+	case "zstdcat":
+		zr, err := zstd.NewReader(bufio.NewReader(f), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotatef(err, "decompressing %s", fname)
+		}
+
+		return &decompressingReader{
+			Reader: zr,
+			closers: []io.Closer{
+				closerFunc(func() error { zr.Close(); return nil }),
+				f,
+			},
+		}, nil
+
+	default:
+		return f, nil
+	}
+}
+
+// decompressingReader reads from the decompressor, and closes both the
+// decompressor and the underlying file.
+type decompressingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *decompressingReader) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func (ag *agent) membersFile() string {
+	return ag.indexFile + "_members"
+}
+
+// memberKey returns the member cache key of the given compressed log file.
+func memberKey(fname string) (string, error) {
+	stat, err := os.Stat(fname)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	inode, ok := fileInode(stat)
+	if !ok {
+		return "", errors.Errorf("failed to get inode of %s", fname)
+	}
+
+	return fmt.Sprintf("%d:%d", inode, stat.ModTime().Unix()), nil
+}
+
+// readMembersLines returns all the lines of the member cache file, split by
+// tabs, or nothing if the file doesn't exist.
+func (ag *agent) readMembersLines() ([][]string, error) {
+	data, err := os.ReadFile(ag.membersFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, errors.Trace(err)
+	}
+
+	var ret [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		ret = append(ret, strings.Split(line, "\t"))
+	}
+
+	return ret, nil
+}
+
+// memberInfoFromCache returns the info about the compressed log file with the
+// given key, as stored in the member cache.
+func (ag *agent) memberInfoFromCache(key string) (memberInfo, bool, error) {
+	lines, err := ag.readMembersLines()
+	if err != nil {
+		return memberInfo{}, false, errors.Trace(err)
+	}
+
+	for _, fields := range lines {
+		if fields[0] != memberCacheKeyMember || len(fields) != 4 || fields[1] != key {
+			continue
+		}
+
+		numLines, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return memberInfo{}, false, errors.Annotatef(err, "parsing member lines")
+		}
+
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return memberInfo{}, false, errors.Annotatef(err, "parsing member size")
+		}
+
+		return memberInfo{numLines: numLines, size: size}, true, nil
+	}
+
+	return memberInfo{}, false, nil
+}
+
+// memberIndexEntries returns the index entries of the compressed log file
+// with the given key, relative to its beginning.
+func (ag *agent) memberIndexEntries(key string) ([]indexEntry, error) {
+	lines, err := ag.readMembersLines()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret []indexEntry
+	for _, fields := range lines {
+		if fields[0] != memberCacheKeyIdx || len(fields) < 2 || fields[1] != key {
+			continue
+		}
+
+		// Without the key, it's the same as the idx line in the index.
+		entry, err := parseIndexEntry(append([]string{indexKeyIdx}, fields[2:]...))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret = append(ret, entry)
+	}
+
+	return ret, nil
+}
+
+// indexMember decompresses and indexes the given compressed log file, and
+// adds it to the member cache with the given key. Nothing is added unless the
+// whole file is indexed successfully.
+func (ag *agent) indexMember(fname, key string) error {
+	fmt.Fprintf(ag.stderr, "debug:indexing compressed logfile %s\n", fname)
+
+	var buf bytes.Buffer
+	scan := &indexScan{
+		ag:     ag,
+		w:      &buf,
+		idxKey: memberCacheKeyIdx + "\t" + key,
+	}
+
+	if err := scan.runMember(fname); err != nil {
+		fmt.Fprintf(ag.stderr, "debug:failed to index compressed logfile %s\n", fname)
+		return errors.Trace(err)
+	}
+
+	fmt.Fprintf(&buf, "%s\t%s\t%d\t%d\n", memberCacheKeyMember, key, scan.numLines, scan.numBytes)
+
+	f, err := os.OpenFile(ag.membersFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(buf.Bytes())
+	return errors.Trace(err)
+}
+
+// forgetStaleMembers deletes the compressed files which aren't among our log
+// files anymore (normally, logrotate has deleted them) from the member cache.
+func (ag *agent) forgetStaleMembers() error {
+	lines, err := ag.readMembersLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if lines == nil && !fileExists(ag.membersFile()) {
+		return nil
+	}
+
+	var contents strings.Builder
+	for _, fields := range lines {
+		if len(fields) < 2 || fields[1] == "" || !containsString(ag.memberKeys, fields[1]) {
+			continue
+		}
+
+		contents.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+
+	if contents.Len() == 0 {
+		return errors.Trace(removeIfExists(ag.membersFile()))
+	}
+
+	return errors.Trace(os.WriteFile(ag.membersFile(), []byte(contents.String()), 0666))
+}
+
+// getLogfileSizes returns the sizes of all the log files; for the compressed
+// ones, the decompressed size is used, which we get from the member cache,
+// indexing them first if needed. It also sets ag.memberKeys.
+func (ag *agent) getLogfileSizes() (logfileSizes, error) {
+	sizes := make(logfileSizes, len(ag.logfiles))
+	ag.memberKeys = make([]string, len(ag.logfiles))
+
+	for i := len(ag.logfiles) - 1; i >= 0; i-- {
+		fname := ag.logfiles[i]
+
+		if decompressorName(fname) == "" {
+			stat, err := os.Stat(fname)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			sizes[i] = stat.Size()
+			continue
+		}
+
+		key, err := memberKey(fname)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ag.memberKeys[i] = key
+
+		info, found, err := ag.memberInfoFromCache(key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if !found {
+			if err := ag.indexMember(fname, key); err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			info, found, err = ag.memberInfoFromCache(key)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			if !found {
+				return nil, errors.Errorf("no member info for %s after indexing it", fname)
+			}
+		}
+
+		sizes[i] = info.size
+	}
+
+	if err := ag.forgetStaleMembers(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return sizes, nil
+}
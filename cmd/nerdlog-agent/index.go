@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// The index file has the same format as the one of the shell agent, so that
+// switching between the agents doesn't invalidate it:
+//
+//	rotated_logfile	2025-03-09 10:20:00.000000000 +0000	/var/log/syslog.2
+//	rotated_logfile	2025-03-10 10:20:00.000000000 +0000	/var/log/syslog.1
+//	logfile_lines	0	/var/log/syslog.2
+//	idx	2025-03-08-06:00	1	1
+//	...
+//	logfile_lines	12345	/var/log/syslog.1
+//	idx	2025-03-09-10:20	12346	780012
+//	...
+//	logfile_lines	23456	/var/log/syslog
+//	idx	2025-03-10-10:20	23457	1560024
+//	...
+//
+// The "rotated_logfile" lines contain the modification time and the path of
+// every rotated log file, the oldest first; if any of them changes, the index
+// has to be rebuilt. Every "logfile_lines" line contains the number of lines
+// before the given log file.
+//
+// Every "idx" line contains the timestr like "2006-01-02-15:04", and the
+// line number and byte number (both 1-based) of the first log line with that
+// timestr, counting from the beginning of the oldest log file; the newer log
+// files follow it. For the compressed log files, the idx lines are copied from
+// the member cache, see compressed.go.
+const (
+	indexKeyIdx            = "idx"
+	indexKeyRotatedLogfile = "rotated_logfile"
+	indexKeyLogfileLines   = "logfile_lines"
+)
+
+// statTimeLayout is the format of the modification time as printed by
+// "stat -c %y", which is what the shell agent stores in the index.
+const statTimeLayout = "2006-01-02 15:04:05.000000000 -0700"
+
+type indexLookupResult string
+
+const (
+	// indexLookupFound means the timestr is found in the index, or it's in
+	// between two index entries; then the linenr and bytenr are those of the
+	// later entry.
+	indexLookupFound indexLookupResult = "found"
+	// indexLookupBefore means the timestr is earlier than the earliest log we
+	// have.
+	indexLookupBefore indexLookupResult = "before"
+	// indexLookupAfter means the timestr is later than the latest log we have.
+	indexLookupAfter indexLookupResult = "after"
+)
+
+type indexEntry struct {
+	timestr string
+	linenr  int64
+	bytenr  int64
+}
+
+// readIndexLines returns all the lines of the index file, split by tabs.
+func (ag *agent) readIndexLines() ([][]string, error) {
+	data, err := os.ReadFile(ag.indexFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		ret = append(ret, strings.Split(line, "\t"))
+	}
+
+	return ret, nil
+}
+
+// logfileLines returns the number of lines before the given log file, as
+// stored in the index.
+func logfileLines(lines [][]string, fname string) (int64, bool, error) {
+	for _, fields := range lines {
+		if fields[0] != indexKeyLogfileLines || len(fields) != 3 || fields[2] != fname {
+			continue
+		}
+
+		numLines, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, false, errors.Annotatef(err, "parsing logfile_lines for %s", fname)
+		}
+
+		return numLines, true, nil
+	}
+
+	return 0, false, nil
+}
+
+// lastIndexTimestr returns the timestr of the last "idx" line in the index,
+// or an empty string if there are no such lines.
+func lastIndexTimestr(lines [][]string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i][0] == indexKeyIdx && len(lines[i]) > 1 {
+			return lines[i][1]
+		}
+	}
+
+	return ""
+}
+
+// rotatedLogfilesIndexLines returns the "rotated_logfile" index lines (without
+// the trailing newlines) for the current rotated log files, the oldest first.
+func (ag *agent) rotatedLogfilesIndexLines() ([]string, error) {
+	var ret []string
+	for i := len(ag.logfiles) - 1; i >= 1; i-- {
+		stat, err := os.Stat(ag.logfiles[i])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret = append(ret, fmt.Sprintf(
+			"%s\t%s\t%s", indexKeyRotatedLogfile, stat.ModTime().Format(statTimeLayout), ag.logfiles[i],
+		))
+	}
+
+	return ret, nil
+}
+
+// indexLookup looks up the given timestr like "2006-01-02-15:04" (typically
+// given as --from or --to) in the index.
+func (ag *agent) indexLookup(timestr string) (indexLookupResult, indexEntry, error) {
+	lines, err := ag.readIndexLines()
+	if err != nil {
+		return "", indexEntry{}, errors.Trace(err)
+	}
+
+	isFirstIdx := true
+	for _, fields := range lines {
+		if fields[0] != indexKeyIdx {
+			continue
+		}
+
+		entry, err := parseIndexEntry(fields)
+		if err != nil {
+			return "", indexEntry{}, errors.Trace(err)
+		}
+
+		if timestr == entry.timestr {
+			return indexLookupFound, entry, nil
+		} else if timestr < entry.timestr {
+			if isFirstIdx {
+				return indexLookupBefore, indexEntry{}, nil
+			}
+
+			return indexLookupFound, entry, nil
+		}
+
+		isFirstIdx = false
+	}
+
+	return indexLookupAfter, indexEntry{}, nil
+}
+
+func parseIndexEntry(fields []string) (indexEntry, error) {
+	if len(fields) != 4 {
+		return indexEntry{}, errors.Errorf("malformed index line %q", strings.Join(fields, "\t"))
+	}
+
+	linenr, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return indexEntry{}, errors.Annotatef(err, "parsing index linenr")
+	}
+
+	bytenr, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return indexEntry{}, errors.Annotatef(err, "parsing index bytenr")
+	}
+
+	return indexEntry{
+		timestr: fields[1],
+		linenr:  linenr,
+		bytenr:  bytenr,
+	}, nil
+}
+
+// updateIndex adds the new entries to the index, or builds it from scratch
+// if it doesn't exist.
+func (ag *agent) updateIndex(sizes logfileSizes) error {
+	// If the query is cancelled while we're indexing, the index would be left
+	// half-written, so remove it.
+	sigCh := make(chan os.Signal, 1)
+	doneCh := make(chan struct{})
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigCh:
+			os.Remove(ag.indexFile)
+			os.Exit(1)
+		case <-doneCh:
+		}
+	}()
+	defer func() {
+		signal.Reset(syscall.SIGTERM)
+		close(doneCh)
+	}()
+
+	if stat, err := os.Stat(ag.indexFile); err == nil && stat.Size() > 0 {
+		return errors.Trace(ag.indexUp(sizes))
+	}
+
+	return errors.Trace(ag.indexFromScratch(sizes))
+}
+
+func (ag *agent) indexUp(sizes logfileSizes) error {
+	fmt.Fprintf(ag.stderr, "p:stage:%d:indexing up\n", stageIndexAppend)
+
+	lines, err := ag.readIndexLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	lastBytesBefore := sizes.bytesBefore(0)
+
+	// Normally the last index line is an "idx" one; if it's not (the latest log
+	// file had no lines at all when it was indexed), start from the beginning
+	// of the latest log file.
+	var last indexEntry
+	if len(lines) > 0 && lines[len(lines)-1][0] == indexKeyIdx {
+		last, err = parseIndexEntry(lines[len(lines)-1])
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		numLines, _, err := logfileLines(lines, ag.logfileLast())
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		last.linenr = numLines + 1
+		last.bytenr = lastBytesBefore + 1
+	}
+
+	offset := last.bytenr - lastBytesBefore - 1
+	if offset < 0 {
+		offset = 0
+	}
+
+	err = ag.appendToIndex(func(w io.Writer) error {
+		scan := &indexScan{
+			ag:           ag,
+			w:            w,
+			idxKey:       indexKeyIdx,
+			lastTimestr:  lastIndexTimestr(lines),
+			linenrOffset: last.linenr - 1,
+			bytenrOffset: last.bytenr - 1,
+			// The percentage is relative to the indexed part.
+			percentOffset: 0,
+			percentTotal:  sizes.total() - last.bytenr,
+		}
+
+		return errors.Trace(scan.run(ag.logfileLast(), offset))
+	})
+	if err != nil {
+		fmt.Fprintf(ag.stderr, "debug:failed to index up, removing index file\n")
+		os.Remove(ag.indexFile)
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (ag *agent) indexFromScratch(sizes logfileSizes) error {
+	fmt.Fprintf(ag.stderr, "p:stage:%d:indexing from scratch\n", stageIndexFull)
+
+	rotatedLines, err := ag.rotatedLogfilesIndexLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var indexContents strings.Builder
+	for _, line := range rotatedLines {
+		indexContents.WriteString(line + "\n")
+	}
+
+	if err := os.WriteFile(ag.indexFile, []byte(indexContents.String()), 0666); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Index all the log files one by one, the oldest first. Before every log
+	// file, we store the number of lines before it, and the last timestr from
+	// the previous log file is carried over, otherwise there is a gap in index
+	// before the first line of the next log file.
+	var lastTimestr string
+	var linesBefore int64
+
+	for i := len(ag.logfiles) - 1; i >= 0; i-- {
+		fname := ag.logfiles[i]
+
+		err := ag.appendToIndex(func(w io.Writer) error {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", indexKeyLogfileLines, linesBefore, fname)
+
+			// The compressed log files are already indexed in the member cache, so
+			// we only copy the index lines from there, adjusting the numbers.
+			if ag.memberKeys[i] != "" {
+				numLines, err := ag.copyMemberIndex(w, i, &lastTimestr, linesBefore, sizes)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				linesBefore += numLines
+
+				return nil
+			}
+
+			scan := &indexScan{
+				ag:            ag,
+				w:             w,
+				idxKey:        indexKeyIdx,
+				lastTimestr:   lastTimestr,
+				linenrOffset:  linesBefore,
+				bytenrOffset:  sizes.bytesBefore(i),
+				percentOffset: sizes.bytesBefore(i),
+				percentTotal:  sizes.total(),
+			}
+
+			if err := scan.run(fname, 0); err != nil {
+				return errors.Trace(err)
+			}
+
+			lastTimestr = scan.lastTimestr
+			linesBefore += scan.numLines
+
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(ag.stderr, "debug:failed to index from scratch %s, removing index file\n", fname)
+			os.Remove(ag.indexFile)
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// copyMemberIndex writes the idx lines of the i-th log file (which must be
+// compressed) from the member cache, with the line and byte numbers counted from
+// the beginning of the oldest log file, and returns the number of lines in it.
+// Just like indexScan, it checks that the timestr doesn't go down, and updates
+// lastTimestr.
+func (ag *agent) copyMemberIndex(
+	w io.Writer, i int, lastTimestr *string, linesBefore int64, sizes logfileSizes,
+) (int64, error) {
+	key := ag.memberKeys[i]
+
+	info, found, err := ag.memberInfoFromCache(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if !found {
+		return 0, errors.Errorf("no member info for %s", ag.logfiles[i])
+	}
+
+	entries, err := ag.memberIndexEntries(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var prog progress
+	for _, entry := range entries {
+		if entry.timestr < *lastTimestr {
+			fmt.Fprintf(
+				ag.stderr,
+				"%serror:timestamp decreased from %s to %s, might be using inconsistent timestamp formats\n",
+				ag.markerPrefix, *lastTimestr, entry.timestr,
+			)
+			return 0, &exitError{code: 1}
+		}
+
+		bytenr := entry.bytenr + sizes.bytesBefore(i)
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", indexKeyIdx, entry.timestr, entry.linenr+linesBefore, bytenr)
+		prog.print(ag.stderr, bytenr, sizes.total())
+
+		*lastTimestr = entry.timestr
+	}
+
+	return info.numLines, nil
+}
+
+// appendToIndex opens the index file for appending, and calls f with a
+// buffered writer to it.
+func (ag *agent) appendToIndex(f func(w io.Writer) error) error {
+	indexFile, err := os.OpenFile(ag.indexFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer indexFile.Close()
+
+	w := bufio.NewWriter(indexFile)
+
+	if err := f(w); err != nil {
+		// Still flush what we have, just like awk would have written it.
+		w.Flush()
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(w.Flush())
+}
+
+// indexScan scans a single log file and writes an "idx" line for every
+// minute.
+type indexScan struct {
+	ag *agent
+	w  io.Writer
+
+	// idxKey is what the written lines start with; for the index file, it's
+	// just "idx", and for the member cache, the key of the member is added.
+	idxKey string
+
+	// lastTimestr is the timestr of the last written idx line; the timestr
+	// can't go down.
+	lastTimestr string
+
+	// linenrOffset and bytenrOffset are added to the line and byte numbers
+	// in the idx lines.
+	linenrOffset int64
+	bytenrOffset int64
+
+	// percentOffset is added to the current byte number when calculating the
+	// percentage, and percentTotal is the total.
+	percentOffset int64
+	percentTotal  int64
+
+	progress progress
+
+	numLines int64
+	numBytes int64
+
+	// err is set if the scan was stopped by the index callback.
+	err error
+}
+
+func (s *indexScan) run(fname string, offset int64) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(s.scan(f))
+}
+
+// runMember is like run, but for a compressed log file, which is decompressed
+// on the fly and always scanned from the beginning.
+func (s *indexScan) runMember(fname string) error {
+	r, err := openLogfile(fname)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer r.Close()
+
+	return errors.Trace(s.scan(r))
+}
+
+func (s *indexScan) scan(r io.Reader) error {
+	// The HH:MM of the previous line is initialized from the last timestr in
+	// the same way as the shell agent does it; since the timestr is like
+	// "2006-01-02-15:04", it doesn't match any real HH:MM, so the first line
+	// always gets indexed (unless there is no last timestr yet, and the HH:MM
+	// of the first line is empty).
+	lastHHMM := awkSubstr(s.lastTimestr, 8, 5)
+
+	exprs := s.ag.awktime
+	src := fmt.Sprintf(`
+BEGIN {
+%s
+nerdlogLastHHMM = %q
+}
+{ nerdlogHHMM = %s }
+nerdlogHHMM != nerdlogLastHHMM {
+  month = %s;
+  year = %s;
+  day = %s;
+  hhmm = %s;
+  nerdlogIndex(NR, nerdlogBytes, year "-" month "-" day "-" hhmm);
+  nerdlogLastHHMM = nerdlogHHMM
+}
+{ nerdlogBytes += length($0) + 1 }
+END { nerdlogEnd(NR, nerdlogBytes) }
+`,
+		s.ag.awkVarsBegin(), lastHHMM,
+		exprs.hhmm, exprs.month, exprs.year, exprs.day, exprs.hhmm,
+	)
+
+	funcs := map[string]interface{}{
+		"nerdlogIndex": s.index,
+		"nerdlogEnd": func(nr, numBytes int64) {
+			s.numLines = nr
+			s.numBytes = numBytes
+		},
+	}
+
+	err := s.ag.runAWK(src, funcs, bufio.NewReaderSize(r, 256*1024))
+	if s.err != nil {
+		return errors.Trace(s.err)
+	}
+
+	return errors.Trace(err)
+}
+
+// index is called from awk for every line whose HH:MM differs from the
+// previous one; bytesBefore is the number of bytes before that line.
+//
+// The return value is unused, it's only there because goawk only supports
+// returning an error along with a value.
+func (s *indexScan) index(nr, bytesBefore int64, timestr string) (int, error) {
+	if timestr < s.lastTimestr {
+		fmt.Fprintf(
+			s.ag.stderr,
+			"%serror:timestamp decreased from %s to %s, might be using inconsistent timestamp formats\n",
+			s.ag.markerPrefix, s.lastTimestr, timestr,
+		)
+		s.err = &exitError{code: 1}
+		return 0, s.err
+	}
+
+	bytenr := bytesBefore + 1
+	fmt.Fprintf(
+		s.w, "%s\t%s\t%d\t%d\n",
+		s.idxKey, timestr, nr+s.linenrOffset, bytenr+s.bytenrOffset,
+	)
+	s.progress.print(s.ag.stderr, bytenr+s.percentOffset, s.percentTotal)
+
+	s.lastTimestr = timestr
+
+	return 0, nil
+}
+
+// awkSubstr is like substr in awk, with 1-based pos.
+func awkSubstr(s string, pos, length int) string {
+	start := pos - 1
+	if start < 0 {
+		length += start
+		start = 0
+	}
+
+	if start >= len(s) || length <= 0 {
+		return ""
+	}
+
+	end := start + length
+	if end > len(s) {
+		end = len(s)
+	}
+
+	return s[start:end]
+}
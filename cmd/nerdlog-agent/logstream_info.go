@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// logstreamInfo prints the info about the host and the log files, in the same
+// format as the shell agent does. Since we don't need gawk or coreutils, only
+// the tools which are still needed are reported.
+func (ag *agent) logstreamInfo() error {
+	ag.printHostInfo()
+
+	if tz, ok := detectTimezone(); ok {
+		fmt.Fprintf(ag.stdout, "host_timezone:%s\n", tz)
+	} else {
+		fmt.Fprintf(ag.stdout, "warn:failed to detect host timezone\n")
+	}
+
+	for _, fname := range ag.logfiles {
+		if !fileExists(fname) {
+			fmt.Fprintf(ag.stdout, "%serror:%s does not exist\n", ag.markerPrefix, fname)
+			return &exitError{code: 1}
+		}
+
+		if !fileIsReadable(fname) {
+			fmt.Fprintf(
+				ag.stdout,
+				"%serror:%s exists but is not readable by %s; if only root can read it, set sudo: true for this logstream in the nerdlog config\n",
+				ag.markerPrefix, fname, currentUsername(),
+			)
+			return &exitError{code: 1}
+		}
+	}
+
+	for _, fname := range ag.logfiles {
+		if stat, err := os.Stat(fname); err == nil {
+			fmt.Fprintf(ag.stdout, "logfile_info:%d:%d:%s\n", stat.Size(), stat.ModTime().Unix(), fname)
+		}
+	}
+
+	// Print a bunch of example log lines, so that the client can autodetect the
+	// format.
+	for _, fname := range ag.logfiles {
+		stat, err := os.Stat(fname)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if stat.Size() == 0 {
+			continue
+		}
+
+		if decompressorName(fname) != "" {
+			firstLine, lastLine, err := readFirstAndLastCompressedLines(fname)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// A compressed file can be non-empty even if there are no logs in it.
+			if firstLine == "" {
+				continue
+			}
+
+			fmt.Fprintf(ag.stdout, "example_log_line:%s\n", lastLine)
+			fmt.Fprintf(ag.stdout, "example_log_line:%s\n", firstLine)
+			continue
+		}
+
+		lastLine, err := readLastLine(fname, stat.Size())
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		firstLine, err := readFirstLine(fname)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		fmt.Fprintf(ag.stdout, "example_log_line:%s\n", lastLine)
+		fmt.Fprintf(ag.stdout, "example_log_line:%s\n", firstLine)
+	}
+
+	return nil
+}
+
+// printHostInfo prints the "cap:" lines with the tools available on the host,
+// and the free space in the work dir (in bytes).
+func (ag *agent) printHostInfo() {
+	fmt.Fprintf(ag.stdout, "cap:bash:%s\n", bashInfo())
+	fmt.Fprintf(ag.stdout, "cap:gzip:%s\n", gzipInfo())
+	fmt.Fprintf(ag.stdout, "cap:zstd:%s\n", zstdInfo())
+
+	if _, err := exec.LookPath("timedatectl"); err == nil {
+		fmt.Fprintf(ag.stdout, "cap:timedatectl:1\n")
+	} else {
+		fmt.Fprintf(ag.stdout, "cap:timedatectl:0\n")
+	}
+
+	if free, err := freeSpace(ag.workDir); err == nil {
+		fmt.Fprintf(ag.stdout, "cap:work_dir_free:%d\n", free)
+	}
+}
+
+// bashInfo returns the bash version like "bash 5.1.16(1)-release", or an
+// empty string if bash is not found.
+func bashInfo() string {
+	// The first line looks like "GNU bash, version 5.1.16(1)-release (x86_64-pc-linux-gnu)"
+	versionStr := firstOutputLine("bash", "--version")
+	idx := strings.Index(versionStr, "version ")
+	if idx < 0 {
+		return ""
+	}
+
+	fields := strings.Fields(versionStr[idx+len("version "):])
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return "bash " + fields[0]
+}
+
+// gzipInfo returns the gzip flavour and version like "gzip 1.10", or an empty
+// string if gzip is not found.
+func gzipInfo() string {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		return ""
+	}
+
+	versionStr := firstOutputLine("gzip", "--version")
+	switch {
+	case strings.HasPrefix(versionStr, "gzip "):
+		return "gzip " + versionStr[strings.LastIndex(versionStr, " ")+1:]
+	case strings.Contains(versionStr, "BusyBox"):
+		return "busybox " + busyboxVersion()
+	default:
+		return "unknown"
+	}
+}
+
+// zstdInfo returns the zstd version like "zstd 1.5.5", or an empty string if
+// zstd is not found.
+func zstdInfo() string {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return ""
+	}
+
+	// The first line looks like "*** Zstandard CLI (64-bit) v1.5.5, by Yann Collet ***"
+	versionStr := firstOutputLine("zstd", "--version")
+	for _, field := range strings.Fields(versionStr) {
+		if len(field) > 1 && field[0] == 'v' && field[1] >= '0' && field[1] <= '9' {
+			return "zstd " + strings.TrimSuffix(field[1:], ",")
+		}
+	}
+
+	return "unknown"
+}
+
+func busyboxVersion() string {
+	// The first line looks like "BusyBox v1.36.1 (2023-07-27 17:12:24 UTC) multi-call binary."
+	versionStr := strings.TrimPrefix(firstOutputLine("busybox"), "BusyBox ")
+	if idx := strings.Index(versionStr, " "); idx >= 0 {
+		versionStr = versionStr[:idx]
+	}
+
+	return versionStr
+}
+
+// firstOutputLine runs the command and returns the first line of its
+// combined output, ignoring the exit status.
+func firstOutputLine(name string, args ...string) string {
+	out, _ := exec.Command(name, args...).CombinedOutput()
+	if idx := bytes.IndexByte(out, '\n'); idx >= 0 {
+		out = out[:idx]
+	}
+
+	return string(out)
+}
+
+// detectTimezone detects the host timezone in the same ways as the shell
+// agent does: using timedatectl, then /etc/timezone, and then by looking for
+// the zoneinfo file which is the same as /etc/localtime.
+func detectTimezone() (string, bool) {
+	if out, err := exec.Command("timedatectl", "show", "--property=Timezone", "--value").Output(); err == nil {
+		return strings.TrimRight(string(out), "\n"), true
+	}
+
+	if data, err := os.ReadFile("/etc/timezone"); err == nil {
+		return strings.TrimRight(string(data), "\n"), true
+	}
+
+	localtime, err := os.ReadFile("/etc/localtime")
+	if err != nil {
+		return "", false
+	}
+
+	const zoneinfoDir = "/usr/share/zoneinfo"
+
+	// errFound stops the walk once the zoneinfo file is found.
+	errFound := errors.New("found")
+
+	var tz string
+	filepath.WalkDir(zoneinfoDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := strings.TrimPrefix(path, zoneinfoDir+"/")
+		if strings.Contains(name, "posix/") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(data, localtime) {
+			return nil
+		}
+
+		tz = name
+		return errFound
+	})
+
+	return tz, tz != ""
+}
+
+func fileIsReadable(fname string) bool {
+	f, err := os.Open(fname)
+	if err != nil {
+		return false
+	}
+	f.Close()
+
+	return true
+}
+
+func currentUsername() string {
+	u, err := user.Current()
+	if err != nil {
+		return fmt.Sprintf("uid %d", os.Getuid())
+	}
+
+	return u.Username
+}
+
+// readFirstLine returns the first line of the file, without the newline.
+func readFirstLine(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Trace(err)
+	}
+
+	return strings.TrimRight(line, "\n"), nil
+}
+
+// readLastLine returns the last line of the file, without the newline, like
+// "tail -n 1" does. It reads the file backwards in chunks, so it doesn't
+// depend on the file size.
+func readLastLine(fname string, size int64) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	const chunkSize = 64 * 1024
+
+	var buf []byte
+	for offset := size; offset > 0; {
+		n := int64(chunkSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return "", errors.Trace(err)
+		}
+		buf = append(chunk, buf...)
+
+		// The newline at the very end belongs to the last line.
+		trimmed := bytes.TrimSuffix(buf, []byte("\n"))
+		if idx := bytes.LastIndexByte(trimmed, '\n'); idx >= 0 {
+			return strings.TrimRight(string(trimmed[idx+1:]), "\n"), nil
+		}
+	}
+
+	return strings.TrimRight(string(buf), "\n"), nil
+}
+
+// readFirstAndLastCompressedLines returns the first and the last lines of the
+// compressed log file, without the newlines. Since it can't be read backwards,
+// the whole file is decompressed.
+func readFirstAndLastCompressedLines(fname string) (firstLine, lastLine string, err error) {
+	r, err := openLogfile(fname)
+	if err != nil {
+		return "", "", errors.Trace(err)
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for i := 0; scanner.Scan(); i++ {
+		if i == 0 {
+			firstLine = scanner.Text()
+		}
+		lastLine = scanner.Text()
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	return firstLine, lastLine, nil
+}
@@ -0,0 +1,338 @@
+// Command nerdlog-agent is the native implementation of the nerdlog agent: it
+// understands the same commands, flags and output format as
+// core/nerdlog_agent.sh, but it doesn't depend on gawk or coreutils on the
+// host. The client uploads it instead of the shell agent when there is a
+// build for the host's architecture.
+//
+// The awk expressions (the query pattern and the --awktime-* flags) are
+// evaluated using goawk.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/spf13/pflag"
+)
+
+// Those numbers are supposed to go up as the query progresses; the Go app
+// will then be able to tell which node is the slowest and show info for it.
+const (
+	stageIndexFull   = 1
+	stageIndexAppend = 2
+	stageQuerying    = 3
+	stageDone        = 4
+)
+
+// emptyFileName is the dummy empty log file which older versions of the
+// agents used to create in the work dir; it's only needed for the cleanup.
+const emptyFileName = "nerdlog-empty-file"
+
+// agent contains the parsed flags and the output streams; every command is
+// implemented as a method of it.
+type agent struct {
+	stdout *bufio.Writer
+	stderr io.Writer
+
+	// argv0 is the path which the agent was invoked by; the cleanup command
+	// doesn't delete it, unless --all is given.
+	argv0 string
+
+	indexFile string
+	workDir   string
+
+	// logfiles are the log files, the latest one first, and the older rotated
+	// ones after it. Before resolveLogfiles is called, any of them can be
+	// "auto", and the rotated ones can also be glob patterns; after that, all
+	// the rotated ones exist. The rotated ones can be compressed, see
+	// compressed.go.
+	logfiles []string
+
+	// memberKeys contains the member cache keys of the compressed log files,
+	// in the same order as logfiles; for the uncompressed ones, it's empty.
+	// It's only set by getLogfileSizes.
+	memberKeys []string
+
+	from string
+	to   string
+
+	// linesUntil is 0 if not given.
+	linesUntil int
+
+	refreshIndex bool
+	indexTTLDays int
+
+	dryRun     bool
+	cleanupAll bool
+
+	maxNumLines int
+
+	awktime awkTimeExprs
+
+	curYear  int
+	curMonth int
+
+	// markerPrefix is prepended to the "error:" and "exit_code:" lines; see
+	// the --marker-prefix flag.
+	markerPrefix string
+}
+
+// exitError is returned by the agent commands when the problem is already
+// reported, so the only thing left is to exit with the given code.
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit code %d", e.code)
+}
+
+func main() {
+	ag := &agent{
+		stdout: bufio.NewWriter(os.Stdout),
+		stderr: os.Stderr,
+		argv0:  os.Args[0],
+	}
+
+	code := ag.run(os.Args[1:])
+	ag.exit(code)
+}
+
+// exit prints the exit code (like the EXIT trap of the shell agent does) and
+// exits.
+func (ag *agent) exit(code int) {
+	fmt.Fprintf(ag.stdout, "%sexit_code:%d\n", ag.markerPrefix, code)
+	ag.stdout.Flush()
+	os.Exit(code)
+}
+
+func (ag *agent) run(args []string) int {
+	err := ag.run2(args)
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := errors.Cause(err).(*exitError); ok {
+		return exitErr.code
+	}
+
+	fmt.Fprintf(ag.stderr, "%serror:%s\n", ag.markerPrefix, err.Error())
+	return 1
+}
+
+func (ag *agent) run2(args []string) error {
+	positionalArgs, err := ag.parseFlags(args)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(positionalArgs) > 0 && positionalArgs[0] == "cleanup" {
+		return errors.Trace(ag.cleanup())
+	}
+
+	// Either use the provided current year and month (for tests), or get the
+	// actual ones.
+	now := time.Now()
+	ag.curYear, err = intFromEnv("CUR_YEAR", now.Year())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ag.curMonth, err = intFromEnv("CUR_MONTH", int(now.Month()))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := ag.resolveLogfiles(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(positionalArgs) == 0 {
+		return errors.Errorf("command is required")
+	}
+
+	switch positionalArgs[0] {
+	case "query":
+		var userPattern string
+		if len(positionalArgs) > 1 {
+			userPattern = positionalArgs[1]
+		}
+
+		return errors.Trace(ag.query(userPattern))
+
+	case "logstream_info":
+		return errors.Trace(ag.logstreamInfo())
+
+	default:
+		return errors.Errorf("invalid command %s", positionalArgs[0])
+	}
+}
+
+// parseFlags parses the same flags as the shell agent does, and returns the
+// positional args.
+func (ag *agent) parseFlags(args []string) ([]string, error) {
+	flags := pflag.NewFlagSet("nerdlog-agent", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	flags.StringVarP(&ag.indexFile, "index-file", "c", "/tmp/nerdlog_agent_index", "")
+	flags.StringArrayVar(&ag.logfiles, "logfile", nil, "")
+	flags.StringVarP(&ag.from, "from", "f", "", "")
+	flags.StringVarP(&ag.to, "to", "t", "", "")
+	flags.IntVarP(&ag.linesUntil, "lines-until", "u", 0, "")
+	flags.BoolVar(&ag.refreshIndex, "refresh-index", false, "")
+	flags.IntVar(&ag.indexTTLDays, "index-ttl-days", 0, "")
+	// The work dir is where all the nerdlog files are, like the index files.
+	// The client always provides it; the default is only for the manual runs
+	// and tests.
+	flags.StringVar(&ag.workDir, "work-dir", "/tmp", "")
+	flags.BoolVar(&ag.dryRun, "dry-run", false, "")
+	flags.BoolVar(&ag.cleanupAll, "all", false, "")
+	flags.IntVarP(&ag.maxNumLines, "max-num-lines", "l", 100, "")
+	// The client gives the per-session marker prefix, so that the "error:" and
+	// "exit_code:" lines can't be confused with whatever else is printed.
+	flags.StringVar(&ag.markerPrefix, "marker-prefix", "", "")
+
+	defaultTimeExprs := defaultAWKTimeExprs()
+	flags.StringVar(&ag.awktime.month, "awktime-month", defaultTimeExprs.month, "")
+	flags.StringVar(&ag.awktime.year, "awktime-year", defaultTimeExprs.year, "")
+	flags.StringVar(&ag.awktime.day, "awktime-day", defaultTimeExprs.day, "")
+	flags.StringVar(&ag.awktime.hhmm, "awktime-hhmm", defaultTimeExprs.hhmm, "")
+	flags.StringVar(&ag.awktime.minuteKey, "awktime-minute-key", defaultTimeExprs.minuteKey, "")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return flags.Args(), nil
+}
+
+// resolveLogfiles resolves the "auto" log files, and skips the rotated ones
+// which don't exist.
+func (ag *agent) resolveLogfiles() error {
+	// By default, use the latest log file and the previous one.
+	if len(ag.logfiles) == 0 {
+		ag.logfiles = []string{"auto", "auto"}
+	}
+
+	if ag.logfiles[0] == "auto" {
+		if fileExists("/var/log/messages") {
+			ag.logfiles[0] = "/var/log/messages"
+		} else if fileExists("/var/log/syslog") {
+			ag.logfiles[0] = "/var/log/syslog"
+		} else {
+			return errors.Errorf("failed to autodetect log file: neither /var/log/messages nor /var/log/syslog are present. Specify the log file manually")
+		}
+	}
+
+	// The latest log file is constantly appended to, so it can't be compressed.
+	if decompressorName(ag.logfiles[0]) != "" {
+		return errors.Errorf("the latest logfile %s can't be compressed", ag.logfiles[0])
+	}
+
+	// For the rotated log files, "auto" means just appending ".1", ".2" etc to
+	// the latest log file, and a glob pattern is replaced with all the matching
+	// files, the newest first. The rotated files which don't exist (e.g. the
+	// logs weren't rotated yet) are skipped, and so are the ones which are
+	// already listed.
+	resolved := []string{ag.logfiles[0]}
+	for i, fname := range ag.logfiles[1:] {
+		if fname == "auto" {
+			fname = fmt.Sprintf("%s.%d", ag.logfiles[0], i+1)
+		}
+
+		patternFnames := []string{fname}
+		if isGlobPattern(fname) {
+			patternFnames = expandLogfilePattern(fname)
+			if len(patternFnames) == 0 {
+				fmt.Fprintf(ag.stderr, "debug:rotated logfile pattern %s doesn't match anything, skipping it\n", fname)
+				continue
+			}
+		}
+
+		for _, fname := range patternFnames {
+			if !fileExists(fname) {
+				fmt.Fprintf(ag.stderr, "debug:rotated logfile %s doesn't exist, skipping it\n", fname)
+				continue
+			}
+
+			if containsString(resolved, fname) {
+				continue
+			}
+
+			resolved = append(resolved, fname)
+		}
+	}
+
+	ag.logfiles = resolved
+
+	return nil
+}
+
+// isGlobPattern returns whether the log file contains any of the glob
+// special characters, the same way the shell agent checks it.
+func isGlobPattern(fname string) bool {
+	return strings.ContainsAny(fname, "*?[")
+}
+
+// expandLogfilePattern returns the files matching the given glob pattern, the
+// newest first (and alphabetically if the modification times are the same).
+func expandLogfilePattern(pattern string) []string {
+	// The only possible error is a malformed pattern, in which case bash just
+	// doesn't match anything either.
+	fnames, _ := filepath.Glob(pattern)
+
+	mtimes := make(map[string]int64, len(fnames))
+	for _, fname := range fnames {
+		if stat, err := os.Stat(fname); err == nil {
+			mtimes[fname] = stat.ModTime().Unix()
+		}
+	}
+
+	sort.SliceStable(fnames, func(i, j int) bool {
+		return mtimes[fnames[i]] > mtimes[fnames[j]]
+	})
+
+	return fnames
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logfileLast returns the latest log file.
+func (ag *agent) logfileLast() string {
+	return ag.logfiles[0]
+}
+
+func intFromEnv(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Annotatef(err, "parsing %s", name)
+	}
+
+	return v, nil
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// logfileSizes contains the sizes of the log files in bytes, in the same order
+// as agent.logfiles (the latest one first).
+type logfileSizes []int64
+
+func (s logfileSizes) total() int64 {
+	return s.bytesBefore(-1)
+}
+
+// bytesBefore returns the number of bytes in the log files which are older
+// than the i-th one.
+func (s logfileSizes) bytesBefore(i int) int64 {
+	var ret int64
+	for _, size := range s[i+1:] {
+		ret += size
+	}
+
+	return ret
+}
+
+// progress prints the "p:p:" lines with the percentage.
+//
+// NOTE: we only show percentages with 5% increments, to save on traffic and
+// other overhead.
+type progress struct {
+	lastPercent int
+}
+
+func (p *progress) print(w io.Writer, cur, total int64) {
+	if total == 0 {
+		return
+	}
+
+	curPercent := int(float64(cur) / float64(total) * 20)
+	if curPercent != p.lastPercent {
+		fmt.Fprintf(w, "p:p:%d\n", curPercent*5)
+		p.lastPercent = curPercent
+	}
+}
+
+// logSegment is a part of a log file to scan.
+type logSegment struct {
+	fname string
+	// offset is 0-based.
+	offset int64
+	// length is -1 if the segment spans until the end of file.
+	length int64
+}
+
+func (ag *agent) query(userPattern string) error {
+	// For the query command, become the leader of a new process group, so that
+	// the client can cancel the query by killing the whole group. It's not
+	// essential since we don't have any subprocesses, so the error is ignored.
+	setProcessGroup()
+
+	// The client needs the pid to be able to cancel the query.
+	fmt.Fprintf(ag.stderr, "p:pid:%d\n", os.Getpid())
+
+	// If the TTL for the index files is given, delete the index files which
+	// weren't used for that many days (they're likely left behind by some other
+	// clients), and touch our own ones, so that others don't delete them.
+	if ag.indexTTLDays > 0 {
+		ag.deleteStaleIndexFiles()
+	}
+	if fileExists(ag.indexFile) {
+		touchFile(ag.indexFile)
+	}
+	if fileExists(ag.membersFile()) {
+		touchFile(ag.membersFile())
+	}
+
+	if ag.refreshIndex {
+		if err := removeIfExists(ag.indexFile); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := removeIfExists(ag.membersFile()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// All the log files are treated as a single combined one, the oldest first,
+	// so for every log file we need to know how many bytes are before it.
+	sizes, err := ag.getLogfileSizes()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// If indexfile exists, check if it's valid and relevant; if not, delete it.
+	if fileExists(ag.indexFile) {
+		if err := ag.checkIndex(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	var fromEntry, toEntry *indexEntry
+
+	if ag.from != "" || ag.to != "" {
+		isOutsideOfRange := false
+		fromEntry, toEntry, isOutsideOfRange, err = ag.lookupFromTo(sizes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if isOutsideOfRange {
+			fmt.Fprintf(ag.stderr, "p:stage:%d:done\n", stageDone)
+			return nil
+		}
+	} else if !indexIsNonEmpty(ag.indexFile) {
+		fmt.Fprintf(ag.stderr, "debug:neither --from or --to are given, but index doesn't exist at all, gonna rebuild\n")
+		if err := ag.updateIndex(sizes); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	fmt.Fprintf(ag.stderr, "p:stage:%d:querying logs\n", stageQuerying)
+
+	// The "logfile:" lines tell the client how many lines are before every log
+	// file, so that it can map the line numbers back to the log files.
+	indexLines, err := ag.readIndexLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	logfilesNumLines := make([]int64, len(ag.logfiles))
+	for i, fname := range ag.logfiles {
+		numLines, found, err := logfileLines(indexLines, fname)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !found {
+			return errors.Errorf("no logfile_lines for %s in the index", fname)
+		}
+
+		logfilesNumLines[i] = numLines
+	}
+
+	fromLinenr := int64(1)
+	if fromEntry != nil {
+		fromLinenr = fromEntry.linenr
+	}
+
+	var numBytesToScan int64
+	switch {
+	case fromEntry == nil && toEntry == nil:
+		// Getting _all_ available logs
+		numBytesToScan = sizes.total()
+	case fromEntry != nil && toEntry == nil:
+		// Getting logs from some point in time to the very end (most frequent case)
+		numBytesToScan = sizes.total() - fromEntry.bytenr
+	case fromEntry == nil && toEntry != nil:
+		// Getting logs from the beginning until some point in time
+		numBytesToScan = toEntry.bytenr
+	default:
+		// Getting logs between two points T1 and T2
+		numBytesToScan = toEntry.bytenr - fromEntry.bytenr
+	}
+
+	segments := ag.getLogSegments(sizes, fromEntry, toEntry)
+
+	input, closeFiles, err := openLogSegments(segments)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeFiles()
+
+	res := newQueryResult(ag.maxNumLines)
+
+	linesUntil := int64(-1)
+	if ag.linesUntil != 0 {
+		linesUntil = int64(ag.linesUntil) - fromLinenr + 1
+	}
+
+	var prog progress
+
+	awkPattern := ""
+	if userPattern != "" {
+		awkPattern = fmt.Sprintf("!(%s) {next}", userPattern)
+	}
+
+	src := fmt.Sprintf(`
+BEGIN { nerdlogBytes = 1 }
+{ nerdlogBytes += length($0) + 1 }
+NR %% 100 == 0 { nerdlogPercentage(nerdlogBytes) }
+%s
+{ nerdlogMatch(NR, %s, $0) }
+`, awkPattern, ag.awktime.minuteKey)
+
+	funcs := map[string]interface{}{
+		"nerdlogPercentage": func(bytenr int64) {
+			prog.print(ag.stderr, bytenr, numBytesToScan)
+		},
+		"nerdlogMatch": func(nr int64, minuteKey, line string) {
+			res.stats[minuteKey]++
+
+			if linesUntil >= 0 && nr >= linesUntil {
+				return
+			}
+
+			res.addLine(nr, line)
+		},
+	}
+
+	if err := ag.runAWK(src, funcs, input); err != nil {
+		return errors.Trace(err)
+	}
+
+	for i := len(ag.logfiles) - 1; i >= 0; i-- {
+		fmt.Fprintf(ag.stdout, "logfile:%s:%d\n", ag.logfiles[i], logfilesNumLines[i])
+	}
+
+	res.print(ag.stdout, fromLinenr)
+
+	fmt.Fprintf(ag.stderr, "p:stage:%d:done\n", stageDone)
+
+	return nil
+}
+
+// lookupFromTo looks up --from and --to in the index, refreshing it if
+// needed. The returned entries are nil if the corresponding flag isn't given,
+// or if it's outside of the logs we have (so we use the beginning or the end
+// of logs instead); if the whole range is outside of the logs,
+// isOutsideOfRange is true.
+func (ag *agent) lookupFromTo(
+	sizes logfileSizes,
+) (fromEntry, toEntry *indexEntry, isOutsideOfRange bool, err error) {
+	refreshAndRetry := false
+
+	// First try to find it in index without refreshing the index
+	if indexIsNonEmpty(ag.indexFile) {
+		if ag.from != "" {
+			result, entry, err := ag.indexLookup(ag.from)
+			if err != nil {
+				return nil, nil, false, errors.Trace(err)
+			}
+
+			if result == indexLookupFound {
+				fromEntry = &entry
+			} else {
+				fmt.Fprintf(ag.stderr, "debug:the from %s isn't found, gonna refresh the index\n", ag.from)
+				refreshAndRetry = true
+			}
+		}
+
+		if ag.to != "" {
+			result, entry, err := ag.indexLookup(ag.to)
+			if err != nil {
+				return nil, nil, false, errors.Trace(err)
+			}
+
+			if result == indexLookupFound {
+				toEntry = &entry
+			} else {
+				fmt.Fprintf(ag.stderr, "debug:the to %s isn't found, gonna refresh the index\n", ag.to)
+				refreshAndRetry = true
+			}
+		}
+	} else {
+		fmt.Fprintf(ag.stderr, "debug:index file doesn't exist or is empty, gonna refresh it\n")
+		refreshAndRetry = true
+	}
+
+	if !refreshAndRetry {
+		return fromEntry, toEntry, false, nil
+	}
+
+	if err := ag.updateIndex(sizes); err != nil {
+		return nil, nil, false, errors.Trace(err)
+	}
+
+	fromEntry, toEntry = nil, nil
+
+	if ag.from != "" {
+		result, entry, err := ag.indexLookup(ag.from)
+		if err != nil {
+			return nil, nil, false, errors.Trace(err)
+		}
+
+		switch result {
+		case indexLookupBefore:
+			fmt.Fprintf(ag.stderr, "debug:the from %s isn't found, will use the beginning\n", ag.from)
+		case indexLookupFound:
+			fmt.Fprintf(ag.stderr, "debug:the from %s is found: %d (%d)\n", ag.from, entry.linenr, entry.bytenr)
+			fromEntry = &entry
+		case indexLookupAfter:
+			fmt.Fprintf(ag.stderr, "debug:the from %s is after the latest log we have, will return nothing\n", ag.from)
+			isOutsideOfRange = true
+		}
+	}
+
+	if ag.to != "" {
+		result, entry, err := ag.indexLookup(ag.to)
+		if err != nil {
+			return nil, nil, false, errors.Trace(err)
+		}
+
+		switch result {
+		case indexLookupAfter:
+			fmt.Fprintf(ag.stderr, "debug:the to %s isn't found, will use the end\n", ag.to)
+		case indexLookupFound:
+			fmt.Fprintf(ag.stderr, "debug:the to %s is found: %d (%d)\n", ag.to, entry.linenr, entry.bytenr)
+			toEntry = &entry
+		case indexLookupBefore:
+			fmt.Fprintf(ag.stderr, "debug:the to %s is before the first log we have, will return nothing\n", ag.to)
+			isOutsideOfRange = true
+		}
+	}
+
+	return fromEntry, toEntry, isOutsideOfRange, nil
+}
+
+// checkIndex deletes the index file if the rotated log files have changed
+// since the index was built, or if the index is broken.
+func (ag *agent) checkIndex() error {
+	lines, err := ag.readIndexLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var storedRotated []string
+	for _, fields := range lines {
+		if fields[0] == indexKeyRotatedLogfile {
+			storedRotated = append(storedRotated, strings.Join(fields, "\t"))
+		}
+	}
+
+	curRotated, err := ag.rotatedLogfilesIndexLines()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if strings.Join(storedRotated, "\n") != strings.Join(curRotated, "\n") {
+		fmt.Fprintf(ag.stderr, "debug:rotated logfiles have changed, deleting index file\n")
+		return errors.Trace(removeIfExists(ag.indexFile))
+	}
+
+	if _, found, err := logfileLines(lines, ag.logfileLast()); err != nil || !found {
+		fmt.Fprintf(ag.stderr, "debug:broken index file (no logfile_lines for %s), deleting it\n", ag.logfileLast())
+		return errors.Trace(removeIfExists(ag.indexFile))
+	}
+
+	return nil
+}
+
+// getLogSegments returns the parts of the log files to scan, as per the
+// requested time range: the range [fromEntry, toEntry) in the combined log
+// files is split into the parts of the individual log files, the oldest
+// first.
+func (ag *agent) getLogSegments(
+	sizes logfileSizes, fromEntry, toEntry *indexEntry,
+) []logSegment {
+	var segments []logSegment
+
+	for i := len(ag.logfiles) - 1; i >= 0; i-- {
+		fname := ag.logfiles[i]
+		fileStart := sizes.bytesBefore(i) + 1
+
+		// start and end are the 1-based offsets in the current log file, the end
+		// is exclusive; tillEnd is whether we need everything until the end of it.
+		start := int64(1)
+		if fromEntry != nil && fromEntry.bytenr > fileStart {
+			start = fromEntry.bytenr - fileStart + 1
+		}
+
+		tillEnd := true
+		end := sizes[i] + 1
+		if toEntry != nil && toEntry.bytenr < fileStart+sizes[i] {
+			tillEnd = false
+			end = toEntry.bytenr - fileStart + 1
+		}
+
+		// Skip the log files which are outside of the range; but if we need logs
+		// until the very end, the latest log file is always used, since it might
+		// have grown after we checked its size.
+		if start >= end && (i != 0 || toEntry != nil) {
+			continue
+		}
+
+		switch {
+		case start == 1 && tillEnd:
+			fmt.Fprintf(ag.stderr, "debug:Getting all logs from %s\n", fname)
+			segments = append(segments, logSegment{fname, 0, -1})
+		case tillEnd:
+			fmt.Fprintf(ag.stderr, "debug:Getting logs from offset %d until the end of %s\n", start, fname)
+			segments = append(segments, logSegment{fname, start - 1, -1})
+		case start == 1:
+			fmt.Fprintf(ag.stderr, "debug:Getting logs from the very beginning to offset %d in %s\n", end-1, fname)
+			segments = append(segments, logSegment{fname, 0, end - 1})
+		default:
+			fmt.Fprintf(ag.stderr, "debug:Getting logs from offset %d, only %d bytes, in %s\n", start, end-start, fname)
+			segments = append(segments, logSegment{fname, start - 1, end - start})
+		}
+	}
+
+	return segments
+}
+
+// openLogSegments opens all the segments and returns a reader which
+// concatenates them, and a function to close the files.
+func openLogSegments(segments []logSegment) (io.Reader, func(), error) {
+	var files []io.ReadCloser
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	readers := make([]io.Reader, 0, len(segments))
+	for _, seg := range segments {
+		f, err := openLogfile(seg.fname)
+		if err != nil {
+			closeFiles()
+			return nil, nil, errors.Trace(err)
+		}
+		files = append(files, f)
+
+		if seg.offset > 0 {
+			if err := skipBytes(f, seg.offset); err != nil {
+				closeFiles()
+				return nil, nil, errors.Trace(err)
+			}
+		}
+
+		var r io.Reader = f
+		if seg.length >= 0 {
+			r = io.LimitReader(f, seg.length)
+		}
+
+		readers = append(readers, r)
+	}
+
+	return bufio.NewReaderSize(io.MultiReader(readers...), 256*1024), closeFiles, nil
+}
+
+// skipBytes skips the given number of bytes in the reader: the plain files
+// are just seeked, but the compressed ones can't be, so the decompressed data
+// is read and discarded.
+func skipBytes(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return errors.Trace(err)
+	}
+
+	if _, err := io.CopyN(io.Discard, r, n); err != nil && err != io.EOF {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// queryResult accumulates the query results: the number of matching lines
+// per minute, and the last maxLines matching lines.
+type queryResult struct {
+	stats map[string]int
+
+	lines   []string
+	lineNRs []int64
+	// curLine is the index in lines to write the next line to.
+	curLine int
+}
+
+func newQueryResult(maxLines int) *queryResult {
+	if maxLines < 0 {
+		maxLines = 0
+	}
+
+	return &queryResult{
+		stats:   map[string]int{},
+		lines:   make([]string, maxLines),
+		lineNRs: make([]int64, maxLines),
+	}
+}
+
+func (r *queryResult) addLine(nr int64, line string) {
+	if len(r.lines) == 0 {
+		return
+	}
+
+	r.lines[r.curLine] = line
+	r.lineNRs[r.curLine] = nr
+
+	r.curLine++
+	if r.curLine >= len(r.lines) {
+		r.curLine = 0
+	}
+}
+
+// print prints the "s:" lines with the stats, and the "m:" lines with the
+// log messages (oldest first), in the same way as the shell agent does.
+func (r *queryResult) print(w io.Writer, fromLinenr int64) {
+	keys := make([]string, 0, len(r.stats))
+	for k := range r.stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "s:%s,%d\n", k, r.stats[k])
+	}
+
+	maxLines := len(r.lines)
+	for i := 0; i < maxLines; i++ {
+		ln := (r.curLine + i) % maxLines
+
+		// The awk code in the shell agent skips the lines which are false in awk,
+		// so we do the same.
+		if isAWKFalse(r.lines[ln]) {
+			continue
+		}
+
+		fmt.Fprintf(w, "m:%d:%s\n", r.lineNRs[ln]+fromLinenr-1, r.lines[ln])
+	}
+}
+
+// indexIsNonEmpty returns whether the index file exists and is not empty.
+func indexIsNonEmpty(fname string) bool {
+	stat, err := os.Stat(fname)
+	return err == nil && stat.Size() > 0
+}
+
+func removeIfExists(fname string) error {
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
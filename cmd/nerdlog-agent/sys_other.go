@@ -0,0 +1,29 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+
+	"github.com/juju/errors"
+)
+
+// The agent is only built for Linux hosts; on other platforms it only needs
+// to compile, so the helpers below are stubs.
+
+func setProcessGroup() error {
+	return errors.New("not supported")
+}
+
+func isOwnFile(info os.FileInfo) bool {
+	return false
+}
+
+func fileInode(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("not supported")
+}
@@ -97,6 +97,8 @@ func newNerdlogApp(
 		Options: app.options,
 		OnLogQuery: func(params core.QueryLogsParams) {
 			params.MaxNumLines = app.options.GetMaxNumLines()
+			params.Progressive = app.options.GetProgressive()
+			params.SkipUnreachable = params.SkipUnreachable || app.options.GetSkipUnreachable()
 
 			// Get the current QueryFull and marshal it to a shell command.
 			qf := app.mainView.getQueryFull()
@@ -129,6 +131,12 @@ func newNerdlogApp(
 		OnReconnectRequest: func() {
 			app.lsman.Reconnect()
 		},
+		OnCancelQueryRequest: func() {
+			app.lsman.CancelQuery()
+		},
+		OnCleanupRequest: func(params core.CleanupParams) {
+			app.lsman.Cleanup(params)
+		},
 		OnCmd: func(cmd string, opts CmdOpts) {
 			cmdCh <- cmdWithOpts{
 				cmd:  cmd,
@@ -185,6 +193,8 @@ func (app *nerdlogApp) initLStreamsManager(
 		var lastState *core.LStreamsManagerState
 		var logResps []*core.LogRespTotal // TODO: perhaps we should also only keep the last one?
 		var bootstrapErrors []error
+		var userPrompts []*core.UserPrompt
+		var cleanupResps []*core.CleanupRespTotal
 
 		handleUpdate := func(upd core.LStreamsManagerUpdate) {
 			switch {
@@ -197,6 +207,10 @@ func (app *nerdlogApp) initLStreamsManager(
 					bootstrapErrors,
 					errors.Errorf("%s: %s", upd.BootstrapIssue.LStreamName, upd.BootstrapIssue.Err),
 				)
+			case upd.UserPrompt != nil:
+				userPrompts = append(userPrompts, upd.UserPrompt)
+			case upd.CleanupResp != nil:
+				cleanupResps = append(cleanupResps, upd.CleanupResp)
 
 			default:
 				panic("empty lstreams manager update")
@@ -215,16 +229,23 @@ func (app *nerdlogApp) initLStreamsManager(
 				// still receiving updates during the teardown; so if that's the case,
 				// just don't update the TUI.
 				if app.tviewApp != nil &&
-					(lastState != nil || len(logResps) > 0 || len(bootstrapErrors) > 0) {
+					(lastState != nil || len(logResps) > 0 || len(bootstrapErrors) > 0 ||
+						len(userPrompts) > 0 || len(cleanupResps) > 0) {
 
 					app.tviewApp.QueueUpdateDraw(func() {
 						if lastState != nil {
 							app.mainView.applyHMState(lastState)
 						}
 
+						for _, p := range userPrompts {
+							app.mainView.handleUserPrompt(p)
+						}
+
 						for _, logResp := range logResps {
 							if len(logResp.Errs) > 0 {
-								app.mainView.handleQueryError(combineErrors(logResp.Errs))
+								app.mainView.handleQueryError(combineErrors(logResp.Errs), func() {
+									app.mainView.doQuery(doQueryParams{})
+								})
 								return
 							}
 
@@ -235,11 +256,17 @@ func (app *nerdlogApp) initLStreamsManager(
 						if len(bootstrapErrors) > 0 {
 							app.mainView.handleBootstrapError(combineErrors(bootstrapErrors))
 						}
+
+						for _, cleanupResp := range cleanupResps {
+							app.mainView.handleCleanupResp(cleanupResp)
+						}
 					})
 
 					lastState = nil
 					logResps = nil
 					bootstrapErrors = nil
+					userPrompts = nil
+					cleanupResps = nil
 				}
 
 				// The same select again, but without the default case.
@@ -251,18 +278,36 @@ func (app *nerdlogApp) initLStreamsManager(
 		}
 	}()
 
+	lsmanParams, err := makeLStreamsManagerParams(homeDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	lsmanParams.Logger = logger
+	lsmanParams.InitialLStreams = initialLStreams
+	lsmanParams.UpdatesCh = updatesCh
+
+	app.lsman = core.NewLStreamsManager(lsmanParams)
+
+	return nil
+}
+
+// makeLStreamsManagerParams loads the nerdlog and ssh configs, and returns the
+// LStreamsManagerParams with all the config-related fields populated; the rest
+// (Logger, InitialLStreams, UpdatesCh) are up to the caller.
+func makeLStreamsManagerParams(homeDir string) (core.LStreamsManagerParams, error) {
 	envUser := os.Getenv("USER")
 
-	var logstreamsCfg core.ConfigLogStreams
+	var appLogstreamsCfg ConfigLogStreams
 	logstreamsCfgPath := filepath.Join(homeDir, ".config", "nerdlog", "logstreams.yaml")
 	_, statErr := os.Stat(logstreamsCfgPath)
 	if statErr == nil {
-		appLogstreamsCfg, err := LoadLogstreamsConfigFromFile(logstreamsCfgPath)
+		cfg, err := LoadLogstreamsConfigFromFile(logstreamsCfgPath)
 		if err != nil {
-			return errors.Trace(err)
+			return core.LStreamsManagerParams{}, errors.Trace(err)
 		}
 
-		logstreamsCfg = appLogstreamsCfg.LogStreams
+		appLogstreamsCfg = *cfg
 	}
 
 	var sshConfig *ssh_config.Config
@@ -271,7 +316,7 @@ func (app *nerdlogApp) initLStreamsManager(
 		if !os.IsNotExist(err) {
 			// TODO: would perhaps be more useful if we warn the user about it,
 			// but still proceed.
-			return errors.Annotatef(err, "reading ssh config")
+			return core.LStreamsManagerParams{}, errors.Annotatef(err, "reading ssh config")
 		}
 	} else {
 		var err error
@@ -279,24 +324,19 @@ func (app *nerdlogApp) initLStreamsManager(
 		if err != nil {
 			// TODO: would perhaps be more useful if we warn the user about it,
 			// but still proceed.
-			return errors.Annotatef(err, "parsing ssh config")
+			return core.LStreamsManagerParams{}, errors.Annotatef(err, "parsing ssh config")
 		}
 	}
 
-	app.lsman = core.NewLStreamsManager(core.LStreamsManagerParams{
-		Logger: logger,
-
-		ConfigLogStreams: logstreamsCfg,
+	return core.LStreamsManagerParams{
+		ConfigLogStreams: appLogstreamsCfg.LogStreams,
+		ConfigConnection: appLogstreamsCfg.Connection,
 		SSHConfig:        sshConfig,
 
-		InitialLStreams: initialLStreams,
-
 		ClientID: envUser,
 
-		UpdatesCh: updatesCh,
-	})
-
-	return nil
+		IndexTTLDays: appLogstreamsCfg.IndexTTLDays,
+	}, nil
 }
 
 func (app *nerdlogApp) handleCmdLine(cmdCh <-chan cmdWithOpts) {
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dimonomid/nerdlog/core"
+	"github.com/dimonomid/nerdlog/log"
+	"github.com/juju/errors"
+)
+
+// cleanupConnectTimeout is how long the "nerdlog cleanup" mode waits for the
+// logstreams to connect; the ones which didn't connect by then are reported
+// as failed.
+const cleanupConnectTimeout = 1 * time.Minute
+
+// runCleanup implements the "nerdlog cleanup" mode: it connects to the given
+// logstreams, deletes (or with dryRun, only lists) all the files nerdlog has
+// left there, prints the results to stdout, and disconnects. The returned
+// error is non-nil if anything has failed.
+func runCleanup(homeDir, lstreamsSpec string, dryRun bool, logLevel log.LogLevel) error {
+	lsmanParams, err := makeLStreamsManagerParams(homeDir)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	updatesCh := make(chan core.LStreamsManagerUpdate, 128)
+
+	lsmanParams.Logger = log.NewLogger(logLevel)
+	lsmanParams.InitialLStreams = lstreamsSpec
+	lsmanParams.UpdatesCh = updatesCh
+
+	lsman := core.NewLStreamsManager(lsmanParams)
+
+	// Keep draining the updates until the manager is torn down, so that it
+	// never blocks on sending them.
+	cleanupRespCh := make(chan *core.CleanupRespTotal, 1)
+	stateCh := make(chan *core.LStreamsManagerState, 1)
+	bootstrapErrsCh := make(chan *core.BootstrapIssue, 128)
+	doneCh := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case upd := <-updatesCh:
+				switch {
+				case upd.State != nil:
+					// Only keep the latest state.
+					select {
+					case <-stateCh:
+					default:
+					}
+					stateCh <- upd.State
+
+				case upd.BootstrapIssue != nil:
+					select {
+					case bootstrapErrsCh <- upd.BootstrapIssue:
+					default:
+						// Nobody is waiting for those anymore.
+					}
+
+				case upd.UserPrompt != nil:
+					// We're not interactive, so can't answer any questions; the
+					// logstream will fail to connect then.
+					upd.UserPrompt.Respond(core.UserPromptResp{})
+
+				case upd.CleanupResp != nil:
+					cleanupRespCh <- upd.CleanupResp
+				}
+
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		lsman.Close()
+		lsman.Wait()
+		close(doneCh)
+	}()
+
+	// Wait until every logstream either connects or fails.
+	var lastState *core.LStreamsManagerState
+	bootstrapErrs := map[string]string{}
+	timeout := time.After(cleanupConnectTimeout)
+
+waitConnected:
+	for {
+		select {
+		case state := <-stateCh:
+			if state.NoMatchingLStreams {
+				return errors.Errorf("no matching logstreams for %q", lstreamsSpec)
+			}
+
+			lastState = state
+
+		case issue := <-bootstrapErrsCh:
+			bootstrapErrs[issue.LStreamName] = issue.Err
+
+		case <-timeout:
+			fmt.Fprintf(os.Stderr, "Timed out waiting for all logstreams to connect, proceeding with the connected ones\n")
+			break waitConnected
+		}
+
+		if lastState != nil &&
+			(lastState.Connected || cleanupAllSettled(lastState, bootstrapErrs)) {
+			break
+		}
+	}
+
+	// Nerdlog is not going to be used after that, so delete the agent as well.
+	lsman.Cleanup(core.CleanupParams{
+		DryRun: dryRun,
+		All:    true,
+	})
+
+	resp := <-cleanupRespCh
+	if len(resp.Errs) > 0 {
+		return combineErrors(resp.Errs)
+	}
+
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+
+	fmt.Print(formatCleanupResp(resp, verb))
+
+	if len(resp.LStreamErrs) > 0 {
+		return errors.Errorf("cleanup failed on %d logstream(s)", len(resp.LStreamErrs))
+	}
+
+	return nil
+}
+
+// cleanupAllSettled returns true if every logstream has either connected, or
+// failed to connect or bootstrap at least once.
+func cleanupAllSettled(state *core.LStreamsManagerState, bootstrapErrs map[string]string) bool {
+	for lscState, names := range state.LStreamsByState {
+		if lscState == core.LStreamClientStateConnectedIdle || lscState == core.LStreamClientStateConnectedBusy {
+			continue
+		}
+
+		for name := range names {
+			if _, ok := bootstrapErrs[name]; ok {
+				continue
+			}
+
+			if state.ConnDetailsByLStream[name].Err != "" {
+				continue
+			}
+
+			return false
+		}
+	}
+
+	return true
+}
+
+// formatCleanupResp returns a human-readable summary of the cleanup: the files
+// for every logstream, prefixed with the verb (like "Deleted"), and the
+// errors.
+func formatCleanupResp(resp *core.CleanupRespTotal, verb string) string {
+	var sb strings.Builder
+
+	names := make([]string, 0, len(resp.Resps))
+	for name := range resp.Resps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var totalSize int64
+	numFiles := 0
+
+	for _, name := range names {
+		lsResp := resp.Resps[name]
+
+		var lstreamSize int64
+		for _, f := range lsResp.Files {
+			lstreamSize += f.Size
+		}
+
+		sb.WriteString(fmt.Sprintf(
+			"%s: %s %d file(s), %s\n", name, verb, len(lsResp.Files), formatFileSize(lstreamSize),
+		))
+		for _, f := range lsResp.Files {
+			sb.WriteString(fmt.Sprintf("  %s (%s)\n", f.Path, formatFileSize(f.Size)))
+		}
+
+		totalSize += lstreamSize
+		numFiles += len(lsResp.Files)
+	}
+
+	errNames := make([]string, 0, len(resp.LStreamErrs))
+	for name := range resp.LStreamErrs {
+		errNames = append(errNames, name)
+	}
+	sort.Strings(errNames)
+
+	for _, name := range errNames {
+		sb.WriteString(fmt.Sprintf("%s: error: %s\n", name, resp.LStreamErrs[name]))
+	}
+
+	sb.WriteString(fmt.Sprintf(
+		"Total: %d file(s), %s on %d logstream(s)\n",
+		numFiles, formatFileSize(totalSize), len(names),
+	))
+
+	return sb.String()
+}
+
+// formatFileSize returns the size like "1.5 MiB".
+func formatFileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -182,6 +182,26 @@ func (app *nerdlogApp) handleCmd(cmd string) {
 	case "disconnect":
 		app.mainView.disconnect()
 
+	case "cancel":
+		app.mainView.cancelQuery()
+
+	case "cleanup":
+		dryRun := false
+		for _, arg := range parts[1:] {
+			switch arg {
+			case "--dry-run", "-n":
+				dryRun = true
+			default:
+				app.printError(fmt.Sprintf("unknown cleanup argument %q, the only supported one is --dry-run", arg))
+				return
+			}
+		}
+
+		app.mainView.cleanup(dryRun)
+
+	case "hostinfo":
+		app.mainView.showHostInfo()
+
 	default:
 		app.printError(fmt.Sprintf("unknown command %q", parts[0]))
 	}
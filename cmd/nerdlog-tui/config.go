@@ -11,6 +11,14 @@ import (
 
 type ConfigLogStreams struct {
 	LogStreams core.ConfigLogStreams `yaml:"log_streams"`
+
+	// Connection contains the global connection settings, which can be
+	// overridden by every logstream.
+	Connection *core.ConfigConnection `yaml:"connection"`
+
+	// IndexTTLDays, if not zero, makes the agent delete the index files which
+	// weren't used for that many days.
+	IndexTTLDays int `yaml:"index_ttl_days"`
 }
 
 func LoadLogstreamsConfigFromFile(path string) (*ConfigLogStreams, error) {
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dimonomid/nerdlog/core"
+)
+
+// formatHostInfo returns a human-readable report about every lstream's host:
+// the tools which the agent relies on, the free space in the work dir, and
+// the log files. The problems are marked with "⚠".
+func formatHostInfo(state *core.LStreamsManagerState) string {
+	stateByName := map[string]core.LStreamClientState{}
+	for lstreamState, names := range state.LStreamsByState {
+		for name := range names {
+			stateByName[name] = lstreamState
+		}
+	}
+
+	names := make([]string, 0, len(stateByName))
+	for name := range stateByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+
+		sb.WriteString(fmt.Sprintf("%s (%s)\n", name, stateByName[name]))
+
+		hi, ok := state.HostInfoByLStream[name]
+		if !ok {
+			sb.WriteString("  no info yet\n")
+			continue
+		}
+
+		writeRow := func(key, value, problem string) {
+			if problem != "" {
+				value += " ⚠ " + problem
+			}
+			sb.WriteString(fmt.Sprintf("  %-12s %s\n", key+":", value))
+		}
+
+		agent := "bash script"
+		if hi.NativeAgent {
+			agent = "native"
+		}
+		if hi.Arch != "" {
+			agent += " (" + hi.Arch + ")"
+		}
+		writeRow("agent", agent, "")
+
+		writeRow("bash", hi.Bash.String(), "")
+
+		// The native agent doesn't need awk and coreutils, so it doesn't even
+		// report them.
+		if !hi.NativeAgent {
+			var awkProblem string
+			if hi.Awk.Name != "gawk" {
+				awkProblem = "gawk is required"
+			}
+			writeRow("awk", hi.Awk.String(), awkProblem)
+		}
+
+		writeRow("gzip", hi.Gzip.String(), "")
+		writeRow("zstd", hi.Zstd.String(), "")
+
+		// It's only chosen once the bootstrap succeeds.
+		if hi.Compression.Kind != "" {
+			writeRow("compression", hi.Compression.String(), "")
+		}
+
+		if !hi.NativeAgent {
+			writeRow("coreutils", hi.Coreutils.String(), "")
+
+			if hi.StatFormat {
+				writeRow("stat -c", "yes", "")
+			} else {
+				writeRow("stat -c", "no", "stat -c is required")
+			}
+		}
+
+		if hi.Timedatectl {
+			writeRow("timedatectl", "yes", "")
+		} else {
+			writeRow("timedatectl", "no", "")
+		}
+
+		if hi.WorkDirFree >= 0 {
+			writeRow("work dir", formatFileSize(hi.WorkDirFree)+" free", "")
+		} else {
+			writeRow("work dir", "free space unknown", "")
+		}
+
+		for _, f := range hi.LogFiles {
+			sb.WriteString(fmt.Sprintf(
+				"  %s: %s, modified %s\n",
+				f.Path, formatFileSize(f.Size), f.ModTime.Format("2006-01-02 15:04:05 MST"),
+			))
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const inputPromptViewWidth = 70
+
+type InputPromptViewParams struct {
+	Title   string
+	Message string
+
+	// Secret means that the input should be masked, e.g. for passwords.
+	Secret bool
+
+	// OnSubmit is called when the user presses Enter, and OnCancel is called
+	// on Esc. In both cases, the view is hidden before the callback is called.
+	OnSubmit func(text string)
+	OnCancel func()
+}
+
+// InputPromptView is a modal which asks the user to enter some text, like a
+// password or a key passphrase.
+type InputPromptView struct {
+	params   InputPromptViewParams
+	mainView *MainView
+
+	flex  *tview.Flex
+	input *tview.InputField
+	frame *tview.Frame
+
+	msgHeight int
+}
+
+func NewInputPromptView(
+	mainView *MainView, params *InputPromptViewParams,
+) *InputPromptView {
+	ipv := &InputPromptView{
+		params:   *params,
+		mainView: mainView,
+	}
+
+	ipv.flex = tview.NewFlex().SetDirection(tview.FlexRow)
+
+	// Account for the borders and padding of the frame.
+	ipv.msgHeight = getNumLines(params.Message, inputPromptViewWidth-4)
+
+	msgView := tview.NewTextView()
+	msgView.SetText(params.Message)
+	msgView.SetWrap(true)
+	ipv.flex.AddItem(msgView, ipv.msgHeight, 0, false)
+
+	ipv.flex.AddItem(nil, 1, 0, false)
+
+	ipv.input = tview.NewInputField()
+	if params.Secret {
+		ipv.input.SetMaskCharacter('*')
+	}
+	ipv.input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyEnter:
+			text := ipv.input.GetText()
+			ipv.Hide()
+			ipv.params.OnSubmit(text)
+			return nil
+
+		case tcell.KeyEsc:
+			ipv.Hide()
+			ipv.params.OnCancel()
+			return nil
+		}
+
+		return event
+	})
+	ipv.flex.AddItem(ipv.input, 1, 0, true)
+
+	ipv.flex.AddItem(nil, 1, 0, false)
+
+	hint := tview.NewTextView()
+	hint.SetText("Enter: submit, Esc: cancel")
+	ipv.flex.AddItem(hint, 1, 0, false)
+
+	ipv.frame = tview.NewFrame(ipv.flex).SetBorders(0, 0, 0, 0, 0, 0)
+	ipv.frame.SetBorder(true).SetBorderPadding(0, 0, 1, 1)
+	ipv.frame.SetTitle(params.Title)
+
+	return ipv
+}
+
+func (ipv *InputPromptView) Show() {
+	ipv.mainView.showModal(
+		pageNameInputPrompt, ipv.frame,
+		inputPromptViewWidth,
+		// Message, input, hint, two spacers and two borders.
+		ipv.msgHeight+7,
+		true,
+	)
+}
+
+func (ipv *InputPromptView) Hide() {
+	ipv.mainView.hideModal(pageNameInputPrompt, true)
+}
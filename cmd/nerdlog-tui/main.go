@@ -20,19 +20,13 @@ var (
 	flagLStreams    = pflag.StringP("lstreams", "h", "", "Logstreams to connect to, as comma-separated glob patterns, e.g. 'foo-*,bar-*'")
 	flagQuery       = pflag.StringP("pattern", "p", "", "Initial awk pattern to use")
 	flagSelectQuery = pflag.StringP("selquery", "s", "", "SELECT-like query to specify which fields to show, like 'time STICKY, message, lstream, level_name AS level, *'")
+	flagDryRun      = pflag.Bool("dry-run", false, "Only for the cleanup mode: list the files which would be deleted, without deleting them")
 	flagLogLevel    = pflag.String("loglevel", "error", "This is NOT about the logs that nerdlog fetches from the remote servers, it's rather about nerdlog's own log. Valid values are: error, warning, info, verbose1, verbose2 or verbose3")
 )
 
 func main() {
 	pflag.Parse()
 
-	// As of today, the only way to connect to a logstream is to use ssh via agent,
-	// so check if the agent env var is present, and fail quickly if it's not.
-	if os.Getenv("SSH_AUTH_SOCK") == "" {
-		fmt.Fprintf(os.Stderr, "SSH_AUTH_SOCK env var is not present, which means ssh agent is not running, or at least is not accessible to Nerdlog. As of today, ssh agent is the only way for Nerdlog to connect to logstreams, so please start one, make sure that all the necessary keys are added to it, and retry.\n")
-		os.Exit(1)
-	}
-
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting home dir: %s\n", err)
@@ -94,12 +88,6 @@ func main() {
 		}
 	}
 
-	enableClipboard := true
-	if err := clipboard.Init(); err != nil {
-		enableClipboard = false
-		fmt.Println("NOTE: X Clipboard is not available")
-	}
-
 	logLevel := log.Info
 	if *flagLogLevel == "error" {
 		logLevel = log.Error
@@ -118,6 +106,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	if pflag.Arg(0) == "cleanup" {
+		// Cleanup mode: "nerdlog cleanup --lstreams 'foo-*' [--dry-run]"
+		if *flagLStreams == "" {
+			fmt.Fprintf(os.Stderr, "--lstreams is required for cleanup\n")
+			os.Exit(1)
+		}
+
+		if err := runCleanup(homeDir, *flagLStreams, *flagDryRun, logLevel); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+
+		return
+	} else if pflag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, the only supported one is \"cleanup\"\n", pflag.Arg(0))
+		os.Exit(1)
+	}
+
+	enableClipboard := true
+	if err := clipboard.Init(); err != nil {
+		enableClipboard = false
+		fmt.Println("NOTE: X Clipboard is not available")
+	}
+
 	app, err := newNerdlogApp(
 		nerdlogAppParams{
 			initialQueryData: initialQueryData,
@@ -24,6 +24,7 @@ const (
 	pageNameRowDetails      = "row_details"
 	pageNameColumnDetails   = "column_details"
 	pageNameTextView        = "text_view"
+	pageNameInputPrompt     = "input_prompt"
 )
 
 const (
@@ -44,8 +45,10 @@ type MainViewParams struct {
 
 	OnLStreamsChange OnLStreamsChange
 
-	OnDisconnectRequest OnDisconnectRequest
-	OnReconnectRequest  OnReconnectRequest
+	OnDisconnectRequest  OnDisconnectRequest
+	OnReconnectRequest   OnReconnectRequest
+	OnCancelQueryRequest OnCancelQueryRequest
+	OnCleanupRequest     OnCleanupRequest
 
 	// TODO: support command history
 	OnCmd OnCmdCallback
@@ -131,6 +134,11 @@ type MainView struct {
 	// there, we'll call doQuery().
 	doQueryParamsOnceConnected *doQueryParams
 
+	// rerunOfferedFor is the last LogRespTotal with some unreachable
+	// logstreams, for which we've offered to re-run the query once they're
+	// connected; so that we only offer it once.
+	rerunOfferedFor *core.LogRespTotal
+
 	// If sendLStreamsChangeOnNextQuery, then the next time the user wants to
 	// make a query (just the awk query, without the timeframe and logstreams),
 	// we'll first update the logstreams, and only then make the query.
@@ -149,6 +157,14 @@ type MainView struct {
 	//marketDescrByID map[common.MarketID]MarketDescr
 
 	modalsFocusStack []tview.Primitive
+
+	// userPrompts are the prompts from the logstreams which are waiting for the
+	// user to answer; only the first one is shown at a time.
+	userPrompts []*core.UserPrompt
+
+	// hideUserPrompt hides the currently shown prompt (the first one in
+	// userPrompts) without answering it.
+	hideUserPrompt func()
 }
 
 type CmdOpts struct {
@@ -162,6 +178,8 @@ type OnLogQueryCallback func(params core.QueryLogsParams)
 type OnLStreamsChange func(lstreamsSpec string) error
 type OnDisconnectRequest func()
 type OnReconnectRequest func()
+type OnCancelQueryRequest func()
+type OnCleanupRequest func(params core.CleanupParams)
 type OnCmdCallback func(cmd string, opts CmdOpts)
 
 var (
@@ -1019,10 +1037,78 @@ func (mv *MainView) applyHMState(lsmanState *core.LStreamsManagerState) {
 
 	mv.bumpStatusLineLeft()
 
-	if mv.curHMState.Connected && mv.doQueryParamsOnceConnected != nil {
-		mv.doQuery(*mv.doQueryParamsOnceConnected)
-		mv.doQueryParamsOnceConnected = nil
+	if mv.doQueryParamsOnceConnected != nil {
+		if mv.curHMState.Connected {
+			mv.doQuery(*mv.doQueryParamsOnceConnected)
+			mv.doQueryParamsOnceConnected = nil
+		} else if mv.params.Options.GetSkipUnreachable() && allNotConnectedFailed(mv.curHMState) {
+			// No point waiting for the unreachable logstreams, query the rest.
+			dqp := *mv.doQueryParamsOnceConnected
+			dqp.skipUnreachable = true
+			mv.doQuery(dqp)
+			mv.doQueryParamsOnceConnected = nil
+		}
+	}
+
+	// If the last results are missing some logstreams which were unreachable,
+	// and now everything is connected, offer to re-run the query.
+	if mv.curHMState.Connected && !mv.curHMState.Busy &&
+		mv.curLogResp != nil && len(mv.curLogResp.UnreachableLStreams) > 0 &&
+		mv.rerunOfferedFor != mv.curLogResp {
+		mv.rerunOfferedFor = mv.curLogResp
+		mv.offerRerun(mv.curLogResp.UnreachableLStreams)
+	}
+}
+
+// allNotConnectedFailed returns true if there is at least one connected
+// logstream, and every logstream which is not connected has failed to connect
+// at least once (as opposed to those which are still trying for the first
+// time).
+func allNotConnectedFailed(lsmanState *core.LStreamsManagerState) bool {
+	if lsmanState.NumConnected == 0 {
+		return false
 	}
+
+	for state, lstreams := range lsmanState.LStreamsByState {
+		if state == core.LStreamClientStateConnectedIdle || state == core.LStreamClientStateConnectedBusy {
+			continue
+		}
+
+		for name := range lstreams {
+			if lsmanState.ConnDetailsByLStream[name].Err == "" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// offerRerun shows a dialog offering to re-run the query, now that the
+// previously unreachable logstreams are connected.
+func (mv *MainView) offerRerun(unreachable []string) {
+	msgID := "rerunQuery"
+
+	mv.showMessagebox(
+		msgID,
+		"Logstreams are connected",
+		fmt.Sprintf(
+			"The last query skipped %d unreachable logstream(s): %s\n\nThey are connected now; re-run the query?",
+			len(unreachable), strings.Join(unreachable, ", "),
+		),
+		&MessageboxParams{
+			Buttons: []string{"Re-run", "Dismiss"},
+			OnButtonPressed: func(label string, idx int) {
+				// TODO: using pageNameMessage here directly is too hacky
+				mv.hideModal(pageNameMessage+msgID, true)
+
+				switch label {
+				case "Re-run":
+					mv.doQuery(doQueryParams{})
+				}
+			},
+		},
+	)
 }
 
 func (mv *MainView) makeOverlayVisible() {
@@ -1199,9 +1285,53 @@ func (mv *MainView) applyLogs(resp *core.LogRespTotal) {
 		mv.logsTable.Select(selectedRow+numNewRows, 0)
 	}
 
+	mv.bumpStatusLineLeft()
+
+	if len(resp.PendingLStreams) > 0 {
+		mv.printMsg(fmt.Sprintf(
+			"Partial results so far (%s), waiting for %d logstream(s): %s",
+			resp.QueryDur.Round(1*time.Millisecond), len(resp.PendingLStreams), strings.Join(resp.PendingLStreams, ", "),
+		), nlMsgLevelInfo)
+		return
+	}
+
+	if len(resp.UnreachableLStreams) > 0 {
+		mv.printMsg(fmt.Sprintf(
+			"Query took: %s; partial results, %d logstream(s) unreachable: %s",
+			resp.QueryDur.Round(1*time.Millisecond), len(resp.UnreachableLStreams), strings.Join(resp.UnreachableLStreams, ", "),
+		), nlMsgLevelWarn)
+		return
+	}
+
+	if len(resp.LStreamErrs) > 0 {
+		errStrs := make([]string, 0, len(resp.LStreamErrs))
+		for _, name := range getFailedLStreams(resp) {
+			errStrs = append(errStrs, fmt.Sprintf("%s: %s", name, resp.LStreamErrs[name]))
+		}
+
+		mv.printMsg(fmt.Sprintf(
+			"Query took: %s; partial results, %d logstream(s) failed: %s",
+			resp.QueryDur.Round(1*time.Millisecond), len(resp.LStreamErrs), strings.Join(errStrs, "; "),
+		), nlMsgLevelWarn)
+		return
+	}
+
 	mv.printMsg(fmt.Sprintf("Query took: %s", resp.QueryDur.Round(1*time.Millisecond)), nlMsgLevelInfo)
 }
 
+// getFailedLStreams returns the sorted names of the logstreams which failed
+// to return logs.
+func getFailedLStreams(resp *core.LogRespTotal) []string {
+	ret := make([]string, 0, len(resp.LStreamErrs))
+	for name := range resp.LStreamErrs {
+		ret = append(ret, name)
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
 func (mv *MainView) formatLogs() {
 	resp := mv.curLogResp
 	if resp == nil {
@@ -1309,12 +1439,65 @@ func (mv *MainView) bumpStatusLineLeft() {
 	sb.WriteString(" ")
 	sb.WriteString(getStatuslineNumStr("🖳", numOther, "red"))
 
+	// If the last results are partial, show which logstreams are missing.
+	if mv.curLogResp != nil && len(mv.curLogResp.LStreamErrs) > 0 {
+		sb.WriteString(" [yellow::b]⚠ failed: ")
+		sb.WriteString(tview.Escape(strings.Join(getFailedLStreams(mv.curLogResp), ", ")))
+		sb.WriteString("[-::-]")
+	}
+	if mv.curLogResp != nil && len(mv.curLogResp.UnreachableLStreams) > 0 {
+		sb.WriteString(" [yellow::b]⚠ unreachable: ")
+		sb.WriteString(tview.Escape(strings.Join(mv.curLogResp.UnreachableLStreams, ", ")))
+		sb.WriteString("[-::-]")
+	}
+
+	if slow := getSlowLStreams(lsmanState); len(slow) > 0 {
+		sb.WriteString(" [orange::b]⏱ slow: ")
+		sb.WriteString(tview.Escape(strings.Join(slow, ", ")))
+		sb.WriteString("[-::-]")
+	}
+
 	sb.WriteString(" | ")
 	sb.WriteString(mv.lstreamsSpec)
 
 	mv.statusLineLeft.SetText(sb.String())
 }
 
+// slowLinkRTT is the round-trip time starting from which the link to the
+// logstream is considered slow, and it's shown in the status line.
+const slowLinkRTT = 500 * time.Millisecond
+
+// getSlowLStreams returns the logstreams with slow links, together with their
+// round-trip times, like "myhost (1.2s)"; the slowest ones go first.
+func getSlowLStreams(lsmanState *core.LStreamsManagerState) []string {
+	type lstreamWRTT struct {
+		name string
+		rtt  time.Duration
+	}
+
+	var slow []lstreamWRTT
+	for name, stats := range lsmanState.ConnStatsByLStream {
+		if stats.RTT >= slowLinkRTT {
+			slow = append(slow, lstreamWRTT{name: name, rtt: stats.RTT})
+		}
+	}
+
+	sort.Slice(slow, func(i, j int) bool {
+		if slow[i].rtt != slow[j].rtt {
+			return slow[i].rtt > slow[j].rtt
+		}
+
+		return slow[i].name < slow[j].name
+	})
+
+	ret := make([]string, 0, len(slow))
+	for _, v := range slow {
+		ret = append(ret, fmt.Sprintf("%s (%s)", v.name, v.rtt.Round(100*time.Millisecond)))
+	}
+
+	return ret
+}
+
 func (mv *MainView) bumpStatusLineRight() {
 	selectedRow, _ := mv.logsTable.GetSelection()
 	selectedRow -= 1
@@ -1486,6 +1669,10 @@ type doQueryParams struct {
 	// populated with a new item (it should be used exactly when we're navigating
 	// this browser-like history back and forth)
 	dontAddHistoryItem bool
+
+	// If skipUnreachable is true, only the connected logstreams will be
+	// queried, even if the skipunreachable option is off.
+	skipUnreachable bool
 }
 
 func (mv *MainView) doQuery(params doQueryParams) {
@@ -1494,6 +1681,8 @@ func (mv *MainView) doQuery(params doQueryParams) {
 		To:    mv.actualToForQuery,
 		Query: mv.query,
 
+		SkipUnreachable: params.skipUnreachable,
+
 		DontAddHistoryItem: params.dontAddHistoryItem,
 	})
 }
@@ -1703,7 +1892,11 @@ func (mv *MainView) disconnect() {
 }
 
 // handleQueryError shows the right messagebox based on the error cause.
-func (mv *MainView) handleQueryError(err error) {
+//
+// If retry is not nil, and the error is "busy with another query", there will
+// also be an "Override" button, which cancels the query in progress and calls
+// retry.
+func (mv *MainView) handleQueryError(err error, retry func()) {
 	if errors.Cause(err) == core.ErrBusyWithAnotherQuery ||
 		errors.Cause(err) == core.ErrNotYetConnected {
 		// In this particular error ("busy with another query"), show a dialog
@@ -1712,12 +1905,20 @@ func (mv *MainView) handleQueryError(err error) {
 
 		msgID := "busyWithAnotherQuery"
 
+		buttons := []string{"OK", "Details"}
+		if retry != nil && errors.Cause(err) == core.ErrBusyWithAnotherQuery {
+			buttons = append(buttons, "Override")
+		}
+		if errors.Cause(err) == core.ErrNotYetConnected {
+			buttons = append(buttons, "Query connected")
+		}
+
 		mv.showMessagebox(
 			msgID,
 			"Log query error",
 			err.Error(),
 			&MessageboxParams{
-				Buttons: []string{"OK", "Details"},
+				Buttons: buttons,
 				OnButtonPressed: func(label string, idx int) {
 					// Whatever button the user pressed, we hide the dialog. Keep in mind
 					// it needs to happen _before_ we call makeOverlayVisible() below.
@@ -1735,15 +1936,15 @@ func (mv *MainView) handleQueryError(err error) {
 							mv.bumpOverlay()
 						}
 
-						// TODO: would be useful to implement force-override right from this dialog,
-						// but keep in mind it should work both when we just send a new query,
-						// and when the "full" query changes (with lstreams, timeline etc).
-						// It's non-essential though, so for now I ignore it.
+					case "Override":
+						// The cancellation request is handled before whatever retry
+						// sends, so by the time the retried query gets there, the
+						// LStreamsManager is not busy anymore.
+						mv.params.OnCancelQueryRequest()
+						retry()
 
-						//case "Override":
-						//// TODO: using pageNameMessage here directly is too hacky
-						//mv.hideModal(pageNameMessage+msgID, true)
-						//mv.reconnect(true)
+					case "Query connected":
+						mv.doQuery(doQueryParams{skipUnreachable: true})
 					}
 				},
 
@@ -1765,6 +1966,111 @@ func (mv *MainView) handleBootstrapError(err error) {
 	})
 }
 
+// handleUserPrompt adds the prompt to the queue, and shows it right away if
+// there are no other prompts being shown.
+func (mv *MainView) handleUserPrompt(p *core.UserPrompt) {
+	mv.userPrompts = append(mv.userPrompts, p)
+	if len(mv.userPrompts) == 1 {
+		mv.showNextUserPrompt()
+	}
+
+	// If the prompt gets abandoned before the user answers it, drop it.
+	go func() {
+		<-p.Done()
+		mv.params.App.QueueUpdateDraw(func() {
+			mv.dropUserPrompt(p)
+		})
+	}()
+}
+
+// dropUserPrompt removes the prompt from the queue without answering it, and
+// if it's being shown, hides it and shows the next one. If the prompt is not
+// in the queue (e.g. because it was answered), it's a no-op.
+func (mv *MainView) dropUserPrompt(p *core.UserPrompt) {
+	for i, qp := range mv.userPrompts {
+		if qp != p {
+			continue
+		}
+
+		mv.userPrompts = append(mv.userPrompts[:i:i], mv.userPrompts[i+1:]...)
+
+		if i == 0 {
+			mv.hideUserPrompt()
+			mv.showNextUserPrompt()
+		}
+
+		return
+	}
+}
+
+// showNextUserPrompt shows the first prompt from the queue, if any.
+func (mv *MainView) showNextUserPrompt() {
+	if len(mv.userPrompts) == 0 {
+		return
+	}
+
+	p := mv.userPrompts[0]
+	msgID := "user_prompt"
+
+	respond := func(resp core.UserPromptResp) {
+		// TODO: using pageNameMessage here directly is too hacky
+		mv.hideModal(pageNameMessage+msgID, true)
+
+		p.Respond(resp)
+
+		mv.userPrompts = mv.userPrompts[1:]
+		mv.showNextUserPrompt()
+	}
+
+	switch p.Kind {
+	case core.UserPromptKindConfirm:
+		mv.hideUserPrompt = func() {
+			mv.hideModal(pageNameMessage+msgID, true)
+		}
+
+		mv.showMessagebox(
+			msgID,
+			fmt.Sprintf("%s (%s)", p.Title, p.LStreamName),
+			p.Message,
+			&MessageboxParams{
+				Buttons: []string{"Yes", "No"},
+				OnButtonPressed: func(label string, idx int) {
+					respond(core.UserPromptResp{Yes: label == "Yes"})
+				},
+				OnEsc: func() {
+					respond(core.UserPromptResp{Yes: false})
+				},
+			},
+		)
+
+	case core.UserPromptKindSecret, core.UserPromptKindText:
+		// The view hides itself, so here we only deliver the answer.
+		respondInput := func(resp core.UserPromptResp) {
+			p.Respond(resp)
+
+			mv.userPrompts = mv.userPrompts[1:]
+			mv.showNextUserPrompt()
+		}
+
+		ipv := NewInputPromptView(mv, &InputPromptViewParams{
+			Title:   fmt.Sprintf("%s (%s)", p.Title, p.LStreamName),
+			Message: p.Message,
+			Secret:  p.Kind == core.UserPromptKindSecret,
+			OnSubmit: func(text string) {
+				respondInput(core.UserPromptResp{Yes: true, Text: text})
+			},
+			OnCancel: func() {
+				respondInput(core.UserPromptResp{Yes: false})
+			},
+		})
+		mv.hideUserPrompt = ipv.Hide
+		ipv.Show()
+
+	default:
+		panic(fmt.Sprintf("unknown prompt kind %q", p.Kind))
+	}
+}
+
 // reconnect initiates reconnection to all the log streams. If repeatQuery
 // is true, then after reconnecting, the current query will be repeated, too.
 func (mv *MainView) reconnect(repeatQuery bool) {
@@ -1778,3 +2084,54 @@ func (mv *MainView) reconnect(repeatQuery bool) {
 
 	mv.params.OnReconnectRequest()
 }
+
+// cancelQuery cancels the query in progress, if any.
+func (mv *MainView) cancelQuery() {
+	mv.params.OnCancelQueryRequest()
+}
+
+// cleanup requests the cleanup of the nerdlog files on the logstreams; the
+// agent which is in use is kept, so that we can keep querying logs.
+func (mv *MainView) cleanup(dryRun bool) {
+	mv.params.OnCleanupRequest(core.CleanupParams{
+		DryRun: dryRun,
+	})
+}
+
+// handleCleanupResp shows the result of the cleanup: the files listed or
+// deleted on every logstream, and the errors, if any.
+func (mv *MainView) handleCleanupResp(resp *core.CleanupRespTotal) {
+	if len(resp.Errs) > 0 {
+		mv.showMessagebox("err", "Cleanup error", combineErrors(resp.Errs).Error(), &MessageboxParams{
+			BackgroundColor: tcell.ColorDarkRed,
+		})
+		return
+	}
+
+	title := "Cleanup done"
+	verb := "Deleted"
+	if resp.DryRun {
+		title = "Cleanup dry run"
+		verb = "Would delete"
+	}
+
+	msg := tview.Escape(formatCleanupResp(resp, verb))
+
+	params := &MessageboxParams{}
+	if len(resp.LStreamErrs) > 0 {
+		params.BackgroundColor = tcell.ColorDarkRed
+	}
+
+	mv.showMessagebox("cleanup", title, msg, params)
+}
+
+// showHostInfo shows the info about every lstream's host, as reported during
+// the last bootstrap.
+func (mv *MainView) showHostInfo() {
+	if mv.curHMState == nil {
+		mv.printMsg("No lstreams yet", nlMsgLevelErr)
+		return
+	}
+
+	mv.showMessagebox("hostinfo", "Host info", tview.Escape(formatHostInfo(mv.curHMState)), nil)
+}
@@ -15,6 +15,14 @@ type Options struct {
 	// MaxNumLines is how many log lines the nerdlog_agent.sh will return at
 	// most. Initially it's set to 250.
 	MaxNumLines int
+
+	// If Progressive is true, the logs are shown as soon as any logstream
+	// responds, without waiting for all of them.
+	Progressive bool
+
+	// If SkipUnreachable is true, the queries are done on the connected
+	// logstreams only, instead of waiting for all of them to connect.
+	SkipUnreachable bool
 }
 
 type OptionsShared struct {
@@ -41,6 +49,18 @@ func (o *OptionsShared) GetMaxNumLines() int {
 	return o.options.MaxNumLines
 }
 
+func (o *OptionsShared) GetProgressive() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.Progressive
+}
+
+func (o *OptionsShared) GetSkipUnreachable() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.options.SkipUnreachable
+}
+
 func (o *OptionsShared) GetAll() Options {
 	o.mtx.Lock()
 	defer o.mtx.Unlock()
@@ -100,6 +120,36 @@ var AllOptions = map[string]*OptionMeta{
 	"numlines": {
 		AliasOf: "maxnumlines",
 	}, // }}}
+	"progressive": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.Progressive)
+		},
+		Set: func(o *Options, value string) error {
+			progressive, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.Progressive = progressive
+			return nil
+		},
+		Help: "Whether to show the logs from every logstream as soon as it responds, without waiting for all of them",
+	}, // }}}
+	"skipunreachable": { // {{{
+		Get: func(o *Options) string {
+			return strconv.FormatBool(o.SkipUnreachable)
+		},
+		Set: func(o *Options, value string) error {
+			skipUnreachable, err := strconv.ParseBool(value)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			o.SkipUnreachable = skipUnreachable
+			return nil
+		},
+		Help: "Whether to query only the connected logstreams, instead of waiting for all of them to connect",
+	}, // }}}
 }
 
 func OptionMetaByName(name string) *OptionMeta {
@@ -253,9 +253,7 @@ func NewQueryEditView(
 
 		switch event.Key() {
 		case tcell.KeyEnter:
-			if err := qev.applyQuery(); err != nil {
-				qev.mainView.handleQueryError(err)
-			}
+			qev.applyQueryOrShowError()
 			return nil
 		}
 
@@ -275,9 +273,7 @@ func NewQueryEditView(
 
 		switch event.Key() {
 		case tcell.KeyEnter:
-			if err := qev.applyQuery(); err != nil {
-				qev.mainView.handleQueryError(err)
-			}
+			qev.applyQueryOrShowError()
 			return nil
 		}
 
@@ -297,9 +293,7 @@ func NewQueryEditView(
 
 		switch event.Key() {
 		case tcell.KeyEnter:
-			if err := qev.applyQuery(); err != nil {
-				qev.mainView.handleQueryError(err)
-			}
+			qev.applyQueryOrShowError()
 			return nil
 		}
 
@@ -319,9 +313,7 @@ func NewQueryEditView(
 
 		switch event.Key() {
 		case tcell.KeyEnter:
-			if err := qev.applyQuery(); err != nil {
-				qev.mainView.handleQueryError(err)
-			}
+			qev.applyQueryOrShowError()
 			return nil
 		}
 
@@ -487,3 +479,12 @@ func (qev *QueryEditView) applyQuery() error {
 
 	return nil
 }
+
+// applyQueryOrShowError applies the query, and if it fails, shows the error;
+// if the error can be overridden (e.g. another query is in progress), the
+// override will retry applying the query.
+func (qev *QueryEditView) applyQueryOrShowError() {
+	if err := qev.applyQuery(); err != nil {
+		qev.mainView.handleQueryError(err, qev.applyQueryOrShowError)
+	}
+}
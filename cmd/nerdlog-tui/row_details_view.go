@@ -506,8 +506,6 @@ func NewRowDetailsView(
 			default:
 				break ks
 			}
-
-			return nil
 		}
 
 		event = rdv.genericInputHandler(event, getGenericTabHandler(rdv.tbl), nil, nil)
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// nerdlogAgentBinFS contains the gzipped native agent binaries, built by
+// "make agent-bins"; see nerdlog_agent_bin/README.md. If they weren't built,
+// only the shell agent is used.
+//
+//go:embed nerdlog_agent_bin
+var nerdlogAgentBinFS embed.FS
+
+const nerdlogAgentBinDir = "nerdlog_agent_bin"
+
+// shellAgentVariantName is the agent variant name of the shell agent; the
+// native ones are named like "linux-amd64".
+const shellAgentVariantName = "sh"
+
+// agentUnameMachines maps the GOARCH of the native agent builds to the
+// corresponding values of "uname -m" on the logstream hosts.
+var agentUnameMachines = map[string][]string{
+	"amd64": {"x86_64"},
+	"arm64": {"aarch64", "arm64"},
+	"arm":   {"armv6l", "armv7l", "armv8l"},
+	"386":   {"i386", "i486", "i586", "i686"},
+}
+
+// agentVariant is an implementation of the agent which can be uploaded to the
+// logstream host: either the shell script, which runs anywhere (as long as
+// gawk and friends are there), or a native binary for a particular
+// architecture.
+type agentVariant struct {
+	// name is "sh" for the shell agent, or like "linux-amd64" for the native
+	// ones.
+	name string
+
+	// unameMachines are the values of "uname -m" on which the native agent
+	// runs; empty for the shell agent.
+	unameMachines []string
+
+	// hash is the hex-encoded sha256 of the agent file.
+	hash string
+
+	// shellScript is the contents of the shell agent; empty for the native
+	// ones.
+	shellScript string
+	// gzData is the gzipped native agent binary; empty for the shell agent.
+	gzData []byte
+}
+
+var shellAgentVariant = &agentVariant{
+	name:        shellAgentVariantName,
+	hash:        nerdlogAgentShHash,
+	shellScript: nerdlogAgentSh,
+}
+
+func (v *agentVariant) isNative() bool {
+	return v.name != shellAgentVariantName
+}
+
+// fname returns the filename of the agent in the work dir. It's named after
+// the client ID and the agent checksum, so it's shared by all the logstreams
+// of the same client on the same host, and neither other clients nor a
+// different version of nerdlog use the same file.
+func (v *agentVariant) fname(clientID string) string {
+	fname := fmt.Sprintf("nerdlog_agent_%s_%s", clientID, v.hash[:16])
+	if !v.isNative() {
+		fname += ".sh"
+	}
+
+	return fname
+}
+
+// runner returns the command to run the agent file with: bash for the shell
+// agent, and nothing for the native ones.
+func (v *agentVariant) runner() string {
+	if v.isNative() {
+		return ""
+	}
+
+	return "bash"
+}
+
+// writeScript returns the shell code which writes the agent to the file dst
+// (which is a shell expression, like "$tmp_path").
+// Since it's a heredoc, it can't be indented.
+func (v *agentVariant) writeScript(dst string) string {
+	if !v.isNative() {
+		return "cat << 'EOF' > " + dst + "\n" + v.shellScript + "EOF\n"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("base64 -d << 'EOF' | gzip -dc > " + dst + "\n")
+
+	encoded := base64.StdEncoding.EncodeToString(v.gzData)
+	for len(encoded) > 76 {
+		sb.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+	sb.WriteString(encoded + "\n")
+
+	sb.WriteString("EOF\n")
+
+	return sb.String()
+}
+
+// agentVariants is the set of agents which the client can upload: the shell
+// agent, and the native ones which are loaded from the given fs.FS.
+type agentVariants struct {
+	binFS  fs.FS
+	binDir string
+
+	loadOnce   sync.Once
+	natives    []*agentVariant
+	nativesErr error
+}
+
+// defaultAgentVariants are the agents embedded in the nerdlog binary.
+var defaultAgentVariants = newAgentVariants(nerdlogAgentBinFS, nerdlogAgentBinDir)
+
+// newAgentVariants creates the agentVariants with the native agents loaded
+// from the dir in binFS, with the files named like
+// "nerdlog-agent-linux-amd64.gz"; other files are ignored.
+func newAgentVariants(binFS fs.FS, binDir string) *agentVariants {
+	return &agentVariants{
+		binFS:  binFS,
+		binDir: binDir,
+	}
+}
+
+// getNatives returns the native agents. Since it needs to decompress them
+// all, it's done only once, and not until the agents are actually needed.
+func (av *agentVariants) getNatives() ([]*agentVariant, error) {
+	av.loadOnce.Do(func() {
+		av.natives, av.nativesErr = loadNativeAgentVariants(av.binFS, av.binDir)
+	})
+
+	return av.natives, av.nativesErr
+}
+
+// byName returns the agent variant with the given name, or nil.
+func (av *agentVariants) byName(name string) *agentVariant {
+	if name == shellAgentVariantName {
+		return shellAgentVariant
+	}
+
+	natives, _ := av.getNatives()
+	for _, v := range natives {
+		if v.name == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func loadNativeAgentVariants(binFS fs.FS, binDir string) ([]*agentVariant, error) {
+	entries, err := fs.ReadDir(binFS, binDir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret []*agentVariant
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "nerdlog-agent-linux-") || !strings.HasSuffix(name, ".gz") {
+			continue
+		}
+
+		goarch := strings.TrimSuffix(strings.TrimPrefix(name, "nerdlog-agent-linux-"), ".gz")
+		unameMachines, ok := agentUnameMachines[goarch]
+		if !ok {
+			continue
+		}
+
+		gzData, err := fs.ReadFile(binFS, path.Join(binDir, name))
+		if err != nil {
+			return nil, errors.Annotatef(err, "reading %s", name)
+		}
+
+		gzReader, err := gzip.NewReader(bytes.NewReader(gzData))
+		if err != nil {
+			return nil, errors.Annotatef(err, "decompressing %s", name)
+		}
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, gzReader); err != nil {
+			return nil, errors.Annotatef(err, "decompressing %s", name)
+		}
+
+		ret = append(ret, &agentVariant{
+			name:          "linux-" + goarch,
+			unameMachines: unameMachines,
+			hash:          hex.EncodeToString(hasher.Sum(nil)),
+			gzData:        gzData,
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+
+	return ret, nil
+}
+
+// Names of the shell variables set by agentSelectScript.
+const (
+	agentVariantShellVar = "nerdlog_agent_variant"
+	agentPathShellVar    = "nerdlog_agent_path"
+	agentHashShellVar    = "nerdlog_agent_hash"
+	agentRunnerShellVar  = "nerdlog_agent_runner"
+)
+
+// agentSelectScript returns the part of the bootstrap script which picks the
+// agent to use: one of the natives, if it's there for the host architecture
+// (archScript should be run before), otherwise the shell agent. It sets
+// the shell vars with the agent variant name, the path to the agent file in
+// the work dir, its checksum, and the command to run it with, and prints
+// "agent_variant:<name>".
+//
+// The native agents are only used on Linux, and only if base64 is there,
+// since it's needed for the upload.
+func agentSelectScript(natives []*agentVariant, clientID string) string {
+	var sb strings.Builder
+
+	sb.WriteString(agentAssignScript(shellAgentVariant, clientID))
+
+	if len(natives) > 0 {
+		sb.WriteString("  if [[ \"$(uname -s 2>/dev/null)\" == Linux ]] && command -v base64 > /dev/null; then\n")
+		sb.WriteString("    case \"$nerdlog_arch\" in\n")
+		for _, v := range natives {
+			sb.WriteString("      " + strings.Join(v.unameMachines, "|") + ")\n")
+			sb.WriteString(indentScript(agentAssignScript(v, clientID), "    "))
+			sb.WriteString("        ;;\n")
+		}
+		sb.WriteString("    esac\n")
+		sb.WriteString("  fi\n")
+	}
+
+	sb.WriteString("  echo \"agent_variant:$" + agentVariantShellVar + "\"\n")
+
+	return sb.String()
+}
+
+// archScript returns the part of the bootstrap script which figures out the
+// host architecture, and prints it as "arch:<uname -m>".
+func archScript() string {
+	return "  nerdlog_arch=\"$(uname -m 2>/dev/null)\"\n" +
+		"  echo \"arch:$nerdlog_arch\"\n"
+}
+
+// agentAssignScript returns the shell code which sets the same vars as
+// agentSelectScript does, for the given agent.
+func agentAssignScript(v *agentVariant, clientID string) string {
+	return fmt.Sprintf(
+		"  %s=%s\n  %s=\"$%s\"/%s\n  %s=%s\n  %s=%s\n",
+		agentVariantShellVar, shellQuote(v.name),
+		agentPathShellVar, workDirShellVar, shellQuote(v.fname(clientID)),
+		agentHashShellVar, shellQuote(v.hash),
+		agentRunnerShellVar, shellQuote(v.runner()),
+	)
+}
+
+// indentScript adds the given indentation to every line of the script.
+func indentScript(script, indent string) string {
+	lines := strings.SplitAfter(script, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+
+	return strings.Join(lines, "")
+}
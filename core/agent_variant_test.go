@@ -0,0 +1,95 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	_, err := gzWriter.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, gzWriter.Close())
+
+	return buf.Bytes()
+}
+
+func TestAgentVariantsLoad(t *testing.T) {
+	// Big enough so that the base64 in the upload script takes many lines.
+	bin := bytes.Repeat([]byte("\x00\x01native agent\xff"), 1000)
+	binHash := sha256.Sum256(bin)
+
+	agents := newAgentVariants(fstest.MapFS{
+		"bin/nerdlog-agent-linux-arm64.gz": {Data: gzipBytes(t, bin)},
+		"bin/nerdlog-agent-linux-mips.gz":  {Data: gzipBytes(t, bin)},
+		"bin/README.md":                    {Data: []byte("whatever")},
+	}, "bin")
+
+	natives, err := agents.getNatives()
+	if !assert.NoError(t, err) || !assert.Len(t, natives, 1) {
+		return
+	}
+
+	native := natives[0]
+	assert.Equal(t, "linux-arm64", native.name)
+	assert.Equal(t, []string{"aarch64", "arm64"}, native.unameMachines)
+	assert.Equal(t, hex.EncodeToString(binHash[:]), native.hash)
+	assert.True(t, native.isNative())
+	assert.Equal(t, "", native.runner())
+	assert.Equal(t, "nerdlog_agent_myid_"+native.hash[:16], native.fname("myid"))
+
+	assert.Equal(t, native, agents.byName("linux-arm64"))
+	assert.Equal(t, shellAgentVariant, agents.byName(shellAgentVariantName))
+	assert.Nil(t, agents.byName("linux-mips"))
+
+	assert.False(t, shellAgentVariant.isNative())
+	assert.Equal(t, "bash", shellAgentVariant.runner())
+	assert.Equal(t, "nerdlog_agent_myid_"+nerdlogAgentShHash[:16]+".sh", shellAgentVariant.fname("myid"))
+
+	// The upload scripts should write the agents exactly as they are.
+	for _, tc := range []struct {
+		agent *agentVariant
+		want  []byte
+	}{
+		{agent: native, want: bin},
+		{agent: shellAgentVariant, want: []byte(nerdlogAgentSh)},
+	} {
+		dst := filepath.Join(t.TempDir(), "agent")
+
+		cmd := exec.Command("bash")
+		cmd.Stdin = bytes.NewBufferString(tc.agent.writeScript(shellQuote(dst)))
+		out, err := cmd.CombinedOutput()
+		if !assert.NoError(t, err, string(out)) {
+			continue
+		}
+
+		got, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(tc.want, got), "agent %s is corrupted by the upload", tc.agent.name)
+	}
+}
+
+func TestAgentVariantsLoadError(t *testing.T) {
+	agents := newAgentVariants(fstest.MapFS{
+		"bin/nerdlog-agent-linux-amd64.gz": {Data: []byte("not gzipped")},
+	}, "bin")
+
+	_, err := agents.getNatives()
+	assert.Error(t, err)
+
+	// Only the shell agent is still there.
+	assert.Nil(t, agents.byName("linux-amd64"))
+	assert.Equal(t, shellAgentVariant, agents.byName(shellAgentVariantName))
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"strconv"
+
+	"github.com/juju/errors"
+)
+
+// CompressionKind specifies how the query output is compressed on the
+// logstream host before it's sent to nerdlog.
+type CompressionKind string
+
+const (
+	// CompressionAuto picks the best compressor available on the host: zstd
+	// if it's there, otherwise gzip, otherwise no compression. It's the
+	// default.
+	CompressionAuto CompressionKind = "auto"
+
+	// CompressionZstd uses the zstd binary on the host. It's faster and
+	// compresses better than gzip, so it's the best choice for slow links.
+	CompressionZstd CompressionKind = "zstd"
+
+	// CompressionGzip uses the gzip binary on the host.
+	CompressionGzip CompressionKind = "gzip"
+
+	// CompressionNone sends the query output as is; it saves some CPU on both
+	// sides, so it might be the best choice for fast links.
+	CompressionNone CompressionKind = "none"
+)
+
+// LogStreamCompression specifies how the query output is compressed.
+type LogStreamCompression struct {
+	// Kind is the compression algorithm; empty means CompressionAuto.
+	Kind CompressionKind
+
+	// Level is the compression level: 1-9 for gzip, 1-19 for zstd. Zero means
+	// the default level of the compressor (6 for gzip, 3 for zstd). It can only
+	// be set together with an explicit Kind, since the levels of different
+	// compressors mean different things.
+	Level int
+}
+
+func (c LogStreamCompression) String() string {
+	kind := c.Kind
+	if kind == "" {
+		kind = CompressionAuto
+	}
+
+	if c.Level == 0 {
+		return string(kind)
+	}
+
+	return string(kind) + " -" + strconv.Itoa(c.Level)
+}
+
+func (c LogStreamCompression) validate() error {
+	maxLevel := 0
+
+	switch c.Kind {
+	case "", CompressionAuto, CompressionNone:
+	case CompressionGzip:
+		maxLevel = 9
+	case CompressionZstd:
+		maxLevel = 19
+	default:
+		return errors.Errorf("unknown compression %q", c.Kind)
+	}
+
+	if c.Level != 0 {
+		if maxLevel == 0 {
+			return errors.Errorf("compression level can only be set for gzip or zstd")
+		}
+
+		if c.Level < 1 || c.Level > maxLevel {
+			return errors.Errorf("%s compression level must be 1-%d, got %d", c.Kind, maxLevel, c.Level)
+		}
+	}
+
+	return nil
+}
+
+// chooseCompression returns the compression to use for the host with the
+// given info: if the compression is configured explicitly, it's checked that
+// the compressor is available; otherwise, the best available one is picked.
+func chooseCompression(configured LogStreamCompression, hostInfo *HostInfo) (LogStreamCompression, error) {
+	if hostInfo == nil {
+		// Nothing is known about the host, so don't rely on any compressors.
+		hostInfo = newHostInfo()
+	}
+
+	switch configured.Kind {
+	case "", CompressionAuto:
+		switch {
+		case hostInfo.Zstd.Name != "":
+			return LogStreamCompression{Kind: CompressionZstd}, nil
+		case hostInfo.Gzip.Name != "":
+			return LogStreamCompression{Kind: CompressionGzip}, nil
+		default:
+			return LogStreamCompression{Kind: CompressionNone}, nil
+		}
+
+	case CompressionZstd:
+		if hostInfo.Zstd.Name == "" {
+			return LogStreamCompression{}, errors.Errorf("zstd compression is configured, but zstd is not found on the host")
+		}
+
+	case CompressionGzip:
+		if hostInfo.Gzip.Name == "" {
+			return LogStreamCompression{}, errors.Errorf("gzip compression is configured, but gzip is not found on the host")
+		}
+	}
+
+	return configured, nil
+}
+
+// shellCmd returns the command which compresses stdin to stdout; it's empty
+// for CompressionNone.
+func (c LogStreamCompression) shellCmd() string {
+	var cmd string
+
+	switch c.Kind {
+	case CompressionZstd:
+		cmd = "zstd -q -c"
+	case CompressionGzip:
+		cmd = "gzip -c"
+	default:
+		return ""
+	}
+
+	if c.Level != 0 {
+		cmd += " -" + strconv.Itoa(c.Level)
+	}
+
+	return cmd
+}
+
+// marker returns the marker which precedes every chunk of the compressed
+// payload, see markers.go; it's empty for CompressionNone.
+func (c LogStreamCompression) marker() string {
+	switch c.Kind {
+	case CompressionZstd:
+		return markerZstd
+	case CompressionGzip:
+		return markerGzip
+	default:
+		return ""
+	}
+}
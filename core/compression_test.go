@@ -0,0 +1,112 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChooseCompression(t *testing.T) {
+	gzipOnly := &HostInfo{Gzip: HostTool{Name: "gzip", Version: "1.12"}}
+	both := &HostInfo{
+		Gzip: HostTool{Name: "busybox", Version: "v1.36.1"},
+		Zstd: HostTool{Name: "zstd", Version: "1.5.5"},
+	}
+	neither := newHostInfo()
+
+	for _, tc := range []struct {
+		name       string
+		configured LogStreamCompression
+		hostInfo   *HostInfo
+		want       LogStreamCompression
+		wantErr    string
+	}{
+		{
+			name:     "auto with both",
+			hostInfo: both,
+			want:     LogStreamCompression{Kind: CompressionZstd},
+		},
+		{
+			name:       "explicit auto with gzip only",
+			configured: LogStreamCompression{Kind: CompressionAuto},
+			hostInfo:   gzipOnly,
+			want:       LogStreamCompression{Kind: CompressionGzip},
+		},
+		{
+			name:     "auto with neither",
+			hostInfo: neither,
+			want:     LogStreamCompression{Kind: CompressionNone},
+		},
+		{
+			name:     "auto without host info",
+			hostInfo: nil,
+			want:     LogStreamCompression{Kind: CompressionNone},
+		},
+		{
+			name:       "gzip with level",
+			configured: LogStreamCompression{Kind: CompressionGzip, Level: 1},
+			hostInfo:   both,
+			want:       LogStreamCompression{Kind: CompressionGzip, Level: 1},
+		},
+		{
+			name:       "none even if there are compressors",
+			configured: LogStreamCompression{Kind: CompressionNone},
+			hostInfo:   both,
+			want:       LogStreamCompression{Kind: CompressionNone},
+		},
+		{
+			name:       "zstd is not available",
+			configured: LogStreamCompression{Kind: CompressionZstd, Level: 3},
+			hostInfo:   gzipOnly,
+			wantErr:    "zstd compression is configured, but zstd is not found on the host",
+		},
+		{
+			name:       "gzip is not available",
+			configured: LogStreamCompression{Kind: CompressionGzip},
+			hostInfo:   neither,
+			wantErr:    "gzip compression is configured, but gzip is not found on the host",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := chooseCompression(tc.configured, tc.hostInfo)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestLogStreamCompressionValidate(t *testing.T) {
+	for _, c := range []LogStreamCompression{
+		{},
+		{Kind: CompressionAuto},
+		{Kind: CompressionNone},
+		{Kind: CompressionGzip, Level: 9},
+		{Kind: CompressionZstd, Level: 19},
+	} {
+		assert.NoError(t, c.validate(), c.String())
+	}
+
+	for _, c := range []LogStreamCompression{
+		{Kind: "lz4"},
+		{Level: 3},
+		{Kind: CompressionNone, Level: 1},
+		{Kind: CompressionGzip, Level: 10},
+		{Kind: CompressionZstd, Level: -1},
+	} {
+		assert.Error(t, c.validate(), c.String())
+	}
+}
+
+func TestLogStreamCompressionShellCmd(t *testing.T) {
+	assert.Equal(t, "zstd -q -c -3", LogStreamCompression{Kind: CompressionZstd, Level: 3}.shellCmd())
+	assert.Equal(t, "gzip -c", LogStreamCompression{Kind: CompressionGzip}.shellCmd())
+	assert.Equal(t, "", LogStreamCompression{Kind: CompressionNone}.shellCmd())
+
+	assert.Equal(t, "zstd -3", LogStreamCompression{Kind: CompressionZstd, Level: 3}.String())
+	assert.Equal(t, "auto", LogStreamCompression{}.String())
+}
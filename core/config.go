@@ -1,6 +1,9 @@
 package core
 
-import "sort"
+import (
+	"sort"
+	"time"
+)
 
 type ConfigLogStreams map[string]ConfigLogStream
 
@@ -20,17 +23,109 @@ type ConfigLogStream struct {
 	// apply.
 	User string `yaml:"user"`
 
-	// TODO: optional Jumphost configuration, also with addr and user.
+	// Jumphost is the jumphost (or a chain of them) to connect through, in the
+	// same format as ProxyJump in the ssh config: a comma-separated list of
+	// "[user@]host[:port]", in the order of connection. The jumphosts themselves
+	// are looked up in the nerdlog config and the ssh config. Optional.
+	Jumphost string `yaml:"jumphost"`
 
 	// LogFiles contains a list of files which are part of the logstream, like
 	// ["/var/log/syslog", "/var/log/syslog.1"]. The [0]th item is the latest log
-	// file [1]st is the previous one, etc.
+	// file [1]st is the previous one, etc. The rotated ones can be compressed
+	// (.gz or .zst) and can be glob patterns like "/var/log/syslog.*.gz".
 	//
 	// During the final usage (after resolving everything), it must contain at
 	// least a single item, otherwise LogStream is invalid. However in the configs,
 	// it's optional (and eventually, if empty, will be set to default values by
 	// the LStreamsResolver).
 	LogFiles []string `yaml:"log_files"`
+
+	// Transport specifies how to get to the shell on the host: "ssh" (the
+	// default) uses the ssh client built into nerdlog, "ssh-bin" runs the system
+	// ssh binary. Optional.
+	Transport string `yaml:"transport"`
+
+	// Connection overrides the global connection settings (timeouts and the
+	// reconnect policy) for this logstream. Optional.
+	Connection *ConfigConnection `yaml:"connection"`
+
+	// WorkDir is the directory on the host where nerdlog keeps its files: the
+	// agent script and the index files. It's created with the 0700 permissions
+	// if needed, and "~/" at the beginning means the home dir. Optional; by
+	// default, $XDG_RUNTIME_DIR/nerdlog is used, or if it's not available,
+	// ~/.cache/nerdlog, or as a last resort, a private dir in /tmp.
+	WorkDir string `yaml:"work_dir"`
+
+	// If Sudo is true, the agent runs as root via "sudo -n", so that the log
+	// files which are only readable by root can be read. Optional.
+	Sudo bool `yaml:"sudo"`
+
+	// SudoUser, if not empty, is the user to run the agent as, instead of root;
+	// it implies Sudo. Optional.
+	SudoUser string `yaml:"sudo_user"`
+
+	// SudoCmd is the privilege escalation command to use instead of "sudo",
+	// e.g. "doas"; it must support the same -n and -u flags. Only "sudo" itself
+	// supports asking for a password though. Optional.
+	SudoCmd string `yaml:"sudo_cmd"`
+
+	// Compression is how the query output is compressed on the host: "auto"
+	// (the default) uses zstd if it's available on the host, otherwise gzip,
+	// otherwise no compression; "zstd", "gzip" and "none" force the respective
+	// option. Optional.
+	Compression string `yaml:"compression"`
+
+	// CompressionLevel is the compression level: 1-9 for gzip, 1-19 for zstd.
+	// It requires an explicit Compression. Optional; by default, the default
+	// level of the compressor is used.
+	CompressionLevel int `yaml:"compression_level"`
+
+	// sshAlias, sshOptions and proxyCommand are only populated for the items
+	// coming from the ssh config (see sshConfigToLSConfig). sshAlias is the
+	// Host from the ssh config.
+	sshAlias     string
+	sshOptions   *SSHOptions
+	proxyCommand string
+}
+
+// ConfigConnection contains the connection settings: timeouts and the
+// reconnect policy. It can be specified globally, and overridden per
+// logstream; every field is optional, and the unset ones (zero durations, nil
+// pointers) are inherited from the global settings or the defaults (see
+// connection.go).
+type ConfigConnection struct {
+	// DialTimeout is the timeout of establishing the ssh connection (including
+	// the handshake, but not the time spent waiting for the user to enter a
+	// passphrase or confirm a host key), for the host itself and for the
+	// jumphosts.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+
+	// KeepaliveInterval is how often we check that the connection is still
+	// alive. For the built-in ssh client, it's done using the ssh keepalives;
+	// for the other transports, by running a command in the shell once it's
+	// been idle for that long.
+	KeepaliveInterval time.Duration `yaml:"keepalive_interval"`
+
+	// KeepaliveTimeout is how long we wait for the ssh keepalive reply; if
+	// there's no reply in time, the connection is considered dead, and we
+	// reconnect.
+	KeepaliveTimeout time.Duration `yaml:"keepalive_timeout"`
+
+	// ReconnectDelay is the delay before the first reconnect attempt; every
+	// next attempt waits twice as long as the previous one, up to
+	// ReconnectMaxDelay.
+	ReconnectDelay    time.Duration `yaml:"reconnect_delay"`
+	ReconnectMaxDelay time.Duration `yaml:"reconnect_max_delay"`
+
+	// ReconnectJitter is the fraction by which every reconnect delay is
+	// randomly increased or decreased, e.g. 0.2 means +-20%. It helps to avoid
+	// reconnecting to all the hosts at once.
+	ReconnectJitter *float64 `yaml:"reconnect_jitter"`
+
+	// MaxAttempts is the number of consecutive failed connection attempts after
+	// which we give up and stay disconnected, until the user reconnects
+	// explicitly. Zero means unlimited.
+	MaxAttempts *int `yaml:"max_attempts"`
 }
 
 func (lss ConfigLogStreams) Keys() []string {
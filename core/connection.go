@@ -0,0 +1,170 @@
+package core
+
+import (
+	"math"
+	"time"
+)
+
+// Defaults for the ConfigConnection fields which aren't specified anywhere.
+const (
+	defaultDialTimeout       = 5 * time.Second
+	defaultKeepaliveInterval = 15 * time.Second
+	defaultKeepaliveTimeout  = 15 * time.Second
+	defaultReconnectDelay    = 2 * time.Second
+	defaultReconnectMaxDelay = 1 * time.Minute
+	defaultReconnectJitter   = 0.2
+)
+
+// mergeConfigConnection returns the connection settings from base, with
+// the fields which are set in override taking precedence. Either of them
+// might be nil; the result is nil if both are nil.
+func mergeConfigConnection(base, override *ConfigConnection) *ConfigConnection {
+	if override == nil {
+		return base
+	}
+
+	if base == nil {
+		return override
+	}
+
+	ret := *base
+
+	if override.DialTimeout != 0 {
+		ret.DialTimeout = override.DialTimeout
+	}
+
+	if override.KeepaliveInterval != 0 {
+		ret.KeepaliveInterval = override.KeepaliveInterval
+	}
+
+	if override.KeepaliveTimeout != 0 {
+		ret.KeepaliveTimeout = override.KeepaliveTimeout
+	}
+
+	if override.ReconnectDelay != 0 {
+		ret.ReconnectDelay = override.ReconnectDelay
+	}
+
+	if override.ReconnectMaxDelay != 0 {
+		ret.ReconnectMaxDelay = override.ReconnectMaxDelay
+	}
+
+	if override.ReconnectJitter != nil {
+		ret.ReconnectJitter = override.ReconnectJitter
+	}
+
+	if override.MaxAttempts != nil {
+		ret.MaxAttempts = override.MaxAttempts
+	}
+
+	return &ret
+}
+
+// The getters below return the effective settings, falling back to the
+// defaults; they work on a nil *ConfigConnection as well.
+
+func (cc *ConfigConnection) dialTimeout() time.Duration {
+	if cc == nil || cc.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+
+	return cc.DialTimeout
+}
+
+func (cc *ConfigConnection) keepaliveInterval() time.Duration {
+	if cc == nil || cc.KeepaliveInterval <= 0 {
+		return defaultKeepaliveInterval
+	}
+
+	return cc.KeepaliveInterval
+}
+
+func (cc *ConfigConnection) keepaliveTimeout() time.Duration {
+	if cc == nil || cc.KeepaliveTimeout <= 0 {
+		return defaultKeepaliveTimeout
+	}
+
+	return cc.KeepaliveTimeout
+}
+
+func (cc *ConfigConnection) reconnectDelayRange() (minDelay, maxDelay time.Duration) {
+	minDelay, maxDelay = defaultReconnectDelay, defaultReconnectMaxDelay
+
+	if cc != nil && cc.ReconnectDelay > 0 {
+		minDelay = cc.ReconnectDelay
+	}
+
+	if cc != nil && cc.ReconnectMaxDelay > 0 {
+		maxDelay = cc.ReconnectMaxDelay
+	}
+
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+
+	return minDelay, maxDelay
+}
+
+func (cc *ConfigConnection) reconnectJitter() float64 {
+	if cc == nil || cc.ReconnectJitter == nil {
+		return defaultReconnectJitter
+	}
+
+	return math.Min(math.Max(*cc.ReconnectJitter, 0), 1)
+}
+
+func (cc *ConfigConnection) maxAttempts() int {
+	if cc == nil || cc.MaxAttempts == nil || *cc.MaxAttempts < 0 {
+		return 0
+	}
+
+	return *cc.MaxAttempts
+}
+
+// setConnectionConfig sets the connection settings of the host which are
+// specified in the config; the rest are left zero, meaning the defaults.
+func (ch *ConfigHost) setConnectionConfig(cc *ConfigConnection) {
+	if cc == nil {
+		return
+	}
+
+	ch.DialTimeout = cc.DialTimeout
+	ch.KeepaliveInterval = cc.KeepaliveInterval
+	ch.KeepaliveTimeout = cc.KeepaliveTimeout
+}
+
+// The getters below return the effective settings of the host, falling back
+// to the defaults.
+
+func (ch *ConfigHost) dialTimeout() time.Duration {
+	return (&ConfigConnection{DialTimeout: ch.DialTimeout}).dialTimeout()
+}
+
+func (ch *ConfigHost) keepaliveInterval() time.Duration {
+	return (&ConfigConnection{KeepaliveInterval: ch.KeepaliveInterval}).keepaliveInterval()
+}
+
+func (ch *ConfigHost) keepaliveTimeout() time.Duration {
+	return (&ConfigConnection{KeepaliveTimeout: ch.KeepaliveTimeout}).keepaliveTimeout()
+}
+
+// reconnectDelay returns how long to wait before the next connection attempt,
+// after the given number of consecutive failed attempts (starting from 1).
+// The delay grows exponentially, and then the jitter is applied: rnd must be
+// a random number in [0, 1), so that 0.5 means no jitter.
+func (cc *ConfigConnection) reconnectDelay(numFailedAttempts int, rnd float64) time.Duration {
+	minDelay, maxDelay := cc.reconnectDelayRange()
+
+	delay := minDelay
+	for i := 1; i < numFailedAttempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	jitter := cc.reconnectJitter() * (2*rnd - 1)
+
+	return time.Duration(float64(delay) * (1 + jitter))
+}
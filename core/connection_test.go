@@ -0,0 +1,79 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigConnectionMerge(t *testing.T) {
+	var global, perHost ConfigConnection
+
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+dial_timeout: 10s
+reconnect_delay: 1s
+reconnect_jitter: 0.5
+max_attempts: 3
+`), &global))
+
+	assert.NoError(t, yaml.Unmarshal([]byte(`
+dial_timeout: 20s
+reconnect_jitter: 0
+max_attempts: 0
+`), &perHost))
+
+	assert.Nil(t, mergeConfigConnection(nil, nil))
+	assert.Equal(t, &global, mergeConfigConnection(&global, nil))
+	assert.Equal(t, &perHost, mergeConfigConnection(nil, &perHost))
+
+	merged := mergeConfigConnection(&global, &perHost)
+	assert.Equal(t, 20*time.Second, merged.dialTimeout())
+	assert.Equal(t, defaultKeepaliveInterval, merged.keepaliveInterval())
+	assert.Equal(t, 0.0, merged.reconnectJitter())
+	assert.Equal(t, 0, merged.maxAttempts())
+
+	minDelay, maxDelay := merged.reconnectDelayRange()
+	assert.Equal(t, 1*time.Second, minDelay)
+	assert.Equal(t, defaultReconnectMaxDelay, maxDelay)
+
+	// The global one is unchanged.
+	assert.Equal(t, 10*time.Second, global.dialTimeout())
+	assert.Equal(t, 3, global.maxAttempts())
+
+	// And nil means all defaults.
+	var none *ConfigConnection
+	assert.Equal(t, defaultDialTimeout, none.dialTimeout())
+	assert.Equal(t, defaultReconnectJitter, none.reconnectJitter())
+	assert.Equal(t, 0, none.maxAttempts())
+}
+
+func TestConfigConnectionReconnectDelay(t *testing.T) {
+	jitter := 0.25
+	cc := &ConfigConnection{
+		ReconnectDelay:    1 * time.Second,
+		ReconnectMaxDelay: 10 * time.Second,
+		ReconnectJitter:   &jitter,
+	}
+
+	// Without jitter (rnd is 0.5), it doubles with every attempt, up to the max.
+	wantDelays := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for i, want := range wantDelays {
+		assert.Equal(t, want, cc.reconnectDelay(i+1, 0.5), "attempt %d", i+1)
+	}
+
+	// A huge number of attempts doesn't overflow.
+	assert.Equal(t, 10*time.Second, cc.reconnectDelay(1000, 0.5))
+
+	// Jitter.
+	assert.Equal(t, 3*time.Second, cc.reconnectDelay(3, 0))
+	assert.Equal(t, 4500*time.Millisecond, cc.reconnectDelay(3, 0.75))
+}
@@ -21,6 +21,18 @@ type QueryLogsParams struct {
 	// we already had.
 	LoadEarlier bool
 
+	// If Progressive is true, then as soon as any logstream responds (but not
+	// the last one), the results collected so far are merged and sent as an
+	// intermediate LogRespTotal, with the remaining logstreams listed in its
+	// PendingLStreams. The final LogRespTotal is sent as usual.
+	Progressive bool
+
+	// If SkipUnreachable is true, and some logstreams are not connected, the
+	// query is done on the connected ones only (instead of failing with
+	// ErrNotYetConnected), and the rest are listed in the
+	// LogRespTotal.UnreachableLStreams.
+	SkipUnreachable bool
+
 	// If DontAddHistoryItem is true, the browser-like history will not be
 	// populated with a new item (it should be used exactly when we're navigating
 	// this browser-like history back and forth)
@@ -59,10 +71,66 @@ type LogRespTotal struct {
 
 	Errs []error
 
+	// LStreamErrs contains the errors from the logstreams which failed to return
+	// logs, keyed by the logstream name. Unlike Errs, these errors don't make the
+	// whole response fail: Logs, MinuteStats etc contain the results from all
+	// the other logstreams.
+	LStreamErrs map[string]error
+
+	// PendingLStreams is only non-empty for the intermediate results of a
+	// progressive query (see QueryLogsParams.Progressive): it contains the
+	// sorted names of the logstreams which didn't respond yet, and thus are
+	// not included in the results. The final LogRespTotal always has it empty.
+	PendingLStreams []string
+
+	// UnreachableLStreams contains the sorted names of the logstreams which
+	// were not queried because they were not connected; see
+	// QueryLogsParams.SkipUnreachable.
+	UnreachableLStreams []string
+
 	// QueryDur shows how long the query took.
 	QueryDur time.Duration
 }
 
+// CleanupParams are the params of LStreamsManager.Cleanup.
+type CleanupParams struct {
+	// DryRun means only listing the files, without deleting them.
+	DryRun bool
+
+	// If All is true, the agent script itself is deleted as well, so the
+	// logstreams won't work after that until they reconnect. It's only useful
+	// when nerdlog is about to exit, like in the "nerdlog cleanup" mode.
+	All bool
+}
+
+// RemoteFile is a file created by nerdlog on the logstream host.
+type RemoteFile struct {
+	Path string
+	Size int64
+}
+
+// CleanupResp is the result of the cleanup on a single logstream.
+type CleanupResp struct {
+	// Files are the files which were deleted, or with DryRun, the ones which
+	// would be deleted.
+	Files []RemoteFile
+}
+
+// CleanupRespTotal is the result of the cleanup on all the logstreams.
+type CleanupRespTotal struct {
+	DryRun bool
+
+	// Errs contains the errors which prevented the cleanup altogether, like
+	// ErrBusyWithAnotherQuery.
+	Errs []error
+
+	// Resps contains the results of the logstreams which succeeded, and
+	// LStreamErrs the errors of those which didn't (including the ones which
+	// are not connected), both keyed by the logstream name.
+	Resps       map[string]*CleanupResp
+	LStreamErrs map[string]error
+}
+
 type MinuteStatsItem struct {
 	NumMsgs int
 }
@@ -75,10 +143,10 @@ type LogMsg struct {
 	LogFilename   string
 	LogLinenumber int
 
-	// CombinedLinenumber is the line number in pseudo-file: all (actually just
-	// two) log files concatenated. This is the linenumbers output by the
-	// nerdlog_agent.sh for every "msg:" line, and this is the linenumber
-	// which should be used for --lines-until param.
+	// CombinedLinenumber is the line number in pseudo-file: all the log files
+	// of the logstream concatenated, the oldest first. This is the linenumbers
+	// output by the nerdlog_agent.sh for every "msg:" line, and this is the
+	// linenumber which should be used for --lines-until param.
 	CombinedLinenumber int
 
 	Msg     string
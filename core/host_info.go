@@ -0,0 +1,168 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	hostInfoCapPrefix     = "cap:"
+	hostInfoLogfilePrefix = "logfile_info:"
+)
+
+// HostInfo contains the info about the logstream host, as reported by the
+// agent during bootstrap: the tools which the agent relies on, the free space
+// in the work dir, and the log files.
+type HostInfo struct {
+	Bash      HostTool
+	Awk       HostTool
+	Gzip      HostTool
+	Zstd      HostTool
+	Coreutils HostTool
+
+	// StatFormat is whether stat supports the -c option.
+	StatFormat bool
+	// Timedatectl is whether timedatectl is available; without it, the timezone
+	// is detected using the fallback methods.
+	Timedatectl bool
+
+	// WorkDirFree is the free space in the work dir, in bytes, or -1 if
+	// unknown.
+	WorkDirFree int64
+
+	// Arch is the host architecture, as reported by "uname -m".
+	Arch string
+	// NativeAgent is whether the native agent binary is used on the host; if
+	// not, it's the shell agent, which needs gawk and friends.
+	NativeAgent bool
+	// Compression is the compression of the query output which was chosen for
+	// the host, see LogStream.Compression.
+	Compression LogStreamCompression
+
+	LogFiles []HostLogFile
+}
+
+// HostTool describes a tool on the logstream host.
+type HostTool struct {
+	// Name is the flavour of the tool, like "gawk", "mawk" or "busybox". It's
+	// "unknown" if the tool is there but we don't know what it is, and empty if
+	// the tool is not found.
+	Name string
+	// Version is the version, like "5.1.0"; might be empty.
+	Version string
+}
+
+// HostLogFile describes a log file on the logstream host.
+type HostLogFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+func (t HostTool) String() string {
+	if t.Name == "" {
+		return "not found"
+	}
+
+	if t.Version == "" {
+		return t.Name
+	}
+
+	return t.Name + " " + t.Version
+}
+
+func newHostInfo() *HostInfo {
+	return &HostInfo{
+		WorkDirFree: -1,
+	}
+}
+
+// isHostInfoLine returns whether the given line from the agent's
+// logstream_info output should be parsed with parseLine.
+func isHostInfoLine(line string) bool {
+	return strings.HasPrefix(line, hostInfoCapPrefix) ||
+		strings.HasPrefix(line, hostInfoLogfilePrefix)
+}
+
+// parseLine parses a single "cap:" or "logfile_info:" line from the agent's
+// logstream_info output, and updates the HostInfo accordingly. Unknown
+// capabilities are ignored.
+func (hi *HostInfo) parseLine(line string) error {
+	switch {
+	case strings.HasPrefix(line, hostInfoCapPrefix):
+		parts := strings.SplitN(strings.TrimPrefix(line, hostInfoCapPrefix), ":", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("malformed cap line %q", line)
+		}
+
+		key, value := parts[0], parts[1]
+
+		switch key {
+		case "bash":
+			hi.Bash = parseHostTool(value)
+		case "awk":
+			hi.Awk = parseHostTool(value)
+		case "gzip":
+			hi.Gzip = parseHostTool(value)
+		case "zstd":
+			hi.Zstd = parseHostTool(value)
+		case "coreutils":
+			hi.Coreutils = parseHostTool(value)
+		case "stat_c":
+			hi.StatFormat = value == "1"
+		case "timedatectl":
+			hi.Timedatectl = value == "1"
+		case "work_dir_free":
+			free, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.Annotatef(err, "parsing work dir free space in %q", line)
+			}
+
+			hi.WorkDirFree = free
+		}
+
+	case strings.HasPrefix(line, hostInfoLogfilePrefix):
+		// The line looks like "logfile_info:<size>:<mtime>:<path>"
+		parts := strings.SplitN(strings.TrimPrefix(line, hostInfoLogfilePrefix), ":", 3)
+		if len(parts) != 3 {
+			return errors.Errorf("malformed logfile_info line %q", line)
+		}
+
+		size, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return errors.Annotatef(err, "parsing size in %q", line)
+		}
+
+		mtime, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return errors.Annotatef(err, "parsing mtime in %q", line)
+		}
+
+		hi.LogFiles = append(hi.LogFiles, HostLogFile{
+			Path:    parts[2],
+			Size:    size,
+			ModTime: time.Unix(mtime, 0).UTC(),
+		})
+
+	default:
+		return errors.Errorf("not a host info line: %q", line)
+	}
+
+	return nil
+}
+
+// parseHostTool parses the tool description as printed by the agent, like
+// "gawk 5.1.0"; an empty string means that the tool is not found.
+func parseHostTool(s string) HostTool {
+	parts := strings.SplitN(s, " ", 2)
+
+	tool := HostTool{Name: parts[0]}
+	if len(parts) == 2 {
+		tool.Version = parts[1]
+	}
+
+	return tool
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostInfoParseLine(t *testing.T) {
+	hi := newHostInfo()
+
+	for _, line := range []string{
+		"cap:bash:bash 5.2.15(1)-release",
+		"cap:awk:mawk 1.3.4",
+		"cap:gzip:",
+		"cap:zstd:zstd 1.5.5",
+		"cap:coreutils:busybox v1.36.1",
+		"cap:stat_c:1",
+		"cap:timedatectl:0",
+		"cap:work_dir_free:1048576",
+		"cap:something_new:whatever",
+		"logfile_info:123:1700000000:/var/log/my:log",
+	} {
+		assert.True(t, isHostInfoLine(line), line)
+		assert.NoError(t, hi.parseLine(line), line)
+	}
+
+	assert.Equal(t, &HostInfo{
+		Bash:        HostTool{Name: "bash", Version: "5.2.15(1)-release"},
+		Awk:         HostTool{Name: "mawk", Version: "1.3.4"},
+		Gzip:        HostTool{},
+		Zstd:        HostTool{Name: "zstd", Version: "1.5.5"},
+		Coreutils:   HostTool{Name: "busybox", Version: "v1.36.1"},
+		StatFormat:  true,
+		Timedatectl: false,
+		WorkDirFree: 1048576,
+		LogFiles: []HostLogFile{
+			{Path: "/var/log/my:log", Size: 123, ModTime: time.Unix(1700000000, 0).UTC()},
+		},
+	}, hi)
+
+	assert.Equal(t, "not found", hi.Gzip.String())
+	assert.Equal(t, "mawk 1.3.4", hi.Awk.String())
+
+	assert.False(t, isHostInfoLine("host_timezone:UTC"))
+	assert.Error(t, hi.parseLine("cap:bash"))
+	assert.Error(t, hi.parseLine("cap:work_dir_free:lots"))
+	assert.Error(t, hi.parseLine("logfile_info:123:/var/log/syslog"))
+	assert.Error(t, hi.parseLine("logfile_info:big:1700000000:/var/log/syslog"))
+}
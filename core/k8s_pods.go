@@ -0,0 +1,78 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// kubectlTimeout is how long we wait for kubectl to list the pods.
+const kubectlTimeout = 15 * time.Second
+
+// k8sPodList is the part of the "kubectl get pods -o json" output we care
+// about.
+type k8sPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// listK8sPods returns the sorted names of the running pods in the given
+// namespace matching the label selector.
+func listK8sPods(namespace, selector string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubectlTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(
+		ctx, "kubectl", "get", "pods",
+		"--namespace", namespace,
+		"--selector", selector,
+		"--output", "json",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Annotatef(err, "kubectl get pods: %s", msg)
+		}
+		return nil, errors.Annotatef(err, "kubectl get pods")
+	}
+
+	var podList k8sPodList
+	if err := json.Unmarshal(stdout.Bytes(), &podList); err != nil {
+		return nil, errors.Annotatef(err, "parsing kubectl output")
+	}
+
+	var ret []string
+	for _, pod := range podList.Items {
+		// The pods which are not running can't be exec-ed into anyway.
+		if pod.Status.Phase != "Running" {
+			continue
+		}
+
+		ret = append(ret, pod.Metadata.Name)
+	}
+
+	sort.Strings(ret)
+
+	return ret, nil
+}
+
+// k8sShellCmd returns the ShellCmd to run the shell in the pod.
+func k8sShellCmd(namespace, pod string) []string {
+	return []string{"kubectl", "exec", "-i", "--namespace", namespace, pod, "--", "bash"}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testK8sPodsJSON = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {"metadata": {"name": "web-7d9f-b2"}, "status": {"phase": "Running"}},
+    {"metadata": {"name": "web-7d9f-a1"}, "status": {"phase": "Running"}},
+    {"metadata": {"name": "web-7d9f-c3"}, "status": {"phase": "Pending"}}
+  ]
+}`
+
+// setupFakeKubectl puts the fake kubectl binary in PATH: "get" prints the
+// given pods json (or fails if it's empty), and "exec" just runs the command
+// locally. The args of every invocation are appended to the returned file.
+func setupFakeKubectl(t *testing.T, podsJSON string) string {
+	t.Helper()
+
+	binDir := t.TempDir()
+	argsFname := filepath.Join(binDir, "kubectl_args")
+	podsFname := filepath.Join(binDir, "pods.json")
+
+	if podsJSON != "" {
+		if err := os.WriteFile(podsFname, []byte(podsJSON), 0644); err != nil {
+			t.Fatalf("writing pods json: %s", err)
+		}
+	}
+
+	fakeKubectl := `#!/bin/sh
+echo "$@" >> "` + argsFname + `"
+case "$1" in
+  get)
+    if [ ! -f "` + podsFname + `" ]; then
+      echo 'error: You must be logged in to the server (Unauthorized)' >&2
+      exit 1
+    fi
+    cat "` + podsFname + `"
+    ;;
+  exec)
+    while [ "$1" != "--" ]; do shift; done
+    shift
+    exec "$@"
+    ;;
+  *)
+    exit 1
+    ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(binDir, "kubectl"), []byte(fakeKubectl), 0755); err != nil {
+		t.Fatalf("writing fake kubectl: %s", err)
+	}
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return argsFname
+}
+
+func TestListK8sPods(t *testing.T) {
+	t.Run("only running pods, sorted", func(t *testing.T) {
+		argsFname := setupFakeKubectl(t, testK8sPodsJSON)
+
+		pods, err := listK8sPods("myns", "app=web")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"web-7d9f-a1", "web-7d9f-b2"}, pods)
+
+		args, err := os.ReadFile(argsFname)
+		assert.NoError(t, err)
+		assert.Equal(t, "get pods --namespace myns --selector app=web --output json\n", string(args))
+	})
+
+	t.Run("kubectl fails", func(t *testing.T) {
+		setupFakeKubectl(t, "")
+
+		_, err := listK8sPods("myns", "app=web")
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "Unauthorized")
+		}
+	})
+}
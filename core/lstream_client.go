@@ -2,46 +2,27 @@ package core
 
 import (
 	"bufio"
-	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
-	"os"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 
 	"github.com/dimonomid/nerdlog/log"
 )
 
-const connectionTimeout = 5 * time.Second
-
-// Setting useGzip to false is just a simple way to disable gzip, for debugging
-// purposes or w/e, since it's still experimental. Maybe we need to add a flag
-// for it, we'll see.
-const useGzip = true
-
-const (
-	// gzipStartMarker and gzipEndMarker are echoed in the beginning and the end
-	// of the gzipped output. Effectively we're doing this:
-	//
-	//   $ echo gzip_start ; whatever command we need to run | gzip ; echo gzip_end
-	//
-	// and the scanner func (returned by getScannerFunc) sees those markers and
-	// buffers gzipped output until it's done, then gunzips it and sends to the
-	// clients, so it's totally opaque for them.
-	gzipStartMarker = "gzip_start"
-	gzipEndMarker   = "gzip_end"
-)
-
 // queryLogsArgsTimeLayout is used to format the --from and --to arguments for
 // nerdlog_agent.sh.
 //
@@ -53,13 +34,35 @@ const queryLogsArgsTimeLayout = "2006-01-02-15:04"
 //go:embed nerdlog_agent.sh
 var nerdlogAgentSh string
 
+// nerdlogAgentShHash is the hex-encoded sha256 of nerdlogAgentSh. The agent
+// file on the logstream host is named after it, and on bootstrap, we only
+// upload the agent if the file there doesn't have this checksum.
+var nerdlogAgentShHash = func() string {
+	sum := sha256.Sum256([]byte(nerdlogAgentSh))
+	return hex.EncodeToString(sum[:])
+}()
+
+// agentUploadNeededMarker is printed by the bootstrap command if the agent
+// needs to be uploaded.
+const agentUploadNeededMarker = "agent_upload_needed"
+
+// agentExecFailedMarker is printed by the bootstrap command if the native
+// agent could not be executed on the host, so the shell one should be used.
+const agentExecFailedMarker = "agent_exec_failed"
+
 var syslogRegex = regexp.MustCompile(`^(\S+)\s+(\S+?)(?:\[(\d+)\])?:\s+(.*)`)
 
 type LStreamClient struct {
 	params LStreamClientParams
 
 	connectResCh chan lstreamConnRes
-	enqueueCmdCh chan lstreamCmd
+	// connectAbortCh is closed if we abandon the connection attempt before it
+	// finishes (e.g. because of the teardown).
+	connectAbortCh chan struct{}
+	enqueueCmdCh   chan lstreamCmd
+	// cancelQueryCh receives the respCh of the queries to cancel; see
+	// CancelQuery.
+	cancelQueryCh chan chan lstreamCmdRes
 
 	// timezone is a string received from the logstream
 	timezone string
@@ -71,8 +74,33 @@ type LStreamClient struct {
 	exampleLogLines []string
 	timeFormat      *TimeFormatDescr
 
+	// workDir is the directory on the logstream host where the agent and the
+	// index files are; it's figured out during the bootstrap.
+	workDir string
+
+	// agent is the agent used on the logstream host, as picked by the
+	// bootstrap; it's nil until then.
+	agent *agentVariant
+	// nativeAgentFailed is set if the native agent was uploaded but it failed
+	// to run on the host (e.g. because the work dir is mounted with noexec), so
+	// the shell agent should be used instead.
+	nativeAgentFailed bool
+
+	// compression is the compression of the query output, chosen by the
+	// bootstrap based on the config and the compressors available on the host.
+	compression LogStreamCompression
+
+	// sudoPassword is the password for the escalation command (see
+	// LogStream.Sudo), if the user has provided it; sudoPrompt is the prompt
+	// asking for it, if we're waiting for the answer.
+	sudoPassword string
+	sudoPrompt   *UserPrompt
+
 	numConnAttempts int
 
+	// connStats are the last stats of the connection which we've sent.
+	connStats ConnStats
+
 	state     LStreamClientState
 	busyStage BusyStage
 
@@ -105,13 +133,61 @@ type disconnectReq struct {
 	changeName string
 }
 
+// connCtx is a running shell on the logstream host, as provided by the
+// lstreamTransport.
 type connCtx struct {
-	sshClient  *ssh.Client
-	sshSession *ssh.Session
-	stdinBuf   io.WriteCloser
+	stdinBuf io.WriteCloser
 
 	stdoutLinesCh chan string
 	stderrLinesCh chan string
+
+	// markerPrefix is the prefix of all the control lines in this shell
+	// session; see markers.go.
+	markerPrefix string
+
+	// closeFunc is provided by the transport, and it closes the connection.
+	closeFunc func()
+
+	// rttFunc, if not nil, returns the current round-trip time of the
+	// connection (zero if unknown yet). It's only set by the transports which
+	// check the connection liveness themselves (TransportSSH, using the ssh
+	// keepalives), so there's no need to ping the shell for them.
+	rttFunc func() time.Duration
+}
+
+// newConnCtx creates the connCtx for the shell with the given stdio, and
+// starts reading its stdout and stderr.
+func newConnCtx(
+	stdin io.WriteCloser, stdout, stderr io.Reader, closeFunc func(),
+) *connCtx {
+	stdoutLinesCh := make(chan string, 32)
+	stderrLinesCh := make(chan string, 32)
+
+	markerPrefix := newMarkerPrefix()
+
+	go getScannerFunc("stdout", stdout, markerPrefix, stdoutLinesCh)()
+	go getScannerFunc("stderr", stderr, markerPrefix, stderrLinesCh)()
+
+	return &connCtx{
+		stdinBuf: stdin,
+
+		markerPrefix: markerPrefix,
+
+		stdoutLinesCh: stdoutLinesCh,
+		stderrLinesCh: stderrLinesCh,
+
+		closeFunc: closeFunc,
+	}
+}
+
+func (c *connCtx) close() {
+	c.closeFunc()
+}
+
+// marker returns the control line (or its beginning) with the given marker,
+// like markerCommandDone.
+func (c *connCtx) marker(name string) string {
+	return c.markerPrefix + name
 }
 
 type BusyStage struct {
@@ -133,9 +209,21 @@ type ConnDetails struct {
 	Err string
 }
 
+// ConnStats contains the stats of the established connection.
+type ConnStats struct {
+	// RTT is the round-trip time of the connection, as measured by the last
+	// keepalive.
+	RTT time.Duration
+}
+
 type BootstrapDetails struct {
-	// Err is an error message from the last bootstrap attempt.
+	// Err is an error message from the last bootstrap attempt; empty if the
+	// bootstrap succeeded.
 	Err string
+
+	// HostInfo is the info about the host, as reported by the agent. It might
+	// be nil if the bootstrap failed before the agent could report it.
+	HostInfo *HostInfo
 }
 
 func (c *connCtx) getStdoutLinesCh() chan string {
@@ -163,9 +251,14 @@ type LStreamClientUpdate struct {
 	State *LStreamClientUpdateState
 
 	ConnDetails      *ConnDetails
+	ConnStats        *ConnStats
 	BootstrapDetails *BootstrapDetails
 	BusyStage        *BusyStage
 
+	// UserPrompt is a question to the user, which needs to be answered before
+	// the connection can proceed.
+	UserPrompt *UserPrompt
+
 	// If TornDown is true, it means it's the last update from that client.
 	TornDown bool
 }
@@ -187,7 +280,14 @@ type LStreamClientParams struct {
 	// files when using the tool concurrently on the same nodes.
 	ClientID string
 
+	// IndexTTLDays is passed to the agent as --index-ttl-days, if not zero.
+	IndexTTLDays int
+
 	UpdatesCh chan<- *LStreamClientUpdate
+
+	// agentVariants are the agents which can be uploaded to the host; if nil,
+	// defaultAgentVariants is used. Only needed for tests.
+	agentVariants *agentVariants
 }
 
 func NewLStreamClient(params LStreamClientParams) *LStreamClient {
@@ -195,6 +295,10 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 		fmt.Sprintf("LSClient_%s", params.LogStream.Name),
 	)
 
+	if params.agentVariants == nil {
+		params.agentVariants = defaultAgentVariants
+	}
+
 	lsc := &LStreamClient{
 		params: params,
 
@@ -204,6 +308,8 @@ func NewLStreamClient(params LStreamClientParams) *LStreamClient {
 		state:        LStreamClientStateDisconnected,
 		enqueueCmdCh: make(chan lstreamCmd, 32),
 
+		cancelQueryCh: make(chan chan lstreamCmdRes, 32),
+
 		disconnectReqCh:              make(chan disconnectReq, 1),
 		disconnectedBeforeTeardownCh: make(chan struct{}),
 	}
@@ -242,14 +348,31 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 
 	if isStateConnected(oldState) && !isStateConnected(newState) {
 		// Initiate disconnect
-		lsc.conn.stdinBuf.Close()
-		lsc.conn.sshSession.Close()
-		lsc.conn.sshClient.Close()
+		lsc.conn.close()
+		lsc.connStats = ConnStats{}
+
+		// Whatever commands we were going to run, they won't be done.
+		lsc.failPendingCmds(errors.Errorf("connection lost"))
+
+		// If we were waiting for the sudo password, the answer is not needed
+		// anymore; we'll ask again after reconnecting, if needed.
+		if lsc.sudoPrompt != nil {
+			lsc.sudoPrompt.done()
+			lsc.sudoPrompt = nil
+		}
 	}
 
 	switch oldState {
 	case LStreamClientStateConnecting:
+		if lsc.connectResCh != nil {
+			// We're leaving the connecting state without having received the
+			// result, so abandon the connection attempt.
+			close(lsc.connectAbortCh)
+			go closeAbandonedConn(lsc.connectResCh)
+		}
+
 		lsc.connectResCh = nil
+		lsc.connectAbortCh = nil
 	case LStreamClientStateConnectedBusy:
 		lsc.curCmdCtx = nil
 		lsc.busyStage = BusyStage{}
@@ -269,7 +392,13 @@ func (lsc *LStreamClient) changeState(newState LStreamClientState) {
 	case LStreamClientStateConnecting:
 		lsc.numConnAttempts++
 		lsc.connectResCh = make(chan lstreamConnRes, 1)
-		go connectToLogStream(lsc.params.Logger, lsc.params.LogStream, lsc.connectResCh)
+		lsc.connectAbortCh = make(chan struct{})
+		go connectToLogStream(
+			lsc.params.Logger,
+			lsc.params.LogStream,
+			lsc.makeUserPrompter(lsc.connectAbortCh),
+			lsc.connectResCh,
+		)
 
 	case LStreamClientStateConnectedIdle:
 		if len(lsc.cmdQueue) > 0 {
@@ -296,11 +425,15 @@ func (lsc *LStreamClient) sendCmdResp(resp interface{}, err error) {
 		return
 	}
 
-	if lsc.curCmdCtx.cmd.respCh == nil {
+	lsc.sendCmdRespTo(lsc.curCmdCtx.cmd, resp, err)
+}
+
+func (lsc *LStreamClient) sendCmdRespTo(cmd lstreamCmd, resp interface{}, err error) {
+	if cmd.respCh == nil {
 		return
 	}
 
-	lsc.curCmdCtx.cmd.respCh <- lstreamCmdRes{
+	cmd.respCh <- lstreamCmdRes{
 		hostname: lsc.params.LogStream.Name,
 		resp:     resp,
 		err:      err,
@@ -315,6 +448,10 @@ func (lsc *LStreamClient) run() {
 	for {
 		select {
 		case res := <-lsc.connectResCh:
+			// The result is received, so the connection attempt is not going to be
+			// abandoned.
+			lsc.connectResCh = nil
+
 			if res.err != nil {
 				lsc.sendUpdate(&LStreamClientUpdate{
 					ConnDetails: &ConnDetails{
@@ -328,7 +465,30 @@ func (lsc *LStreamClient) run() {
 					continue
 				}
 
-				connectAfter = time.Now().Add(2 * time.Second)
+				if isHostKeyError(res.err) {
+					// Retrying won't help here, so we stay disconnected until the user
+					// fixes the issue and reconnects explicitly.
+					continue
+				}
+
+				connConfig := lsc.params.LogStream.Connection
+				if maxAttempts := connConfig.maxAttempts(); maxAttempts > 0 && lsc.numConnAttempts >= maxAttempts {
+					// Give up, and park the logstream until the user reconnects
+					// explicitly.
+					lsc.sendUpdate(&LStreamClientUpdate{
+						ConnDetails: &ConnDetails{
+							Err: fmt.Sprintf(
+								"attempt %d: %s; giving up after %d attempts, use :reconnect to try again",
+								lsc.numConnAttempts, res.err.Error(), maxAttempts,
+							),
+						},
+					})
+					continue
+				}
+
+				delay := connConfig.reconnectDelay(lsc.numConnAttempts, rand.Float64())
+				lsc.params.Logger.Verbose1f("Reconnecting in %s", delay)
+				connectAfter = time.Now().Add(delay)
 				continue
 			}
 
@@ -344,6 +504,28 @@ func (lsc *LStreamClient) run() {
 				bootstrap: &lstreamCmdBootstrap{},
 			})
 
+		case resp := <-lsc.getSudoPromptRespCh():
+			lsc.sudoPrompt = nil
+
+			if !resp.Yes {
+				lsc.sendUpdate(&LStreamClientUpdate{
+					BootstrapDetails: &BootstrapDetails{
+						Err: fmt.Sprintf("%s needs a password, but it wasn't provided", lsc.params.LogStream.Sudo.cmd()),
+					},
+				})
+
+				lsc.changeState(LStreamClientStateDisconnected)
+				continue
+			}
+
+			// Bootstrap again with the password; it must be the very next command,
+			// before whatever was enqueued meanwhile.
+			lsc.sudoPassword = resp.Text
+			lsc.cmdQueue = append([]lstreamCmd{{
+				bootstrap: &lstreamCmdBootstrap{},
+			}}, lsc.cmdQueue...)
+			lsc.changeState(LStreamClientStateConnectedIdle)
+
 		case cmd := <-lsc.enqueueCmdCh:
 			// Require a connection.
 			if !isStateConnected(lsc.state) {
@@ -359,6 +541,9 @@ func (lsc *LStreamClient) run() {
 				lsc.addCmdToQueue(cmd)
 			}
 
+		case respCh := <-lsc.cancelQueryCh:
+			lsc.cancelQuery(respCh)
+
 		case line, ok := <-lsc.conn.getStdoutLinesCh():
 			if !ok {
 				// Stdout was just closed
@@ -407,6 +592,9 @@ func (lsc *LStreamClient) run() {
 				case cmdCtx.cmd.bootstrap != nil:
 					tzPrefix := "host_timezone:"
 					logLinePrefix := "example_log_line:"
+					workDirPrefix := "work_dir:"
+					archPrefix := "arch:"
+					agentVariantPrefix := "agent_variant:"
 
 					if strings.HasPrefix(line, tzPrefix) {
 						tz := strings.TrimPrefix(line, tzPrefix)
@@ -426,6 +614,24 @@ func (lsc *LStreamClient) run() {
 						lsc.params.Logger.Verbose1f("Got example log line: %s\n", exampleLogLine)
 
 						lsc.exampleLogLines = append(lsc.exampleLogLines, exampleLogLine)
+					} else if strings.HasPrefix(line, workDirPrefix) {
+						cmdCtx.bootstrapCtx.workDir = strings.TrimPrefix(line, workDirPrefix)
+					} else if isHostInfoLine(line) {
+						if cmdCtx.bootstrapCtx.hostInfo == nil {
+							cmdCtx.bootstrapCtx.hostInfo = newHostInfo()
+						}
+
+						if err := cmdCtx.bootstrapCtx.hostInfo.parseLine(line); err != nil {
+							cmdCtx.errs = append(cmdCtx.errs, errors.Trace(err))
+						}
+					} else if strings.HasPrefix(line, archPrefix) {
+						cmdCtx.bootstrapCtx.arch = strings.TrimPrefix(line, archPrefix)
+					} else if strings.HasPrefix(line, agentVariantPrefix) {
+						cmdCtx.bootstrapCtx.agentVariant = strings.TrimPrefix(line, agentVariantPrefix)
+					} else if line == agentUploadNeededMarker {
+						cmdCtx.bootstrapCtx.agentUploadNeeded = true
+					} else if line == agentExecFailedMarker {
+						cmdCtx.bootstrapCtx.agentExecFailed = true
 					} else if line == "bootstrap ok" {
 						cmdCtx.bootstrapCtx.receivedSuccess = true
 					} else if line == "bootstrap failed" {
@@ -438,6 +644,38 @@ func (lsc *LStreamClient) run() {
 					// Nothing special to do
 					cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
 
+				case cmdCtx.cmd.cleanup != nil:
+					// Both "file:" (for a dry run) and "deleted:" lines look the same:
+					// "file:<size>:<path>".
+					var fileLine string
+					switch {
+					case strings.HasPrefix(line, "file:"):
+						fileLine = strings.TrimPrefix(line, "file:")
+					case strings.HasPrefix(line, "deleted:"):
+						fileLine = strings.TrimPrefix(line, "deleted:")
+					default:
+						cmdCtx.unhandledStdout = append(cmdCtx.unhandledStdout, line)
+						continue
+					}
+
+					parts := strings.SplitN(fileLine, ":", 2)
+					if len(parts) != 2 {
+						cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("malformed file line %q", line))
+						continue
+					}
+
+					size, err := strconv.ParseInt(parts[0], 10, 64)
+					if err != nil {
+						cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "parsing file size in %q", line))
+						continue
+					}
+
+					resp := cmdCtx.cleanupCtx.Resp
+					resp.Files = append(resp.Files, RemoteFile{
+						Path: parts[1],
+						Size: size,
+					})
+
 				case cmdCtx.cmd.queryLogs != nil:
 					respCtx := cmdCtx.queryLogsCtx
 					resp := respCtx.Resp
@@ -471,8 +709,10 @@ func (lsc *LStreamClient) run() {
 						}
 
 					case strings.HasPrefix(line, "logfile:"):
+						// The line looks like "logfile:<path>:<number of lines before it>",
+						// and the path might contain colons too.
 						msg := strings.TrimPrefix(line, "logfile:")
-						idx := strings.IndexRune(msg, ':')
+						idx := strings.LastIndexByte(msg, ':')
 						if idx <= 0 {
 							cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("parsing logfile msg: no number of lines %q", line))
 							continue
@@ -586,9 +826,9 @@ func (lsc *LStreamClient) run() {
 			lastUpdTime = time.Now()
 
 			// NOTE: the "p:" lines (process-related) are here in stderr, because
-			// stdout is gzipped and thus we don't have any partial results (we get
-			// them all at once), but for the process info, we actually want it right
-			// when it's printed by the nerdlog_agent.sh.
+			// stdout is compressed and thus we only get the results in chunks, but
+			// for the process info, we actually want it right when it's printed by
+			// the nerdlog_agent.sh.
 			switch lsc.state {
 			case LStreamClientStateConnectedBusy:
 				cmdCtx := lsc.curCmdCtx
@@ -616,9 +856,15 @@ func (lsc *LStreamClient) run() {
 
 				switch {
 				case cmdCtx.cmd.bootstrap != nil:
+					if lsc.params.LogStream.Sudo != nil && isSudoPasswordLine(line) {
+						cmdCtx.bootstrapCtx.sudoPasswordRequired = true
+					}
+
 					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 				case cmdCtx.cmd.ping != nil:
 					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
+				case cmdCtx.cmd.cleanup != nil:
+					cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 				case cmdCtx.cmd.queryLogs != nil:
 					switch {
 					case strings.HasPrefix(line, "p:"):
@@ -651,12 +897,27 @@ func (lsc *LStreamClient) run() {
 
 							percentage, err := strconv.Atoi(strings.TrimPrefix(processLine, "p:"))
 							if err != nil {
-								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:p line:", line))
+								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:p line: %s", line))
 								continue
 							}
 
 							lsc.busyStage.Percentage = percentage
 							lsc.sendBusyStageUpdate()
+
+						case strings.HasPrefix(processLine, "pid:"):
+							pid, err := strconv.Atoi(strings.TrimPrefix(processLine, "pid:"))
+							if err != nil {
+								cmdCtx.errs = append(cmdCtx.errs, errors.Annotatef(err, "received malformed p:pid line: %s", line))
+								continue
+							}
+
+							cmdCtx.queryLogsCtx.pid = pid
+
+							// If the query was cancelled before we knew the pid, kill it now.
+							if cmdCtx.queryLogsCtx.cancelled {
+								lsc.killAgent(pid)
+							}
+
 						default:
 							cmdCtx.unhandledStderr = append(cmdCtx.unhandledStderr, line)
 						}
@@ -676,11 +937,17 @@ func (lsc *LStreamClient) run() {
 			//}
 
 		case <-ticker.C:
-			if lsc.state == LStreamClientStateConnectedIdle && time.Since(lastUpdTime) > 40*time.Second {
+			lsc.updateConnStats()
+
+			// If the transport doesn't check the connection itself, ping the shell
+			// once it's been idle for a while.
+			if lsc.state == LStreamClientStateConnectedIdle &&
+				lsc.conn.rttFunc == nil &&
+				time.Since(lastUpdTime) > lsc.params.LogStream.Connection.keepaliveInterval() {
 				lsc.startCmd(lstreamCmd{
 					ping: &lstreamCmdPing{},
 				})
-			} else if !connectAfter.IsZero() {
+			} else if !connectAfter.IsZero() && time.Now().After(connectAfter) {
 				connectAfter = time.Time{}
 				lsc.changeState(LStreamClientStateConnecting)
 			}
@@ -696,13 +963,27 @@ func (lsc *LStreamClient) run() {
 				lsc.params.LogStream.Name = req.changeName
 			}
 
-			// If we're already disconnected, consider ourselves torn-down already.
-			// Otherwise, initiate disconnection.
-			if lsc.state == LStreamClientStateDisconnected {
+			switch lsc.state {
+			case LStreamClientStateDisconnected, LStreamClientStateConnecting:
+				// There is no connection to close yet; if we're still connecting, just
+				// abandon that attempt. Then, either consider ourselves torn-down
+				// already, or connect again right away (even if there was no scheduled
+				// reconnect, e.g. after a host key error, or if we gave up after too
+				// many attempts).
+				connectAfter = time.Time{}
+				lsc.numConnAttempts = 0
+				if lsc.state == LStreamClientStateConnecting {
+					lsc.changeState(LStreamClientStateDisconnected)
+				}
+
 				if req.teardown {
 					close(lsc.disconnectedBeforeTeardownCh)
+				} else {
+					lsc.changeState(LStreamClientStateConnecting)
 				}
-			} else {
+
+			default:
+				// Initiate disconnection.
 				lsc.changeState(LStreamClientStateDisconnecting)
 			}
 
@@ -721,14 +1002,82 @@ func (lsc *LStreamClient) sendUpdate(upd *LStreamClientUpdate) {
 	lsc.params.UpdatesCh <- upd
 }
 
+// askSudoPassword sends the prompt for the sudo password to the user; the
+// answer is handled in the run loop.
+func (lsc *LStreamClient) askSudoPassword() {
+	sudo := lsc.params.LogStream.Sudo
+
+	msg := fmt.Sprintf("%s on %s needs a password", sudo.cmd(), lsc.params.LogStream.Name)
+	if lsc.sudoPassword != "" {
+		msg = fmt.Sprintf("Wrong password for %s on %s, try again", sudo.cmd(), lsc.params.LogStream.Name)
+	}
+
+	lsc.sudoPassword = ""
+	lsc.sudoPrompt = newUserPrompt(
+		lsc.params.LogStream.Name, UserPromptKindSecret, "Sudo password", msg,
+	)
+
+	lsc.sendUpdate(&LStreamClientUpdate{
+		UserPrompt: lsc.sudoPrompt,
+	})
+}
+
+// getSudoPromptRespCh returns the channel to receive the answer for the sudo
+// password prompt, or nil if we're not waiting for it.
+func (lsc *LStreamClient) getSudoPromptRespCh() chan UserPromptResp {
+	if lsc.sudoPrompt == nil {
+		return nil
+	}
+
+	return lsc.sudoPrompt.respCh
+}
+
+// makeUserPrompter returns the userPrompter for a connection attempt: it
+// sends the prompt as an update, and waits for the answer, or for abortCh to
+// be closed.
+func (lsc *LStreamClient) makeUserPrompter(abortCh <-chan struct{}) userPrompter {
+	// The prompter is called from the connection goroutine, so it must not
+	// access lsc; make copies of what we need.
+	name := lsc.params.LogStream.Name
+	updatesCh := lsc.params.UpdatesCh
+
+	return func(p *UserPrompt) (UserPromptResp, error) {
+		p.LStreamName = name
+		updatesCh <- &LStreamClientUpdate{
+			Name:       name,
+			UserPrompt: p,
+		}
+
+		select {
+		case resp := <-p.respCh:
+			return resp, nil
+		case <-abortCh:
+			p.done()
+			return UserPromptResp{}, errors.Trace(errPromptAborted)
+		}
+	}
+}
+
 type lstreamConnRes struct {
 	conn *connCtx
 	err  error
 }
 
+// closeAbandonedConn waits for the result of the abandoned connection
+// attempt, and if it was successful after all, closes the connection.
+func closeAbandonedConn(resCh <-chan lstreamConnRes) {
+	res := <-resCh
+	if res.conn == nil {
+		return
+	}
+
+	res.conn.close()
+}
+
 func connectToLogStream(
 	logger *log.Logger,
 	logStream LogStream,
+	prompter userPrompter,
 	resCh chan<- lstreamConnRes,
 ) (res lstreamConnRes) {
 	defer func() {
@@ -739,177 +1088,131 @@ func connectToLogStream(
 		resCh <- res
 	}()
 
-	var sshClient *ssh.Client
-
-	conf := getClientConfig(logger, logStream.Host.User)
-
-	if logStream.Jumphost != nil {
-		logger.Infof("Connecting via jumphost")
-		// Use jumphost
-		jumphost, err := getJumphostClient(logger, logStream.Jumphost)
-		if err != nil {
-			logger.Errorf("Jumphost connection failed: %s", err)
-			res.err = errors.Annotatef(err, "getting jumphost client")
-			return res
-		}
-
-		conn, err := dialWithTimeout(jumphost, "tcp", logStream.Host.Addr, connectionTimeout)
-		if err != nil {
-			res.err = errors.Trace(err)
-			return res
-		}
-
-		authConn, chans, reqs, err := ssh.NewClientConn(conn, logStream.Host.Addr, conf)
-		if err != nil {
-			res.err = errors.Trace(err)
-			return res
-		}
-
-		sshClient = ssh.NewClient(authConn, chans, reqs)
-	} else {
-		logger.Infof("Connecting to %s (%+v)", logStream.Host.Addr, conf)
-		var err error
-		sshClient, err = ssh.Dial("tcp", logStream.Host.Addr, conf)
-		if err != nil {
-			res.err = errors.Trace(err)
-			return res
-		}
-	}
-	//defer client.Close()
-
-	logger.Infof("Connected to %s", logStream.Host.Addr)
-
-	sshSession, err := sshClient.NewSession()
-	if err != nil {
-		res.err = errors.Trace(err)
-		return res
-	}
-
-	//defer sess.Close()
-
-	stdinBuf, err := sshSession.StdinPipe()
-	if err != nil {
-		res.err = errors.Trace(err)
-		return res
-	}
-
-	stdoutBuf, err := sshSession.StdoutPipe()
+	transport, err := getTransport(logStream.Transport)
 	if err != nil {
 		res.err = errors.Trace(err)
 		return res
 	}
 
-	stderrBuf, err := sshSession.StderrPipe()
+	conn, err := transport.connect(logger, logStream, prompter)
 	if err != nil {
 		res.err = errors.Trace(err)
 		return res
 	}
 
-	err = sshSession.Shell()
-	if err != nil {
+	if err := waitShellReady(conn); err != nil {
+		conn.close()
 		res.err = errors.Trace(err)
 		return res
 	}
 
-	stdoutLinesCh := make(chan string, 32)
-	stderrLinesCh := make(chan string, 32)
-
-	go getScannerFunc("stdout", stdoutBuf, stdoutLinesCh)()
-	go getScannerFunc("stderr", stderrBuf, stderrLinesCh)()
-
-	res.conn = &connCtx{
-		sshClient:  sshClient,
-		sshSession: sshSession,
-		stdinBuf:   stdinBuf,
-
-		stdoutLinesCh: stdoutLinesCh,
-		stderrLinesCh: stderrLinesCh,
-	}
+	res.conn = conn
 
 	return res
 }
 
-func getClientConfig(logger *log.Logger, username string) *ssh.ClientConfig {
-	auth, err := getSSHAgentAuth(logger)
+// killRemoteAgentTimeout is how long we wait for the kill command to finish.
+const killRemoteAgentTimeout = 10 * time.Second
+
+// killRemoteAgent connects to the logstream and kills the agent process group
+// with the given pid (or just the agent itself, if it couldn't create its own
+// process group). The sudoPrefix is the prefix for the kill command if the
+// agent runs as another user, see LogStreamSudo.shellPrefix.
+func killRemoteAgent(
+	logger *log.Logger,
+	logStream LogStream,
+	prompter userPrompter,
+	sudoPrefix string,
+	pid int,
+) {
+	transport, err := getTransport(logStream.Transport)
 	if err != nil {
-		panic(err.Error())
+		logger.Errorf("Failed to kill the agent: %s", err)
+		return
 	}
 
-	return &ssh.ClientConfig{
-		User: username,
-		Auth: []ssh.AuthMethod{auth},
-
-		// TODO: fix it
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-
-		Timeout: connectionTimeout,
+	conn, err := transport.connect(logger, logStream, prompter)
+	if err != nil {
+		logger.Errorf("Failed to kill the agent: %s", err)
+		return
 	}
-}
-
-var (
-	jumphostsShared    = map[string]*ssh.Client{}
-	jumphostsSharedMtx sync.Mutex
-)
+	defer conn.close()
 
-func getJumphostClient(logger *log.Logger, jhConfig *ConfigHost) (*ssh.Client, error) {
-	jumphostsSharedMtx.Lock()
-	defer jumphostsSharedMtx.Unlock()
-
-	key := jhConfig.Key()
-	jh := jumphostsShared[key]
-	if jh == nil {
-		logger.Infof("Connecting to jumphost... %+v", jhConfig)
-
-		parts := strings.Split(jhConfig.Addr, ":")
-		if len(parts) != 2 {
-			return nil, errors.Errorf("malformed jumphost address %q", jhConfig.Addr)
-		}
+	if err := waitShellReady(conn); err != nil {
+		logger.Errorf("Failed to kill the agent: %s", err)
+		return
+	}
 
-		addrs, err := net.LookupHost(parts[0])
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+	cmd := fmt.Sprintf(
+		"%skill -TERM -- -%d 2>/dev/null || %skill -TERM %d\nexit\n",
+		sudoPrefix, pid, sudoPrefix, pid,
+	)
+	if _, err := conn.stdinBuf.Write([]byte(cmd)); err != nil {
+		logger.Errorf("Failed to kill the agent: %s", err)
+		return
+	}
 
-		if len(addrs) != 1 {
-			return nil, errors.New("Address not found")
-		}
+	// Wait for the shell to exit, so that we don't close the connection before
+	// the kill command is executed.
+	timeout := time.After(killRemoteAgentTimeout)
+	for conn.stdoutLinesCh != nil || conn.stderrLinesCh != nil {
+		select {
+		case line, ok := <-conn.getStdoutLinesCh():
+			if !ok {
+				conn.stdoutLinesCh = nil
+				continue
+			}
 
-		conf := getClientConfig(logger, jhConfig.User)
+			logger.Verbose2f("Kill stdout: %s", line)
+		case line, ok := <-conn.getStderrLinesCh():
+			if !ok {
+				conn.stderrLinesCh = nil
+				continue
+			}
 
-		jh, err = ssh.Dial("tcp", jhConfig.Addr, conf)
-		if err != nil {
-			return nil, errors.Trace(err)
+			logger.Verbose2f("Kill stderr: %s", line)
+		case <-timeout:
+			logger.Errorf("Timed out waiting for the agent to be killed")
+			return
 		}
+	}
 
-		jumphostsShared[key] = jh
+	logger.Infof("Killed the agent (pid %d)", pid)
+}
 
-		logger.Infof("Jumphost ok")
+func getClientConfig(
+	logger *log.Logger, host ConfigHost, prompter userPrompter,
+) (*ssh.ClientConfig, *hostKeyChecker, error) {
+	hkc, err := newHostKeyChecker(logger, host, prompter)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "initializing host key checker")
 	}
 
-	return jh, nil
-}
+	hostKeyAlgos, err := hkc.hostKeyAlgorithms()
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "reading known_hosts")
+	}
 
-var (
-	sshAuthMethodShared    ssh.AuthMethod
-	sshAuthMethodSharedMtx sync.Mutex
-)
+	return &ssh.ClientConfig{
+		User: host.User,
+		Auth: getSSHAuthMethods(logger, host, prompter),
 
-func getSSHAgentAuth(logger *log.Logger) (ssh.AuthMethod, error) {
-	sshAuthMethodSharedMtx.Lock()
-	defer sshAuthMethodSharedMtx.Unlock()
+		HostKeyCallback:   hkc.check,
+		HostKeyAlgorithms: hostKeyAlgos,
 
-	if sshAuthMethodShared == nil {
-		logger.Infof("Initializing sshAuthMethodShared...")
-		sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
-		if err != nil {
-			logger.Infof("Failed to initialize sshAuthMethodShared: %s", err.Error())
-			return nil, errors.Trace(err)
-		}
+		Timeout: host.dialTimeout(),
+	}, hkc, nil
+}
 
-		sshAuthMethodShared = ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+// hostKeyErrOr returns the host key error if the host key check has failed,
+// or the given error otherwise. It's needed because the ssh package doesn't
+// wrap the errors from HostKeyCallback, so we'd lose the type information.
+func hostKeyErrOr(hkc *hostKeyChecker, err error) error {
+	if hkc.err != nil {
+		return errors.Trace(hkc.err)
 	}
 
-	return sshAuthMethodShared, nil
+	return errors.Trace(err)
 }
 
 // dialWithTimeout is a hack needed to get a timeout for the ssh client.
@@ -936,108 +1239,270 @@ func dialWithTimeout(client *ssh.Client, protocol, hostAddr string, timeout time
 	case err := <-errChan:
 		return nil, errors.Trace(err)
 
-	case <-time.After(connectionTimeout):
+	case <-time.After(timeout):
 		// Don't close the connection here since it's reused
 		return nil, errors.New("ssh client dial timed out")
 	}
 }
 
-// scanLinesPreserveCarriageReturn is the same as bufio.ScanLines, but it does
-// not strip the \r characters: it's just a hack to support gzipping. In fact,
-// since we sometimes read text lines and sometimes gzipped data, we'd better
-// use some other custom scanner, but for now just this simple hack.
-func scanLinesPreserveCarriageReturn(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return 0, nil, nil
-	}
-	if i := bytes.IndexByte(data, '\n'); i >= 0 {
-		// We have a full newline-terminated line.
-		return i + 1, data[0:i], nil
-	}
-	// If we're at EOF, we have a final, non-terminated line. Return it.
-	if atEOF {
-		return len(data), data, nil
+// maxLineLen is the max length of a line delivered by the scanner func; the
+// longer lines are truncated, so that a single huge line can't make us use
+// an arbitrary amount of memory.
+const maxLineLen = 1024 * 1024
+
+// readLine reads the next line from the reader, and returns it without the
+// trailing \n. Unlike bufio.ScanLines, it doesn't strip the \r, since those
+// are a part of the log lines. The last line doesn't have to be terminated
+// with a newline; once there is nothing more to read, io.EOF is returned.
+//
+// The lines longer than maxLineLen are truncated.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	truncated := false
+
+	for {
+		chunk, err := r.ReadSlice('\n')
+
+		if len(line)+len(chunk) > maxLineLen {
+			chunk = chunk[:maxLineLen-len(line)]
+			truncated = true
+		}
+		line = append(line, chunk...)
+
+		switch err {
+		case nil:
+			if !truncated {
+				line = line[:len(line)-1]
+			}
+			return string(line), nil
+
+		case bufio.ErrBufferFull:
+			// The line is longer than the reader's buffer, keep reading.
+			continue
+
+		case io.EOF:
+			if len(line) > 0 {
+				return string(line), nil
+			}
+			return "", io.EOF
+
+		default:
+			return "", err
+		}
 	}
-	// Request more data.
-	return 0, nil, nil
 }
 
-func getScannerFunc(name string, reader io.Reader, linesCh chan<- string) func() {
+// getScannerFunc returns the function which reads the lines from the reader
+// and feeds them to linesCh, until the reader is exhausted, and then closes
+// linesCh.
+//
+// The compressed payloads (framed with the markerGzip or markerZstd lines
+// with the given markerPrefix) are decompressed as they arrive, and their
+// lines are fed to linesCh as well, so it's totally opaque for the clients.
+func getScannerFunc(name string, reader io.Reader, markerPrefix string, linesCh chan<- string) func() {
 	return func() {
 		defer func() {
 			close(linesCh)
 		}()
 
-		scanner := bufio.NewScanner(reader)
-
-		// See comments for scanLinesPreserveCarriageReturn for details why we need
-		// this custom split function.
-		scanner.Split(scanLinesPreserveCarriageReturn)
+		r := bufio.NewReader(reader)
 
 		// TODO: also defer signal to reconnect
 
-		// inGzip is true when we're receiving gzipped data.
-		// gzipBuf accumulates that data, and once we receive the gzipEndMarker,
-		// we gunzip all this data and feed the lines to the channel.
-		//
-		// TODO: instead of accumulating it and then unpacking all at once, do it
-		// gradually as we receive data. Idk how much of an improvement it'd be in
-		// practice though, since we're not receiving some huge chunks of data,
-		// just a bit nicer.
-		inGzip := false
-		var gzipBuf bytes.Buffer
-
-		for scanner.Scan() {
-			lineBytes := scanner.Bytes()
-			line := string(lineBytes)
-
-			if !inGzip && line == gzipStartMarker {
-				// Gzipped data begins
-				inGzip = true
-				gzipBuf.Reset()
-
-				// We also need to continue loop iteration now so that we don't
-				// add this gzipStartMarker line to the gzipBuf below.
+		for {
+			line, err := readLine(r)
+			if err != nil {
+				return
+			}
+
+			var decomp *decompressor
+			for i := range decompressors {
+				if strings.HasPrefix(line, markerPrefix+decompressors[i].marker) {
+					decomp = &decompressors[i]
+					break
+				}
+			}
+
+			if decomp == nil {
+				linesCh <- line
 				continue
-			} else if inGzip && strings.HasSuffix(line, gzipEndMarker) {
-				// We just reached the end of the gzipped data
-				inGzip = false
+			}
 
-				// Append this last piece
-				gzipBuf.Write(lineBytes[:len(lineBytes)-len(gzipEndMarker)])
+			chunks := &compressedChunksReader{
+				r:            r,
+				headerPrefix: markerPrefix + decomp.marker,
+			}
+			if err := chunks.parseHeader(line); err != nil {
+				// We don't know where the payload ends, so we can't go on.
+				linesCh <- fmt.Sprintf("%serror:%s", markerPrefix, err.Error())
+				return
+			}
 
-				var err error
+			if err := decomp.decompressLines(chunks, linesCh); err != nil {
+				linesCh <- fmt.Sprintf("%serror:failed to %s data: %s", markerPrefix, decomp.verb, err.Error())
+			}
 
-				// Gunzip the data and feed all the lines to linesCh
-				var r io.Reader
-				r, err = gzip.NewReader(&gzipBuf)
-				if err != nil {
-					linesCh <- fmt.Sprintf("error:failed to gunzip data: %s", err.Error())
+			// Skip whatever is left of the payload (e.g. if it's corrupted), so that
+			// we can go on with whatever follows it.
+			if _, err := io.Copy(io.Discard, chunks); err != nil {
+				if chunks.unexpectedLine == nil {
+					// The reader itself has failed.
 					return
 				}
 
-				scanner := bufio.NewScanner(r)
-				for scanner.Scan() {
-					linesCh <- scanner.Text()
-				}
-
-				continue
+				// The payload has ended abruptly, and we've already consumed the next
+				// line, so deliver it as usual.
+				linesCh <- fmt.Sprintf("%serror:%s", markerPrefix, err.Error())
+				linesCh <- *chunks.unexpectedLine
 			}
+		}
+	}
+}
 
-			if !inGzip {
-				// We're not in gzipped data, so just feed this line directly.
-				linesCh <- line
-			} else {
-				// We're reading gzipped data now, so for now just add it to the
-				// gzipBuf (together with the \n which was stripped by the scanner).
-				gzipBuf.Write(lineBytes)
-				gzipBuf.WriteByte('\n')
-			}
+// decompressor describes how to decompress the payload framed with the given
+// marker.
+type decompressor struct {
+	marker string
+	// verb is used in the error messages, like "failed to gunzip data".
+	verb string
+	// decompressLines decompresses the data from the reader as it arrives, and
+	// feeds all the lines to linesCh.
+	decompressLines func(reader io.Reader, linesCh chan<- string) error
+}
+
+var decompressors = []decompressor{
+	{marker: markerGzip, verb: "gunzip", decompressLines: gunzipLines},
+	{marker: markerZstd, verb: "unzstd", decompressLines: unzstdLines},
+}
+
+// compressedChunksReader reads the compressed payload which consists of the
+// chunks, each one preceded with the header line (markerGzip or markerZstd)
+// with its length, and terminated with a zero-length chunk. This way, the
+// payload can be sent as it's produced, without knowing its total length in
+// advance, and we can decompress it as it arrives, while nothing in the
+// payload can be taken for a control line.
+type compressedChunksReader struct {
+	r            *bufio.Reader
+	headerPrefix string
+
+	// remaining is the number of bytes left in the current chunk.
+	remaining int64
+	// done is set once the terminating zero-length chunk is received.
+	done bool
+
+	// unexpectedLine is set if instead of the next chunk header, some other
+	// line was received.
+	unexpectedLine *string
+}
+
+// parseHeader parses the chunk header line, and prepares to read the chunk.
+func (c *compressedChunksReader) parseHeader(line string) error {
+	size, err := strconv.ParseInt(strings.TrimPrefix(line, c.headerPrefix), 10, 64)
+	if err != nil || size < 0 {
+		return errors.Errorf("malformed compressed chunk header %q", line)
+	}
+
+	c.remaining = size
+	c.done = size == 0
+
+	return nil
+}
+
+func (c *compressedChunksReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
 		}
 
-		if err := scanner.Err(); err != nil {
-			return
+		line, err := readLine(c.r)
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		if !strings.HasPrefix(line, c.headerPrefix) {
+			c.unexpectedLine = &line
+			c.done = true
+			return 0, errors.Errorf("compressed payload has ended without the terminating chunk")
+		}
+
+		if err := c.parseHeader(line); err != nil {
+			c.unexpectedLine = &line
+			c.done = true
+			return 0, errors.Trace(err)
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// gunzipLines gunzips the data from the reader as it arrives, and feeds all
+// the lines to linesCh.
+func gunzipLines(reader io.Reader, linesCh chan<- string) error {
+	gzReader, err := gzip.NewReader(reader)
+	if err != nil {
+		if err == io.EOF {
+			// Empty payload, no lines.
+			return nil
 		}
+
+		return errors.Trace(err)
+	}
+
+	// There is only one gzip member in the payload; don't even try to read the
+	// next one, so that the remaining data is left for the caller to skip.
+	gzReader.Multistream(false)
+
+	return errors.Trace(feedLines(gzReader, linesCh))
+}
+
+// zstdMaxWindow is the max window size of the zstd data which we agree to
+// decompress; it's enough for all the levels up to 19 (the "--ultra" ones
+// need more), and it limits the memory needed by the decoder.
+const zstdMaxWindow = 16 << 20
+
+// unzstdLines decompresses the zstd data from the reader as it arrives, and
+// feeds all the lines to linesCh.
+func unzstdLines(reader io.Reader, linesCh chan<- string) error {
+	// With the concurrency 1, the decoding is synchronous, so that it doesn't
+	// read ahead more than it needs.
+	zReader, err := zstd.NewReader(
+		reader,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxWindow(zstdMaxWindow),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer zReader.Close()
+
+	return errors.Trace(feedLines(zReader, linesCh))
+}
+
+// feedLines reads the lines from the reader until it's exhausted, and feeds
+// them to linesCh.
+func feedLines(reader io.Reader, linesCh chan<- string) error {
+	r := bufio.NewReader(reader)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return errors.Trace(err)
+		}
+
+		linesCh <- line
 	}
 }
 
@@ -1070,6 +1535,97 @@ func (lsc *LStreamClient) Reconnect() {
 	}
 }
 
+// CancelQuery cancels the queries which were enqueued with the given respCh:
+// the ones which are still in the queue are just dropped, and if one is
+// running already, the agent process is killed. Either way, respCh receives
+// ErrQueryCancelled for every such query.
+//
+// Queries enqueued with other respCh-s are not affected, so it's safe to
+// enqueue the next query right after cancelling the previous one.
+func (lsc *LStreamClient) CancelQuery(respCh chan lstreamCmdRes) {
+	lsc.cancelQueryCh <- respCh
+}
+
+func (lsc *LStreamClient) cancelQuery(respCh chan lstreamCmdRes) {
+	var cmdQueue []lstreamCmd
+	for _, cmd := range lsc.cmdQueue {
+		if cmd.queryLogs != nil && cmd.respCh == respCh {
+			lsc.sendCmdRespTo(cmd, nil, ErrQueryCancelled)
+			continue
+		}
+
+		cmdQueue = append(cmdQueue, cmd)
+	}
+	lsc.cmdQueue = cmdQueue
+
+	cmdCtx := lsc.curCmdCtx
+	if lsc.state != LStreamClientStateConnectedBusy ||
+		cmdCtx == nil || cmdCtx.cmd.queryLogs == nil || cmdCtx.cmd.respCh != respCh ||
+		cmdCtx.queryLogsCtx.cancelled {
+		return
+	}
+
+	lsc.params.Logger.Infof("Cancelling the query (pid %d)", cmdCtx.queryLogsCtx.pid)
+
+	cmdCtx.queryLogsCtx.cancelled = true
+
+	// If we don't know the pid yet, the agent will be killed once we receive
+	// it.
+	if cmdCtx.queryLogsCtx.pid != 0 {
+		lsc.killAgent(cmdCtx.queryLogsCtx.pid)
+	}
+}
+
+// killAgent kills the agent process group with the given pid, in the
+// background. Our own shell is busy waiting for the agent, so it has to be
+// done using a separate connection.
+func (lsc *LStreamClient) killAgent(pid int) {
+	// Never aborted: the kill is short-lived anyway.
+	prompter := lsc.makeUserPrompter(nil)
+
+	go killRemoteAgent(
+		lsc.params.Logger, lsc.params.LogStream, prompter,
+		lsc.params.LogStream.Sudo.shellPrefix(lsc.sudoPassword), pid,
+	)
+}
+
+// failPendingCmds responds with the given error to the current command (if
+// any) and all the queued ones, and drops the queue. It's called once the
+// connection is lost.
+func (lsc *LStreamClient) failPendingCmds(err error) {
+	if cmdCtx := lsc.curCmdCtx; cmdCtx != nil {
+		if cmdCtx.queryLogsCtx != nil && cmdCtx.queryLogsCtx.cancelled {
+			lsc.sendCmdResp(nil, ErrQueryCancelled)
+		} else {
+			lsc.sendCmdResp(nil, err)
+		}
+	}
+
+	for _, cmd := range lsc.cmdQueue {
+		lsc.sendCmdRespTo(cmd, nil, err)
+	}
+	lsc.cmdQueue = nil
+}
+
+// updateConnStats sends the ConnStats update if the stats have changed.
+func (lsc *LStreamClient) updateConnStats() {
+	if !isStateConnected(lsc.state) || lsc.conn.rttFunc == nil {
+		return
+	}
+
+	stats := ConnStats{
+		RTT: lsc.conn.rttFunc(),
+	}
+	if stats == lsc.connStats {
+		return
+	}
+
+	lsc.connStats = stats
+	lsc.sendUpdate(&LStreamClientUpdate{
+		ConnStats: &stats,
+	})
+}
+
 func (lsc *LStreamClient) addCmdToQueue(cmd lstreamCmd) {
 	lsc.cmdQueue = append(lsc.cmdQueue, cmd)
 }
@@ -1087,37 +1643,171 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 	case cmdCtx.cmd.bootstrap != nil:
 		cmdCtx.bootstrapCtx = &lstreamCmdCtxBootstrap{}
 
-		lsc.conn.stdinBuf.Write([]byte("echo reset_output\n"))
-		lsc.conn.stdinBuf.Write([]byte("echo reset_output 1>&2\n"))
-		lsc.conn.stdinBuf.Write([]byte("("))
-		lsc.conn.stdinBuf.Write([]byte("  cat <<- 'EOF' > " + lsc.getLStreamNerdlogAgentPath() + "\n" + nerdlogAgentSh + "EOF\n"))
-		lsc.conn.stdinBuf.Write([]byte("  if [[ $? != 0 ]]; then echo 'bootstrap failed'; exit 1; fi\n"))
+		// The work dir is not known until the first phase of the bootstrap (the
+		// one without the upload) reports it, so the bootstrap script refers to
+		// it by the shell variable; same for the agent, which is picked by the
+		// bootstrap script based on the host architecture.
+		agentPath := `"$` + agentPathShellVar + `"`
+
+		// The script is built separately, since with sudo, it runs as another
+		// user, via bash -c.
+		var script strings.Builder
+
+		script.WriteString("  " + markerPrefixShellVar + "=" + shellQuote(lsc.conn.markerPrefix) + "\n")
+
+		if cmdCtx.cmd.bootstrap.uploadAgent {
+			script.WriteString("  " + workDirShellVar + "=" + shellQuote(lsc.workDir) + "\n")
+		} else {
+			script.WriteString(workDirShellScript(lsc.params.LogStream.WorkDir))
+		}
+
+		script.WriteString(`  echo "work_dir:$` + workDirShellVar + `"` + "\n")
+		script.WriteString(archScript())
+
+		// stagedUpload is set if the agent is first uploaded to a temporary file
+		// as the login user, and then copied from there by the bootstrap script;
+		// see below.
+		stagedUpload := false
+
+		if cmdCtx.cmd.bootstrap.uploadAgent {
+			script.WriteString(agentAssignScript(lsc.getAgent(), lsc.params.ClientID))
+
+			// Upload the agent to a temporary file first and then move it in place,
+			// so that an interrupted upload can't leave a broken agent behind, and
+			// the other logstreams on the same host can't see it half-written.
+			script.WriteString(
+				`  tmp_path="$(mktemp "$` + workDirShellVar + `/nerdlog_agent_upload_XXXXXXXXXX")"` + "\n",
+			)
+			script.WriteString("  if [[ $? != 0 ]]; then echo 'bootstrap failed'; exit 1; fi\n")
+
+			if lsc.params.LogStream.Sudo != nil {
+				// With sudo, the whole script is passed as an argument to bash -c, and
+				// the native agent is way too large for that (a single argument can't
+				// be larger than 128K on Linux), so the agent is uploaded separately
+				// to a file private to the login user, and fed to the script via
+				// stdin.
+				stagedUpload = true
+				script.WriteString("  cat > \"$tmp_path\"\n")
+			} else {
+				script.WriteString("  " + lsc.getAgent().writeScript(`"$tmp_path"`))
+			}
+			script.WriteString("  if [[ $? != 0 ]]; then rm -f \"$tmp_path\"; echo 'bootstrap failed'; exit 1; fi\n")
+
+			if lsc.getAgent().isNative() {
+				script.WriteString("  chmod 0700 \"$tmp_path\"\n")
+				script.WriteString("  if [[ $? != 0 ]]; then rm -f \"$tmp_path\"; echo 'bootstrap failed'; exit 1; fi\n")
+			}
+
+			script.WriteString("  mv -f \"$tmp_path\" " + agentPath + "\n")
+			script.WriteString("  if [[ $? != 0 ]]; then rm -f \"$tmp_path\"; echo 'bootstrap failed'; exit 1; fi\n")
+		} else {
+			natives, err := lsc.params.agentVariants.getNatives()
+			if err != nil {
+				lsc.params.Logger.Errorf("Failed to load the native agents, will use the shell one: %s", err.Error())
+				natives = nil
+			}
+
+			if lsc.nativeAgentFailed {
+				natives = nil
+			}
+
+			script.WriteString(agentSelectScript(natives, lsc.params.ClientID))
+
+			// If the agent is already there, we don't need to upload it. If there is
+			// no sha256sum on the host, we'll just upload it every time.
+			script.WriteString(
+				"  if [[ \"$(sha256sum " + agentPath + " 2>/dev/null | cut -d' ' -f1)\" != \"$" + agentHashShellVar + "\" ]]; " +
+					"then echo '" + agentUploadNeededMarker + "'; exit 0; fi\n",
+			)
+		}
 
 		var parts []string
 		parts = append(
 			parts,
-			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
+			`$`+agentRunnerShellVar, agentPath,
 			"logstream_info",
-			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
+			"--work-dir", `"$`+workDirShellVar+`"`,
+			"--marker-prefix", `"$`+markerPrefixShellVar+`"`,
 		)
+		parts = append(parts, lsc.agentLogFileArgs()...)
+
+		script.WriteString("  " + strings.Join(parts, " ") + "\n")
+
+		// If the native agent can't be executed at all (126 is what bash returns
+		// if exec fails), we'll fall back to the shell one.
+		script.WriteString(
+			"  nerdlog_rc=$?; if [[ $nerdlog_rc == 126 && \"$" + agentVariantShellVar + "\" != " + shellAgentVariantName + " ]]; " +
+				"then echo '" + agentExecFailedMarker + "'; exit 0; fi\n",
+		)
+		script.WriteString("  if [[ $nerdlog_rc != 0 ]]; then echo 'bootstrap failed'; exit 1; fi\n")
+
+		script.WriteString("  echo 'bootstrap ok'\n")
+
+		resetOutput := shellQuote(lsc.conn.marker(markerResetOutput))
+		lsc.conn.stdinBuf.Write([]byte("echo " + resetOutput + "\n"))
+		lsc.conn.stdinBuf.Write([]byte("echo " + resetOutput + " 1>&2\n"))
 
-		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
-			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
+		if stagedUpload {
+			lsc.conn.stdinBuf.Write([]byte(
+				"nerdlog_upload_src=\"$(mktemp \"${TMPDIR:-/tmp}/nerdlog_agent_upload_XXXXXXXXXX\")\" && " +
+					lsc.getAgent().writeScript(`"$nerdlog_upload_src"`),
+			))
 		}
 
-		lsc.conn.stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
-		lsc.conn.stdinBuf.Write([]byte("  if [[ $? != 0 ]]; then echo 'bootstrap failed'; exit 1; fi\n"))
+		if sudo := lsc.params.LogStream.Sudo; sudo != nil {
+			prefix := sudo.shellPrefix(lsc.sudoPassword)
+			if stagedUpload {
+				// The password has been checked by the previous bootstrap, the one
+				// which has found out that the upload is needed.
+				prefix = sudo.shellPrefixWithStdin(lsc.sudoPassword, `cat "$nerdlog_upload_src"`)
+			}
 
-		lsc.conn.stdinBuf.Write([]byte("  echo 'bootstrap ok'\n"))
-		lsc.conn.stdinBuf.Write([]byte(")\n"))
-		lsc.conn.stdinBuf.Write([]byte("echo exit_code:$?\n"))
+			cmd := prefix + "bash -c " + shellQuote(script.String())
+			lsc.conn.stdinBuf.Write([]byte(cmd + "\n"))
+		} else {
+			lsc.conn.stdinBuf.Write([]byte("(\n" + script.String() + ")\n"))
+		}
+
+		if stagedUpload {
+			// Remove the staged agent, keeping the exit code of the bootstrap.
+			lsc.conn.stdinBuf.Write([]byte(
+				"nerdlog_rc=$?; rm -f \"$nerdlog_upload_src\"; (exit $nerdlog_rc)\n",
+			))
+		}
+		lsc.conn.stdinBuf.Write([]byte("echo " + shellQuote(lsc.conn.marker(markerExitCode)) + "$?\n"))
 
 	case cmdCtx.cmd.ping != nil:
 		cmdCtx.pingCtx = &lstreamCmdCtxPing{}
 
 		cmd := "whoami\n"
 		lsc.conn.stdinBuf.Write([]byte(cmd))
-		lsc.conn.stdinBuf.Write([]byte("echo exit_code:$?\n"))
+		lsc.conn.stdinBuf.Write([]byte("echo " + shellQuote(lsc.conn.marker(markerExitCode)) + "$?\n"))
+
+	case cmdCtx.cmd.cleanup != nil:
+		cmdCtx.cleanupCtx = &lstreamCmdCtxCleanup{
+			Resp: &CleanupResp{},
+		}
+
+		// NOTE: with sudo, the files are owned by the sudo user, so the cleanup
+		// has to run as that user too.
+		parts := []string{
+			lsc.agentCmd(),
+			"cleanup",
+			"--work-dir", shellQuote(lsc.workDir),
+			"--marker-prefix", shellQuote(lsc.conn.markerPrefix),
+		}
+
+		if cmdCtx.cmd.cleanup.dryRun {
+			parts = append(parts, "--dry-run")
+		}
+
+		if cmdCtx.cmd.cleanup.all {
+			parts = append(parts, "--all")
+		}
+
+		// NOTE: the "exit_code:" is printed by the trap in the agent script, same
+		// as for the query command.
+		lsc.conn.stdinBuf.Write([]byte(strings.Join(parts, " ") + "\n"))
 
 	case cmdCtx.cmd.queryLogs != nil:
 		cmdCtx.queryLogsCtx = &lstreamCmdCtxQueryLogs{
@@ -1128,22 +1818,46 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 
 		var parts []string
 
-		if useGzip {
-			parts = append(parts, "echo", gzipStartMarker, ";")
+		// With compression, the query output is compressed on the host and printed
+		// in chunks, each one after the marker line with its length; the scanner
+		// func (returned by getScannerFunc) decompresses it as it arrives and
+		// feeds the lines to the clients, so it's totally opaque for them.
+		compressCmd := lsc.compression.shellCmd()
+
+		// The chunks go through a temporary file in the work dir, which, with
+		// sudo, is private to the sudo user; so then the whole pipeline runs as
+		// the sudo user, not just the agent.
+		sudo := lsc.params.LogStream.Sudo
+		wholeAsSudo := compressCmd != "" && sudo != nil
+
+		agentCmd := lsc.agentCmd()
+		if wholeAsSudo {
+			agentCmd = lsc.agentCmdNoSudo()
+		}
+
+		if compressCmd != "" {
+			// Every chunk goes through a temporary file first, since we need to
+			// know its length before printing it. See markers.go. It's named like
+			// the rest of the nerdlog files in the work dir, so that the cleanup
+			// finds it if the query gets interrupted.
+			parts = append(
+				parts,
+				`nerdlog_chunk="$(mktemp `+shellQuote(lsc.workDir)+`/nerdlog_agent_chunk_XXXXXXXXXX)"`,
+				"||", "echo", shellQuote(lsc.conn.marker(markerError)+"failed to create a temporary file"), ";",
+				`[ -n "$nerdlog_chunk" ]`, "&&", "{",
+			)
 		}
 
 		parts = append(
 			parts,
-			"bash", shellQuote(lsc.getLStreamNerdlogAgentPath()),
+			agentCmd,
 			"query",
+			"--work-dir", shellQuote(lsc.workDir),
+			"--marker-prefix", shellQuote(lsc.conn.markerPrefix),
 			"--index-file", shellQuote(lsc.getLStreamIndexFilePath()),
 			"--max-num-lines", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.maxNumLines)),
-			"--logfile-last", shellQuote(lsc.params.LogStream.LogFileLast()),
 		)
-
-		if logFilePrev, ok := lsc.params.LogStream.LogFilePrev(); ok {
-			parts = append(parts, "--logfile-prev", shellQuote(logFilePrev))
-		}
+		parts = append(parts, lsc.agentLogFileArgs()...)
 
 		if !cmdCtx.cmd.queryLogs.from.IsZero() {
 			parts = append(parts, "--from", shellQuote(cmdCtx.cmd.queryLogs.from.In(lsc.location).Format(queryLogsArgsTimeLayout)))
@@ -1153,6 +1867,13 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, "--to", shellQuote(cmdCtx.cmd.queryLogs.to.In(lsc.location).Format(queryLogsArgsTimeLayout)))
 		}
 
+		if lsc.params.IndexTTLDays > 0 {
+			parts = append(
+				parts,
+				"--index-ttl-days", shellQuote(strconv.Itoa(lsc.params.IndexTTLDays)),
+			)
+		}
+
 		if cmdCtx.cmd.queryLogs.linesUntil > 0 {
 			parts = append(parts, "--lines-until", shellQuote(strconv.Itoa(cmdCtx.cmd.queryLogs.linesUntil)))
 		}
@@ -1163,17 +1884,40 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 			parts = append(parts, shellQuote(cmdCtx.cmd.queryLogs.query))
 		}
 
-		if useGzip {
-			parts = append(parts, "|", "gzip", ";", "echo", gzipEndMarker)
+		if compressCmd != "" {
+			parts = append(
+				parts,
+				"|", compressCmd,
+				"|", "while", ":", ";", "do",
+				// Without iflag=fullblock, dd reads whatever is available right now (up
+				// to the block size), so the chunks are sent as soon as the compressor
+				// emits them.
+				"dd", "bs=65536", "count=1", `of="$nerdlog_chunk"`, "2>/dev/null", ";",
+				`nerdlog_chunk_len="$(wc -c < "$nerdlog_chunk" | tr -d ' ')"`, ";",
+				"echo", shellQuote(lsc.conn.marker(lsc.compression.marker()))+`"$nerdlog_chunk_len"`, ";",
+				`[ "$nerdlog_chunk_len" -gt 0 ]`, "||", "break", ";",
+				"cat", `"$nerdlog_chunk"`, ";",
+				"done", ";",
+				"rm", "-f", `"$nerdlog_chunk"`, ";",
+				"}",
+			)
 		}
 
-		cmd := strings.Join(parts, " ") + "\n"
-		lsc.params.Logger.Verbose2f("Executing query command(%s): %s", lsc.params.LogStream.Name, cmd)
+		cmd := strings.Join(parts, " ")
+		if wholeAsSudo {
+			cmd = sudo.shellPrefix(lsc.sudoPassword) + "bash -c " + shellQuote(cmd)
+		}
+		cmd += "\n"
+
+		lsc.params.Logger.Verbose2f(
+			"Executing query command(%s): %s",
+			lsc.params.LogStream.Name, redactSudoPassword(cmd, lsc.sudoPassword),
+		)
 
 		lsc.conn.stdinBuf.Write([]byte(cmd))
 
 		// NOTE: we don't print the "exit_code:" here, because we can't reliably
-		// do that across all possible shells, due to gzipping: the agent script
+		// do that across all possible shells, due to compression: the agent script
 		// is not the last one in the pipeline.
 		//
 		// Instead, the agent script itself has a trap which prints this line for
@@ -1183,30 +1927,67 @@ func (lsc *LStreamClient) startCmd(cmd lstreamCmd) {
 		panic(fmt.Sprintf("invalid command %+v", cmdCtx.cmd))
 	}
 
-	lsc.conn.stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d'\n", cmdCtx.idx)))
-	lsc.conn.stdinBuf.Write([]byte(fmt.Sprintf("echo 'command_done:%d' 1>&2\n", cmdCtx.idx)))
+	commandDone := shellQuote(lsc.conn.marker(markerCommandDone) + strconv.Itoa(cmdCtx.idx))
+	lsc.conn.stdinBuf.Write([]byte("echo " + commandDone + "\n"))
+	lsc.conn.stdinBuf.Write([]byte("echo " + commandDone + " 1>&2\n"))
 
 	lsc.changeState(LStreamClientStateConnectedBusy)
 }
 
-// getLStreamNerdlogAgentPath returns the logstream-side path to the nerdlog_agent.sh
-// for the particular log stream.
+// getAgent returns the agent used on the logstream host; it's the shell agent
+// until the bootstrap has picked one.
+func (lsc *LStreamClient) getAgent() *agentVariant {
+	if lsc.agent == nil {
+		return shellAgentVariant
+	}
+
+	return lsc.agent
+}
+
+// getLStreamNerdlogAgentPath returns the logstream-side path to the agent.
+// It's only valid after the bootstrap, when the work dir is known.
 func (lsc *LStreamClient) getLStreamNerdlogAgentPath() string {
-	return fmt.Sprintf(
-		"/tmp/nerdlog_agent_%s_%s.sh",
-		lsc.params.ClientID,
-		filepathToId(lsc.params.LogStream.LogFileLast()),
-	)
+	return path.Join(lsc.workDir, lsc.getAgent().fname(lsc.params.ClientID))
+}
+
+// agentCmd returns the shell command to run the agent with, without the
+// agent arguments. With sudo, it runs the agent via the escalation command.
+func (lsc *LStreamClient) agentCmd() string {
+	return lsc.params.LogStream.Sudo.shellPrefix(lsc.sudoPassword) + lsc.agentCmdNoSudo()
+}
+
+// agentCmdNoSudo is like agentCmd, but it runs the agent as the current user
+// even with sudo; it's for when the whole command already runs as the sudo
+// user.
+func (lsc *LStreamClient) agentCmdNoSudo() string {
+	var cmd string
+	if runner := lsc.getAgent().runner(); runner != "" {
+		cmd += runner + " "
+	}
+
+	return cmd + shellQuote(lsc.getLStreamNerdlogAgentPath())
+}
+
+// agentLogFileArgs returns the agent flags with all the log files of the
+// logstream, the latest one first.
+func (lsc *LStreamClient) agentLogFileArgs() []string {
+	var ret []string
+	for _, logFile := range lsc.params.LogStream.LogFiles {
+		ret = append(ret, "--logfile", shellQuote(logFile))
+	}
+
+	return ret
 }
 
 // getLStreamIndexFilePath returns the logstream-side path to the index file for
-// the particular log stream.
+// the particular log stream. Same as getLStreamNerdlogAgentPath, it's only
+// valid after the bootstrap.
 func (lsc *LStreamClient) getLStreamIndexFilePath() string {
-	return fmt.Sprintf(
-		"/tmp/nerdlog_agent_index_%s_%s",
+	return path.Join(lsc.workDir, fmt.Sprintf(
+		"nerdlog_agent_index_%s_%s",
 		lsc.params.ClientID,
 		filepathToId(lsc.params.LogStream.LogFileLast()),
-	)
+	))
 }
 
 // filepathToId takes a path and returns a string suitable to be used as
@@ -1232,11 +2013,11 @@ func (lsc *LStreamClient) checkIfDisconnected() {
 func (lsc *LStreamClient) checkCommandDone(
 	line string, cmdCtx *lstreamCmdCtx, isStderr bool,
 ) bool {
-	if !strings.HasPrefix(line, "command_done:") {
+	if !strings.HasPrefix(line, lsc.conn.marker(markerCommandDone)) {
 		return false
 	}
 
-	_, err := parseCommandDoneLine(line, cmdCtx.idx)
+	_, err := parseCommandDoneLine(strings.TrimPrefix(line, lsc.conn.markerPrefix), cmdCtx.idx)
 	if err != nil {
 		lsc.params.Logger.Errorf("Got malformed command_done line: %s (%s)", line, err.Error())
 		return true
@@ -1255,14 +2036,14 @@ func (lsc *LStreamClient) checkCommandDone(
 func (lsc *LStreamClient) checkError(
 	line string, cmdCtx *lstreamCmdCtx,
 ) bool {
-	if !strings.HasPrefix(line, "error:") {
+	if !strings.HasPrefix(line, lsc.conn.marker(markerError)) {
 		return false
 	}
 
 	// The agent script printed an error; it means that the whole execution will
 	// be considered failed once it's done. For now we just add the error to the
 	// resulting response.
-	errMsg := strings.TrimPrefix(line, "error:")
+	errMsg := strings.TrimPrefix(line, lsc.conn.marker(markerError))
 	cmdCtx.errs = append(cmdCtx.errs, errors.New(errMsg))
 
 	return true
@@ -1283,11 +2064,11 @@ func (lsc *LStreamClient) checkDebug(
 func (lsc *LStreamClient) checkExitCode(
 	line string, cmdCtx *lstreamCmdCtx,
 ) bool {
-	if !strings.HasPrefix(line, "exit_code:") {
+	if !strings.HasPrefix(line, lsc.conn.marker(markerExitCode)) {
 		return false
 	}
 
-	cmdCtx.exitCode = strings.TrimPrefix(line, "exit_code:")
+	cmdCtx.exitCode = strings.TrimPrefix(line, lsc.conn.marker(markerExitCode))
 	lsc.params.Logger.Verbose1f("Received exit code: %q", cmdCtx.exitCode)
 	return true
 }
@@ -1295,7 +2076,7 @@ func (lsc *LStreamClient) checkExitCode(
 func (lsc *LStreamClient) checkResetOutput(
 	line string, cmdCtx *lstreamCmdCtx, isStderr bool,
 ) bool {
-	if line != "reset_output" {
+	if line != lsc.conn.marker(markerResetOutput) {
 		return false
 	}
 
@@ -1319,6 +2100,35 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 
 	switch {
 	case cmdCtx.cmd.bootstrap != nil:
+		if cmdCtx.bootstrapCtx.workDir != "" {
+			lsc.workDir = cmdCtx.bootstrapCtx.workDir
+		}
+
+		if name := cmdCtx.bootstrapCtx.agentVariant; name != "" {
+			if agent := lsc.params.agentVariants.byName(name); agent != nil {
+				lsc.agent = agent
+			} else {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Errorf("unknown agent variant %q", name))
+			}
+		}
+
+		if hostInfo := cmdCtx.bootstrapCtx.hostInfo; hostInfo != nil {
+			hostInfo.Arch = cmdCtx.bootstrapCtx.arch
+			hostInfo.NativeAgent = lsc.getAgent().isNative()
+		}
+
+		if cmdCtx.bootstrapCtx.receivedSuccess {
+			compression, err := chooseCompression(lsc.params.LogStream.Compression, cmdCtx.bootstrapCtx.hostInfo)
+			if err != nil {
+				cmdCtx.errs = append(cmdCtx.errs, errors.Trace(err))
+			} else {
+				lsc.compression = compression
+				if hostInfo := cmdCtx.bootstrapCtx.hostInfo; hostInfo != nil {
+					hostInfo.Compression = compression
+				}
+			}
+		}
+
 		if cmdCtx.bootstrapCtx.receivedSuccess && len(cmdCtx.errs) == 0 {
 			// Bootstrap script has ran successfully, let's now try to autodetect the
 			// envelope log format.
@@ -1333,11 +2143,53 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 					timeFormat.TimestampLayout,
 				)
 				lsc.timeFormat = timeFormat
+
+				if cmdCtx.bootstrapCtx.hostInfo != nil {
+					lsc.sendUpdate(&LStreamClientUpdate{
+						BootstrapDetails: &BootstrapDetails{
+							HostInfo: cmdCtx.bootstrapCtx.hostInfo,
+						},
+					})
+				}
+
 				lsc.changeState(LStreamClientStateConnectedIdle)
 				return
 			}
 		}
 
+		if cmdCtx.bootstrapCtx.agentExecFailed && len(cmdCtx.errs) == 0 {
+			// The native agent is there, but it can't run; bootstrap again with the
+			// shell agent. Same as with the upload, it must be the very next command.
+			lsc.params.Logger.Infof(
+				"Failed to run the native agent on %s, falling back to the shell one",
+				lsc.params.LogStream.Name,
+			)
+			lsc.nativeAgentFailed = true
+			lsc.cmdQueue = append([]lstreamCmd{{
+				bootstrap: &lstreamCmdBootstrap{},
+			}}, lsc.cmdQueue...)
+			lsc.changeState(LStreamClientStateConnectedIdle)
+			return
+		}
+
+		if cmdCtx.bootstrapCtx.agentUploadNeeded && len(cmdCtx.errs) == 0 {
+			// Bootstrap again, this time uploading the agent. It must be the very
+			// next command, before whatever was enqueued meanwhile.
+			lsc.params.Logger.Verbose1f("Uploading the agent to %s", lsc.params.LogStream.Name)
+			lsc.cmdQueue = append([]lstreamCmd{{
+				bootstrap: &lstreamCmdBootstrap{uploadAgent: true},
+			}}, lsc.cmdQueue...)
+			lsc.changeState(LStreamClientStateConnectedIdle)
+			return
+		}
+
+		if cmdCtx.bootstrapCtx.sudoPasswordRequired && lsc.params.LogStream.Sudo.supportsPassword() {
+			// Ask the user for the password, and then bootstrap again; until then,
+			// we stay busy, so that no other commands are run.
+			lsc.askSudoPassword()
+			return
+		}
+
 		// There was an issue with bootstrapping.
 
 		err := summaryCmdError(cmdCtx)
@@ -1353,9 +2205,21 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 			)
 		}
 
+		if cmdCtx.bootstrapCtx.sudoPasswordRequired {
+			err = errors.Annotatef(
+				err, "%s needs a password, but only sudo can be given one; allow running bash without a password for this user, or use sudo",
+				lsc.params.LogStream.Sudo.cmd(),
+			)
+		} else if lsc.params.LogStream.Sudo != nil && !cmdCtx.bootstrapCtx.receivedFailure {
+			// The bootstrap script didn't even run, so likely the escalation
+			// command itself has failed.
+			err = errors.Annotatef(err, "running the agent via %s", lsc.params.LogStream.Sudo.cmd())
+		}
+
 		lsc.sendUpdate(&LStreamClientUpdate{
 			BootstrapDetails: &BootstrapDetails{
-				Err: err.Error(),
+				Err:      err.Error(),
+				HostInfo: cmdCtx.bootstrapCtx.hostInfo,
 			},
 		})
 
@@ -1365,9 +2229,17 @@ func (lsc *LStreamClient) handleCommandResultsIfDone(cmdCtx *lstreamCmdCtx) {
 		lsc.sendCmdResp(nil, nil)
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
+	case cmdCtx.cmd.cleanup != nil:
+		lsc.sendCmdResp(cmdCtx.cleanupCtx.Resp, summaryCmdError(cmdCtx))
+		lsc.changeState(LStreamClientStateConnectedIdle)
+
 	case cmdCtx.cmd.queryLogs != nil:
-		resp := cmdCtx.queryLogsCtx.Resp
-		lsc.sendCmdResp(resp, summaryCmdError(cmdCtx))
+		if cmdCtx.queryLogsCtx.cancelled {
+			lsc.sendCmdResp(nil, ErrQueryCancelled)
+		} else {
+			resp := cmdCtx.queryLogsCtx.Resp
+			lsc.sendCmdResp(resp, summaryCmdError(cmdCtx))
+		}
 		lsc.changeState(LStreamClientStateConnectedIdle)
 
 	default:
@@ -0,0 +1,305 @@
+//go:build go1.18
+// +build go1.18
+
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+// scanTestLines feeds the data through getScannerFunc, and returns all the
+// lines it produces.
+func scanTestLines(markerPrefix string, data []byte) []string {
+	linesCh := make(chan string)
+	go getScannerFunc("test", bytes.NewReader(data), markerPrefix, linesCh)()
+
+	var lines []string
+	for line := range linesCh {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// splitTestLines splits the text into lines the same way as getScannerFunc
+// does: only on \n, and the last line doesn't have to be terminated.
+func splitTestLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// writeCompressedChunks writes the compressed data framed the same way as the
+// query command does it: in chunks of at most chunkSize bytes, each one
+// preceded with the header line (like markerGzip with the prefix), and
+// terminated with the zero-length chunk.
+func writeCompressedChunks(w io.Writer, headerPrefix string, data []byte, chunkSize int) {
+	for len(data) > 0 {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		io.WriteString(w, headerPrefix+strconv.Itoa(n)+"\n")
+		w.Write(data[:n])
+		data = data[n:]
+	}
+
+	io.WriteString(w, headerPrefix+"0\n")
+}
+
+// addScannerSeeds adds the log contents which used to confuse the client.
+//
+// If args are given, every seed is added with each of them as the second
+// fuzz argument.
+func addScannerSeeds(f *testing.F, args ...interface{}) {
+	for _, seed := range []string{
+		"",
+		"just a log line\n",
+		"gzip_end",
+		"gzip_start\nfoo\ngzip_end\n",
+		"foo gzip_end\nbar\n",
+		"command_done:1\n",
+		"error:boom\nexit_code:0\nreset_output\n",
+		"line with \r\n and \r in the middle\r",
+		"nerdlog_0000000000000000:gzip:5\n\x1f\x8b\x08\x00",
+		"no trailing newline",
+		"\x00\x01\x02\xff\n\n\n",
+	} {
+		if len(args) == 0 {
+			f.Add(seed)
+			continue
+		}
+
+		for _, arg := range args {
+			f.Add(seed, arg)
+		}
+	}
+}
+
+// FuzzScannerFuncCompressed checks that whatever the log lines are, the
+// compressed query output framed as the agent does it is delivered intact, and
+// the control lines around it are still recognized.
+func FuzzScannerFuncCompressed(f *testing.F) {
+	addScannerSeeds(f, uint16(1), uint16(7), uint16(65535))
+
+	zstdEncoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		f.Fatalf("creating zstd encoder: %s", err)
+	}
+
+	f.Fuzz(func(t *testing.T, logs string, chunkSize uint16) {
+		markerPrefix := newMarkerPrefix()
+
+		if chunkSize == 0 {
+			chunkSize = 1
+		}
+
+		type payload struct {
+			marker string
+			data   []byte
+		}
+
+		var payloads []payload
+
+		// With no compression, the log contents end up in the gzip data as is,
+		// which is the worst case for the framing.
+		for _, level := range []int{gzip.NoCompression, gzip.BestSpeed} {
+			var gzBuf bytes.Buffer
+			gzWriter, err := gzip.NewWriterLevel(&gzBuf, level)
+			assert.NoError(t, err)
+			gzWriter.Write([]byte(logs))
+			gzWriter.Close()
+
+			payloads = append(payloads, payload{marker: markerGzip, data: gzBuf.Bytes()})
+		}
+
+		payloads = append(payloads, payload{
+			marker: markerZstd,
+			data:   zstdEncoder.EncodeAll([]byte(logs), nil),
+		})
+
+		for _, p := range payloads {
+			var data bytes.Buffer
+			data.WriteString("p:pid:123\n")
+			writeCompressedChunks(&data, markerPrefix+p.marker, p.data, int(chunkSize))
+			data.WriteString(markerPrefix + "command_done:1\n")
+
+			want := []string{"p:pid:123"}
+			want = append(want, splitTestLines(logs)...)
+			want = append(want, markerPrefix+"command_done:1")
+
+			assert.Equal(t, want, scanTestLines(markerPrefix, data.Bytes()), p.marker)
+		}
+	})
+}
+
+// FuzzScannerFuncPlain checks that the plain (not gzipped) log lines can
+// never be taken for control lines.
+func FuzzScannerFuncPlain(f *testing.F) {
+	addScannerSeeds(f)
+
+	f.Fuzz(func(t *testing.T, logs string) {
+		markerPrefix := newMarkerPrefix()
+
+		data := logs
+		if data != "" && !strings.HasSuffix(data, "\n") {
+			data += "\n"
+		}
+		data += markerPrefix + "command_done:1\n"
+
+		lines := scanTestLines(markerPrefix, []byte(data))
+
+		want := append(splitTestLines(logs), markerPrefix+"command_done:1")
+		assert.Equal(t, want, lines)
+
+		for _, line := range lines[:len(lines)-1] {
+			assert.False(t, strings.HasPrefix(line, markerPrefix), "line %q looks like a control line", line)
+		}
+	})
+}
+
+// FuzzScannerFuncGarbage feeds arbitrary data, with the known marker prefix,
+// so that the malformed gzip frames are exercised too: whatever the data is,
+// the scanner should never panic or hang.
+func FuzzScannerFuncGarbage(f *testing.F) {
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	f.Add([]byte(markerPrefix + "gzip:5\nhello" + markerPrefix + "gzip:0\n" + markerPrefix + "command_done:1\n"))
+	f.Add([]byte(markerPrefix + "gzip:5\nhello" + markerPrefix + "command_done:1\n"))
+	f.Add([]byte(markerPrefix + "gzip:2\n\x1f\x8b" + markerPrefix + "gzip:2\n\x08\x00" + markerPrefix + "gzip:0\n"))
+	f.Add([]byte(markerPrefix + "gzip:0\n"))
+	f.Add([]byte(markerPrefix + "zstd:4\n\x28\xb5\x2f\xfd" + markerPrefix + "zstd:0\n"))
+	f.Add([]byte(markerPrefix + "gzip:100\nshort"))
+	f.Add([]byte(markerPrefix + "gzip:-1\n"))
+	f.Add([]byte(markerPrefix + "gzip:abc\n"))
+	f.Add([]byte(markerPrefix + "gzip:99999999999999999999\n"))
+	f.Add([]byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scanTestLines(markerPrefix, data)
+	})
+}
+
+func TestScannerFuncCorruptedGzip(t *testing.T) {
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	// The payload is not gzip, but since it's framed, the lines after it are
+	// still fine.
+	data := markerPrefix + "gzip:5\nhello" + markerPrefix + "gzip:0\n" +
+		"after\n" + markerPrefix + "command_done:1\n"
+
+	lines := scanTestLines(markerPrefix, []byte(data))
+	if assert.Len(t, lines, 3) {
+		assert.True(t, strings.HasPrefix(lines[0], markerPrefix+"error:failed to gunzip data"), lines[0])
+		assert.Equal(t, []string{"after", markerPrefix + "command_done:1"}, lines[1:])
+	}
+}
+
+func TestScannerFuncUnterminatedGzip(t *testing.T) {
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	var gzBuf bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzBuf)
+	gzWriter.Write([]byte("foo\nbar\n"))
+	gzWriter.Close()
+
+	// The terminating chunk is missing, so the payload ends abruptly; the line
+	// which follows it should still be delivered.
+	data := markerPrefix + "gzip:" + strconv.Itoa(gzBuf.Len()) + "\n" + gzBuf.String() +
+		markerPrefix + "command_done:1\n"
+
+	lines := scanTestLines(markerPrefix, []byte(data))
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, []string{"foo", "bar"}, lines[:2])
+		assert.True(t, strings.HasPrefix(lines[2], markerPrefix+"error:"), lines[2])
+		assert.Equal(t, markerPrefix+"command_done:1", lines[3])
+	}
+}
+
+// TestScannerFuncStreamsGzip checks that the gzipped lines are delivered as
+// soon as their chunk is received, without waiting for the whole payload.
+func TestScannerFuncStreamsGzip(t *testing.T) {
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	linesCh := make(chan string)
+	go getScannerFunc("test", pr, markerPrefix, linesCh)()
+
+	var gzBuf bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzBuf)
+
+	nextLine := func() string {
+		select {
+		case line := <-linesCh:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a line")
+			return ""
+		}
+	}
+
+	for _, line := range []string{"first", "second"} {
+		gzWriter.Write([]byte(line + "\n"))
+		gzWriter.Flush()
+
+		go func(chunk []byte) {
+			io.WriteString(pw, markerPrefix+"gzip:"+strconv.Itoa(len(chunk))+"\n")
+			pw.Write(chunk)
+		}(append([]byte(nil), gzBuf.Bytes()...))
+		gzBuf.Reset()
+
+		assert.Equal(t, line, nextLine())
+	}
+
+	gzWriter.Close()
+	go func() {
+		writeCompressedChunks(pw, markerPrefix+markerGzip, gzBuf.Bytes(), 10)
+		io.WriteString(pw, markerPrefix+"command_done:1\n")
+		pw.Close()
+	}()
+
+	assert.Equal(t, markerPrefix+"command_done:1", nextLine())
+
+	_, ok := <-linesCh
+	assert.False(t, ok)
+}
+
+func TestScannerFuncLongLine(t *testing.T) {
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	long := strings.Repeat("x", maxLineLen+100)
+	exact := strings.Repeat("y", maxLineLen)
+
+	var gzBuf bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzBuf)
+	gzWriter.Write([]byte(long + "\nafter\n"))
+	gzWriter.Close()
+
+	var data bytes.Buffer
+	data.WriteString(long + "\n" + exact + "\n")
+	writeCompressedChunks(&data, markerPrefix+markerGzip, gzBuf.Bytes(), 65536)
+	data.WriteString(markerPrefix + "command_done:1\n")
+
+	lines := scanTestLines(markerPrefix, data.Bytes())
+	assert.Equal(t, []string{
+		long[:maxLineLen],
+		exact,
+		long[:maxLineLen],
+		"after",
+		markerPrefix + "command_done:1",
+	}, lines)
+}
@@ -12,6 +12,7 @@ type lstreamCmd struct {
 	bootstrap *lstreamCmdBootstrap
 	ping      *lstreamCmdPing
 	queryLogs *lstreamCmdQueryLogs
+	cleanup   *lstreamCmdCleanup
 }
 
 type lstreamCmdCtx struct {
@@ -22,6 +23,7 @@ type lstreamCmdCtx struct {
 	bootstrapCtx *lstreamCmdCtxBootstrap
 	pingCtx      *lstreamCmdCtxPing
 	queryLogsCtx *lstreamCmdCtxQueryLogs
+	cleanupCtx   *lstreamCmdCtxCleanup
 
 	// Initially, stdoutDoneIdx and stderrDoneIdx are set to false. Once we
 	// receive the "command_done" marker from either stdout or stderr, we set the
@@ -54,11 +56,38 @@ type lstreamCmdRes struct {
 	resp interface{}
 }
 
-type lstreamCmdBootstrap struct{}
+type lstreamCmdBootstrap struct {
+	// If uploadAgent is false, the agent is only checked to be present on the
+	// host; if it's not, the bootstrap is done again with uploadAgent set to
+	// true.
+	uploadAgent bool
+}
 
 type lstreamCmdCtxBootstrap struct {
 	receivedSuccess bool
 	receivedFailure bool
+
+	// agentUploadNeeded is set if the agent wasn't found on the host.
+	agentUploadNeeded bool
+	// agentExecFailed is set if the native agent failed to run on the host.
+	agentExecFailed bool
+
+	// arch is the host architecture as reported by "uname -m", and
+	// agentVariant is the name of the agent picked by the bootstrap script.
+	arch         string
+	agentVariant string
+
+	// workDir is the work dir on the host, as reported by the bootstrap script.
+	workDir string
+
+	// sudoPasswordRequired is set if the escalation command has failed because
+	// it needs a password (or the one we've given is wrong).
+	sudoPasswordRequired bool
+
+	// hostInfo is populated from the "cap:" and "logfile_info:" lines printed
+	// by the logstream_info command; it stays nil if there were no such lines
+	// (e.g. because the agent needs to be uploaded first).
+	hostInfo *HostInfo
 }
 
 type lstreamCmdPing struct{}
@@ -82,10 +111,29 @@ type lstreamCmdQueryLogs struct {
 type lstreamCmdCtxQueryLogs struct {
 	Resp *LogResp
 
+	// pid is the pid of the agent running the query, as printed by it in the
+	// "p:pid:" line; we need it to be able to cancel the query. Zero if we
+	// didn't receive it yet.
+	pid int
+
+	// cancelled is set to true once the query is cancelled. The agent is killed
+	// then, and whatever results we get are discarded.
+	cancelled bool
+
 	logfiles []logfileWithStartingLinenumber
 	lastTime time.Time
 }
 
+type lstreamCmdCleanup struct {
+	// dryRun and all are the same as in CleanupParams.
+	dryRun bool
+	all    bool
+}
+
+type lstreamCmdCtxCleanup struct {
+	Resp *CleanupResp
+}
+
 type logfileWithStartingLinenumber struct {
 	filename       string
 	fromLinenumber int
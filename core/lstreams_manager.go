@@ -16,6 +16,7 @@ import (
 
 var ErrBusyWithAnotherQuery = errors.Errorf("busy with another query")
 var ErrNotYetConnected = errors.Errorf("not connected to all lstreams yet")
+var ErrQueryCancelled = errors.Errorf("query cancelled")
 
 type LStreamsManager struct {
 	params LStreamsManagerParams
@@ -31,6 +32,13 @@ type LStreamsManager struct {
 	// lscBusyStages only contains items for lstreams which are in the
 	// LStreamClientStateConnectedBusy state.
 	lscBusyStages map[string]BusyStage
+	// lscConnStats only contains items for lstreams which are connected, and
+	// whose transport reports the stats.
+	lscConnStats map[string]ConnStats
+	// lscHostInfos contains the host info of the lstreams, as reported during
+	// the last bootstrap; it's kept after disconnecting too, since it might
+	// help to figure out why the lstream can't connect.
+	lscHostInfos map[string]*HostInfo
 
 	// lscPendingTeardown contains info about LStreamClient-s that are being torn
 	// down. NOTE that when a LStreamClient starts tearing down, its key changes
@@ -43,7 +51,6 @@ type LStreamsManager struct {
 
 	lstreamUpdatesCh chan *LStreamClientUpdate
 	reqCh            chan lstreamsManagerReq
-	respCh           chan lstreamCmdRes
 
 	// teardownReqCh is written to once when Close is called.
 	teardownReqCh chan struct{}
@@ -54,6 +61,7 @@ type LStreamsManager struct {
 	torndownCh chan struct{}
 
 	curQueryLogsCtx *manQueryLogsCtx
+	curCleanupCtx   *manCleanupCtx
 
 	curLogs manLogsCtx
 }
@@ -63,6 +71,11 @@ type LStreamsManagerParams struct {
 	// ~/.config/nerdlog/logstreams.yaml.
 	ConfigLogStreams ConfigLogStreams
 
+	// ConfigConnection contains the global connection settings (timeouts and
+	// the reconnect policy), which can be overridden per logstream in
+	// ConfigLogStreams. Optional.
+	ConfigConnection *ConfigConnection
+
 	// SSHConfig contains the general ssh config, typically coming from
 	// ~/.ssh/config.
 	SSHConfig *ssh_config.Config
@@ -78,7 +91,15 @@ type LStreamsManagerParams struct {
 	// files when using the tool concurrently on the same nodes.
 	ClientID string
 
+	// IndexTTLDays, if not zero, makes the agent delete the index files (of any
+	// clients) which weren't used for that many days.
+	IndexTTLDays int
+
 	UpdatesCh chan<- LStreamsManagerUpdate
+
+	// agentVariants are passed to the LStreamClient-s; see
+	// LStreamClientParams.agentVariants.
+	agentVariants *agentVariants
 }
 
 func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
@@ -91,11 +112,12 @@ func NewLStreamsManager(params LStreamsManagerParams) *LStreamsManager {
 		lscStates:          map[string]LStreamClientState{},
 		lscConnDetails:     map[string]ConnDetails{},
 		lscBusyStages:      map[string]BusyStage{},
+		lscConnStats:       map[string]ConnStats{},
+		lscHostInfos:       map[string]*HostInfo{},
 		lscPendingTeardown: map[string]int{},
 
 		lstreamUpdatesCh: make(chan *LStreamClientUpdate, 1024),
 		reqCh:            make(chan lstreamsManagerReq, 8),
-		respCh:           make(chan lstreamCmdRes),
 
 		teardownReqCh: make(chan struct{}, 1),
 		torndownCh:    make(chan struct{}, 1),
@@ -124,6 +146,7 @@ func (lsman *LStreamsManager) setLStreams(lstreamsStr string) error {
 		CurOSUser: u.Username,
 
 		ConfigLogStreams: lsman.params.ConfigLogStreams,
+		ConfigConnection: lsman.params.ConfigConnection,
 		SSHConfig:        lsman.params.SSHConfig,
 	})
 
@@ -153,6 +176,8 @@ func (lsman *LStreamsManager) updateHAs() {
 		delete(lsman.lscStates, key)
 		delete(lsman.lscConnDetails, key)
 		delete(lsman.lscBusyStages, key)
+		delete(lsman.lscConnStats, key)
+		delete(lsman.lscHostInfos, key)
 
 		keyNew := fmt.Sprintf("OLD_%s_%s", randomString(4), key)
 		lsman.lscPendingTeardown[keyNew] += 1
@@ -172,6 +197,10 @@ func (lsman *LStreamsManager) updateHAs() {
 			Logger:    lsman.params.Logger,
 			ClientID:  lsman.params.ClientID, //fmt.Sprintf("%s-%d", lsman.params.ClientID, rand.Int()),
 			UpdatesCh: lsman.lstreamUpdatesCh,
+
+			IndexTTLDays: lsman.params.IndexTTLDays,
+
+			agentVariants: lsman.params.agentVariants,
 		})
 		lsman.lscs[key] = lsc
 		lsman.lscStates[key] = LStreamClientStateDisconnected
@@ -208,6 +237,11 @@ func (lsman *LStreamsManager) run() {
 					if upd.State.NewState != LStreamClientStateConnectedBusy {
 						delete(lsman.lscBusyStages, upd.Name)
 					}
+
+					// Maintain lsman.lscConnStats
+					if !isStateConnected(upd.State.NewState) {
+						delete(lsman.lscConnStats, upd.Name)
+					}
 				} else if _, ok := lsman.lscPendingTeardown[upd.Name]; ok {
 					lsman.params.Logger.Verbose1f(
 						"Got state update from tearing-down %s: %s -> %s",
@@ -226,19 +260,37 @@ func (lsman *LStreamsManager) run() {
 				lsman.params.Logger.Verbose1f("ConnDetails for %s: %+v", upd.Name, *upd.ConnDetails)
 				lsman.lscConnDetails[upd.Name] = *upd.ConnDetails
 				lsman.sendStateUpdate()
+			} else if upd.ConnStats != nil {
+				if _, ok := lsman.lscStates[upd.Name]; ok {
+					lsman.lscConnStats[upd.Name] = *upd.ConnStats
+					lsman.sendStateUpdate()
+				}
 			} else if upd.BootstrapDetails != nil {
 				lsman.params.Logger.Verbose1f("BootstrapDetails for %s: %+v", upd.Name, *upd.BootstrapDetails)
 
-				upd := LStreamsManagerUpdate{
-					BootstrapIssue: &BootstrapIssue{
-						LStreamName: upd.Name,
-						Err:         upd.BootstrapDetails.Err,
-					},
+				if upd.BootstrapDetails.HostInfo != nil {
+					if _, ok := lsman.lscStates[upd.Name]; ok {
+						lsman.lscHostInfos[upd.Name] = upd.BootstrapDetails.HostInfo
+						lsman.sendStateUpdate()
+					}
+				}
+
+				if upd.BootstrapDetails.Err != "" {
+					lsman.params.UpdatesCh <- LStreamsManagerUpdate{
+						BootstrapIssue: &BootstrapIssue{
+							LStreamName: upd.Name,
+							Err:         upd.BootstrapDetails.Err,
+						},
+					}
 				}
-				lsman.params.UpdatesCh <- upd
 			} else if upd.BusyStage != nil {
 				lsman.lscBusyStages[upd.Name] = *upd.BusyStage
 				lsman.sendStateUpdate()
+			} else if upd.UserPrompt != nil {
+				lsman.params.Logger.Verbose1f("UserPrompt for %s: %s", upd.Name, upd.UserPrompt.Title)
+				lsman.params.UpdatesCh <- LStreamsManagerUpdate{
+					UserPrompt: upd.UserPrompt,
+				}
 			} else if upd.TornDown {
 				// One of our LStreamClient-s has just shut down, account for it properly.
 				lsman.lscPendingTeardown[upd.Name] -= 1
@@ -300,14 +352,34 @@ func (lsman *LStreamsManager) run() {
 					continue
 				}
 
+				// Figure which logstreams to query: normally all of them must be
+				// connected, but with SkipUnreachable, we just query the connected
+				// ones.
+				queryLSCs := lsman.lscs
+				var unreachable []string
 				if lsman.numNotConnected > 0 {
-					lsman.sendLogRespUpdate(&LogRespTotal{
-						Errs: []error{ErrNotYetConnected},
-					})
-					continue
+					if req.queryLogs.SkipUnreachable {
+						queryLSCs = make(map[string]*LStreamClient, len(lsman.lscs))
+						for name, lsc := range lsman.lscs {
+							if isStateConnected(lsman.lscStates[name]) {
+								queryLSCs[name] = lsc
+							} else {
+								unreachable = append(unreachable, name)
+							}
+						}
+
+						sort.Strings(unreachable)
+					}
+
+					if len(unreachable) == 0 || len(queryLSCs) == 0 {
+						lsman.sendLogRespUpdate(&LogRespTotal{
+							Errs: []error{ErrNotYetConnected},
+						})
+						continue
+					}
 				}
 
-				if lsman.curQueryLogsCtx != nil {
+				if lsman.curQueryLogsCtx != nil || lsman.curCleanupCtx != nil {
 					lsman.sendLogRespUpdate(&LogRespTotal{
 						Errs: []error{ErrBusyWithAnotherQuery},
 					})
@@ -319,16 +391,23 @@ func (lsman *LStreamsManager) run() {
 				}
 
 				lsman.curQueryLogsCtx = &manQueryLogsCtx{
-					req:       req.queryLogs,
-					startTime: time.Now(),
-					resps:     make(map[string]*LogResp, len(lsman.lscs)),
-					errs:      map[string]error{},
+					req:         req.queryLogs,
+					respCh:      make(chan lstreamCmdRes, len(queryLSCs)),
+					startTime:   time.Now(),
+					lstreams:    make(map[string]struct{}, len(queryLSCs)),
+					unreachable: unreachable,
+					resps:       make(map[string]*LogResp, len(queryLSCs)),
+					errs:        map[string]error{},
+				}
+
+				for lstreamName := range queryLSCs {
+					lsman.curQueryLogsCtx.lstreams[lstreamName] = struct{}{}
 				}
 
 				// sendStateUpdate must be done after setting curQueryLogsCtx.
 				lsman.sendStateUpdate()
 
-				for lstreamName, lsc := range lsman.lscs {
+				for lstreamName, lsc := range queryLSCs {
 					var linesUntil int
 					if req.queryLogs.LoadEarlier {
 						// TODO: right now, this loadEarlier case isn't optimized at all:
@@ -356,7 +435,7 @@ func (lsman *LStreamsManager) run() {
 					}
 
 					lsc.EnqueueCmd(lstreamCmd{
-						respCh: lsman.respCh,
+						respCh: lsman.curQueryLogsCtx.respCh,
 						queryLogs: &lstreamCmdQueryLogs{
 							maxNumLines: req.queryLogs.MaxNumLines,
 
@@ -373,7 +452,7 @@ func (lsman *LStreamsManager) run() {
 				r := req.updLStreams
 				lsman.params.Logger.Infof("LStreams manager: update logstreams spec: %s", r.logStreamsSpec)
 
-				if lsman.curQueryLogsCtx != nil {
+				if lsman.curQueryLogsCtx != nil || lsman.curCleanupCtx != nil {
 					r.resCh <- ErrBusyWithAnotherQuery
 					continue
 				}
@@ -389,6 +468,57 @@ func (lsman *LStreamsManager) run() {
 
 				r.resCh <- nil
 
+			case req.cancelQuery:
+				if lsman.curQueryLogsCtx == nil {
+					lsman.params.Logger.Infof("Cancel command, but there is no query in progress")
+					continue
+				}
+
+				lsman.params.Logger.Infof("Cancelling the in-progress query")
+				lsman.cancelQuery()
+
+				// sendStateUpdate must be done after setting curQueryLogsCtx.
+				lsman.sendStateUpdate()
+
+			case req.cleanup != nil:
+				lsman.params.Logger.Infof("Cleanup command (dry run: %v)", req.cleanup.DryRun)
+
+				if lsman.curQueryLogsCtx != nil || lsman.curCleanupCtx != nil {
+					lsman.params.UpdatesCh <- LStreamsManagerUpdate{
+						CleanupResp: &CleanupRespTotal{
+							DryRun: req.cleanup.DryRun,
+							Errs:   []error{ErrBusyWithAnotherQuery},
+						},
+					}
+					continue
+				}
+
+				lsman.curCleanupCtx = &manCleanupCtx{
+					params:  *req.cleanup,
+					respCh:  make(chan lstreamCmdRes, len(lsman.lscs)),
+					resps:   map[string]*CleanupResp{},
+					errs:    map[string]error{},
+					pending: map[string]struct{}{},
+				}
+
+				for name, lsc := range lsman.lscs {
+					if !isStateConnected(lsman.lscStates[name]) {
+						lsman.curCleanupCtx.errs[name] = errors.Errorf("not connected")
+						continue
+					}
+
+					lsman.curCleanupCtx.pending[name] = struct{}{}
+					lsc.EnqueueCmd(lstreamCmd{
+						respCh: lsman.curCleanupCtx.respCh,
+						cleanup: &lstreamCmdCleanup{
+							dryRun: req.cleanup.DryRun,
+							all:    req.cleanup.All,
+						},
+					})
+				}
+
+				lsman.sendCleanupRespIfDone()
+
 			case req.ping:
 				for _, lsc := range lsman.lscs {
 					lsc.EnqueueCmd(lstreamCmd{
@@ -399,8 +529,11 @@ func (lsman *LStreamsManager) run() {
 			case req.reconnect:
 				lsman.params.Logger.Infof("Reconnect command")
 				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
+					lsman.params.Logger.Infof("Cancelling the in-progress query")
+					lsman.cancelQuery()
+				}
+				if lsman.curCleanupCtx != nil {
+					lsman.abortCleanup()
 				}
 				for _, lsc := range lsman.lscs {
 					lsc.Reconnect()
@@ -415,8 +548,11 @@ func (lsman *LStreamsManager) run() {
 			case req.disconnect:
 				lsman.params.Logger.Infof("Disconnect command")
 				if lsman.curQueryLogsCtx != nil {
-					lsman.params.Logger.Infof("Forgetting the in-progress query")
-					lsman.curQueryLogsCtx = nil
+					lsman.params.Logger.Infof("Cancelling the in-progress query")
+					lsman.cancelQuery()
+				}
+				if lsman.curCleanupCtx != nil {
+					lsman.abortCleanup()
 				}
 				lsman.setLStreams("")
 
@@ -425,49 +561,59 @@ func (lsman *LStreamsManager) run() {
 				lsman.sendStateUpdate()
 			}
 
-		case resp := <-lsman.respCh:
+		case resp := <-lsman.getQueryRespCh():
 			lsman.params.Logger.Verbose1f("Got a response from %v: %+v", resp.hostname, resp)
 
-			switch {
-			case lsman.curQueryLogsCtx != nil:
-				if resp.err != nil {
-					lsman.params.Logger.Errorf("Got an error response from %v: %s", resp.hostname, resp.err)
-					lsman.curQueryLogsCtx.errs[resp.hostname] = resp.err
-				}
-
+			if resp.err != nil {
+				lsman.params.Logger.Errorf("Got an error response from %v: %s", resp.hostname, resp.err)
+				lsman.curQueryLogsCtx.errs[resp.hostname] = resp.err
+			} else {
 				switch v := resp.resp.(type) {
 				case *LogResp:
 					lsman.curQueryLogsCtx.resps[resp.hostname] = v
 
-					// If we collected responses from all nodes, handle them.
-					if len(lsman.curQueryLogsCtx.resps) == len(lsman.lscs) {
-						lsman.params.Logger.Verbose1f(
-							"Got logs from %v, this was the last one, query is completed",
-							resp.hostname,
-						)
+				default:
+					panic(fmt.Sprintf("unexpected resp type %T", v))
+				}
+			}
 
-						lsman.mergeLogRespsAndSend()
+			// If we collected responses from all nodes, handle them.
+			numResps := len(lsman.curQueryLogsCtx.resps) + len(lsman.curQueryLogsCtx.errs)
+			if numResps == len(lsman.curQueryLogsCtx.lstreams) {
+				lsman.params.Logger.Verbose1f(
+					"Got response from %v, this was the last one, query is completed",
+					resp.hostname,
+				)
 
-						lsman.curQueryLogsCtx = nil
+				lsman.mergeLogRespsAndSend(true)
 
-						// sendStateUpdate must be done after setting curQueryLogsCtx.
-						lsman.sendStateUpdate()
-					} else {
-						lsman.params.Logger.Verbose1f(
-							"Got logs from %v, %d more to go",
-							resp.hostname,
-							len(lsman.lscs)-len(lsman.curQueryLogsCtx.resps),
-						)
-					}
+				lsman.curQueryLogsCtx = nil
 
-				default:
-					panic(fmt.Sprintf("unexpected resp type %T", v))
+				// sendStateUpdate must be done after setting curQueryLogsCtx.
+				lsman.sendStateUpdate()
+			} else {
+				lsman.params.Logger.Verbose1f(
+					"Got response from %v, %d more to go",
+					resp.hostname,
+					len(lsman.curQueryLogsCtx.lstreams)-numResps,
+				)
+
+				if lsman.curQueryLogsCtx.req.Progressive {
+					lsman.mergeLogRespsAndSend(false)
 				}
+			}
 
-			default:
-				lsman.params.Logger.Errorf("Dropping update from %s on the floor", resp.hostname)
+		case resp := <-lsman.getCleanupRespCh():
+			if resp.err != nil {
+				lsman.params.Logger.Errorf("Got a cleanup error from %v: %s", resp.hostname, resp.err)
+				lsman.curCleanupCtx.errs[resp.hostname] = resp.err
+			} else {
+				lsman.curCleanupCtx.resps[resp.hostname] = resp.resp.(*CleanupResp)
 			}
 
+			delete(lsman.curCleanupCtx.pending, resp.hostname)
+			lsman.sendCleanupRespIfDone()
+
 		case <-lsman.teardownReqCh:
 			lsman.params.Logger.Infof("LStreamsManager teardown is started")
 			lsman.tearingDown = true
@@ -491,6 +637,67 @@ func (lsman *LStreamsManager) run() {
 	}
 }
 
+// cancelQuery cancels the query in progress; it must not be nil. The
+// responses to the cancelled query (if any) will go to its own respCh, which
+// nobody reads anymore, so the next query can be started right away.
+func (lsman *LStreamsManager) cancelQuery() {
+	for _, lsc := range lsman.lscs {
+		lsc.CancelQuery(lsman.curQueryLogsCtx.respCh)
+	}
+
+	lsman.curQueryLogsCtx = nil
+}
+
+// getQueryRespCh returns the respCh of the query in progress, or nil if
+// there's no query.
+func (lsman *LStreamsManager) getQueryRespCh() chan lstreamCmdRes {
+	if lsman.curQueryLogsCtx == nil {
+		return nil
+	}
+
+	return lsman.curQueryLogsCtx.respCh
+}
+
+// sendCleanupRespIfDone sends the results of the cleanup in progress if all
+// the logstreams have responded.
+func (lsman *LStreamsManager) sendCleanupRespIfDone() {
+	cctx := lsman.curCleanupCtx
+	if len(cctx.pending) > 0 {
+		return
+	}
+
+	lsman.curCleanupCtx = nil
+
+	lsman.params.UpdatesCh <- LStreamsManagerUpdate{
+		CleanupResp: &CleanupRespTotal{
+			DryRun:      cctx.params.DryRun,
+			Resps:       cctx.resps,
+			LStreamErrs: cctx.errs,
+		},
+	}
+}
+
+// abortCleanup finishes the cleanup in progress right away, without waiting
+// for the remaining logstreams; they are reported as failed.
+func (lsman *LStreamsManager) abortCleanup() {
+	for name := range lsman.curCleanupCtx.pending {
+		lsman.curCleanupCtx.errs[name] = errors.Errorf("cleanup aborted")
+	}
+
+	lsman.curCleanupCtx.pending = nil
+	lsman.sendCleanupRespIfDone()
+}
+
+// getCleanupRespCh returns the respCh of the cleanup in progress, or nil if
+// there's no cleanup.
+func (lsman *LStreamsManager) getCleanupRespCh() chan lstreamCmdRes {
+	if lsman.curCleanupCtx == nil {
+		return nil
+	}
+
+	return lsman.curCleanupCtx.respCh
+}
+
 func (lsman *LStreamsManager) getNumLStreamClientsTearingDown() int {
 	numPending := 0
 	for _, v := range lsman.lscPendingTeardown {
@@ -519,6 +726,8 @@ type lstreamsManagerReq struct {
 
 	queryLogs   *QueryLogsParams
 	updLStreams *lstreamsManagerReqUpdLStreams
+	cleanup     *CleanupParams
+	cancelQuery bool
 	ping        bool
 	reconnect   bool
 	disconnect  bool
@@ -536,6 +745,15 @@ func (lsman *LStreamsManager) QueryLogs(params QueryLogsParams) {
 	}
 }
 
+// Cleanup deletes (or with DryRun, only lists) the files which nerdlog has
+// left on the logstream hosts; the result is delivered as the CleanupResp
+// update. Only the connected logstreams are cleaned up.
+func (lsman *LStreamsManager) Cleanup(params CleanupParams) {
+	lsman.reqCh <- lstreamsManagerReq{
+		cleanup: &params,
+	}
+}
+
 func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
 	resCh := make(chan error, 1)
 
@@ -549,6 +767,15 @@ func (lsman *LStreamsManager) SetLStreams(logStreamsSpec string) error {
 	return <-resCh
 }
 
+// CancelQuery cancels the query in progress, if any: the agents running it
+// are killed, and the LStreamsManager is ready for the next query right away.
+// The cancelled query doesn't produce any LogResp.
+func (lsman *LStreamsManager) CancelQuery() {
+	lsman.reqCh <- lstreamsManagerReq{
+		cancelQuery: true,
+	}
+}
+
 func (lsman *LStreamsManager) Ping() {
 	lsman.reqCh <- lstreamsManagerReq{
 		ping: true,
@@ -570,14 +797,40 @@ func (lsman *LStreamsManager) Disconnect() {
 type manQueryLogsCtx struct {
 	req *QueryLogsParams
 
+	// respCh receives the responses from all the LStreamClient-s. Every query
+	// has its own respCh, so that the responses to a cancelled or forgotten
+	// query can't be confused with the responses to the next one.
+	respCh chan lstreamCmdRes
+
 	startTime time.Time
 
+	// lstreams contains the names of the logstreams being queried; usually
+	// it's all of them, but with SkipUnreachable, only the connected ones.
+	lstreams map[string]struct{}
+	// unreachable contains the sorted names of the logstreams which were
+	// skipped because they weren't connected.
+	unreachable []string
+
 	// resps is a map from logstream name to its response. Once all responses have
 	// been collected, we'll start merging them together.
 	resps map[string]*LogResp
 	errs  map[string]error
 }
 
+type manCleanupCtx struct {
+	params CleanupParams
+
+	// respCh receives the responses from all the LStreamClient-s, same as
+	// manQueryLogsCtx.respCh.
+	respCh chan lstreamCmdRes
+
+	// pending contains the names of the logstreams which didn't respond yet.
+	pending map[string]struct{}
+
+	resps map[string]*CleanupResp
+	errs  map[string]error
+}
+
 type manLogsCtx struct {
 	minuteStats  map[int64]MinuteStatsItem
 	numMsgsTotal int
@@ -596,7 +849,14 @@ type LStreamsManagerUpdate struct {
 	State   *LStreamsManagerState
 	LogResp *LogRespTotal
 
+	// CleanupResp is the result of Cleanup.
+	CleanupResp *CleanupRespTotal
+
 	BootstrapIssue *BootstrapIssue
+
+	// UserPrompt is a question from one of the logstreams to the user; the
+	// client code must eventually call UserPrompt.Respond.
+	UserPrompt *UserPrompt
 }
 
 type LStreamsManagerState struct {
@@ -620,6 +880,15 @@ type LStreamsManagerState struct {
 	ConnDetailsByLStream map[string]ConnDetails
 	BusyStageByLStream   map[string]BusyStage
 
+	// ConnStatsByLStream contains the connection stats (like the round-trip
+	// time) of the connected lstreams, for those transports which report them.
+	ConnStatsByLStream map[string]ConnStats
+
+	// HostInfoByLStream contains the host info (the available tools, the log
+	// files etc) of the lstreams, as reported during the last bootstrap. The
+	// HostInfo values must not be modified.
+	HostInfoByLStream map[string]*HostInfo
+
 	// TearingDown contains logstream names whic are in the process of teardown.
 	TearingDown []string
 }
@@ -666,6 +935,16 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 		busyStagesCopy[k] = v
 	}
 
+	connStatsCopy := make(map[string]ConnStats, len(lsman.lscConnStats))
+	for k, v := range lsman.lscConnStats {
+		connStatsCopy[k] = v
+	}
+
+	hostInfosCopy := make(map[string]*HostInfo, len(lsman.lscHostInfos))
+	for k, v := range lsman.lscHostInfos {
+		hostInfosCopy[k] = v
+	}
+
 	tearingDown := make([]string, 0, len(lsman.lscPendingTeardown))
 	for k, num := range lsman.lscPendingTeardown {
 		for i := 0; i < num; i++ {
@@ -684,6 +963,8 @@ func (lsman *LStreamsManager) sendStateUpdate() {
 			Busy:                 lsman.curQueryLogsCtx != nil,
 			ConnDetailsByLStream: connDetailsCopy,
 			BusyStageByLStream:   busyStagesCopy,
+			ConnStatsByLStream:   connStatsCopy,
+			HostInfoByLStream:    hostInfosCopy,
 			TearingDown:          tearingDown,
 		},
 	}
@@ -701,11 +982,24 @@ func (lsman *LStreamsManager) sendLogRespUpdate(resp *LogRespTotal) {
 	}
 }
 
-func (lsman *LStreamsManager) mergeLogRespsAndSend() {
+// mergeLogRespsAndSend merges the responses received so far and sends the
+// result. If final is false, it's an intermediate update of a progressive
+// query: the logstreams which didn't respond yet are listed in
+// PendingLStreams, and the merged logs are not remembered (so that the
+// "load earlier" queries keep working on the final results only).
+func (lsman *LStreamsManager) mergeLogRespsAndSend(final bool) {
 	resps := lsman.curQueryLogsCtx.resps
 	errs := lsman.curQueryLogsCtx.errs
 
-	if len(errs) != 0 {
+	// If all logstreams failed, there's nothing to show but the errors. If only
+	// some of them did, the rest of the logs are still useful, so we send what
+	// we have, together with the per-logstream errors.
+	if len(resps) == 0 {
+		if !final {
+			// Nothing to show yet.
+			return
+		}
+
 		errs2 := make([]error, 0, len(errs))
 		for hostname, err := range errs {
 			errs2 = append(errs2, errors.Annotatef(err, "%s", hostname))
@@ -722,46 +1016,92 @@ func (lsman *LStreamsManager) mergeLogRespsAndSend() {
 		return
 	}
 
+	var curLogs manLogsCtx
+
 	// If we're not adding to already existing logs, reset w/e we've had already,
 	// and calculate minuteStats from the resps.
 	if !lsman.curQueryLogsCtx.req.LoadEarlier {
-		lsman.curLogs = manLogsCtx{
+		curLogs = manLogsCtx{
 			minuteStats: map[int64]MinuteStatsItem{},
 			perNode:     map[string]*manLogsNodeCtx{},
 		}
 
 		for nodeName, resp := range resps {
 			for k, v := range resp.MinuteStats {
-				lsman.curLogs.minuteStats[k] = MinuteStatsItem{
-					NumMsgs: lsman.curLogs.minuteStats[k].NumMsgs + v.NumMsgs,
+				curLogs.minuteStats[k] = MinuteStatsItem{
+					NumMsgs: curLogs.minuteStats[k].NumMsgs + v.NumMsgs,
 				}
 
-				lsman.curLogs.numMsgsTotal += v.NumMsgs
+				curLogs.numMsgsTotal += v.NumMsgs
 			}
 
-			lsman.curLogs.perNode[nodeName] = &manLogsNodeCtx{
+			curLogs.perNode[nodeName] = &manLogsNodeCtx{
 				logs:          resp.Logs,
 				isMaxNumLines: len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines,
 			}
 		}
 	} else {
-		// Add to existing logs
+		// Add to existing logs. The perNode items are copied, since the
+		// intermediate results must not affect the existing ones.
+		curLogs = lsman.curLogs
+		curLogs.perNode = make(map[string]*manLogsNodeCtx, len(lsman.curLogs.perNode))
+		for nodeName, pn := range lsman.curLogs.perNode {
+			pnCopy := *pn
+			curLogs.perNode[nodeName] = &pnCopy
+		}
+
 		for nodeName, resp := range resps {
-			pn := lsman.curLogs.perNode[nodeName]
-			pn.logs = append(resp.Logs, pn.logs...)
+			pn := curLogs.perNode[nodeName]
+			if pn == nil {
+				// This logstream failed during the initial query, so we have no logs
+				// from it yet.
+				pn = &manLogsNodeCtx{}
+				curLogs.perNode[nodeName] = pn
+			}
+
+			logs := make([]LogMsg, 0, len(resp.Logs)+len(pn.logs))
+			logs = append(logs, resp.Logs...)
+			logs = append(logs, pn.logs...)
+
+			pn.logs = logs
 			pn.isMaxNumLines = len(resp.Logs) == lsman.curQueryLogsCtx.req.MaxNumLines
 		}
 	}
 
+	if final {
+		lsman.curLogs = curLogs
+	}
+
 	ret := &LogRespTotal{
-		MinuteStats:   lsman.curLogs.minuteStats,
-		NumMsgsTotal:  lsman.curLogs.numMsgsTotal,
+		MinuteStats:   curLogs.minuteStats,
+		NumMsgsTotal:  curLogs.numMsgsTotal,
 		LoadedEarlier: lsman.curQueryLogsCtx.req.LoadEarlier,
 	}
 
+	ret.UnreachableLStreams = lsman.curQueryLogsCtx.unreachable
+
+	if len(errs) > 0 {
+		ret.LStreamErrs = make(map[string]error, len(errs))
+		for lstreamName, err := range errs {
+			ret.LStreamErrs[lstreamName] = err
+		}
+	}
+
+	if !final {
+		for lstreamName := range lsman.curQueryLogsCtx.lstreams {
+			_, gotResp := resps[lstreamName]
+			_, gotErr := errs[lstreamName]
+			if !gotResp && !gotErr {
+				ret.PendingLStreams = append(ret.PendingLStreams, lstreamName)
+			}
+		}
+
+		sort.Strings(ret.PendingLStreams)
+	}
+
 	var logsCoveredSince time.Time
 
-	for _, pn := range lsman.curLogs.perNode {
+	for _, pn := range curLogs.perNode {
 		ret.Logs = append(ret.Logs, pn.logs...)
 
 		// If the timespan covered by logs from this logstream is shorter than what
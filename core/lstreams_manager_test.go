@@ -0,0 +1,981 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// TestLStreamsManagerLocalQuery goes through the whole query path: the
+// resolver, the LStreamsManager, the LStreamClient with its bootstrap, and
+// the agent script, using the local transport so that no network is needed.
+func TestLStreamsManagerLocalQuery(t *testing.T) {
+	testLStreamsManagerQuery(t, func(logFname string) (string, []string) {
+		spec := "local:" + logFname
+		return spec, []string{spec}
+	})
+}
+
+// TestLStreamsManagerDockerQuery is the same as TestLStreamsManagerLocalQuery,
+// but with a docker logstream; the fake docker binary just runs the command
+// locally.
+func TestLStreamsManagerDockerQuery(t *testing.T) {
+	binDir := t.TempDir()
+	argsFname := filepath.Join(binDir, "docker_args")
+
+	fakeDocker := `#!/bin/sh
+echo "$@" >> "` + argsFname + `"
+[ "$1" = "exec" ] && [ "$2" = "-i" ] || exit 1
+shift 3
+exec "$@"
+`
+	if err := os.WriteFile(filepath.Join(binDir, "docker"), []byte(fakeDocker), 0755); err != nil {
+		t.Fatalf("writing fake docker: %s", err)
+	}
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	testLStreamsManagerQuery(t, func(logFname string) (string, []string) {
+		spec := "docker://myctr:" + logFname
+		return spec, []string{spec}
+	})
+
+	args, err := os.ReadFile(argsFname)
+	assert.NoError(t, err)
+	assert.Equal(t, "exec -i myctr bash\n", string(args))
+}
+
+// TestLStreamsManagerK8sQuery is the same as TestLStreamsManagerLocalQuery,
+// but with a k8s logstream; the fake kubectl just runs the command locally.
+//
+// Only one pod is running here: the fake pods would share the filesystem,
+// and thus the agent's files, while the real ones don't.
+func TestLStreamsManagerK8sQuery(t *testing.T) {
+	setupFakeKubectl(t, `{"items": [
+		{"metadata": {"name": "web-7d9f-a1"}, "status": {"phase": "Running"}},
+		{"metadata": {"name": "web-7d9f-b2"}, "status": {"phase": "Failed"}}
+	]}`)
+
+	testLStreamsManagerQuery(t, func(logFname string) (string, []string) {
+		return "k8s://myns/app=web:" + logFname, []string{"web-7d9f-a1"}
+	})
+}
+
+// testLStreamsManagerQuery creates a log file, connects to it using the
+// logstream spec returned by makeSpec, runs a query and checks the results.
+// Besides the spec, makeSpec returns the names of the logstreams it expands
+// into; all of them are expected to have the same logs.
+func testLStreamsManagerQuery(
+	t *testing.T, makeSpec func(logFname string) (spec string, lstreamNames []string),
+) {
+	t.Helper()
+
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstreamsSpec, lstreamNames := makeSpec(logFname)
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstreamsSpec)
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, lstreamNames, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerCancelQuery checks that after cancelling a query, the
+// next one can be started right away, and that only the results of the next
+// one are delivered.
+func TestLStreamsManagerCancelQuery(t *testing.T) {
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstreamsSpec := "local:" + logFname
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstreamsSpec)
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+	lsman.CancelQuery()
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [6-7]/",
+	})
+
+	upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{lstreamsSpec}, firstMsgTime, 6, 2)
+
+	// Cancelling when there's no query is a no-op, and the next query works.
+	lsman.CancelQuery()
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{lstreamsSpec}, firstMsgTime, 3, 3)
+}
+
+// writeTestLogFile writes a log file with 10 messages "message 0" to
+// "message 9", one per minute starting at the returned time, and ending a few
+// minutes ago.
+func writeTestLogFile(t *testing.T) (string, time.Time) {
+	t.Helper()
+
+	const numMsgs = 10
+	firstMsgTime := time.Now().UTC().Truncate(time.Minute).Add(-(numMsgs + 5) * time.Minute)
+
+	var sb strings.Builder
+	for i := 0; i < numMsgs; i++ {
+		fmt.Fprintf(
+			&sb, "%s myhost myprogram[123]: message %d\n",
+			firstMsgTime.Add(time.Duration(i)*time.Minute).Format("2006-01-02T15:04:05.000000-07:00"), i,
+		)
+	}
+
+	logFname := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(logFname, []byte(sb.String()), 0644); err != nil {
+		t.Fatalf("writing log file: %s", err)
+	}
+
+	return logFname, firstMsgTime
+}
+
+// newTestLStreamsManager creates the LStreamsManager for the given logstreams
+// spec and waits for it to connect; the LStreamsManager is closed when the
+// test finishes. The returned waitUpdate func returns the first update for
+// which the given func returns true.
+func newTestLStreamsManager(
+	t *testing.T, lstreamsSpec string,
+) (*LStreamsManager, func(what string, f func(upd LStreamsManagerUpdate) bool) LStreamsManagerUpdate) {
+	t.Helper()
+
+	lsman, waitUpdate := startTestLStreamsManager(t, lstreamsSpec)
+
+	waitUpdate("connection", func(upd LStreamsManagerUpdate) bool {
+		return upd.State != nil && upd.State.Connected
+	})
+
+	return lsman, waitUpdate
+}
+
+// startTestLStreamsManager is like newTestLStreamsManager, but doesn't wait
+// for the connection.
+func startTestLStreamsManager(
+	t *testing.T, lstreamsSpec string,
+) (*LStreamsManager, func(what string, f func(upd LStreamsManagerUpdate) bool) LStreamsManagerUpdate) {
+	t.Helper()
+
+	return startTestLStreamsManagerWithConfig(t, lstreamsSpec, nil)
+}
+
+// startTestLStreamsManagerWithConfig is like startTestLStreamsManager, but
+// also takes the logstreams config.
+func startTestLStreamsManagerWithConfig(
+	t *testing.T, lstreamsSpec string, configLogStreams ConfigLogStreams,
+) (*LStreamsManager, func(what string, f func(upd LStreamsManagerUpdate) bool) LStreamsManagerUpdate) {
+	t.Helper()
+
+	// Unless the test is about the native agents, use the shell one, so that the
+	// tests don't depend on whether the native agents were built.
+	return startTestLStreamsManagerWithAgents(
+		t, lstreamsSpec, configLogStreams, newAgentVariants(fstest.MapFS{}, "."),
+	)
+}
+
+// startTestLStreamsManagerWithAgents is like
+// startTestLStreamsManagerWithConfig, but also takes the agents to use.
+func startTestLStreamsManagerWithAgents(
+	t *testing.T, lstreamsSpec string, configLogStreams ConfigLogStreams, agents *agentVariants,
+) (*LStreamsManager, func(what string, f func(upd LStreamsManagerUpdate) bool) LStreamsManagerUpdate) {
+	t.Helper()
+
+	if _, err := exec.LookPath("gawk"); err != nil {
+		t.Skip("gawk is not available")
+	}
+
+	t.Setenv("TZ", "UTC")
+
+	// Make the agent keep its files in a temporary dir, see testWorkDir.
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+
+	updatesCh := make(chan LStreamsManagerUpdate, 128)
+	lsman := NewLStreamsManager(LStreamsManagerParams{
+		Logger:           log.NewLogger(log.Error),
+		ConfigLogStreams: configLogStreams,
+		InitialLStreams:  lstreamsSpec,
+		ClientID:         "test_" + randomString(8),
+		UpdatesCh:        updatesCh,
+
+		agentVariants: agents,
+	})
+
+	t.Cleanup(func() {
+		lsman.Close()
+
+		torndownCh := make(chan struct{})
+		go func() {
+			lsman.Wait()
+			close(torndownCh)
+		}()
+
+		for {
+			select {
+			case <-updatesCh:
+			case <-torndownCh:
+				return
+			}
+		}
+	})
+
+	waitUpdate := func(what string, f func(upd LStreamsManagerUpdate) bool) LStreamsManagerUpdate {
+		timeout := time.After(20 * time.Second)
+		for {
+			select {
+			case upd := <-updatesCh:
+				if upd.BootstrapIssue != nil {
+					t.Fatalf("bootstrap issue: %s", upd.BootstrapIssue.Err)
+				}
+
+				if f(upd) {
+					return upd
+				}
+
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+
+	return lsman, waitUpdate
+}
+
+// testWorkDir returns the work dir of the local logstreams created by
+// startTestLStreamsManager.
+func testWorkDir() string {
+	return filepath.Join(os.Getenv("XDG_RUNTIME_DIR"), "nerdlog")
+}
+
+// checkTestLogResp checks that every one of lstreamNames has numMsgs
+// messages, starting from "message <fromMsg>", from the log file written by
+// writeTestLogFile.
+func checkTestLogResp(
+	t *testing.T, resp *LogRespTotal, lstreamNames []string,
+	firstMsgTime time.Time, fromMsg, numMsgs int,
+) {
+	t.Helper()
+
+	assert.Equal(t, 0, len(resp.Errs), "errors: %v", resp.Errs)
+	assert.Equal(t, numMsgs*len(lstreamNames), resp.NumMsgsTotal)
+
+	logsByLStream := map[string][]LogMsg{}
+	for _, msg := range resp.Logs {
+		lstream := msg.Context["lstream"]
+		logsByLStream[lstream] = append(logsByLStream[lstream], msg)
+	}
+
+	assert.Equal(t, len(lstreamNames), len(logsByLStream))
+
+	for _, lstream := range lstreamNames {
+		logs := logsByLStream[lstream]
+		if !assert.Equal(t, numMsgs, len(logs), "lstream %s", lstream) {
+			continue
+		}
+
+		for i, msg := range logs {
+			msgIdx := fromMsg + i
+			assert.Equal(t, fmt.Sprintf("message %d", msgIdx), msg.Msg)
+			assert.Equal(t, firstMsgTime.Add(time.Duration(msgIdx)*time.Minute), msg.Time)
+			assert.Equal(t, "myprogram", msg.Context["program"])
+		}
+	}
+}
+
+// TestLStreamsManagerPartialResults checks that if some logstreams fail, the
+// logs from the others are still returned, together with the per-logstream
+// errors.
+func TestLStreamsManagerPartialResults(t *testing.T) {
+	logFname, firstMsgTime := writeTestLogFile(t)
+	brokenLogFname, _ := writeTestLogFile(t)
+
+	lstreamOK := "local:" + logFname
+	lstreamBroken := "local:" + brokenLogFname
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstreamOK+","+lstreamBroken)
+
+	// Make sure that both logstreams are fully bootstrapped and work, and only
+	// then break one of them.
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{lstreamOK, lstreamBroken}, firstMsgTime, 3, 3)
+
+	if err := os.Remove(brokenLogFname); err != nil {
+		t.Fatalf("removing log file: %s", err)
+	}
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	resp := upd.LogResp
+	if assert.Equal(t, 1, len(resp.LStreamErrs)) {
+		assert.Error(t, resp.LStreamErrs[lstreamBroken])
+	}
+
+	resp.LStreamErrs = nil
+	checkTestLogResp(t, resp, []string{lstreamOK}, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerProgressiveQuery checks that with a progressive query,
+// there's an intermediate update once the first logstream responds, and then
+// the final one with all the logs.
+func TestLStreamsManagerProgressiveQuery(t *testing.T) {
+	logFname1, firstMsgTime := writeTestLogFile(t)
+	logFname2, _ := writeTestLogFile(t)
+
+	lstream1 := "local:" + logFname1
+	lstream2 := "local:" + logFname2
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstream1+","+lstream2)
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+		Progressive: true,
+	})
+
+	upd := waitUpdate("intermediate logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	resp := upd.LogResp
+	if assert.Equal(t, 1, len(resp.PendingLStreams)) {
+		// Whichever logstream is still pending, the logs must be from the other one.
+		respondedLStream := lstream1
+		if resp.PendingLStreams[0] == lstream1 {
+			respondedLStream = lstream2
+		}
+
+		resp.PendingLStreams = nil
+		checkTestLogResp(t, resp, []string{respondedLStream}, firstMsgTime, 3, 3)
+	}
+
+	upd = waitUpdate("final logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	assert.Equal(t, 0, len(upd.LogResp.PendingLStreams))
+	checkTestLogResp(t, upd.LogResp, []string{lstream1, lstream2}, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerSkipUnreachable checks that with SkipUnreachable, the
+// query is done on the connected logstreams only, while without it, the query
+// fails.
+func TestLStreamsManagerSkipUnreachable(t *testing.T) {
+	// The fake docker which can't connect to anything.
+	binDir := t.TempDir()
+	fakeDocker := "#!/bin/sh\necho 'Error response from daemon: No such container' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(binDir, "docker"), []byte(fakeDocker), 0755); err != nil {
+		t.Fatalf("writing fake docker: %s", err)
+	}
+
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	logFname, firstMsgTime := writeTestLogFile(t)
+
+	lstreamOK := "local:" + logFname
+	lstreamUnreachable := "docker://myctr:" + logFname
+
+	lsman, waitUpdate := startTestLStreamsManager(t, lstreamOK+","+lstreamUnreachable)
+
+	waitUpdate("connection", func(upd LStreamsManagerUpdate) bool {
+		return upd.State != nil && upd.State.NumConnected == 1 &&
+			upd.State.ConnDetailsByLStream[lstreamUnreachable].Err != ""
+	})
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd := waitUpdate("error", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	assert.Equal(t, []error{ErrNotYetConnected}, upd.LogResp.Errs)
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines:     100,
+		Query:           "/message [3-5]/",
+		SkipUnreachable: true,
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	resp := upd.LogResp
+	assert.Equal(t, []string{lstreamUnreachable}, resp.UnreachableLStreams)
+
+	resp.UnreachableLStreams = nil
+	checkTestLogResp(t, resp, []string{lstreamOK}, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerAgentUpload checks that the agent is uploaded on the
+// first connection, then it's not uploaded again as long as it's intact, and
+// if it's not, it's uploaded again.
+func TestLStreamsManagerAgentUpload(t *testing.T) {
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstream := "local:" + logFname
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstream)
+
+	agentPath := filepath.Join(testWorkDir(), fmt.Sprintf("nerdlog_agent_%s_%s.sh", lsman.params.ClientID, nerdlogAgentShHash[:16]))
+
+	queryAndCheck := func() {
+		t.Helper()
+
+		lsman.QueryLogs(QueryLogsParams{
+			MaxNumLines: 100,
+			Query:       "/message [3-5]/",
+		})
+
+		upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+			return upd.LogResp != nil
+		})
+
+		checkTestLogResp(t, upd.LogResp, []string{lstream}, firstMsgTime, 3, 3)
+	}
+
+	reconnect := func() {
+		t.Helper()
+
+		lsman.Reconnect()
+		waitUpdate("disconnection", func(upd LStreamsManagerUpdate) bool {
+			return upd.State != nil && !upd.State.Connected
+		})
+		waitUpdate("connection", func(upd LStreamsManagerUpdate) bool {
+			return upd.State != nil && upd.State.Connected
+		})
+	}
+
+	queryAndCheck()
+
+	data, err := os.ReadFile(agentPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, nerdlogAgentSh, string(data))
+	}
+
+	// Make the file look old, so that we can see whether it's rewritten.
+	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(agentPath, oldTime, oldTime))
+
+	reconnect()
+	queryAndCheck()
+
+	fi, err := os.Stat(agentPath)
+	if assert.NoError(t, err) {
+		assert.True(t, fi.ModTime().Equal(oldTime), "the agent was uploaded again")
+	}
+
+	// Now break the agent, and it should be uploaded again.
+	assert.NoError(t, os.WriteFile(agentPath, []byte("exit 1\n"), 0644))
+
+	reconnect()
+	queryAndCheck()
+
+	data, err = os.ReadFile(agentPath)
+	if assert.NoError(t, err) {
+		assert.Equal(t, nerdlogAgentSh, string(data))
+	}
+
+	// No temporary files are left behind.
+	tmpFiles, err := filepath.Glob(filepath.Join(testWorkDir(), "nerdlog_agent_upload_*"))
+	assert.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+}
+
+// TestLStreamsManagerHostInfo checks that the host info reported by the agent
+// during bootstrap makes it to the manager state.
+func TestLStreamsManagerHostInfo(t *testing.T) {
+	logFname, _ := writeTestLogFile(t)
+	lstream := "local:" + logFname
+
+	_, waitUpdate := startTestLStreamsManager(t, lstream)
+
+	upd := waitUpdate("host info", func(upd LStreamsManagerUpdate) bool {
+		return upd.State != nil && upd.State.HostInfoByLStream[lstream] != nil
+	})
+
+	hi := upd.State.HostInfoByLStream[lstream]
+	assert.Equal(t, "bash", hi.Bash.Name)
+	assert.NotEmpty(t, hi.Bash.Version)
+	assert.Equal(t, "gawk", hi.Awk.Name)
+	assert.Equal(t, "gzip", hi.Gzip.Name)
+	assert.True(t, hi.StatFormat)
+	assert.Greater(t, hi.WorkDirFree, int64(0))
+
+	fi, err := os.Stat(logFname)
+	// There is no previous log file, so it's skipped.
+	if assert.NoError(t, err) && assert.Len(t, hi.LogFiles, 1) {
+		assert.Equal(t, HostLogFile{
+			Path:    logFname,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().Truncate(time.Second).UTC(),
+		}, hi.LogFiles[0])
+	}
+}
+
+func TestLStreamsManagerCleanup(t *testing.T) {
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstream := "local:" + logFname
+
+	lsman, waitUpdate := newTestLStreamsManager(t, lstream)
+
+	queryAndCheck := func() {
+		t.Helper()
+
+		lsman.QueryLogs(QueryLogsParams{
+			MaxNumLines: 100,
+			Query:       "/message [3-5]/",
+		})
+
+		upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+			return upd.LogResp != nil
+		})
+
+		checkTestLogResp(t, upd.LogResp, []string{lstream}, firstMsgTime, 3, 3)
+	}
+
+	cleanup := func(dryRun bool) *CleanupResp {
+		t.Helper()
+
+		lsman.Cleanup(CleanupParams{DryRun: dryRun})
+
+		upd := waitUpdate("cleanup", func(upd LStreamsManagerUpdate) bool {
+			return upd.CleanupResp != nil
+		})
+
+		resp := upd.CleanupResp
+		assert.Equal(t, dryRun, resp.DryRun)
+		assert.Empty(t, resp.Errs)
+		assert.Empty(t, resp.LStreamErrs)
+
+		return resp.Resps[lstream]
+	}
+
+	// The query is run after the bootstrap is fully done, so after that the
+	// work dir is all set up.
+	queryAndCheck()
+
+	workDir := testWorkDir()
+	agentPath := filepath.Join(workDir, fmt.Sprintf("nerdlog_agent_%s_%s.sh", lsman.params.ClientID, nerdlogAgentShHash[:16]))
+
+	fi, err := os.Stat(workDir)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	}
+
+	// Pretend there's an older agent of this client left behind.
+	oldAgentPath := filepath.Join(workDir, fmt.Sprintf("nerdlog_agent_%s_0000000000000000.sh", lsman.params.ClientID))
+	assert.NoError(t, os.WriteFile(oldAgentPath, []byte("old agent"), 0644))
+
+	// And the dummy empty log file which older agents used to create.
+	emptyFilePath := filepath.Join(workDir, "nerdlog-empty-file")
+	assert.NoError(t, os.WriteFile(emptyFilePath, nil, 0644))
+
+	// The agent in use is never going to be deleted, but all the rest are, as
+	// well as the index file.
+	indexPath := filepath.Join(workDir, fmt.Sprintf("nerdlog_agent_index_%s_%s", lsman.params.ClientID, filepathToId(logFname)))
+	wantPaths := []string{
+		emptyFilePath,
+		indexPath,
+		oldAgentPath,
+	}
+
+	checkFiles := func(files []RemoteFile) {
+		t.Helper()
+
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, f.Path)
+			if f.Path == oldAgentPath {
+				assert.Equal(t, int64(9), f.Size)
+			}
+		}
+
+		assert.ElementsMatch(t, wantPaths, paths)
+	}
+
+	// Dry run doesn't delete anything.
+	if resp := cleanup(true); assert.NotNil(t, resp) {
+		checkFiles(resp.Files)
+	}
+	assert.FileExists(t, oldAgentPath)
+	assert.FileExists(t, indexPath)
+
+	if resp := cleanup(false); assert.NotNil(t, resp) {
+		checkFiles(resp.Files)
+	}
+	assert.NoFileExists(t, oldAgentPath)
+	assert.NoFileExists(t, indexPath)
+	assert.FileExists(t, agentPath)
+
+	// The logstream is still usable.
+	queryAndCheck()
+}
+
+// fakeSudo is a stand-in for sudo: it only accepts the password "secret" via
+// -S, and runs the command as the same user, logging it to the file
+// "$0.log".
+const fakeSudo = `#!/bin/bash
+password=""
+while [[ $# -gt 0 ]]; do
+  case "$1" in
+    -n) noninteractive=1; shift ;;
+    -S) read -r password; shift ;;
+    -k) shift ;;
+    -p|-u) shift 2 ;;
+    *) break ;;
+  esac
+done
+
+if [[ "$noninteractive" == "1" ]]; then
+  echo "sudo: a password is required" 1>&2
+  exit 1
+fi
+
+if [[ "$password" != "secret" ]]; then
+  echo "sudo: 1 incorrect password attempt" 1>&2
+  exit 1
+fi
+
+echo "$1" >> "$0.log"
+exec "$@"
+`
+
+func TestLStreamsManagerSudo(t *testing.T) {
+	logFname, firstMsgTime := writeTestLogFile(t)
+
+	// Name it "sudo", so that it's asked for the password.
+	sudoPath := filepath.Join(t.TempDir(), "sudo")
+	assert.NoError(t, os.WriteFile(sudoPath, []byte(fakeSudo), 0755))
+
+	lsman, waitUpdate := startTestLStreamsManagerWithConfig(t, "rootlog", ConfigLogStreams{
+		"rootlog": ConfigLogStream{
+			Hostname:  "localhost",
+			Transport: string(TransportLocal),
+			LogFiles:  []string{logFname},
+			Sudo:      true,
+			SudoCmd:   sudoPath,
+		},
+	})
+
+	waitPrompt := func() *UserPrompt {
+		t.Helper()
+
+		upd := waitUpdate("sudo password prompt", func(upd LStreamsManagerUpdate) bool {
+			return upd.UserPrompt != nil
+		})
+
+		assert.Equal(t, "rootlog", upd.UserPrompt.LStreamName)
+		assert.Equal(t, UserPromptKindSecret, upd.UserPrompt.Kind)
+
+		return upd.UserPrompt
+	}
+
+	// Non-interactive sudo doesn't work, so we're asked for the password.
+	p := waitPrompt()
+	assert.Contains(t, p.Message, "needs a password")
+	p.Respond(UserPromptResp{Yes: true, Text: "wrong"})
+
+	// The password is wrong, so we're asked again.
+	p = waitPrompt()
+	assert.Contains(t, p.Message, "Wrong password")
+	p.Respond(UserPromptResp{Yes: true, Text: "secret"})
+
+	// The query is going to run once the bootstrap is done.
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd := waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{"rootlog"}, firstMsgTime, 3, 3)
+
+	// Both phases of the bootstrap (checking the agent and uploading it) and
+	// the query were run via sudo.
+	sudoLog, err := os.ReadFile(sudoPath + ".log")
+	assert.NoError(t, err)
+	assert.Equal(t, "bash\nbash\nbash\n", string(sudoLog))
+}
+
+// TestLStreamsManagerCompression checks that the queries work with every
+// compression, and that the configured one is used.
+func TestLStreamsManagerCompression(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		compression CompressionKind
+		level       int
+	}{
+		{name: "auto"},
+		{name: "gzip", compression: CompressionGzip, level: 9},
+		{name: "zstd", compression: CompressionZstd, level: 5},
+		{name: "none", compression: CompressionNone},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, zstdErr := exec.LookPath("zstd")
+			if tc.compression == CompressionZstd && zstdErr != nil {
+				t.Skip("zstd is not available")
+			}
+
+			logFname, firstMsgTime := writeTestLogFile(t)
+
+			lsman, waitUpdate := startTestLStreamsManagerWithConfig(t, "mylog", ConfigLogStreams{
+				"mylog": ConfigLogStream{
+					Hostname:         "localhost",
+					Transport:        string(TransportLocal),
+					LogFiles:         []string{logFname},
+					Compression:      string(tc.compression),
+					CompressionLevel: tc.level,
+				},
+			})
+
+			upd := waitUpdate("host info", func(upd LStreamsManagerUpdate) bool {
+				return upd.State != nil && upd.State.HostInfoByLStream["mylog"] != nil
+			})
+
+			want := LogStreamCompression{Kind: tc.compression, Level: tc.level}
+			if tc.compression == "" {
+				// Auto picks the best one available.
+				want.Kind = CompressionZstd
+				if zstdErr != nil {
+					want.Kind = CompressionGzip
+				}
+			}
+			assert.Equal(t, want, upd.State.HostInfoByLStream["mylog"].Compression)
+
+			lsman.QueryLogs(QueryLogsParams{
+				MaxNumLines: 100,
+				Query:       "/message [3-5]/",
+			})
+
+			upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+				return upd.LogResp != nil
+			})
+
+			checkTestLogResp(t, upd.LogResp, []string{"mylog"}, firstMsgTime, 3, 3)
+
+			// The temporary chunk file in the work dir is removed once the query
+			// is done.
+			assert.Eventually(t, func() bool {
+				chunks, err := filepath.Glob(filepath.Join(testWorkDir(), "nerdlog_agent_chunk_*"))
+				return err == nil && len(chunks) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+// testNativeAgentVariants returns the agents with the native one built for the
+// current architecture, or skips the test if there is no native agent for it.
+func testNativeAgentVariants(t *testing.T) *agentVariants {
+	t.Helper()
+
+	if _, ok := agentUnameMachines[runtime.GOARCH]; !ok || runtime.GOOS != "linux" {
+		t.Skipf("no native agent for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+
+	binFname, err := buildNerdlogAgentBin()
+	if err != nil {
+		t.Fatalf("building the agent: %s", err)
+	}
+
+	bin, err := os.ReadFile(binFname)
+	if err != nil {
+		t.Fatalf("reading the agent: %s", err)
+	}
+
+	return testAgentVariantsWithBin(t, bin)
+}
+
+// testAgentVariantsWithBin returns the agents with the given binary as the
+// native agent for the current architecture.
+func testAgentVariantsWithBin(t *testing.T, bin []byte) *agentVariants {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	gzWriter.Write(bin)
+	gzWriter.Close()
+
+	binDir := t.TempDir()
+	gzFname := filepath.Join(binDir, "nerdlog-agent-linux-"+runtime.GOARCH+".gz")
+	if err := os.WriteFile(gzFname, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("writing the agent: %s", err)
+	}
+
+	return newAgentVariants(os.DirFS(binDir), ".")
+}
+
+// TestLStreamsManagerNativeAgent checks that the native agent is uploaded to
+// the host with a matching architecture, and that the queries work with it.
+func TestLStreamsManagerNativeAgent(t *testing.T) {
+	agents := testNativeAgentVariants(t)
+
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstream := "local:" + logFname
+
+	lsman, waitUpdate := startTestLStreamsManagerWithAgents(t, lstream, nil, agents)
+
+	upd := waitUpdate("host info", func(upd LStreamsManagerUpdate) bool {
+		return upd.State != nil && upd.State.HostInfoByLStream[lstream] != nil
+	})
+
+	hi := upd.State.HostInfoByLStream[lstream]
+	assert.True(t, hi.NativeAgent)
+	assert.Contains(t, agentUnameMachines[runtime.GOARCH], hi.Arch)
+	assert.Equal(t, "gzip", hi.Gzip.Name)
+
+	natives, err := agents.getNatives()
+	if assert.NoError(t, err) && assert.Len(t, natives, 1) {
+		agentPath := filepath.Join(testWorkDir(), natives[0].fname(lsman.params.ClientID))
+		fi, err := os.Stat(agentPath)
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+		}
+	}
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{lstream}, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerNativeAgentFallback checks that if the native agent can't
+// run on the host, the shell agent is used instead.
+func TestLStreamsManagerNativeAgentFallback(t *testing.T) {
+	if _, ok := agentUnameMachines[runtime.GOARCH]; !ok || runtime.GOOS != "linux" {
+		t.Skipf("no native agent for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+
+	// It looks like an executable, but the kernel refuses to run it.
+	agents := testAgentVariantsWithBin(t, []byte("\x7fELF\x02\x01\x01\x00broken"))
+
+	logFname, firstMsgTime := writeTestLogFile(t)
+	lstream := "local:" + logFname
+
+	lsman, waitUpdate := startTestLStreamsManagerWithAgents(t, lstream, nil, agents)
+
+	upd := waitUpdate("host info", func(upd LStreamsManagerUpdate) bool {
+		return upd.State != nil && upd.State.HostInfoByLStream[lstream] != nil
+	})
+
+	hi := upd.State.HostInfoByLStream[lstream]
+	assert.False(t, hi.NativeAgent)
+	assert.Equal(t, "gawk", hi.Awk.Name)
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{lstream}, firstMsgTime, 3, 3)
+}
+
+// TestLStreamsManagerNativeAgentSudo checks that the native agent, which is
+// too large to be passed to sudo as an argument, is uploaded and run via sudo.
+func TestLStreamsManagerNativeAgentSudo(t *testing.T) {
+	agents := testNativeAgentVariants(t)
+
+	logFname, firstMsgTime := writeTestLogFile(t)
+
+	sudoPath := filepath.Join(t.TempDir(), "sudo")
+	assert.NoError(t, os.WriteFile(sudoPath, []byte(fakeSudo), 0755))
+
+	lsman, waitUpdate := startTestLStreamsManagerWithAgents(t, "rootlog", ConfigLogStreams{
+		"rootlog": ConfigLogStream{
+			Hostname:  "localhost",
+			Transport: string(TransportLocal),
+			LogFiles:  []string{logFname},
+			Sudo:      true,
+			SudoCmd:   sudoPath,
+
+			// With compression, the whole query pipeline would run via sudo, not
+			// just the agent.
+			Compression: string(CompressionNone),
+		},
+	}, agents)
+
+	upd := waitUpdate("sudo password prompt", func(upd LStreamsManagerUpdate) bool {
+		return upd.UserPrompt != nil
+	})
+	upd.UserPrompt.Respond(UserPromptResp{Yes: true, Text: "secret"})
+
+	lsman.QueryLogs(QueryLogsParams{
+		MaxNumLines: 100,
+		Query:       "/message [3-5]/",
+	})
+
+	upd = waitUpdate("logs", func(upd LStreamsManagerUpdate) bool {
+		return upd.LogResp != nil
+	})
+
+	checkTestLogResp(t, upd.LogResp, []string{"rootlog"}, firstMsgTime, 3, 3)
+
+	// The query runs the native agent directly, without bash.
+	sudoLog, err := os.ReadFile(sudoPath + ".log")
+	if assert.NoError(t, err) {
+		lines := strings.Split(strings.TrimSuffix(string(sudoLog), "\n"), "\n")
+		if assert.Len(t, lines, 3) {
+			assert.Equal(t, []string{"bash", "bash"}, lines[:2])
+			assert.True(t, strings.HasPrefix(filepath.Base(lines[2]), "nerdlog_agent_"), lines[2])
+		}
+	}
+}
@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/dimonomid/nerdlog/shellescape"
 	"github.com/gobwas/glob"
@@ -25,6 +26,10 @@ type LStreamsResolverParams struct {
 
 	// SSHConfig is the general SSH config, typically coming from ~/.ssh/config
 	SSHConfig *ssh_config.Config
+
+	// ConfigConnection contains the global connection settings, which can be
+	// overridden by every item in ConfigLogStreams. Optional.
+	ConfigConnection *ConfigConnection
 }
 
 func NewLStreamsResolver(params LStreamsResolverParams) *LStreamsResolver {
@@ -38,15 +43,57 @@ type LogStream struct {
 	// "lstream" context tag; it must uniquely identify the LogStream.
 	Name string
 
-	Host     ConfigHost
+	Host ConfigHost
+
+	// Jumphost is the host through which Host is reached, if any. The
+	// jumphost might have its own Jumphost, and so on, forming a multi-hop
+	// chain.
 	Jumphost *ConfigHost
 
+	// Transport specifies how to get to the shell on the host. Empty means
+	// TransportSSH.
+	Transport TransportKind
+
+	// ShellCmd, if not empty, is the command to run the shell on the host,
+	// instead of the default one (which is the login shell for TransportSSH,
+	// and bash for the others). It's used to get inside containers, e.g.
+	// ["docker", "exec", "-i", "mycontainer", "bash"].
+	ShellCmd []string
+
 	// LogFiles contains a list of files which are part of the logstream, like
 	// ["/var/log/syslog", "/var/log/syslog.1"]. The [0]th item is the latest log
-	// file [1]st is the previous one, etc.
+	// file [1]st is the previous one, etc. There can be any number of the
+	// rotated files; the ones which don't exist on the host are skipped by the
+	// agent. The rotated ones can be compressed (.gz or .zst) and can be glob
+	// patterns like "/var/log/syslog.*.gz", which are expanded by the agent.
 	//
 	// It must contain at least a single item, otherwise LogStream is invalid.
 	LogFiles []string
+
+	// Connection contains the connection settings (timeouts and the reconnect
+	// policy), as specified in the configs. Nil means all defaults.
+	Connection *ConfigConnection
+
+	// WorkDir is the directory on the host for the nerdlog files, as specified
+	// in the configs. Empty means the default one, see ConfigLogStream.WorkDir.
+	WorkDir string
+
+	// Sudo, if not nil, makes the agent run as another user (root by default),
+	// see ConfigLogStream.Sudo.
+	Sudo *LogStreamSudo
+
+	// Compression specifies how the query output is compressed on the host,
+	// see ConfigLogStream.Compression.
+	Compression LogStreamCompression
+}
+
+// LogStreamSudo specifies how to run the agent as another user.
+type LogStreamSudo struct {
+	// User is the user to run the agent as; empty means root.
+	User string
+
+	// Cmd is the privilege escalation command; empty means "sudo".
+	Cmd string
 }
 
 type ConfigHost struct {
@@ -60,10 +107,88 @@ type ConfigHost struct {
 	Addr string
 	// User is the username to authenticate as.
 	User string
+
+	// Alias is the Host from the ssh config which this host was resolved with,
+	// if any. It's used by the TransportSSHBin, so that the ssh binary applies
+	// the ssh config for this host in full (including the parts we don't
+	// support ourselves, like Match blocks).
+	Alias string
+
+	// SSH contains the ssh options for this host, as specified in the ssh
+	// config. It's nil if there are no relevant options.
+	SSH *SSHOptions
+
+	// Jumphost is only used for the jumphosts themselves (for the logstreams,
+	// LogStream.Jumphost is used instead): it's the previous hop, through which
+	// this jumphost is reached. Nil for the first hop.
+	Jumphost *ConfigHost
+
+	// ProxyCommand, if not empty, is the command to connect to the host, as
+	// specified in the ssh config; the ssh connection goes over its stdin and
+	// stdout. Tokens %h, %p and %r are expanded to the hostname, port and user.
+	// It's ignored if the host is reached through a jumphost.
+	ProxyCommand string
+
+	// DialTimeout, KeepaliveInterval and KeepaliveTimeout are the connection
+	// settings of this host, as specified in the ConfigConnection; zero means
+	// the default.
+	DialTimeout       time.Duration
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+}
+
+// SSHOptions contains ssh options for a particular host, as specified in the
+// ssh config (typically ~/.ssh/config). Empty values mean that the option
+// wasn't specified, and the defaults should be used.
+type SSHOptions struct {
+	// StrictHostKeyChecking is the value of the same-named ssh option: "yes",
+	// "accept-new", "no", "off" or "ask". Empty means "ask".
+	StrictHostKeyChecking string
+
+	// UserKnownHostsFiles are the files from the UserKnownHostsFile option,
+	// as they're specified in the config (so they may contain "~" and tokens
+	// like "%d"). Empty means ~/.ssh/known_hosts and ~/.ssh/known_hosts2.
+	UserKnownHostsFiles []string
+
+	// GlobalKnownHostsFiles are the files from the GlobalKnownHostsFile option.
+	// Empty means /etc/ssh/ssh_known_hosts and /etc/ssh/ssh_known_hosts2.
+	GlobalKnownHostsFiles []string
+
+	// HashKnownHosts is the value of the same-named ssh option, "yes" or "no".
+	// If "yes", the hostnames that we add to known_hosts will be hashed.
+	HashKnownHosts string
+
+	// IdentityFiles are the private key files from the IdentityFile options, as
+	// they're specified in the config (so they may contain "~" and tokens).
+	// They're tried after the keys from the ssh agent, and before the default
+	// key files like ~/.ssh/id_ed25519.
+	IdentityFiles []string
+
+	// IdentitiesOnly is the value of the same-named ssh option, "yes" or "no".
+	// If "yes", the keys from the ssh agent which don't correspond to any of
+	// the IdentityFiles are not used.
+	IdentitiesOnly string
+}
+
+func (o *SSHOptions) isEmpty() bool {
+	return o.StrictHostKeyChecking == "" &&
+		len(o.UserKnownHostsFiles) == 0 &&
+		len(o.GlobalKnownHostsFiles) == 0 &&
+		o.HashKnownHosts == "" &&
+		len(o.IdentityFiles) == 0 &&
+		o.IdentitiesOnly == ""
 }
 
 func (ch *ConfigHost) Key() string {
-	return fmt.Sprintf("%s@%s", ch.Addr, ch.User)
+	key := fmt.Sprintf("%s@%s", ch.Addr, ch.User)
+
+	if ch.Jumphost != nil {
+		key += " via " + ch.Jumphost.Key()
+	} else if ch.ProxyCommand != "" {
+		key += " via proxy command " + ch.ProxyCommand
+	}
+
+	return key
 }
 
 func (ls LogStream) LogFileLast() string {
@@ -72,14 +197,6 @@ func (ls LogStream) LogFileLast() string {
 	return ls.LogFiles[0]
 }
 
-func (ls LogStream) LogFilePrev() (string, bool) {
-	if len(ls.LogFiles) >= 2 {
-		return ls.LogFiles[1], true
-	}
-
-	return "", false
-}
-
 // Resolve parses the given logstream spec, and returns the mapping from
 // LogStream.Name to the corresponding LogStream. Examples of logstream spec are:
 //
@@ -87,6 +204,10 @@ func (ls LogStream) LogFilePrev() (string, bool) {
 // - "myuser@myserver.com:22"
 // - "myuser@myserver.com"
 // - "myserver.com"
+// - "local:/var/log/syslog" (no ssh, just the local machine)
+// - "docker://mycontainer:/var/log/app.log" (container on the local machine)
+// - "docker://myuser@myserver.com/mycontainer:/var/log/app.log"
+// - "k8s://mynamespace/app=web:/var/log/app.log" (one logstream per pod)
 func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, error) {
 	lstreamsStr = strings.TrimSpace(lstreamsStr)
 
@@ -115,6 +236,12 @@ func (r *LStreamsResolver) Resolve(lstreamsStr string) (map[string]LogStream, er
 		for _, ch := range cfs {
 			key := ch.Name
 
+			ch.Connection = mergeConfigConnection(r.params.ConfigConnection, ch.Connection)
+			ch.Host.setConnectionConfig(ch.Connection)
+			for jh := ch.Jumphost; jh != nil; jh = jh.Jumphost {
+				jh.setConnectionConfig(ch.Connection)
+			}
+
 			if _, exists := parsedLogStreams[key]; exists {
 				return nil, errors.Errorf("the logstream %s is present at least twice", key)
 			}
@@ -162,6 +289,9 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 	var plstream *parsedLStream
 	var jhconf *ConfigHost
 	var logFiles []string
+	var shellCmd []string
+	var pk8s *parsedK8sLStream
+	isLocal := false
 
 	curFlag := ""
 	for _, part := range parts {
@@ -172,27 +302,62 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 
 		switch curFlag {
 		case "-J", "--jumphost":
-			jhparsed, err := r.parseLStreamStr(part)
+			var err error
+			jhconf, err = r.resolveJumphosts(part, 0)
 			if err != nil {
 				return nil, errors.Annotatef(err, "parsing %q as a jumphost", part)
 			}
 
-			//if jhparsed.logFileLast != "" || jhparsed.logFilePrev != "" {
-			//return nil, errors.Annotatef(err, "jumphost config shouldn't contain files")
-			//}
+		case "":
+			if part == localLStreamPrefix || strings.HasPrefix(part, localLStreamPrefix+":") {
+				isLocal = true
+				logFiles = strings.Split(part, ":")[1:]
+				if len(logFiles) > 2 {
+					return nil, errors.Errorf("%q: too many colons", part)
+				}
+
+				break
+			}
 
-			jhPort := jhparsed.port
+			if strings.HasPrefix(part, k8sLStreamPrefix) {
+				var err error
+				pk8s, err = parseK8sLStreamStr(part)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing %q as a k8s logstream", part)
+				}
 
-			if len(jhparsed.colonParts) > 1 {
-				return nil, errors.Errorf("parsing %q as a jumphost: too many colons", part)
+				break
 			}
 
-			jhconf = &ConfigHost{
-				Addr: fmt.Sprintf("%s:%s", jhparsed.hostname, jhPort),
-				User: jhparsed.user,
+			if strings.HasPrefix(part, dockerLStreamPrefix) {
+				pd, err := parseDockerLStreamStr(part)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing %q as a docker logstream", part)
+				}
+
+				shellCmd = []string{"docker", "exec", "-i", pd.container, "bash"}
+
+				// Set the defaults right away, so that the log files configured for
+				// the host (which is outside of the container) are not used.
+				logFiles = setLogFilesDefaults(pd.logFiles)
+
+				if pd.host == "" {
+					isLocal = true
+					break
+				}
+
+				plstream, err = r.parseLStreamStr(pd.host)
+				if err != nil {
+					return nil, errors.Annotatef(err, "parsing %q as a host", pd.host)
+				}
+
+				if len(plstream.colonParts) > 0 {
+					return nil, errors.Errorf("%q: too many colons", pd.host)
+				}
+
+				break
 			}
 
-		case "":
 			var err error
 			plstream, err = r.parseLStreamStr(part)
 			if err != nil {
@@ -217,6 +382,36 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		curFlag = ""
 	}
 
+	if pk8s != nil {
+		if jhconf != nil {
+			return nil, errors.Errorf("jumphost can't be used with k8s logstreams")
+		}
+
+		return r.expandK8sLStream(pk8s)
+	}
+
+	if isLocal {
+		if jhconf != nil {
+			return nil, errors.Errorf("jumphost can't be used with local logstreams")
+		}
+
+		// Local logstreams don't need any of the configs.
+		return []LogStream{
+			{
+				Name: s,
+
+				Host: ConfigHost{
+					Addr: "localhost",
+					User: r.params.CurOSUser,
+				},
+				Transport: TransportLocal,
+				ShellCmd:  shellCmd,
+
+				LogFiles: setLogFilesDefaults(logFiles),
+			},
+		}, nil
+	}
+
 	if plstream == nil {
 		return nil, errors.Errorf("no logstream specified in %q", s)
 	}
@@ -230,12 +425,13 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 				User: plstream.user,
 			},
 			Jumphost: jhconf,
+			ShellCmd: shellCmd,
 
 			LogFiles: logFiles,
 		},
 	}
 
-	ret, err = expandFromLogStreamsConfig(ret, r.params.ConfigLogStreams)
+	ret, err = r.expandFromLogStreamsConfig(ret, r.params.ConfigLogStreams)
 	if err != nil {
 		return nil, errors.Annotatef(err, "expanding from nerdlog config")
 	}
@@ -245,11 +441,49 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		return nil, errors.Annotatef(err, "parsing ssh config")
 	}
 
-	ret, err = expandFromLogStreamsConfig(ret, lsConfigFromSSHConfig)
+	ret, err = r.expandFromLogStreamsConfig(ret, lsConfigFromSSHConfig)
 	if err != nil {
 		return nil, errors.Annotatef(err, "expanding from ssh config")
 	}
 
+	// For the logstreams which didn't match any item in the ssh config, the ssh
+	// options (if any) can still come from the wildcard hosts like "Host *", so
+	// look them up using the hostname.
+	for i := range ret {
+		if ret[i].Host.SSH != nil {
+			continue
+		}
+
+		hostname, err := hostnameFromAddr(ret[i].Host.Addr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "logstream #%d, getting hostname", i+1)
+		}
+
+		ret[i].Host.SSH = sshOptionsForHost(r.params.SSHConfig, hostname)
+	}
+
+	// Same for ProxyJump and ProxyCommand.
+	for i := range ret {
+		if ret[i].Jumphost != nil || ret[i].Host.ProxyCommand != "" {
+			continue
+		}
+
+		hostname, err := hostnameFromAddr(ret[i].Host.Addr)
+		if err != nil {
+			return nil, errors.Annotatef(err, "logstream #%d, getting hostname", i+1)
+		}
+
+		proxyJump, proxyCommand := sshProxyForHost(r.params.SSHConfig, hostname)
+		if proxyJump != "" {
+			ret[i].Jumphost, err = r.resolveJumphosts(proxyJump, 0)
+			if err != nil {
+				return nil, errors.Annotatef(err, "logstream %s, resolving jumphost %q", ret[i].Name, proxyJump)
+			}
+		} else {
+			ret[i].Host.ProxyCommand = proxyCommand
+		}
+	}
+
 	ret, err = setLogStreamsDefaults(ret, r.params.CurOSUser)
 	if err != nil {
 		return nil, errors.Annotatef(err, "setting defaults")
@@ -264,6 +498,141 @@ func (r *LStreamsResolver) parseLogStreamSpecEntry(s string) ([]LogStream, error
 		if strings.Contains(ls.Host.Addr, "*") {
 			return nil, errors.Errorf("glob %q didn't match anything (having address %q)", s, ls.Host.Addr)
 		}
+
+		if !ls.Transport.isValid() {
+			return nil, errors.Errorf("logstream %s: invalid transport %q", ls.Name, ls.Transport)
+		}
+
+		if err := ls.Compression.validate(); err != nil {
+			return nil, errors.Annotatef(err, "logstream %s", ls.Name)
+		}
+	}
+
+	return ret, nil
+}
+
+// dockerLStreamPrefix is the prefix of the logstream spec for docker
+// containers, which looks like
+// "docker://[[user@]host[:port]/]container[:logfile_last[:logfile_prev]]".
+// Without the host, the local docker is used; otherwise it's used over ssh.
+const dockerLStreamPrefix = "docker://"
+
+type parsedDockerLStream struct {
+	// host is in the same format as the regular logstream spec, but without
+	// the log files. Empty means the local docker.
+	host      string
+	container string
+	logFiles  []string
+}
+
+func parseDockerLStreamStr(s string) (*parsedDockerLStream, error) {
+	s = strings.TrimPrefix(s, dockerLStreamPrefix)
+
+	ret := &parsedDockerLStream{}
+
+	// The host, if present, is separated with a slash. The log files contain
+	// slashes too, but they're preceded by a colon.
+	slashIdx := strings.IndexRune(s, '/')
+	if slashIdx >= 0 && !strings.HasSuffix(s[:slashIdx], ":") {
+		ret.host = s[:slashIdx]
+		s = s[slashIdx+1:]
+
+		if ret.host == "" {
+			return nil, errors.Errorf("host is empty")
+		}
+	}
+
+	parts := strings.Split(s, ":")
+	if parts[0] == "" {
+		return nil, errors.Errorf("no container")
+	}
+
+	ret.container = parts[0]
+	ret.logFiles = parts[1:]
+
+	if len(ret.logFiles) > 2 {
+		return nil, errors.Errorf("too many colons")
+	}
+
+	return ret, nil
+}
+
+// k8sLStreamPrefix is the prefix of the logstream spec for kubernetes pods,
+// which looks like
+// "k8s://namespace/selector[:logfile_last[:logfile_prev]]", e.g.
+// "k8s://default/app=web:/var/log/app.log". The label selector is expanded
+// into one logstream per running pod, named after the pod.
+const k8sLStreamPrefix = "k8s://"
+
+type parsedK8sLStream struct {
+	namespace string
+	selector  string
+	logFiles  []string
+}
+
+func parseK8sLStreamStr(s string) (*parsedK8sLStream, error) {
+	s = strings.TrimPrefix(s, k8sLStreamPrefix)
+
+	// The namespace can't contain slashes, so it ends at the first one; but the
+	// selector might contain slashes (e.g. "app.kubernetes.io/name=web"), and
+	// it ends at the first colon, which starts the log files.
+	slashIdx := strings.IndexRune(s, '/')
+	if slashIdx < 0 {
+		return nil, errors.Errorf("no namespace")
+	}
+
+	ret := &parsedK8sLStream{
+		namespace: s[:slashIdx],
+	}
+
+	if ret.namespace == "" {
+		return nil, errors.Errorf("namespace is empty")
+	}
+
+	parts := strings.Split(s[slashIdx+1:], ":")
+	if parts[0] == "" {
+		return nil, errors.Errorf("no selector")
+	}
+
+	ret.selector = parts[0]
+	ret.logFiles = parts[1:]
+
+	if len(ret.logFiles) > 2 {
+		return nil, errors.Errorf("too many colons")
+	}
+
+	return ret, nil
+}
+
+// expandK8sLStream returns one logstream per running pod matching the
+// selector; the logstreams are named after the pods.
+func (r *LStreamsResolver) expandK8sLStream(pk8s *parsedK8sLStream) ([]LogStream, error) {
+	pods, err := listK8sPods(pk8s.namespace, pk8s.selector)
+	if err != nil {
+		return nil, errors.Annotatef(err, "listing pods")
+	}
+
+	if len(pods) == 0 {
+		return nil, errors.Errorf(
+			"selector %q didn't match any running pods in the namespace %q",
+			pk8s.selector, pk8s.namespace,
+		)
+	}
+
+	ret := make([]LogStream, 0, len(pods))
+	for _, pod := range pods {
+		ret = append(ret, LogStream{
+			Name: pod,
+
+			Host: ConfigHost{
+				Addr: "localhost",
+				User: r.params.CurOSUser,
+			},
+			Transport: TransportLocal,
+			ShellCmd:  k8sShellCmd(pk8s.namespace, pod),
+
+			LogFiles: setLogFilesDefaults(append([]string(nil), pk8s.logFiles...)),
+		})
 	}
 
 	return ret, nil
@@ -314,6 +683,129 @@ func (r *LStreamsResolver) parseLStreamStr(s string) (*parsedLStream, error) {
 	}, nil
 }
 
+// maxJumphostHops limits the length of the jumphost chain, mostly to catch
+// loops in the configs, like a "Host *" with a ProxyJump.
+const maxJumphostHops = 10
+
+// resolveJumphosts parses the jumphost spec in the same format as ProxyJump
+// in the ssh config: a comma-separated list of "[user@]host[:port]", in the
+// order of connection. It returns the last hop (the one through which the
+// target host is reached), and every hop's Jumphost points to the previous
+// one. Same as with ssh, the first hop might have its own ProxyJump or
+// ProxyCommand in the configs.
+//
+// numHops is the number of hops resolved so far; it's used to detect loops.
+func (r *LStreamsResolver) resolveJumphosts(spec string, numHops int) (*ConfigHost, error) {
+	var prev *ConfigHost
+
+	for i, hopSpec := range strings.Split(spec, ",") {
+		hopSpec = strings.TrimSpace(hopSpec)
+		if hopSpec == "" {
+			return nil, errors.Errorf("jumphost #%d is empty", i+1)
+		}
+
+		numHops++
+		if numHops > maxJumphostHops {
+			return nil, errors.Errorf(
+				"too many jumphost hops (more than %d), is there a loop in the config?", maxJumphostHops,
+			)
+		}
+
+		hop, hopJumphost, hopProxyCommand, err := r.resolveJumphost(hopSpec)
+		if err != nil {
+			return nil, errors.Annotatef(err, "jumphost %q", hopSpec)
+		}
+
+		if i == 0 {
+			if hopJumphost != "" {
+				hop.Jumphost, err = r.resolveJumphosts(hopJumphost, numHops)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+			} else {
+				hop.ProxyCommand = hopProxyCommand
+			}
+		} else {
+			hop.Jumphost = prev
+		}
+
+		prev = hop
+	}
+
+	return prev, nil
+}
+
+// resolveJumphost resolves a single jumphost like "[user@]host[:port]", using
+// the nerdlog config and the ssh config, and returns it together with its own
+// jumphost spec and ProxyCommand from the configs, if any.
+func (r *LStreamsResolver) resolveJumphost(
+	s string,
+) (hop *ConfigHost, jumphost, proxyCommand string, err error) {
+	parsed, err := r.parseLStreamStr(s)
+	if err != nil {
+		return nil, "", "", errors.Trace(err)
+	}
+
+	if len(parsed.colonParts) > 0 {
+		return nil, "", "", errors.Errorf("too many colons")
+	}
+
+	alias := parsed.hostname
+	hostname := ""
+	port := parsed.port
+	user := parsed.user
+
+	if item, ok := r.params.ConfigLogStreams[alias]; ok {
+		hostname = item.Hostname
+		if port == "" {
+			port = item.Port
+		}
+		if user == "" {
+			user = item.User
+		}
+		jumphost = item.Jumphost
+	}
+
+	if sshConfig := r.params.SSHConfig; sshConfig != nil {
+		if hostname == "" {
+			hostname, _ = sshConfig.Get(alias, "HostName")
+		}
+		if port == "" {
+			port, _ = sshConfig.Get(alias, "Port")
+		}
+		if user == "" {
+			user, _ = sshConfig.Get(alias, "User")
+		}
+		if jumphost == "" {
+			jumphost, proxyCommand = sshProxyForHost(sshConfig, alias)
+		}
+	}
+
+	if hostname == "" {
+		hostname = alias
+	}
+
+	if port == "" {
+		port = "22"
+	}
+
+	if user == "" {
+		user = r.params.CurOSUser
+	}
+
+	ret := &ConfigHost{
+		Addr: fmt.Sprintf("%s:%s", hostname, port),
+		User: user,
+		SSH:  sshOptionsForHost(r.params.SSHConfig, alias),
+	}
+
+	if sshConfigHasHost(r.params.SSHConfig, alias) {
+		ret.Alias = alias
+	}
+
+	return ret, jumphost, proxyCommand, nil
+}
+
 type ConfigLogStreamWKey struct {
 	// Key is the key at which the corresponding ConfigLogStream was
 	// stored in the ConfigLogStreams map.
@@ -324,7 +816,7 @@ type ConfigLogStreamWKey struct {
 
 // expandFromLogStreamsConfig goes through each of the logstreams, and
 // potentially expands every item as per the provided config.
-func expandFromLogStreamsConfig(
+func (r *LStreamsResolver) expandFromLogStreamsConfig(
 	logStreams []LogStream,
 	lsConfig ConfigLogStreams,
 ) ([]LogStream, error) {
@@ -395,6 +887,51 @@ func expandFromLogStreamsConfig(
 				lsCopy.LogFiles = matchedItem.LogFiles
 			}
 
+			if lsCopy.Host.SSH == nil {
+				lsCopy.Host.SSH = matchedItem.sshOptions
+			}
+
+			if lsCopy.Host.Alias == "" {
+				lsCopy.Host.Alias = matchedItem.sshAlias
+			}
+
+			if lsCopy.Transport == "" {
+				lsCopy.Transport = TransportKind(matchedItem.Transport)
+			}
+
+			if lsCopy.Connection == nil {
+				lsCopy.Connection = matchedItem.Connection
+			}
+
+			if lsCopy.WorkDir == "" {
+				lsCopy.WorkDir = matchedItem.WorkDir
+			}
+
+			if lsCopy.Sudo == nil && (matchedItem.Sudo || matchedItem.SudoUser != "") {
+				lsCopy.Sudo = &LogStreamSudo{
+					User: matchedItem.SudoUser,
+					Cmd:  matchedItem.SudoCmd,
+				}
+			}
+
+			if lsCopy.Compression == (LogStreamCompression{}) {
+				lsCopy.Compression = LogStreamCompression{
+					Kind:  CompressionKind(matchedItem.Compression),
+					Level: matchedItem.CompressionLevel,
+				}
+			}
+
+			if lsCopy.Jumphost == nil && lsCopy.Host.ProxyCommand == "" {
+				if matchedItem.Jumphost != "" {
+					lsCopy.Jumphost, err = r.resolveJumphosts(matchedItem.Jumphost, 0)
+					if err != nil {
+						return nil, errors.Annotatef(err, "logstream %s, resolving jumphost %q", lsCopy.Name, matchedItem.Jumphost)
+					}
+				} else {
+					lsCopy.Host.ProxyCommand = matchedItem.proxyCommand
+				}
+			}
+
 			lsCopy.Host.Addr = fmt.Sprintf("%s:%s", addrCopy.host, addrCopy.port)
 
 			ret = append(ret, lsCopy)
@@ -427,15 +964,7 @@ func setLogStreamsDefaults(
 			ls.Host.User = osUser
 		}
 
-		if len(ls.LogFiles) == 0 {
-			// Will be autodetected by the agent script.
-			ls.LogFiles = append(ls.LogFiles, "auto")
-		}
-
-		if len(ls.LogFiles) == 1 {
-			// Will be autodetected by the agent script.
-			ls.LogFiles = append(ls.LogFiles, "auto")
-		}
+		ls.LogFiles = setLogFilesDefaults(ls.LogFiles)
 
 		ret = append(ret, ls)
 	}
@@ -443,6 +972,17 @@ func setLogStreamsDefaults(
 	return ret, nil
 }
 
+// setLogFilesDefaults makes sure there are at least two log files (the last
+// one and the previous one), the missing ones will be autodetected by the agent
+// script.
+func setLogFilesDefaults(logFiles []string) []string {
+	for len(logFiles) < 2 {
+		logFiles = append(logFiles, "auto")
+	}
+
+	return logFiles
+}
+
 type parsedAddr struct {
 	host string
 	port string
@@ -509,8 +1049,11 @@ func sshConfigToLSConfig(sshConfig *ssh_config.Config) (ConfigLogStreams, error)
 		hostname, _ := sshConfig.Get(name, "HostName")
 		port, _ := sshConfig.Get(name, "Port")
 		user, _ := sshConfig.Get(name, "User")
+		sshOptions := sshOptionsForHost(sshConfig, name)
+		proxyJump, proxyCommand := sshProxyForHost(sshConfig, name)
 
-		if hostname == "" && port == "" && user == "" {
+		if hostname == "" && port == "" && user == "" && sshOptions == nil &&
+			proxyJump == "" && proxyCommand == "" {
 			// We can't get anything useful out of this entry anyway, so don't add it
 			continue
 		}
@@ -519,8 +1062,98 @@ func sshConfigToLSConfig(sshConfig *ssh_config.Config) (ConfigLogStreams, error)
 			Hostname: hostname,
 			Port:     port,
 			User:     user,
+			Jumphost: proxyJump,
+
+			sshAlias:     name,
+			sshOptions:   sshOptions,
+			proxyCommand: proxyCommand,
 		}
 	}
 
 	return ret, nil
 }
+
+// sshOptionsForHost returns the ssh options for the given host alias (as it'd
+// be given to the ssh command) from the ssh config. If there are no relevant
+// options, or no ssh config at all, it returns nil.
+func sshOptionsForHost(sshConfig *ssh_config.Config, alias string) *SSHOptions {
+	if sshConfig == nil {
+		return nil
+	}
+
+	strictHostKeyChecking, _ := sshConfig.Get(alias, "StrictHostKeyChecking")
+	userKnownHostsFile, _ := sshConfig.Get(alias, "UserKnownHostsFile")
+	globalKnownHostsFile, _ := sshConfig.Get(alias, "GlobalKnownHostsFile")
+	hashKnownHosts, _ := sshConfig.Get(alias, "HashKnownHosts")
+	identityFiles, _ := sshConfig.GetAll(alias, "IdentityFile")
+	identitiesOnly, _ := sshConfig.Get(alias, "IdentitiesOnly")
+
+	ret := &SSHOptions{
+		StrictHostKeyChecking: strings.ToLower(strictHostKeyChecking),
+		UserKnownHostsFiles:   splitSSHOptionList(userKnownHostsFile),
+		GlobalKnownHostsFiles: splitSSHOptionList(globalKnownHostsFile),
+		HashKnownHosts:        strings.ToLower(hashKnownHosts),
+		IdentityFiles:         identityFiles,
+		IdentitiesOnly:        strings.ToLower(identitiesOnly),
+	}
+
+	if ret.isEmpty() {
+		return nil
+	}
+
+	return ret
+}
+
+// sshConfigHasHost returns whether the ssh config has a Host entry for exactly
+// this alias (not counting the patterns).
+func sshConfigHasHost(sshConfig *ssh_config.Config, alias string) bool {
+	if sshConfig == nil {
+		return false
+	}
+
+	for _, host := range sshConfig.Hosts {
+		for _, pattern := range host.Patterns {
+			if pattern.String() == alias {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sshProxyForHost returns the ProxyJump and ProxyCommand options for the
+// given host alias from the ssh config. At most one of them is non-empty: if
+// both are specified, ProxyJump wins. The value "none" is the same as empty.
+func sshProxyForHost(sshConfig *ssh_config.Config, alias string) (proxyJump, proxyCommand string) {
+	if sshConfig == nil {
+		return "", ""
+	}
+
+	proxyJump, _ = sshConfig.Get(alias, "ProxyJump")
+	if strings.ToLower(proxyJump) == "none" {
+		proxyJump = ""
+	}
+
+	if proxyJump != "" {
+		return proxyJump, ""
+	}
+
+	proxyCommand, _ = sshConfig.Get(alias, "ProxyCommand")
+	if strings.ToLower(proxyCommand) == "none" {
+		proxyCommand = ""
+	}
+
+	return "", proxyCommand
+}
+
+// splitSSHOptionList splits a whitespace-separated list from an ssh option
+// value like UserKnownHostsFile; for an empty value, it returns nil.
+func splitSSHOptionList(s string) []string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return fields
+}
@@ -5,6 +5,7 @@ import (
 	_ "embed"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/kevinburke/ssh_config"
 	"github.com/stretchr/testify/assert"
@@ -14,6 +15,20 @@ import (
 var testSSHConfig1Str []byte
 var testSSHConfig1 *ssh_config.Config
 
+// testSSHConfig1Options are the ssh options which every host gets from the
+// "Host *" section of testSSHConfig1.
+var testSSHConfig1Options = &SSHOptions{
+	IdentityFiles: []string{"~/.ssh/id_rsa"},
+}
+
+//go:embed resolver_testdata/ssh_config_2
+var testSSHConfig2Str []byte
+var testSSHConfig2 *ssh_config.Config
+
+//go:embed resolver_testdata/ssh_config_3
+var testSSHConfig3Str []byte
+var testSSHConfig3 *ssh_config.Config
+
 func init() {
 	buf := bytes.NewBuffer(testSSHConfig1Str)
 	var err error
@@ -21,6 +36,18 @@ func init() {
 	if err != nil {
 		panic(fmt.Sprintf("embedded ssh_config_1 is broken: %s", err.Error()))
 	}
+
+	buf = bytes.NewBuffer(testSSHConfig2Str)
+	testSSHConfig2, err = ssh_config.Decode(buf)
+	if err != nil {
+		panic(fmt.Sprintf("embedded ssh_config_2 is broken: %s", err.Error()))
+	}
+
+	buf = bytes.NewBuffer(testSSHConfig3Str)
+	testSSHConfig3, err = ssh_config.Decode(buf)
+	if err != nil {
+		panic(fmt.Sprintf("embedded ssh_config_3 is broken: %s", err.Error()))
+	}
 }
 
 var testConfigLogStreams1 = ConfigLogStreams(map[string]ConfigLogStream{
@@ -85,6 +112,7 @@ type resolverTestCase struct {
 	osUser string
 
 	configLogStreams ConfigLogStreams
+	configConnection *ConfigConnection
 	sshConfig        *ssh_config.Config
 
 	// input is the logstream spec string that we're feeding to Resolve()
@@ -100,6 +128,7 @@ func runResolverTestCase(t *testing.T, tc resolverTestCase) {
 	resolver := NewLStreamsResolver(LStreamsResolverParams{
 		CurOSUser:        tc.osUser,
 		ConfigLogStreams: tc.configLogStreams,
+		ConfigConnection: tc.configConnection,
 		SSHConfig:        tc.sshConfig,
 	})
 
@@ -726,16 +755,20 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshfoo-01": {
 					Name: "sshfoo-01",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-01.com:3001",
-						User: "user-foo-from-ssh-config-01",
+						Addr:  "host-foo-from-ssh-config-01.com:3001",
+						User:  "user-foo-from-ssh-config-01",
+						Alias: "sshfoo-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
 				"sshfoo-02": {
 					Name: "sshfoo-02",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-02.com:3002",
-						User: "user-foo-from-ssh-config-02",
+						Addr:  "host-foo-from-ssh-config-02.com:3002",
+						User:  "user-foo-from-ssh-config-02",
+						Alias: "sshfoo-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -753,32 +786,40 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshfoo-01": {
 					Name: "sshfoo-01",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-01.com:3001",
-						User: "user-foo-from-ssh-config-01",
+						Addr:  "host-foo-from-ssh-config-01.com:3001",
+						User:  "user-foo-from-ssh-config-01",
+						Alias: "sshfoo-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
 				"sshfoo-02": {
 					Name: "sshfoo-02",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-02.com:3002",
-						User: "user-foo-from-ssh-config-02",
+						Addr:  "host-foo-from-ssh-config-02.com:3002",
+						User:  "user-foo-from-ssh-config-02",
+						Alias: "sshfoo-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
 				"sshbar-01": {
 					Name: "sshbar-01",
 					Host: ConfigHost{
-						Addr: "host-bar-from-ssh-config-01.com:3001",
-						User: "user-bar-from-ssh-config-01",
+						Addr:  "host-bar-from-ssh-config-01.com:3001",
+						User:  "user-bar-from-ssh-config-01",
+						Alias: "sshbar-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
 				"sshbar-02": {
 					Name: "sshbar-02",
 					Host: ConfigHost{
-						Addr: "host-bar-from-ssh-config-02.com:3002",
-						User: "user-bar-from-ssh-config-02",
+						Addr:  "host-bar-from-ssh-config-02.com:3002",
+						User:  "user-bar-from-ssh-config-02",
+						Alias: "sshbar-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -796,16 +837,20 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshfoo-01::/var/log/auth.log": {
 					Name: "sshfoo-01::/var/log/auth.log",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-01.com:3001",
-						User: "user-foo-from-ssh-config-01",
+						Addr:  "host-foo-from-ssh-config-01.com:3001",
+						User:  "user-foo-from-ssh-config-01",
+						Alias: "sshfoo-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"/var/log/auth.log", "auto"},
 				},
 				"sshfoo-02::/var/log/auth.log": {
 					Name: "sshfoo-02::/var/log/auth.log",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-02.com:3002",
-						User: "user-foo-from-ssh-config-02",
+						Addr:  "host-foo-from-ssh-config-02.com:3002",
+						User:  "user-foo-from-ssh-config-02",
+						Alias: "sshfoo-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"/var/log/auth.log", "auto"},
 				},
@@ -823,8 +868,10 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshfoo-02": {
 					Name: "sshfoo-02",
 					Host: ConfigHost{
-						Addr: "host-foo-from-ssh-config-02.com:3002",
-						User: "user-foo-from-ssh-config-02",
+						Addr:  "host-foo-from-ssh-config-02.com:3002",
+						User:  "user-foo-from-ssh-config-02",
+						Alias: "sshfoo-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -842,8 +889,10 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshrealhost.com": {
 					Name: "sshrealhost.com",
 					Host: ConfigHost{
-						Addr: "sshrealhost.com:4001",
-						User: "user-from-ssh-config",
+						Addr:  "sshrealhost.com:4001",
+						User:  "user-from-ssh-config",
+						Alias: "sshrealhost.com",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -861,8 +910,10 @@ func TestLStreamsResolverGlobOnlySSHConfig(t *testing.T) {
 				"sshnoport-01": {
 					Name: "sshnoport-01",
 					Host: ConfigHost{
-						Addr: "host-noport-from-ssh-config-01.com:22",
-						User: "user-noport-from-ssh-config-01",
+						Addr:  "host-noport-from-ssh-config-01.com:22",
+						User:  "user-noport-from-ssh-config-01",
+						Alias: "sshnoport-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -894,6 +945,7 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Host: ConfigHost{
 						Addr: "host-foo-from-nerdlog-config-01.com:2001",
 						User: "user-foo-from-nerdlog-config-01",
+						SSH:  testSSHConfig1Options,
 					},
 					LogFiles: []string{"/from/nerdlog/config/foolog", "auto"},
 				},
@@ -902,6 +954,7 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 					Host: ConfigHost{
 						Addr: "host-foo-from-nerdlog-config-02.com:2002",
 						User: "user-foo-from-nerdlog-config-02",
+						SSH:  testSSHConfig1Options,
 					},
 					LogFiles: []string{"/from/nerdlog/config/foolog", "auto"},
 				},
@@ -921,16 +974,20 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 				"bar-01": {
 					Name: "bar-01",
 					Host: ConfigHost{
-						Addr: "host-bar-from-nerdlog-config-01.com:6001",
-						User: "user-bar-from-nerdlog-config-01",
+						Addr:  "host-bar-from-nerdlog-config-01.com:6001",
+						User:  "user-bar-from-nerdlog-config-01",
+						Alias: "host-bar-from-nerdlog-config-01.com",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
 				"bar-02": {
 					Name: "bar-02",
 					Host: ConfigHost{
-						Addr: "host-bar-from-nerdlog-config-02.com:6002",
-						User: "user-bar-from-nerdlog-config-02",
+						Addr:  "host-bar-from-nerdlog-config-02.com:6002",
+						User:  "user-bar-from-nerdlog-config-02",
+						Alias: "host-bar-from-nerdlog-config-02.com",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"auto", "auto"},
 				},
@@ -950,16 +1007,20 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 				"baz-01": {
 					Name: "baz-01",
 					Host: ConfigHost{
-						Addr: "host-baz-from-ssh-config-01.com:7001",
-						User: "user-baz-from-ssh-config-01",
+						Addr:  "host-baz-from-ssh-config-01.com:7001",
+						User:  "user-baz-from-ssh-config-01",
+						Alias: "baz-01",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"/from/nerdlog/config/bazlog", "auto"},
 				},
 				"baz-02": {
 					Name: "baz-02",
 					Host: ConfigHost{
-						Addr: "host-baz-from-ssh-config-02.com:7002",
-						User: "user-baz-from-ssh-config-02",
+						Addr:  "host-baz-from-ssh-config-02.com:7002",
+						User:  "user-baz-from-ssh-config-02",
+						Alias: "baz-02",
+						SSH:   testSSHConfig1Options,
 					},
 					LogFiles: []string{"/from/nerdlog/config/bazlog", "auto"},
 				},
@@ -973,3 +1034,754 @@ func TestLStreamsResolverGlobBothNerdlogAndSSHConfigs(t *testing.T) {
 		})
 	}
 }
+
+func TestLStreamsResolverSSHOptions(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "options from the matching host and from Host *",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig2,
+
+			input: "strict-01",
+
+			wantStreams: map[string]LogStream{
+				"strict-01": {
+					Name: "strict-01",
+					Host: ConfigHost{
+						Addr:  "host-strict-01.com:22",
+						User:  "osuser",
+						Alias: "strict-01",
+						SSH: &SSHOptions{
+							StrictHostKeyChecking: "yes",
+							UserKnownHostsFiles:   []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts_extra"},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "glob, options from the matching hosts",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig2,
+
+			input: "*-01",
+
+			wantStreams: map[string]LogStream{
+				"lax-01": {
+					Name: "lax-01",
+					Host: ConfigHost{
+						Addr:  "host-lax-01.com:22",
+						User:  "osuser",
+						Alias: "lax-01",
+						SSH: &SSHOptions{
+							StrictHostKeyChecking: "accept-new",
+							UserKnownHostsFiles:   []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts_extra"},
+							HashKnownHosts:        "yes",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+				"strict-01": {
+					Name: "strict-01",
+					Host: ConfigHost{
+						Addr:  "host-strict-01.com:22",
+						User:  "osuser",
+						Alias: "strict-01",
+						SSH: &SSHOptions{
+							StrictHostKeyChecking: "yes",
+							UserKnownHostsFiles:   []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts_extra"},
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "no matching host, options from Host *",
+			osUser: "osuser",
+
+			configLogStreams: testConfigLogStreams1,
+			sshConfig:        testSSHConfig2,
+
+			input: "myhost-01",
+
+			wantStreams: map[string]LogStream{
+				"myhost-01": {
+					Name: "myhost-01",
+					Host: ConfigHost{
+						Addr: "host-from-nerdlog-config-01.com:1001",
+						User: "user-from-nerdlog-config-01",
+						SSH: &SSHOptions{
+							UserKnownHostsFiles: []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts_extra"},
+						},
+					},
+					LogFiles: []string{"/from/nerdlog/config/mylog_1", "auto"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverJumphosts(t *testing.T) {
+	bastionA := ConfigHost{
+		Addr:  "bastion-a.example.com:2222",
+		User:  "jumpuser",
+		Alias: "bastion-a",
+	}
+
+	tests := []resolverTestCase{
+		{
+			name:   "multi-hop ProxyJump from ssh config",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "inner-a",
+
+			wantStreams: map[string]LogStream{
+				"inner-a": {
+					Name: "inner-a",
+					Host: ConfigHost{
+						Addr:  "inner-a.internal:22",
+						User:  "osuser",
+						Alias: "inner-a",
+					},
+					Jumphost: &ConfigHost{
+						Addr:     "hop-b.internal:22",
+						User:     "osuser",
+						Alias:    "hop-b",
+						Jumphost: &bastionA,
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "first hop has its own ProxyJump",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "inner-b",
+
+			wantStreams: map[string]LogStream{
+				"inner-b": {
+					Name: "inner-b",
+					Host: ConfigHost{
+						Addr:  "inner-b.internal:22",
+						User:  "osuser",
+						Alias: "inner-b",
+					},
+					Jumphost: &ConfigHost{
+						Addr:     "hop-c.internal:22",
+						User:     "osuser",
+						Alias:    "hop-c",
+						Jumphost: &bastionA,
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "ProxyCommand from ssh config",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "proxied-a",
+
+			wantStreams: map[string]LogStream{
+				"proxied-a": {
+					Name: "proxied-a",
+					Host: ConfigHost{
+						Addr:         "proxied-a.internal:22",
+						User:         "osuser",
+						Alias:        "proxied-a",
+						ProxyCommand: "nc -X connect -x proxy:3128 %h %p",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "ProxyJump none",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "direct-a",
+
+			wantStreams: map[string]LogStream{
+				"direct-a": {
+					Name: "direct-a",
+					Host: ConfigHost{
+						Addr:  "direct-a.internal:22",
+						User:  "osuser",
+						Alias: "direct-a",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "jumphost from the flag overrides ProxyJump",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "-J admin@bastion-a:22 inner-a",
+
+			wantStreams: map[string]LogStream{
+				"-J admin@bastion-a:22 inner-a": {
+					Name: "-J admin@bastion-a:22 inner-a",
+					Host: ConfigHost{
+						Addr:  "inner-a.internal:22",
+						User:  "osuser",
+						Alias: "inner-a",
+					},
+					Jumphost: &ConfigHost{
+						Addr:  "bastion-a.example.com:22",
+						User:  "admin",
+						Alias: "bastion-a",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "jumphost from nerdlog config, hops resolved via both configs",
+			osUser: "osuser",
+
+			configLogStreams: ConfigLogStreams{
+				"myhost-01": ConfigLogStream{
+					Hostname: "host-from-nerdlog-config-01.com",
+					Jumphost: "myjumphost, hop-b",
+				},
+				"myjumphost": ConfigLogStream{
+					Hostname: "myjumphost.example.com",
+					User:     "nerdlogjumpuser",
+				},
+			},
+			sshConfig: testSSHConfig3,
+			input:     "myhost-01",
+
+			wantStreams: map[string]LogStream{
+				"myhost-01": {
+					Name: "myhost-01",
+					Host: ConfigHost{
+						Addr: "host-from-nerdlog-config-01.com:22",
+						User: "osuser",
+					},
+					Jumphost: &ConfigHost{
+						Addr:  "hop-b.internal:22",
+						User:  "osuser",
+						Alias: "hop-b",
+						Jumphost: &ConfigHost{
+							Addr: "myjumphost.example.com:22",
+							User: "nerdlogjumpuser",
+						},
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "ProxyJump loop",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig3,
+			input:     "loop-a",
+
+			wantErr: `parsing entry #1 (loop-a): expanding from ssh config: logstream loop-a, resolving jumphost "loop-a": too many jumphost hops (more than 10), is there a loop in the config?`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverLocal(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "local without log files",
+			osUser: "osuser",
+
+			sshConfig: testSSHConfig1,
+			input:     "local",
+
+			wantStreams: map[string]LogStream{
+				"local": {
+					Name: "local",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					LogFiles:  []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "local with log files, together with a remote one",
+			osUser: "osuser",
+
+			input: "local:/var/log/app.log:/var/log/app.log.1, myserver.com",
+
+			wantStreams: map[string]LogStream{
+				"local:/var/log/app.log:/var/log/app.log.1": {
+					Name: "local:/var/log/app.log:/var/log/app.log.1",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					LogFiles:  []string{"/var/log/app.log", "/var/log/app.log.1"},
+				},
+				"myserver.com": {
+					Name: "myserver.com",
+					Host: ConfigHost{
+						Addr: "myserver.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "local with a jumphost",
+			osUser: "osuser",
+
+			input: "-J mybastion local:/var/log/app.log",
+
+			wantErr: `parsing entry #1 (-J mybastion local:/var/log/app.log): jumphost can't be used with local logstreams`,
+		},
+
+		{
+			name:   "local with too many colons",
+			osUser: "osuser",
+
+			input: "local:/a:/b:/c",
+
+			wantErr: `parsing entry #1 (local:/a:/b:/c): "local:/a:/b:/c": too many colons`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverDocker(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "local docker",
+			osUser: "osuser",
+
+			input: "docker://myctr:/var/log/app.log",
+
+			wantStreams: map[string]LogStream{
+				"docker://myctr:/var/log/app.log": {
+					Name: "docker://myctr:/var/log/app.log",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					ShellCmd:  []string{"docker", "exec", "-i", "myctr", "bash"},
+					LogFiles:  []string{"/var/log/app.log", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "docker on a host from the flag",
+			osUser: "osuser",
+
+			input: "docker://myuser@myserver.com:2222/myctr",
+
+			wantStreams: map[string]LogStream{
+				"docker://myuser@myserver.com:2222/myctr": {
+					Name: "docker://myuser@myserver.com:2222/myctr",
+					Host: ConfigHost{
+						Addr: "myserver.com:2222",
+						User: "myuser",
+					},
+					ShellCmd: []string{"docker", "exec", "-i", "myctr", "bash"},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "docker on hosts from a glob, log files from the config are not used",
+			osUser: "osuser",
+
+			configLogStreams: testConfigLogStreams1,
+			sshConfig:        testSSHConfig1,
+
+			input: "docker://baz-*/myctr:/var/log/app.log:/var/log/app.log.1",
+
+			wantStreams: map[string]LogStream{
+				"docker://baz-01/myctr:/var/log/app.log:/var/log/app.log.1": {
+					Name: "docker://baz-01/myctr:/var/log/app.log:/var/log/app.log.1",
+					Host: ConfigHost{
+						Addr:  "host-baz-from-ssh-config-01.com:7001",
+						User:  "user-baz-from-ssh-config-01",
+						Alias: "baz-01",
+						SSH:   testSSHConfig1Options,
+					},
+					ShellCmd: []string{"docker", "exec", "-i", "myctr", "bash"},
+					LogFiles: []string{"/var/log/app.log", "/var/log/app.log.1"},
+				},
+				"docker://baz-02/myctr:/var/log/app.log:/var/log/app.log.1": {
+					Name: "docker://baz-02/myctr:/var/log/app.log:/var/log/app.log.1",
+					Host: ConfigHost{
+						Addr:  "host-baz-from-ssh-config-02.com:7002",
+						User:  "user-baz-from-ssh-config-02",
+						Alias: "baz-02",
+						SSH:   testSSHConfig1Options,
+					},
+					ShellCmd: []string{"docker", "exec", "-i", "myctr", "bash"},
+					LogFiles: []string{"/var/log/app.log", "/var/log/app.log.1"},
+				},
+			},
+		},
+
+		{
+			name:   "no container",
+			osUser: "osuser",
+
+			input: "docker://myserver.com/:/var/log/app.log",
+
+			wantErr: `parsing entry #1 (docker://myserver.com/:/var/log/app.log): parsing "docker://myserver.com/:/var/log/app.log" as a docker logstream: no container`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverK8s(t *testing.T) {
+	setupFakeKubectl(t, testK8sPodsJSON)
+
+	tests := []resolverTestCase{
+		{
+			name:   "one logstream per running pod",
+			osUser: "osuser",
+
+			input: "k8s://myns/app=web:/var/log/app.log",
+
+			wantStreams: map[string]LogStream{
+				"web-7d9f-a1": {
+					Name: "web-7d9f-a1",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					ShellCmd:  []string{"kubectl", "exec", "-i", "--namespace", "myns", "web-7d9f-a1", "--", "bash"},
+					LogFiles:  []string{"/var/log/app.log", "auto"},
+				},
+				"web-7d9f-b2": {
+					Name: "web-7d9f-b2",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					ShellCmd:  []string{"kubectl", "exec", "-i", "--namespace", "myns", "web-7d9f-b2", "--", "bash"},
+					LogFiles:  []string{"/var/log/app.log", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "selector with a prefixed key",
+			osUser: "osuser",
+
+			input: "k8s://myns/app.kubernetes.io/name=web",
+
+			wantStreams: map[string]LogStream{
+				"web-7d9f-a1": {
+					Name: "web-7d9f-a1",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					ShellCmd:  []string{"kubectl", "exec", "-i", "--namespace", "myns", "web-7d9f-a1", "--", "bash"},
+					LogFiles:  []string{"auto", "auto"},
+				},
+				"web-7d9f-b2": {
+					Name: "web-7d9f-b2",
+					Host: ConfigHost{
+						Addr: "localhost",
+						User: "osuser",
+					},
+					Transport: TransportLocal,
+					ShellCmd:  []string{"kubectl", "exec", "-i", "--namespace", "myns", "web-7d9f-b2", "--", "bash"},
+					LogFiles:  []string{"auto", "auto"},
+				},
+			},
+		},
+
+		{
+			name:   "no namespace",
+			osUser: "osuser",
+
+			input: "k8s://app=web",
+
+			wantErr: `parsing entry #1 (k8s://app=web): parsing "k8s://app=web" as a k8s logstream: no namespace`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverConnection(t *testing.T) {
+	maxAttempts := 5
+
+	tests := []resolverTestCase{
+		{
+			name:   "global and per-host connection settings",
+			osUser: "osuser",
+			configLogStreams: ConfigLogStreams{
+				"flaky": ConfigLogStream{
+					Hostname: "flaky.com",
+					Jumphost: "bastion.com",
+					Connection: &ConfigConnection{
+						DialTimeout: 20 * time.Second,
+						MaxAttempts: &maxAttempts,
+					},
+				},
+			},
+			configConnection: &ConfigConnection{
+				DialTimeout:    10 * time.Second,
+				ReconnectDelay: 1 * time.Second,
+			},
+			input: "flaky, other.com",
+			wantStreams: map[string]LogStream{
+				"flaky": {
+					Name: "flaky",
+					Host: ConfigHost{
+						Addr:        "flaky.com:22",
+						User:        "osuser",
+						DialTimeout: 20 * time.Second,
+					},
+					Jumphost: &ConfigHost{
+						Addr:        "bastion.com:22",
+						User:        "osuser",
+						DialTimeout: 20 * time.Second,
+					},
+					LogFiles: []string{"auto", "auto"},
+					Connection: &ConfigConnection{
+						DialTimeout:    20 * time.Second,
+						ReconnectDelay: 1 * time.Second,
+						MaxAttempts:    &maxAttempts,
+					},
+				},
+				"other.com": {
+					Name: "other.com",
+					Host: ConfigHost{
+						Addr:        "other.com:22",
+						User:        "osuser",
+						DialTimeout: 10 * time.Second,
+					},
+					LogFiles: []string{"auto", "auto"},
+					Connection: &ConfigConnection{
+						DialTimeout:    10 * time.Second,
+						ReconnectDelay: 1 * time.Second,
+					},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverWorkDir(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "work dir from the config",
+			osUser: "osuser",
+			configLogStreams: ConfigLogStreams{
+				"noexec-tmp": ConfigLogStream{
+					Hostname: "noexec.com",
+					WorkDir:  "~/.nerdlog",
+				},
+			},
+			input: "noexec-tmp, other.com",
+			wantStreams: map[string]LogStream{
+				"noexec-tmp": {
+					Name: "noexec-tmp",
+					Host: ConfigHost{
+						Addr: "noexec.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"auto", "auto"},
+					WorkDir:  "~/.nerdlog",
+				},
+				"other.com": {
+					Name: "other.com",
+					Host: ConfigHost{
+						Addr: "other.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverSudo(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "sudo and sudo_user",
+			osUser: "osuser",
+			configLogStreams: ConfigLogStreams{
+				"auth": ConfigLogStream{
+					Hostname: "myhost.com",
+					LogFiles: []string{"/var/log/auth.log"},
+					Sudo:     true,
+				},
+				"pg": ConfigLogStream{
+					Hostname: "myhost.com",
+					LogFiles: []string{"/var/log/postgresql/postgresql.log"},
+					SudoUser: "postgres",
+					SudoCmd:  "doas",
+				},
+			},
+			input: "auth, pg, other.com",
+			wantStreams: map[string]LogStream{
+				"auth": {
+					Name: "auth",
+					Host: ConfigHost{
+						Addr: "myhost.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"/var/log/auth.log", "auto"},
+					Sudo:     &LogStreamSudo{},
+				},
+				"pg": {
+					Name: "pg",
+					Host: ConfigHost{
+						Addr: "myhost.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"/var/log/postgresql/postgresql.log", "auto"},
+					Sudo: &LogStreamSudo{
+						User: "postgres",
+						Cmd:  "doas",
+					},
+				},
+				"other.com": {
+					Name: "other.com",
+					Host: ConfigHost{
+						Addr: "other.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
+
+func TestLStreamsResolverCompression(t *testing.T) {
+	tests := []resolverTestCase{
+		{
+			name:   "compression from the config",
+			osUser: "osuser",
+			configLogStreams: ConfigLogStreams{
+				"far": ConfigLogStream{
+					Hostname:         "far.com",
+					Compression:      "zstd",
+					CompressionLevel: 3,
+				},
+			},
+			input: "far, other.com",
+			wantStreams: map[string]LogStream{
+				"far": {
+					Name: "far",
+					Host: ConfigHost{
+						Addr: "far.com:22",
+						User: "osuser",
+					},
+					LogFiles:    []string{"auto", "auto"},
+					Compression: LogStreamCompression{Kind: CompressionZstd, Level: 3},
+				},
+				"other.com": {
+					Name: "other.com",
+					Host: ConfigHost{
+						Addr: "other.com:22",
+						User: "osuser",
+					},
+					LogFiles: []string{"auto", "auto"},
+				},
+			},
+		},
+		{
+			name:   "invalid compression level",
+			osUser: "osuser",
+			configLogStreams: ConfigLogStreams{
+				"far": ConfigLogStream{
+					Hostname:         "far.com",
+					Compression:      "gzip",
+					CompressionLevel: 12,
+				},
+			},
+			input:   "far",
+			wantErr: "parsing entry #1 (far): logstream far: gzip compression level must be 1-9, got 12",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runResolverTestCase(t, tt)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// The client talks to the logstream host over the plain stdout and stderr of
+// a shell, where the control lines (like the one marking that a command is
+// done) are interleaved with whatever the commands print, including the log
+// lines. To make sure that nothing else can be taken for a control line, every
+// control line starts with the marker prefix, which contains a random nonce
+// generated for every connection, like this:
+//
+//	nerdlog_3f9c0a1b2d4e5f60:command_done:12
+//
+// The compressed output of a query is framed with the same prefix too: it's
+// sent in chunks, each one preceded with its length, so that the raw
+// compressed bytes are never looked at as lines, and the client can
+// decompress them as they arrive. The zero-length chunk terminates the
+// payload. With gzip, it looks like this (and with zstd, it's the same, just
+// with "zstd:" instead of "gzip:"):
+//
+//	nerdlog_3f9c0a1b2d4e5f60:gzip:<length>
+//	<exactly length bytes of gzip data>
+//	nerdlog_3f9c0a1b2d4e5f60:gzip:<length>
+//	<exactly length bytes of gzip data>
+//	...
+//	nerdlog_3f9c0a1b2d4e5f60:gzip:0
+const (
+	// markerCommandDone is followed by the index of the command which is done;
+	// it's printed to both stdout and stderr after every command.
+	markerCommandDone = "command_done:"
+
+	// markerError is followed by the error message.
+	markerError = "error:"
+
+	// markerExitCode is followed by the exit code of the command.
+	markerExitCode = "exit_code:"
+
+	// markerResetOutput makes the client forget the unhandled output which was
+	// received so far for the current command.
+	markerResetOutput = "reset_output"
+
+	// markerGzip is followed by the length of the next gzip payload chunk in
+	// bytes, and the chunk itself starts right after the newline; the zero
+	// length means the end of the payload.
+	markerGzip = "gzip:"
+
+	// markerZstd is the same as markerGzip, but for the zstd payload.
+	markerZstd = "zstd:"
+)
+
+// markerPrefixShellVar is the name of the shell variable in the bootstrap
+// script which contains the marker prefix.
+const markerPrefixShellVar = "nerdlog_marker_prefix"
+
+// newMarkerPrefix returns the marker prefix with a new random nonce.
+func newMarkerPrefix() string {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		// Should never happen, but if it does, we can't talk to the host safely.
+		panic(fmt.Sprintf("generating marker nonce: %s", err.Error()))
+	}
+
+	return "nerdlog_" + hex.EncodeToString(nonce) + ":"
+}
@@ -5,7 +5,15 @@
 # This script logic is really convoluted and hard to understand, and begs for a
 # major rewrite.
 
-trap 'echo "exit_code:$?"' EXIT
+# For the query command, become the leader of a new process group, so that
+# the client can cancel the query by killing the whole group, including all the
+# awk etc subprocesses. Since we're not a group leader yet, setsid doesn't
+# fork, so the pid stays the same.
+if [[ "$1" == "query" && "$NERDLOG_AGENT_SETSID" == "" ]] && command -v setsid > /dev/null; then
+  NERDLOG_AGENT_SETSID=1 exec setsid bash "$0" "$@"
+fi
+
+trap 'echo "${marker_prefix}exit_code:$?"' EXIT
 
 # Arguments:
 #
@@ -20,13 +28,28 @@ STAGE_DONE=4
 
 indexfile=/tmp/nerdlog_agent_index
 
-logfile_prev=auto
-logfile_last=auto
+# work_dir is where all the nerdlog files are, like the index files. The
+# client always provides it; the default is only for the manual runs and
+# tests.
+work_dir=/tmp
+
+# logfiles are given with the repeated --logfile flag, the latest one first,
+# and the older rotated ones after it, like /var/log/syslog,
+# /var/log/syslog.1, etc. Any of them can be "auto", and the rotated ones can
+# also be glob patterns like /var/log/syslog.*.gz; see below how they're
+# resolved. The rotated ones can be compressed with gzip or zstd (as long as
+# the name ends with .gz or .zst).
+logfiles=()
 
 positional_args=()
 
 max_num_lines=100
 
+# marker_prefix is prepended to the "error:" and "exit_code:" lines. The client
+# gives the per-session prefix with a random nonce, so that these lines can't
+# be confused with whatever else is printed.
+marker_prefix=""
+
 awktime_month='monthByName[substr($0, 1, 3)]'
 awktime_year='yearByMonth[month]'
 awktime_day='(substr($0, 5, 1) == " ") ? "0" substr($0, 6, 1) : substr($0, 5, 2)'
@@ -97,6 +120,163 @@ function detect_timezone() { # {{{
   exit 1
 } # }}}
 
+# The functions below print the info about the tools available on the host,
+# for the logstream_info command. Every one of them prints the tool name and
+# version, like "gawk 5.1.0", or nothing if the tool is not found.
+
+function awk_info() { # {{{
+  local awk_path version_str
+
+  awk_path="$(command -v gawk || command -v awk)" || return 0
+
+  version_str="$("$awk_path" --version 2>/dev/null | head -n 1)"
+  if [[ "$version_str" == "GNU Awk "* ]]; then
+    version_str="${version_str#GNU Awk }"
+    echo "gawk ${version_str%%[ ,]*}"
+    return 0
+  fi
+
+  version_str="$("$awk_path" -W version 2>&1 | head -n 1)"
+  if [[ "$version_str" == "mawk "* ]]; then
+    version_str="${version_str#mawk }"
+    echo "mawk ${version_str%% *}"
+    return 0
+  fi
+
+  if [[ "$(readlink -f "$awk_path")" == */busybox ]]; then
+    echo "busybox $(busybox_version)"
+    return 0
+  fi
+
+  echo "unknown"
+} # }}}
+
+function gzip_info() { # {{{
+  local version_str
+
+  command -v gzip > /dev/null || return 0
+
+  version_str="$(gzip --version 2>&1 | head -n 1)"
+  case "$version_str" in
+    gzip\ *)
+      echo "gzip ${version_str##* }"
+      ;;
+    *BusyBox*)
+      echo "busybox $(busybox_version)"
+      ;;
+    *)
+      echo "unknown"
+      ;;
+  esac
+} # }}}
+
+function zstd_info() { # {{{
+  local version_str
+
+  command -v zstd > /dev/null || return 0
+
+  # The first line looks like "*** Zstandard CLI (64-bit) v1.5.5, by Yann Collet ***"
+  version_str="$(zstd --version 2>&1 | head -n 1)"
+  if [[ "$version_str" =~ \ v([0-9][^,\ ]*) ]]; then
+    echo "zstd ${BASH_REMATCH[1]}"
+    return 0
+  fi
+
+  echo "unknown"
+} # }}}
+
+function coreutils_info() { # {{{
+  local version_str
+
+  version_str="$(ls --version 2>/dev/null | head -n 1)"
+  if [[ "$version_str" == *"(GNU coreutils)"* ]]; then
+    echo "coreutils ${version_str##* }"
+    return 0
+  fi
+
+  if [[ "$(readlink -f "$(command -v ls)")" == */busybox ]]; then
+    echo "busybox $(busybox_version)"
+    return 0
+  fi
+
+  echo "unknown"
+} # }}}
+
+function busybox_version() { # {{{
+  # The first line looks like "BusyBox v1.36.1 (2023-07-27 17:12:24 UTC) multi-call binary."
+  local version_str
+  version_str="$(busybox 2>&1 | head -n 1)"
+  version_str="${version_str#BusyBox }"
+  echo "${version_str%% *}"
+} # }}}
+
+# print_host_info prints the "cap:" lines with the tools available on the
+# host, and the free space in the work dir (in bytes).
+function print_host_info() { # {{{
+  local df_line avail_kb
+
+  echo "cap:bash:bash $BASH_VERSION"
+  echo "cap:awk:$(awk_info)"
+  echo "cap:gzip:$(gzip_info)"
+  echo "cap:zstd:$(zstd_info)"
+  echo "cap:coreutils:$(coreutils_info)"
+
+  if stat -c %s "$work_dir" > /dev/null 2>&1; then
+    echo "cap:stat_c:1"
+  else
+    echo "cap:stat_c:0"
+  fi
+
+  if command -v timedatectl > /dev/null; then
+    echo "cap:timedatectl:1"
+  else
+    echo "cap:timedatectl:0"
+  fi
+
+  df_line="$(df -Pk "$work_dir" 2>/dev/null | tail -n 1)"
+  read -r _ _ _ avail_kb _ <<< "$df_line"
+  if [[ "$avail_kb" =~ ^[0-9]+$ ]]; then
+    echo "cap:work_dir_free:$((avail_kb * 1024))"
+  fi
+} # }}}
+
+# print_logfile_info prints the "logfile_info:<size>:<mtime>:<path>" line for
+# the given log file, with the mtime as a unix timestamp.
+function print_logfile_info() { # {{{
+  local info
+  info="$(stat -c '%s:%Y' "$1" 2>/dev/null)" || return 0
+  echo "logfile_info:$info:$1"
+} # }}}
+
+# Prints the command which prints the contents of the given log file: the
+# compressed rotated log files are decompressed on the fly.
+function logfile_cat_cmd() { # {{{
+  case "$1" in
+    *.gz)
+      echo "zcat"
+      ;;
+    *.zst)
+      echo "zstdcat"
+      ;;
+    *)
+      echo "cat"
+      ;;
+  esac
+} # }}}
+
+# Prints the files matching the given glob pattern, one per line, the newest
+# first (and alphabetically if the modification times are the same), or
+# nothing if there are no matches.
+function expand_logfile_pattern() { # {{{
+  local matches
+  mapfile -t matches < <(compgen -G "$1")
+  if [[ ${#matches[@]} == 0 ]]; then
+    return 0
+  fi
+
+  stat -c '%Y %n' "${matches[@]}" | sort -s -k1,1nr | cut -d' ' -f2-
+} # }}}
+
 while [[ $# -gt 0 ]]; do
   case $1 in
     -c|--index-file)
@@ -104,13 +284,8 @@ while [[ $# -gt 0 ]]; do
       shift # past argument
       shift # past value
       ;;
-    --logfile-last)
-      logfile_last="$2"
-      shift # past argument
-      shift # past value
-      ;;
-    --logfile-prev)
-      logfile_prev="$2"
+    --logfile)
+      logfiles+=("$2")
       shift # past argument
       shift # past value
       ;;
@@ -133,11 +308,34 @@ while [[ $# -gt 0 ]]; do
       refresh_index="1"
       shift # past argument
       ;;
+    --index-ttl-days)
+      index_ttl_days="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --work-dir)
+      work_dir="$2"
+      shift # past argument
+      shift # past value
+      ;;
+    --dry-run)
+      dry_run="1"
+      shift # past argument
+      ;;
+    --all)
+      cleanup_all="1"
+      shift # past argument
+      ;;
     -l|--max-num-lines)
       max_num_lines="$2"
       shift # past argument
       shift # past value
       ;;
+    --marker-prefix)
+      marker_prefix="$2"
+      shift # past argument
+      shift # past value
+      ;;
 
     --awktime-month)
       awktime_month="$2"
@@ -178,6 +376,34 @@ done
 
 set -- "${positional_args[@]}" # restore positional parameters
 
+# The cleanup command doesn't need gawk or the log files, so it's handled
+# right away. It deletes (or with --dry-run, only lists) all the nerdlog files
+# of the current user in the work dir: the agent scripts (and their temporary
+# copies during the upload), the index files, the query output chunks left
+# after an interrupted query, and the dummy empty log file which older
+# versions of the agent used to create.
+# The agent itself is kept, unless --all is given.
+if [[ "$1" == "cleanup" ]]; then
+  while IFS= read -r -d '' fname; do
+    if [[ "$cleanup_all" != "1" && "$fname" == "$0" ]]; then
+      continue
+    fi
+
+    # Another logstream on the same host might have deleted it already.
+    size=$(stat -c%s "$fname" 2>/dev/null) || continue
+
+    if [[ "$dry_run" == "1" ]]; then
+      echo "file:$size:$fname"
+    elif rm "$fname" 2>/dev/null; then
+      echo "deleted:$size:$fname"
+    elif [ -e "$fname" ]; then
+      echo "${marker_prefix}error:failed to delete $fname"
+    fi
+  done < <(find "$work_dir" -maxdepth 1 -user "$(id -u)" \( -name 'nerdlog_agent_*' -o -name 'nerdlog-empty-file' \) -print0 2>/dev/null)
+
+  exit 0
+fi
+
 # Either use the provided current year and month (for tests), or get the actual ones.
 if [[ "$CUR_YEAR" == "" ]]; then
   CUR_YEAR="$(date +'%Y')"
@@ -188,11 +414,13 @@ if [[ "$CUR_MONTH" == "" ]]; then
 fi
 
 # TODO: instead of always detecting it, add support for the --awk-binary flag,
-# and only autodetect if it wasn't provided. Also, gotta always do this during
-# logstream_info command.
+# and only autodetect if it wasn't provided.
+#
+# The logstream_info command checks it too, but only after reporting all the
+# host info, so it doesn't fail here.
 awk_binary="$(find_gawk_binary)"
-if [[ $? != 0 ]]; then
-  echo "error:gawk (GNU Awk) is a requirement, but not found on the system. Please install it, then retry" 1>&2
+if [[ $? != 0 && "$1" != "logstream_info" ]]; then
+  echo "${marker_prefix}error:gawk (GNU Awk) is a requirement, but not found on the system. Please install it, then retry" 1>&2
   exit 1
 fi
 
@@ -201,44 +429,72 @@ fi
 # https://lists.gnu.org/archive/html/info-gnu/2011-06/msg00013.html
 # Since it's so old, not bothering to check the version for now.
 
-if [[ "$logfile_last" == "auto" ]]; then
+# By default, use the latest log file and the previous one.
+if [[ ${#logfiles[@]} == 0 ]]; then
+  logfiles=(auto auto)
+fi
+
+if [[ "${logfiles[0]}" == "auto" ]]; then
   if [ -e /var/log/messages ]; then
-    logfile_last=/var/log/messages
+    logfiles[0]=/var/log/messages
   elif [ -e /var/log/syslog ]; then
-    logfile_last=/var/log/syslog
+    logfiles[0]=/var/log/syslog
   else
-    echo "error:failed to autodetect log file: neither /var/log/messages nor /var/log/syslog are present. Specify the log file manually" 1>&2
+    echo "${marker_prefix}error:failed to autodetect log file: neither /var/log/messages nor /var/log/syslog are present. Specify the log file manually" 1>&2
     exit 1
   fi
 fi
 
-if [[ "$logfile_prev" == "auto" ]]; then
-  # For now just blindly append ".1" to the first logfile; if it doesn't actually
-  # exist, we'll handle this case right below.
-  logfile_prev="${logfile_last}.1"
+logfile_last="${logfiles[0]}"
+
+# The latest log file is constantly appended to, so it can't be compressed.
+if [[ "$(logfile_cat_cmd "$logfile_last")" != "cat" ]]; then
+  echo "${marker_prefix}error:the latest logfile $logfile_last can't be compressed" 1>&2
+  exit 1
 fi
 
-# A simple hack to account for cases when /var/log/syslog.1 doesn't exist:
-# create an empty file and pretend that it's an empty log file.
-if [ ! -e "$logfile_prev"  ]; then
-  echo "debug:prev logfile $logfile_prev doesn't exist, using a dummy empty file /tmp/nerdlog-empty-file" 1>&2
-  logfile_prev="/tmp/nerdlog-empty-file"
-  rm -f $logfile_prev || exit 1
-  touch $logfile_prev || exit 1
-
-  # For stable output in tests, also update the creation/modification time of
-  # that file to be the same as the first log file. It's not portable though
-  # (not gonna work on BSD), but it's non-essential functionality, so we just
-  # ignore any errors here and do nothing then.
-  ctime=$(stat -c %W $logfile_last)
-  if [[ $? == 0 ]]; then
-    touch -d "@$ctime" $logfile_prev
+# For the rotated log files, "auto" means just appending ".1", ".2" etc to the
+# latest log file, and a glob pattern is replaced with all the matching files,
+# the newest first. The rotated files which don't exist (e.g. the logs weren't
+# rotated yet) are skipped, and so are the ones which are already listed, so
+# after that, every item in logfiles exists (except maybe the latest one, which
+# is checked later).
+resolved_logfiles=("$logfile_last")
+for (( i=1; i<${#logfiles[@]}; i++ )); do
+  logfile="${logfiles[i]}"
+  if [[ "$logfile" == "auto" ]]; then
+    logfile="${logfile_last}.$i"
   fi
-fi
+
+  pattern_logfiles=("$logfile")
+  if [[ "$logfile" == *[*?[]* ]]; then
+    mapfile -t pattern_logfiles < <(expand_logfile_pattern "$logfile")
+    if [[ ${#pattern_logfiles[@]} == 0 ]]; then
+      echo "debug:rotated logfile pattern $logfile doesn't match anything, skipping it" 1>&2
+      continue
+    fi
+  fi
+
+  for logfile in "${pattern_logfiles[@]}"; do
+    if [ ! -e "$logfile" ]; then
+      echo "debug:rotated logfile $logfile doesn't exist, skipping it" 1>&2
+      continue
+    fi
+
+    for resolved in "${resolved_logfiles[@]}"; do
+      if [[ "$resolved" == "$logfile" ]]; then
+        continue 2
+      fi
+    done
+
+    resolved_logfiles+=("$logfile")
+  done
+done
+logfiles=("${resolved_logfiles[@]}")
 
 command="$1"
 if [[ "${command}" == "" ]]; then
-  echo "error:command is required" 1>&2
+  echo "${marker_prefix}error:command is required" 1>&2
   exit 1
 fi
 
@@ -249,6 +505,8 @@ case "${command}" in
     ;;
 
   logstream_info)
+    print_host_info
+
     host_timezone="$(detect_timezone)"
     if [[ $? == 0 ]]; then
       echo "host_timezone:$host_timezone"
@@ -256,46 +514,70 @@ case "${command}" in
       echo "warn:failed to detect host timezone"
     fi
 
-    if [ ! -e ${logfile_last} ]; then
-      echo "error:${logfile_last} does not exist"
+    # Check the tools which the query command can't work without, so that the
+    # problem is reported right away, instead of failing every query later.
+    if [[ "$awk_binary" == "" ]]; then
+      echo "${marker_prefix}error:gawk (GNU Awk) is a requirement, but not found on the system. Please install it, then retry"
       exit 1
     fi
 
-    if [ ! -r ${logfile_last} ]; then
-      echo "error:${logfile_last} exists but is not readable, check your permissions"
+    if ! stat -c %s "$work_dir" > /dev/null 2>&1; then
+      echo "${marker_prefix}error:stat doesn't support the -c option (GNU coreutils or busybox is needed)"
       exit 1
     fi
 
-    if [ ! -e ${logfile_prev} ]; then
-      echo "error:${logfile_prev} does not exist"
-      exit 1
-    fi
+    for logfile in "${logfiles[@]}"; do
+      if [ ! -e "$logfile" ]; then
+        echo "${marker_prefix}error:$logfile does not exist"
+        exit 1
+      fi
 
-    if [ ! -r ${logfile_prev} ]; then
-      echo "error:${logfile_prev} exists but is not readable, check your permissions"
-      exit 1
-    fi
+      if [ ! -r "$logfile" ]; then
+        echo "${marker_prefix}error:$logfile exists but is not readable by $(id -un); if only root can read it, set sudo: true for this logstream in the nerdlog config"
+        exit 1
+      fi
+
+      cat_cmd="$(logfile_cat_cmd "$logfile")"
+      if ! command -v "$cat_cmd" > /dev/null; then
+        echo "${marker_prefix}error:$logfile is compressed, but $cat_cmd is not found on the system. Please install it, then retry"
+        exit 1
+      fi
+    done
+
+    for logfile in "${logfiles[@]}"; do
+      print_logfile_info "$logfile"
+    done
 
     # Print a bunch of example log lines, so that the client can autodetect the
     # format.
-    if [ -s ${logfile_last} ]; then
-      last_line="$(tail -n 1 ${logfile_last})" || exit 1
-      first_line="$(head -n 1 ${logfile_last})" || exit 1
-      echo "example_log_line:$last_line"
-      echo "example_log_line:$first_line"
-    fi
-    if [ -s ${logfile_prev} ]; then
-      last_line="$(tail -n 1 ${logfile_prev})" || exit 1
-      first_line="$(head -n 1 ${logfile_prev})" || exit 1
+    for logfile in "${logfiles[@]}"; do
+      if ! [ -s "$logfile" ]; then
+        continue
+      fi
+
+      cat_cmd="$(logfile_cat_cmd "$logfile")"
+      if [[ "$cat_cmd" == "cat" ]]; then
+        last_line="$(tail -n 1 "$logfile")" || exit 1
+        first_line="$(head -n 1 "$logfile")" || exit 1
+      else
+        last_line="$($cat_cmd "$logfile" | tail -n 1)" || exit 1
+        first_line="$($cat_cmd "$logfile" | head -n 1)" || exit 1
+
+        # A compressed file can be non-empty even if there are no logs in it.
+        if [[ "$first_line" == "" ]]; then
+          continue
+        fi
+      fi
+
       echo "example_log_line:$last_line"
       echo "example_log_line:$first_line"
-    fi
+    done
 
     exit 0
     ;;
 
   *)
-    echo "error:invalid command ${command}" 1>&2
+    echo "${marker_prefix}error:invalid command ${command}" 1>&2
     exit 1
 esac
 
@@ -303,12 +585,38 @@ esac
 
 user_pattern=$1
 
-logfile_prev_size=$(stat -c%s $logfile_prev) || exit 1
-logfile_last_size=$(stat -c%s $logfile_last) || exit 1
-total_size=$((logfile_prev_size+logfile_last_size)) || exit 1
+# The client needs the pid to be able to cancel the query.
+echo "p:pid:$$" 1>&2
+
+# The compressed rotated log files can't be indexed or queried by offsets
+# directly, so for every one of them, the member cache file keeps the number
+# of lines, the decompressed size, and the index lines relative to the
+# beginning of the decompressed file:
+#
+#   member	<inode>:<mtime>	<number of lines>	<decompressed size>
+#   member_idx	<inode>:<mtime>	<timestr>	<linenr>	<bytenr>
+#
+# The key is the inode and the modification time, which don't change when the
+# logs get rotated further (only the names do), so every compressed file is
+# only decompressed once to index it, even when the index is rebuilt.
+members_file="${indexfile}_members"
+
+# If the TTL for the index files is given, delete the index files which
+# weren't used for that many days (they're likely left behind by some other
+# clients), and touch our own ones, so that others don't delete them.
+if [[ "$index_ttl_days" != "" ]]; then
+  find "$work_dir" -maxdepth 1 -user "$(id -u)" -name 'nerdlog_agent_index_*' \
+    -mtime "+$index_ttl_days" ! -path "$indexfile" ! -path "$members_file" -delete 2>/dev/null
+fi
+if [ -e "$indexfile" ]; then
+  touch "$indexfile"
+fi
+if [ -e "$members_file" ]; then
+  touch "$members_file"
+fi
 
 if [[ "$refresh_index" == "1" ]]; then
-  rm -f $indexfile || exit 1
+  rm -f $indexfile $members_file || exit 1
 fi
 
 # NOTE: we only show percentages with 5% increments, to save on traffic and
@@ -325,62 +633,57 @@ function printPercentage(numCur, numTotal) {
 }
 '
 
-function refresh_index { # {{{
-  local last_linenr=0
-  local last_bytenr=0
-  local prevlog_bytes=$(get_prevlog_bytenr)
-
-  awk_vars='
-    monthByName["Jan"] = "01";
-    monthByName["Feb"] = "02";
-    monthByName["Mar"] = "03";
-    monthByName["Apr"] = "04";
-    monthByName["May"] = "05";
-    monthByName["Jun"] = "06";
-    monthByName["Jul"] = "07";
-    monthByName["Aug"] = "08";
-    monthByName["Sep"] = "09";
-    monthByName["Oct"] = "10";
-    monthByName["Nov"] = "11";
-    monthByName["Dec"] = "12";
-
-    curYear = '${CUR_YEAR}';
-    curMonth = '${CUR_MONTH}';
-
-    yearByMonth["01"] = inferYear(1, curYear, curMonth) "";
-    yearByMonth["02"] = inferYear(2, curYear, curMonth) "";
-    yearByMonth["03"] = inferYear(3, curYear, curMonth) "";
-    yearByMonth["04"] = inferYear(4, curYear, curMonth) "";
-    yearByMonth["05"] = inferYear(5, curYear, curMonth) "";
-    yearByMonth["06"] = inferYear(6, curYear, curMonth) "";
-    yearByMonth["07"] = inferYear(7, curYear, curMonth) "";
-    yearByMonth["08"] = inferYear(8, curYear, curMonth) "";
-    yearByMonth["09"] = inferYear(9, curYear, curMonth) "";
-    yearByMonth["10"] = inferYear(10, curYear, curMonth) "";
-    yearByMonth["11"] = inferYear(11, curYear, curMonth) "";
-    yearByMonth["12"] = inferYear(12, curYear, curMonth) "";
-  '
-
-  # Add new entries to index, if needed
-
-  # NOTE: syslogFieldsToIndexTimestr parses the traditional systemd timestamp
-  # format, like this: "Apr  5 11:07:46". But in the recent versions of
-  # rsyslog, it's not the default; that traditional timestamp format can be
-  # enabled by adding this line:
-  #
-  # $ActionFileDefaultTemplate RSYSLOG_TraditionalFileFormat
-  #
-  # to /etc/rsyslog.conf
-  #
-  # To use ISO 1806 instead (which is the default in recent rsyslog versions),
-  # like "2025-04-05T11:07:46.161001+03:00":
-  #
-  # $ActionFileDefaultTemplate RSYSLOG_FileFormat
-  #
-  # But this function (and its usages) need to be updated to support it, and a
-  # bunch of other time-filtering logic here. Although it's cool since it
-  # includes the year, microseconds, and timezone.
-  awk_functions='
+# The awk snippets below are used to index both the log files and the
+# compressed members.
+awk_vars='
+  monthByName["Jan"] = "01";
+  monthByName["Feb"] = "02";
+  monthByName["Mar"] = "03";
+  monthByName["Apr"] = "04";
+  monthByName["May"] = "05";
+  monthByName["Jun"] = "06";
+  monthByName["Jul"] = "07";
+  monthByName["Aug"] = "08";
+  monthByName["Sep"] = "09";
+  monthByName["Oct"] = "10";
+  monthByName["Nov"] = "11";
+  monthByName["Dec"] = "12";
+
+  curYear = '${CUR_YEAR}';
+  curMonth = '${CUR_MONTH}';
+
+  yearByMonth["01"] = inferYear(1, curYear, curMonth) "";
+  yearByMonth["02"] = inferYear(2, curYear, curMonth) "";
+  yearByMonth["03"] = inferYear(3, curYear, curMonth) "";
+  yearByMonth["04"] = inferYear(4, curYear, curMonth) "";
+  yearByMonth["05"] = inferYear(5, curYear, curMonth) "";
+  yearByMonth["06"] = inferYear(6, curYear, curMonth) "";
+  yearByMonth["07"] = inferYear(7, curYear, curMonth) "";
+  yearByMonth["08"] = inferYear(8, curYear, curMonth) "";
+  yearByMonth["09"] = inferYear(9, curYear, curMonth) "";
+  yearByMonth["10"] = inferYear(10, curYear, curMonth) "";
+  yearByMonth["11"] = inferYear(11, curYear, curMonth) "";
+  yearByMonth["12"] = inferYear(12, curYear, curMonth) "";
+'
+
+# NOTE: syslogFieldsToIndexTimestr parses the traditional systemd timestamp
+# format, like this: "Apr  5 11:07:46". But in the recent versions of
+# rsyslog, it's not the default; that traditional timestamp format can be
+# enabled by adding this line:
+#
+# $ActionFileDefaultTemplate RSYSLOG_TraditionalFileFormat
+#
+# to /etc/rsyslog.conf
+#
+# To use ISO 1806 instead (which is the default in recent rsyslog versions),
+# like "2025-04-05T11:07:46.161001+03:00":
+#
+# $ActionFileDefaultTemplate RSYSLOG_FileFormat
+#
+# But this function (and its usages) need to be updated to support it, and a
+# bunch of other time-filtering logic here. Although it's cool since it
+# includes the year, microseconds, and timezone.
+awk_functions='
 function inferYear(logMonth, curYear, curMonth) {
   delta = logMonth - curMonth
 
@@ -397,51 +700,143 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
 }
 
 '$awk_func_print_percentage'
-  '
+'
 # NOTE: this script MUST be executed with the "-b" awk key, which means that
 # awk will work in terms of bytes, not characters. We use length($0) there and
 # we rely on it being number of bytes.
 # TODO: better rewrite this indexing stuff in perl.
 
-  scriptInitFromLastTimestr='
-    lastHHMM = substr(lastTimestr, 8, 5);
-    last3 = lastHHMM ":00"'
+scriptInitFromLastTimestr='
+  lastHHMM = substr(lastTimestr, 8, 5);
+  last3 = lastHHMM ":00"'
 
-  scriptSetCurTimestr='
-    bytenr_cur = bytenr_next - length($0) - 1;
+scriptSetCurTimestr='
+  bytenr_cur = bytenr_next - length($0) - 1;
 
-    month = '"$awktime_month"';
-    year = '"$awktime_year"';
-    day = '"$awktime_day"';
-    hhmm = '"$awktime_hhmm"';
+  month = '"$awktime_month"';
+  year = '"$awktime_year"';
+  day = '"$awktime_day"';
+  hhmm = '"$awktime_hhmm"';
 
-    curTimestr = year "-" month "-" day "-" hhmm;
-    if (curTimestr < lastTimestr) {
-      print "error:timestamp decreased from " lastTimestr " to " curTimestr ", might be using inconsistent timestamp formats" > "/dev/stderr"
-      exit 1
-    }
-  '
-  scriptSetLastTimestrEtc='
-    lastTimestr = curTimestr;
-    lastHHMM = curHHMM;
-  '
+  curTimestr = year "-" month "-" day "-" hhmm;
+  if (curTimestr < lastTimestr) {
+    print "'"$marker_prefix"'error:timestamp decreased from " lastTimestr " to " curTimestr ", might be using inconsistent timestamp formats" > "/dev/stderr"
+    exit 1
+  }
+'
+scriptSetLastTimestrEtc='
+  lastTimestr = curTimestr;
+  lastHHMM = curHHMM;
+'
 
-  script1='BEGIN { bytenr_next=1; lastPercent=0 }
+script1='BEGIN { bytenr_next=1; lastPercent=0 }
 {
   bytenr_next += length($0)+1
   curHHMM = '"$awktime_hhmm"';
 }'
 
+# Prints the number of lines and the decompressed size of the compressed log
+# file with the given key, space-separated, as stored in the member cache;
+# returns 1 if it's not there.
+function get_member_info_from_cache() { # {{{
+  if ! [ -e "$members_file" ]; then
+    return 1
+  fi
+
+  NERDLOG_MEMBER_KEY="$1" "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "member" && $2 == ENVIRON["NERDLOG_MEMBER_KEY"] { print $3 " " $4; found = 1; exit } END { if (found == 0) { exit 1 } }' "$members_file"
+} # }}}
+
+# Decompresses and indexes the given compressed log file, and adds it to the
+# member cache with the given key. Nothing is added unless the whole file is
+# indexed successfully.
+function index_member() { # {{{
+  local logfile="$1"
+  local key="$2"
+  local tmpfile="${members_file}_tmp"
+
+  echo "debug:indexing compressed logfile $logfile" 1>&2
+
+  $(logfile_cat_cmd "$logfile") "$logfile" | "$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastTimestr = \"\"; $scriptInitFromLastTimestr }"'
+  '"$script1"'
+  ( lastHHMM != curHHMM ) {
+    '"$scriptSetCurTimestr"';
+    print "member_idx\t'"$key"'\t" curTimestr "\t" NR "\t" bytenr_cur;
+    '"$scriptSetLastTimestrEtc"'
+  }
+  END { print "member\t'"$key"'\t" NR "\t" (bytenr_next-1) }
+  ' - > "$tmpfile"
+  if ! [[ ${PIPESTATUS[@]} =~ ^(0[[:space:]]*)+$ ]]; then
+    echo "debug:failed to index compressed logfile $logfile" 1>&2
+    rm -f "$tmpfile"
+    return 1
+  fi
+
+  cat "$tmpfile" >> "$members_file" && rm -f "$tmpfile"
+} # }}}
+
+# All the log files are treated as a single combined one, the oldest first, so
+# for every log file we need to know how many bytes are before it. For the
+# compressed ones, the decompressed size is used, which we get from the member
+# cache, indexing them first if needed.
+declare -a logfile_sizes
+declare -a logfile_bytes_before
+declare -a logfile_member_keys
+total_size=0
+for (( i=${#logfiles[@]}-1; i>=0; i-- )); do
+  if [[ "$(logfile_cat_cmd "${logfiles[i]}")" != "cat" ]]; then
+    logfile_member_keys[i]=$(stat -c '%i:%Y' "${logfiles[i]}") || exit 1
+    if ! member_info="$(get_member_info_from_cache "${logfile_member_keys[i]}")"; then
+      index_member "${logfiles[i]}" "${logfile_member_keys[i]}" || exit 1
+      member_info="$(get_member_info_from_cache "${logfile_member_keys[i]}")" || exit 1
+    fi
+    logfile_sizes[i]=${member_info#* }
+  else
+    logfile_sizes[i]=$(stat -c%s "${logfiles[i]}") || exit 1
+  fi
+
+  logfile_bytes_before[i]=$total_size
+  total_size=$((total_size+logfile_sizes[i]))
+done
+last_bytes_before=${logfile_bytes_before[0]}
+
+# Forget the compressed files which aren't among our log files anymore
+# (normally, logrotate has deleted them).
+if [ -e "$members_file" ]; then
+  NERDLOG_MEMBER_KEYS="${logfile_member_keys[*]}" "$awk_binary" -F"\t" '
+    BEGIN { n = split(ENVIRON["NERDLOG_MEMBER_KEYS"], keys, " "); for (i = 1; i <= n; i++) { isCur[keys[i]] = 1 } }
+    isCur[$2]
+  ' "$members_file" > "${members_file}_tmp" || exit 1
+  mv "${members_file}_tmp" "$members_file" || exit 1
+
+  if ! [ -s "$members_file" ]; then
+    rm -f "$members_file"
+  fi
+fi
+
+function refresh_index { # {{{
+  # If the query is cancelled while we're indexing, the index would be left
+  # half-written, so remove it.
+  trap 'rm -f $indexfile; exit 1' TERM
+
   if [ -s $indexfile ]
   then
     echo "p:stage:$STAGE_INDEX_APPEND:indexing up" 1>&2
 
-    local lastTimestr="$(tail -n 1 $indexfile | cut -f2)"
-    local last_linenr="$(tail -n 1 $indexfile | cut -f3)"
-    local last_bytenr="$(tail -n 1 $indexfile | cut -f4)"
+    local lastTimestr="$(get_last_timestr_from_index)"
+    local last_key last_linenr last_bytenr
+    IFS=$'\t' read -r last_key _ last_linenr last_bytenr <<< "$(tail -n 1 $indexfile)"
+
+    # Normally the last index line is an "idx" one; if it's not (the latest log
+    # file had no lines at all when it was indexed), start from the beginning
+    # of the latest log file.
+    if [[ "$last_key" != "idx" ]]; then
+      last_linenr=$(( $(get_logfile_lines_from_index "$logfile_last") + 1 ))
+      last_bytenr=$(( last_bytes_before + 1 ))
+    fi
+
     local size_to_index=$((total_size-last_bytenr))
 
-    tail -c +$((last_bytenr-prevlog_bytes)) $logfile_last | "$awk_binary" -b "$awk_functions
+    tail -c +$((last_bytenr-last_bytes_before)) $logfile_last | "$awk_binary" -b "$awk_functions
   BEGIN {
     $awk_vars
     lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr
@@ -462,49 +857,61 @@ function printIndexLine(outfile, timestr, linenr, bytenr) {
   else
     echo "p:stage:$STAGE_INDEX_FULL:indexing from scratch" 1>&2
 
-    echo "prevlog_modtime	$(stat -c %y $logfile_prev)" > $indexfile
-
-    "$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastHHMM=\"\"; last3=\"\" }"'
-  '"$script1"'
-  ( lastHHMM != curHHMM ) {
-    '"$scriptSetCurTimestr"';
-    printIndexLine("'$indexfile'", curTimestr, NR, bytenr_cur);
-    printPercentage(bytenr_cur, '$total_size');
-    '"$scriptSetLastTimestrEtc"'
-  }
-  END { print "prevlog_lines\t" NR >> "'$indexfile'" }
-  ' $logfile_prev
-    if [[ "$?" != 0 ]]; then
-      echo "debug:failed to index from scratch $logfile_prev, removing index file" 1>&2
-      rm $indexfile
+    print_rotated_logfiles > $indexfile
+
+    # Index all the log files one by one, the oldest first. Before every log
+    # file, we store the number of lines before it, and the last timestr from
+    # the previous log file is carried over, otherwise there is a gap in index
+    # before the first line of the next log file.
+    local lines_before=0
+    local num_lines logfile lastTimestr i
+    for (( i=${#logfiles[@]}-1; i>=0; i-- )); do
+      logfile="${logfiles[i]}"
+      echo "logfile_lines	$lines_before	$logfile" >> $indexfile
+      lastTimestr="$(get_last_timestr_from_index)"
+
+      if [[ "${logfile_member_keys[i]}" != "" ]]; then
+        # The compressed log files are already indexed in the member cache, so
+        # we only copy the index lines from there, adjusting the numbers.
+        num_lines="$(NERDLOG_MEMBER_KEY="${logfile_member_keys[i]}" "$awk_binary" -F"\t" "$awk_functions"'
+  BEGIN { lastTimestr = "'"$lastTimestr"'"; lastPercent=0 }
+  $1 == "member" && $2 == ENVIRON["NERDLOG_MEMBER_KEY"] { numLines = $3 }
+  $1 == "member_idx" && $2 == ENVIRON["NERDLOG_MEMBER_KEY"] {
+    if ($3 < lastTimestr) {
+      print "'"$marker_prefix"'error:timestamp decreased from " lastTimestr " to " $3 ", might be using inconsistent timestamp formats" > "/dev/stderr"
       exit 1
-    fi
-
-  # Before we start handling $logfile_last, gotta read the last idx line (which is
-  # last-but-one line) and set it for the next script, otherwise there is a gap
-  # in index before the first line in the $logfile_last.
-  # TODO: make sure that if there are no logs in the $lotfile1, we don't screw up.
-    local lastTimestr=""
-    local lastTimestrLine="$(tail -n 2 $indexfile | head -n 1)"
-    if [[ "$lastTimestrLine" =~ ^idx$'\t' ]]; then
-      lastTimestr="$(echo "$lastTimestrLine" | cut -f2)"
-    fi
-    "$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr }"'
+    }
+    bytenr = $5+'${logfile_bytes_before[i]}';
+    printIndexLine("'$indexfile'", $3, $4+'$lines_before', bytenr);
+    printPercentage(bytenr, '$total_size');
+    lastTimestr = $3;
+  }
+  END { print numLines }
+  ' "$members_file")"
+      else
+        num_lines="$("$awk_binary" -b "$awk_functions BEGIN { $awk_vars lastTimestr = \"$lastTimestr\"; $scriptInitFromLastTimestr }"'
   '"$script1"'
   ( lastHHMM != curHHMM ) {
     '"$scriptSetCurTimestr"';
-    bytenr = bytenr_cur+'$prevlog_bytes';
-    printIndexLine("'$indexfile'", curTimestr, NR+'$(get_prevlog_lines_from_index)', bytenr);
+    bytenr = bytenr_cur+'${logfile_bytes_before[i]}';
+    printIndexLine("'$indexfile'", curTimestr, NR+'$lines_before', bytenr);
     printPercentage(bytenr, '$total_size');
     '"$scriptSetLastTimestrEtc"'
   }
-  ' $logfile_last
-    if [[ "$?" != 0 ]]; then
-      echo "debug:failed to index from scratch $logfile_last, removing index file" 1>&2
-      rm $indexfile
-      exit 1
-    fi
+  END { print NR }
+  ' "$logfile")"
+      fi
+      if [[ "$?" != 0 ]]; then
+        echo "debug:failed to index from scratch $logfile, removing index file" 1>&2
+        rm $indexfile
+        exit 1
+      fi
+
+      lines_before=$((lines_before+num_lines))
+    done
   fi
+
+  trap - TERM
 } # }}}
 
 # Performs index lookup by a timestr like "2006-01-02-15:04" (typically given
@@ -541,41 +948,44 @@ function get_linenr_and_bytenr_from_index() { # {{{
   ' $indexfile
 } # }}}
 
-function get_prevlog_lines_from_index() { # {{{
-  if ! "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "prevlog_lines" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
+# Prints the number of lines before the given log file, as stored in the
+# index; returns 1 if it's not there.
+function get_logfile_lines_from_index() { # {{{
+  if ! NERDLOG_LOGFILE="$1" "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "logfile_lines" && $3 == ENVIRON["NERDLOG_LOGFILE"] { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
     return 1
   fi
 } # }}}
 
-function get_prevlog_modtime_from_index() { # {{{
-  if ! "$awk_binary" -F"\t" 'BEGIN { found=0 } $1 == "prevlog_modtime" { print $2; found = 1; exit } END { if (found == 0) { exit 1 } }' $indexfile ; then
-    return 1
-  fi
+# Prints the timestr of the last "idx" line in the index, or nothing if there
+# are no such lines.
+function get_last_timestr_from_index() { # {{{
+  "$awk_binary" -F"\t" '$1 == "idx" { timestr = $2 } END { print timestr }' $indexfile
 } # }}}
 
-function get_prevlog_bytenr() { # {{{
-  du -sb $logfile_prev | "$awk_binary" '{ print $1 }'
+# Prints the "rotated_logfile" index lines with the modification time and the
+# path of every rotated log file, the oldest first. They're stored in the
+# index, so that we can tell when the logs get rotated, and the index has to
+# be rebuilt.
+function print_rotated_logfiles() { # {{{
+  local i
+  for (( i=${#logfiles[@]}-1; i>=1; i-- )); do
+    echo "rotated_logfile	$(stat -c %y "${logfiles[i]}")	${logfiles[i]}"
+  done
 } # }}}
 
-is_outside_of_range=0
-if [[ "$from" != "" || "$to" != "" ]]; then
-  # If indexfile exists, check if it's valid and relevant; if not, delete it.
-  if [ -e "$indexfile" ]; then
-    # Check timestamp in the first line of /tmp/nerdlog_agent_index, and if
-    # $logfile_prev's modification time is newer, then delete whole index
-    logfile_prev_stored_modtime="$(get_prevlog_modtime_from_index)"
-    logfile_prev_cur_modtile=$(stat -c %y $logfile_prev)
-    if [[ "$logfile_prev_stored_modtime" != "$logfile_prev_cur_modtile" ]]; then
-      echo "debug:logfile has changed: stored '$logfile_prev_stored_modtime', actual '$logfile_prev_cur_modtile', deleting index file" 1>&2
-      rm -f $indexfile || exit 1
-    fi
-
-    if ! get_prevlog_lines_from_index > /dev/null; then
-      echo "debug:broken index file (no prevlog lines), deleting it" 1>&2
-      rm -f $indexfile || exit 1
-    fi
+# If indexfile exists, check if it's valid and relevant; if not, delete it.
+if [ -e "$indexfile" ]; then
+  if [[ "$("$awk_binary" -F"\t" '$1 == "rotated_logfile"' $indexfile)" != "$(print_rotated_logfiles)" ]]; then
+    echo "debug:rotated logfiles have changed, deleting index file" 1>&2
+    rm -f $indexfile || exit 1
+  elif ! get_logfile_lines_from_index "$logfile_last" > /dev/null; then
+    echo "debug:broken index file (no logfile_lines for $logfile_last), deleting it" 1>&2
+    rm -f $indexfile || exit 1
   fi
+fi
 
+is_outside_of_range=0
+if [[ "$from" != "" || "$to" != "" ]]; then
   refresh_and_retry=0
 
   # First try to find it in index without refreshing the index
@@ -612,14 +1022,14 @@ if [[ "$from" != "" || "$to" != "" ]]; then
       elif [[ "$from_result" == "found" ]]; then
         echo "debug:the from ${from} is found: $from_linenr ($from_bytenr)" 1>&2
         if [[ "$from_bytenr" == "" || "$from_linenr" == "" ]]; then
-          echo "error:from_result is found but from_bytenr and/or from_linenr is empty" 1>&2
+          echo "${marker_prefix}error:from_result is found but from_bytenr and/or from_linenr is empty" 1>&2
           exit 1
         fi
       elif [[ "$from_result" == "after" ]]; then
         echo "debug:the from ${from} is after the latest log we have, will return nothing" 1>&2
         is_outside_of_range=1
       else
-        echo "error:invalid from_result: $from_result" 1>&2
+        echo "${marker_prefix}error:invalid from_result: $from_result" 1>&2
         exit 1
       fi
     fi
@@ -632,14 +1042,14 @@ if [[ "$from" != "" || "$to" != "" ]]; then
       elif [[ "$to_result" == "found" ]]; then
         echo "debug:the to ${to} is found: $to_linenr ($to_bytenr)" 1>&2
         if [[ "$to_bytenr" == "" || "$to_linenr" == "" ]]; then
-          echo "error:to_result is found but to_bytenr and/or to_linenr is empty" 1>&2
+          echo "${marker_prefix}error:to_result is found but to_bytenr and/or to_linenr is empty" 1>&2
           exit 1
         fi
       elif [[ "$to_result" == "before" ]]; then
         echo "debug:the to ${to} is before the first log we have, will return nothing" 1>&2
         is_outside_of_range=1
       else
-        echo "error:invalid to_result: $to_result" 1>&2
+        echo "${marker_prefix}error:invalid to_result: $to_result" 1>&2
         exit 1
       fi
     fi
@@ -659,8 +1069,18 @@ fi
 
 echo "p:stage:$STAGE_QUERYING:querying logs" 1>&2
 
-prevlog_lines=$(get_prevlog_lines_from_index)
-prevlog_bytes=$(get_prevlog_bytenr)
+# The "logfile:" lines tell the client how many lines are before every log
+# file, so that it can map the line numbers back to the log files.
+awk_print_logfiles=''
+for (( i=${#logfiles[@]}-1; i>=0; i-- )); do
+  num_lines=$(get_logfile_lines_from_index "${logfiles[i]}")
+  if [[ $? != 0 ]]; then
+    echo "${marker_prefix}error:no logfile_lines for ${logfiles[i]} in the index" 1>&2
+    exit 1
+  fi
+
+  awk_print_logfiles+='print "logfile:'"${logfiles[i]}"':'"$num_lines"'";'
+done
 
 from_linenr_int=$from_linenr
 if [[ "$from_linenr" == "" ]]; then
@@ -726,8 +1146,7 @@ NR % 100 == 0 {
 }
 
 END {
-  print "logfile:'$logfile_prev':0";
-  print "logfile:'$logfile_last':'$prevlog_lines'";
+  '"$awk_print_logfiles"'
 
   for (x in stats) {
     print "s:" x "," stats[x]
@@ -773,49 +1192,59 @@ END {
 # do the "-n N", not "-n +N" (but for the latest logfile, which is constantly
 # appended to, we have to use the "-n +N")
 
-# Generate commands to get all the logs as per requested timerange.
+# Generate commands to get all the logs as per requested timerange: the range
+# [from_bytenr, to_bytenr) in the combined log files is split into the parts
+# of the individual log files, the oldest first.
 declare -a cmds
-if [[ "$from_bytenr" != "" && $(( from_bytenr > prevlog_bytes )) == 1 ]]; then
-  # Only $logfile_last is used.
-  from_bytenr=$(( from_bytenr - prevlog_bytes ))
-  if [[ "$to_bytenr" != "" ]]; then
-    to_bytenr=$(( to_bytenr - prevlog_bytes ))
-    echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the latest $logfile_last" 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last | head -c $((to_bytenr - from_bytenr))")
-  else
-    # Most common case
-    echo "debug:Getting logs from offset $from_bytenr until the end of latest $logfile_last." 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_last")
-  fi
-elif [[ "$to_bytenr" != "" && $(( to_bytenr <= prevlog_bytes )) == 1 ]]; then
-  # Only $logfile_prev is used.
-  if [[ "$from_bytenr" != "" ]]; then
-    echo "debug:Getting logs from offset $from_bytenr, only $((to_bytenr - from_bytenr)) bytes, all in the prev $logfile_prev" 1>&2
-    cmds+=("tail -c +$from_bytenr $logfile_prev | head -c $((to_bytenr - from_bytenr))")
-  else
-    echo "debug:Getting logs from the very beginning to offset $(( to_bytenr - 1 )), all in the prev $logfile_prev." 1>&2
-    cmds+=("head -c $(( to_bytenr - 1)) $logfile_prev")
+for (( i=${#logfiles[@]}-1; i>=0; i-- )); do
+  logfile="${logfiles[i]}"
+  file_start=$(( logfile_bytes_before[i] + 1 ))
+
+  # start and end are the 1-based offsets in the current log file, the end is
+  # exclusive; till_end is whether we need everything until the end of it.
+  start=1
+  if [[ "$from_bytenr" != "" && $(( from_bytenr > file_start )) == 1 ]]; then
+    start=$(( from_bytenr - file_start + 1 ))
   fi
-else
-  # Both log files are used
-  if [[ "$from_bytenr" != "" ]]; then
-    info="Getting logs from offset $from_bytenr in prev $logfile_prev"
-    cmds+=("tail -c +$from_bytenr $logfile_prev")
-  else
-    info="Getting logs from the very beginning in prev $logfile_prev"
-    cmds+=("cat $logfile_prev")
+
+  till_end=1
+  end=$(( logfile_sizes[i] + 1 ))
+  if [[ "$to_bytenr" != "" && $(( to_bytenr < file_start + logfile_sizes[i] )) == 1 ]]; then
+    till_end=0
+    end=$(( to_bytenr - file_start + 1 ))
   fi
 
-  if [[ "$to_bytenr" != "" ]]; then
-    info="$info to offset $(( to_bytenr - prevlog_bytes - 1 )) in latest $logfile_last"
-    cmds+=("head -c $(( to_bytenr - prevlog_bytes - 1 )) $logfile_last")
-  else
-    info="$info until the end of latest $logfile_last"
-    cmds+=("cat $logfile_last")
+  # Skip the log files which are outside of the range; but if we need logs
+  # until the very end, the latest log file is always used, since it might
+  # have grown after we checked its size.
+  if [[ $(( start >= end )) == 1 && ( $i != 0 || "$to_bytenr" != "" ) ]]; then
+    continue
   fi
 
-  echo "debug:$info" 1>&2
-fi
+  # The compressed log files can't be read from an offset, so they're
+  # decompressed as a stream, and the tail and head only get the stdin.
+  cat_cmd="$(logfile_cat_cmd "$logfile")"
+  src="$logfile"
+  decompress=""
+  if [[ "$cat_cmd" != "cat" ]]; then
+    src=""
+    decompress="$cat_cmd $logfile | "
+  fi
+
+  if [[ $start == 1 && $till_end == 1 ]]; then
+    echo "debug:Getting all logs from $logfile" 1>&2
+    cmds+=("$cat_cmd $logfile")
+  elif [[ $till_end == 1 ]]; then
+    echo "debug:Getting logs from offset $start until the end of $logfile" 1>&2
+    cmds+=("${decompress}tail -c +$start $src")
+  elif [[ $start == 1 ]]; then
+    echo "debug:Getting logs from the very beginning to offset $(( end - 1 )) in $logfile" 1>&2
+    cmds+=("${decompress}head -c $(( end - 1 )) $src")
+  else
+    echo "debug:Getting logs from offset $start, only $(( end - start )) bytes, in $logfile" 1>&2
+    cmds+=("${decompress}tail -c +$start $src | head -c $(( end - start ))")
+  fi
+done
 
 # Now execute all those commands, and feed those logs to the awk script
 # which will analyze them and produce the final output.
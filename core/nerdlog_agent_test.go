@@ -2,6 +2,7 @@ package core
 
 import (
 	"bufio"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -71,16 +73,89 @@ func TestReadFileRelativeToThisFile(t *testing.T) {
 		panic(err)
 	}
 
+	agent := testAgent{
+		cmd: []string{"/bin/bash", nerdlogAgentShFname},
+	}
+
 	for _, testCaseDir := range testCaseDirs {
 		t.Run(testCaseDir, func(t *testing.T) {
-			if err := runTestCase(t, nerdlogAgentShFname, testCasesDir, testCaseDir); err != nil {
+			if err := runTestCase(t, agent, testCasesDir, testCaseDir); err != nil {
 				t.Fatalf("running test case %s: %s", testCaseDir, err.Error())
 			}
 		})
 	}
 }
 
-func runTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, testName string) error {
+// TestNerdlogAgentBinTestdata runs the same test cases as
+// TestReadFileRelativeToThisFile, but against the native agent binary.
+func TestNerdlogAgentBinTestdata(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to get caller info")
+	}
+
+	parentDir := filepath.Dir(filename)
+	testCasesDir := filepath.Join(parentDir, "nerdlog_agent_testdata", "test_cases")
+
+	agentBinFname, err := buildNerdlogAgentBin()
+	if err != nil {
+		t.Fatalf("building nerdlog agent binary: %s", err.Error())
+	}
+
+	testCaseDirs, err := getTestCaseDirs(testCasesDir)
+	if err != nil {
+		panic(err)
+	}
+
+	agent := testAgent{
+		cmd: []string{agentBinFname},
+	}
+
+	for _, testCaseDir := range testCaseDirs {
+		t.Run(testCaseDir, func(t *testing.T) {
+			if err := runTestCase(t, agent, testCasesDir, testCaseDir); err != nil {
+				t.Fatalf("running test case %s: %s", testCaseDir, err.Error())
+			}
+		})
+	}
+}
+
+// testAgent is an agent implementation to run the test cases against.
+type testAgent struct {
+	// cmd is the command to run the agent, without the agent args.
+	cmd []string
+}
+
+var (
+	nerdlogAgentBinOnce  sync.Once
+	nerdlogAgentBinFname string
+	nerdlogAgentBinErr   error
+)
+
+// buildNerdlogAgentBin builds the native agent (only once per test run), and
+// returns the path to the binary.
+func buildNerdlogAgentBin() (string, error) {
+	nerdlogAgentBinOnce.Do(func() {
+		if err := os.MkdirAll(testOutputRoot, 0755); err != nil {
+			nerdlogAgentBinErr = errors.Annotatef(err, "creating test output root dir %s", testOutputRoot)
+			return
+		}
+
+		fname := filepath.Join(testOutputRoot, "nerdlog-agent")
+
+		cmd := exec.Command("go", "build", "-o", fname, "github.com/dimonomid/nerdlog/cmd/nerdlog-agent")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			nerdlogAgentBinErr = errors.Annotatef(err, "go build: %s", out)
+			return
+		}
+
+		nerdlogAgentBinFname = fname
+	})
+
+	return nerdlogAgentBinFname, nerdlogAgentBinErr
+}
+
+func runTestCase(t *testing.T, agent testAgent, testCasesDir, testName string) error {
 	testCaseDir := filepath.Join(testCasesDir, testName)
 	testCaseDescrFname := filepath.Join(testCaseDir, testCaseYamlFname)
 
@@ -104,30 +179,45 @@ func runTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, testName strin
 		return errors.Annotatef(err, "resolving logfiles")
 	}
 
-	if len(logfiles) == 0 || len(logfiles) > 2 {
-		return errors.Errorf(
-			"For now, there must be exactly 1 or 2 logfiles, but got %d: %v",
-			len(logfiles), logfiles,
-		)
+	if len(logfiles) == 0 {
+		return errors.Errorf("there must be at least one logfile")
 	}
 
-	logfileLast := filepath.Join(testOutputDir, "logfile")
-	logfilePrev := filepath.Join(testOutputDir, "logfile.1")
+	// The logfiles are copied as "logfile", "logfile.1", "logfile.2" etc (the
+	// compressed ones keep the .gz or .zst extension). Just like the logstreams
+	// by default (see setLogFilesDefaults), there are always at least two of
+	// them given to the agent, even if the second one doesn't exist.
+	var logfileArgs []string
+	for i := 0; i < len(logfiles) || i < 2; i++ {
+		logfileDest := filepath.Join(testOutputDir, "logfile")
+		if i > 0 {
+			logfileDest += fmt.Sprintf(".%d", i)
+		}
 
-	if err := copyFile(logfiles[0], logfileLast); err != nil {
-		return errors.Annotatef(err, "copying logfile last: from %s to %s", logfiles[0], logfileLast)
-	}
+		compressedExt := ""
+		if i < len(logfiles) {
+			compressedExt = getCompressedExt(logfiles[i])
+			logfileDest += compressedExt
+		}
 
-	if err := setSyslogFileModTime(logfileLast); err != nil {
-		return errors.Trace(err)
-	}
+		logfileArgs = append(logfileArgs, "--logfile", logfileDest)
 
-	if len(logfiles) > 1 {
-		if err := copyFile(logfiles[1], logfilePrev); err != nil {
-			return errors.Annotatef(err, "copying logfile prev: from %s to %s", logfiles[1], logfilePrev)
+		if i >= len(logfiles) {
+			os.Remove(logfileDest)
+			continue
 		}
 
-		if err := setSyslogFileModTime(logfilePrev); err != nil {
+		if err := copyFile(logfiles[i], logfileDest); err != nil {
+			return errors.Annotatef(err, "copying logfile: from %s to %s", logfiles[i], logfileDest)
+		}
+
+		// The modification time of the compressed logfiles doesn't matter, since
+		// all the logfiles are given to the agent explicitly.
+		if compressedExt != "" {
+			continue
+		}
+
+		if err := setSyslogFileModTime(logfileDest); err != nil {
 			return errors.Trace(err)
 		}
 	}
@@ -135,16 +225,13 @@ func runTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, testName strin
 	indexFname := filepath.Join(testOutputDir, "nerdlog_agent_index")
 
 	os.Remove(indexFname)
+	os.Remove(indexFname + "_members")
 
 	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", logfileLast,
-			"--logfile-prev", logfilePrev,
+		append([]string{}, agent.cmd...),
+		append(append(append([]string{"query"}, logfileArgs...),
 			"--index-file", indexFname,
-		},
-		tc.Args...,
+		), tc.Args...)...,
 	)
 
 	// Do the full run, with the provided initial index (which in most cases
@@ -212,11 +299,6 @@ func runTestCase(t *testing.T, nerdlogAgentShFname, testCasesDir, testName strin
 		}
 	}
 
-	// TODO: the stats lines in stdout (these starting from "s:") are printed in
-	// arbitrary order because they come from a hashmap, so simply comparing the
-	// output is a bad idea. Gotta do some post-processing, like sorting these "s:"
-	// lines, before comparing them.
-
 	return nil
 }
 
@@ -225,7 +307,7 @@ type testNerdlogAgentParams struct {
 }
 
 func runNerdlogAgent(
-	t *testing.T, tc *TestCaseYaml, bashArgs []string, testCaseDir, testName string,
+	t *testing.T, tc *TestCaseYaml, cmdArgs []string, testCaseDir, testName string,
 	params testNerdlogAgentParams,
 ) error {
 	assertArgs := []interface{}{"test case %s", testName}
@@ -243,7 +325,7 @@ func runNerdlogAgent(
 	stderrFile, err := os.Create(stderrFname)
 	defer stderrFile.Close()
 
-	cmd := exec.Command("/bin/bash", bashArgs...)
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
 
 	curYear := tc.CurYear
 	if curYear == 0 {
@@ -264,9 +346,9 @@ func runNerdlogAgent(
 	cmd.Stdout = stdoutFile
 	cmd.Stderr = stderrFile
 
-	fmt.Printf("Running %+v\n", bashArgs)
+	fmt.Printf("Running %+v\n", cmdArgs)
 	if err := cmd.Run(); err != nil {
-		return errors.Annotatef(err, "running nerdlog query command %+v", bashArgs)
+		return errors.Annotatef(err, "running nerdlog query command %+v", cmdArgs)
 	}
 
 	wantStdout, err := os.ReadFile(filepath.Join(testCaseDir, "want_stdout"))
@@ -289,15 +371,77 @@ func runNerdlogAgent(
 		return errors.Annotatef(err, "reading %s", stderrFname)
 	}
 
+	// The stats lines (these starting from "s:") are printed in arbitrary order
+	// because they come from a hashmap, and the order differs between the awk
+	// implementations and versions, and the native agent; so sort them before
+	// comparing.
+	wantStdout = sortStatsLines(wantStdout)
+	gotStdout = sortStatsLines(gotStdout)
+
 	assert.Equal(t, string(wantStdout), string(gotStdout), assertArgs...)
 
 	if params.checkStderr {
-		assert.Equal(t, string(wantStderr), string(gotStderr), assertArgs...)
+		assert.Equal(t, string(wantStderr), stripPidLines(string(gotStderr)), assertArgs...)
 	}
 
 	return nil
 }
 
+// sortStatsLines sorts the "s:" lines in the agent's stdout, keeping them in
+// the same place; the rest of the lines are kept as is.
+func sortStatsLines(stdout []byte) []byte {
+	lines := strings.SplitAfter(string(stdout), "\n")
+
+	var statsLines []string
+	statsIdx := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "s:") {
+			if statsIdx < 0 {
+				statsIdx = i
+			}
+
+			statsLines = append(statsLines, line)
+		}
+	}
+
+	if statsIdx < 0 {
+		return stdout
+	}
+
+	sort.Strings(statsLines)
+
+	ret := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if strings.HasPrefix(line, "s:") {
+			if i == statsIdx {
+				ret = append(ret, statsLines...)
+			}
+
+			continue
+		}
+
+		ret = append(ret, line)
+	}
+
+	return []byte(strings.Join(ret, ""))
+}
+
+// stripPidLines removes the "p:pid:" lines from the agent's stderr, since the
+// pid is different on every run.
+func stripPidLines(stderr string) string {
+	lines := strings.SplitAfter(stderr, "\n")
+	ret := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "p:pid:") {
+			continue
+		}
+
+		ret = append(ret, line)
+	}
+
+	return strings.Join(ret, "")
+}
+
 func runNerdlogAgentForBenchmark(
 	bashArgs []string,
 ) error {
@@ -341,6 +485,18 @@ func resolveLogfiles(
 	}
 }
 
+// getCompressedExt returns the extension of the compressed logfile (".gz" or
+// ".zst"), or an empty string if it's not compressed.
+func getCompressedExt(fname string) string {
+	for _, ext := range []string{".gz", ".zst"} {
+		if strings.HasSuffix(fname, ext) {
+			return ext
+		}
+	}
+
+	return ""
+}
+
 func copyFile(srcPath, destPath string) error {
 	// Open the source file
 	srcFile, err := os.Open(srcPath)
@@ -574,17 +730,15 @@ func BenchmarkNerdlogAgentSmallLogNoIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench1_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", filepath.Join(logfilesDir, "syslog"),
-			"--logfile-prev", filepath.Join(logfilesDir, "syslog.1"),
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-12-10:00",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", filepath.Join(logfilesDir, "syslog"),
+		"--logfile", filepath.Join(logfilesDir, "syslog.1"),
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-12-10:00",
+	}
 
 	b.ResetTimer()
 
@@ -608,17 +762,15 @@ func BenchmarkNerdlogAgentSmallLogCompleteIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench1_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", filepath.Join(logfilesDir, "syslog"),
-			"--logfile-prev", filepath.Join(logfilesDir, "syslog.1"),
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-12-10:00",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", filepath.Join(logfilesDir, "syslog"),
+		"--logfile", filepath.Join(logfilesDir, "syslog.1"),
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-12-10:00",
+	}
 
 	// Build the index
 	os.Remove(indexFname)
@@ -650,17 +802,15 @@ func BenchmarkNerdlogAgentLargeLogSmallPortionNoIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench_large_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", "/tmp/nerdlog_agent_test_output/randomlog_large",
-			"--logfile-prev", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-11-00:00",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-11-00:00",
+	}
 
 	b.ResetTimer()
 
@@ -687,17 +837,15 @@ func BenchmarkNerdlogAgentLargeLogSmallPortionCompleteIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench_large_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", "/tmp/nerdlog_agent_test_output/randomlog_large",
-			"--logfile-prev", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-11-00:00",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-11-00:00",
+	}
 
 	// Build the index
 	os.Remove(indexFname)
@@ -729,17 +877,15 @@ func BenchmarkNerdlogAgentLargeLogTinyPortionCompleteIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench_large_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", "/tmp/nerdlog_agent_test_output/randomlog_large",
-			"--logfile-prev", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-11-01:30",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_large.1",
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-11-01:30",
+	}
 
 	// Build the index
 	os.Remove(indexFname)
@@ -771,17 +917,15 @@ func BenchmarkNerdlogAgentHugeLogOneHourCompleteIndex(b *testing.B) {
 
 	indexFname := filepath.Join(testOutputRoot, "bench_huge_index")
 
-	cmdArgs := append(
-		[]string{
-			nerdlogAgentShFname,
-			"query",
-			"--logfile-last", "/tmp/nerdlog_agent_test_output/randomlog_huge",
-			"--logfile-prev", "/tmp/nerdlog_agent_test_output/randomlog_huge.1",
-			"--index-file", indexFname,
-			"--max-num-lines", "100",
-			"--from", "2025-03-11-12:30",
-		},
-	)
+	cmdArgs := []string{
+		nerdlogAgentShFname,
+		"query",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_huge",
+		"--logfile", "/tmp/nerdlog_agent_test_output/randomlog_huge.1",
+		"--index-file", indexFname,
+		"--max-num-lines", "100",
+		"--from", "2025-03-11-12:30",
+	}
 
 	// Build the index
 	os.Remove(indexFname)
@@ -863,3 +1007,445 @@ func generateLogfilesHuge() error {
 
 	return nil
 }
+
+func TestNerdlogAgentCleanup(t *testing.T) {
+	workDir := t.TempDir()
+
+	agentPath := filepath.Join(workDir, "nerdlog_agent_me_0123456789abcdef.sh")
+	assert.NoError(t, os.WriteFile(agentPath, []byte(nerdlogAgentSh), 0644))
+
+	files := map[string]string{
+		"nerdlog_agent_me_fedcba9876543210.sh": "old agent",
+		"nerdlog_agent_index_me_abc":           "index 1",
+		"nerdlog_agent_index_other_def":        "index 22",
+		"nerdlog-empty-file":                   "",
+		"unrelated":                            "not ours",
+	}
+	for fname, data := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(workDir, fname), []byte(data), 0644))
+	}
+
+	runCleanup := func(args ...string) []string {
+		t.Helper()
+
+		cmd := exec.Command("/bin/bash", append([]string{agentPath, "cleanup", "--work-dir", workDir}, args...)...)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+
+		// The last line is printed by the exit trap.
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		assert.Equal(t, "exit_code:0", lines[len(lines)-1])
+
+		lines = lines[:len(lines)-1]
+		sort.Strings(lines)
+		return lines
+	}
+
+	wantFiles := []string{
+		"%s:0:" + filepath.Join(workDir, "nerdlog-empty-file"),
+		"%s:7:" + filepath.Join(workDir, "nerdlog_agent_index_me_abc"),
+		"%s:8:" + filepath.Join(workDir, "nerdlog_agent_index_other_def"),
+		"%s:9:" + filepath.Join(workDir, "nerdlog_agent_me_fedcba9876543210.sh"),
+	}
+	withPrefix := func(prefix string, lines []string) []string {
+		ret := make([]string, 0, len(lines))
+		for _, line := range lines {
+			ret = append(ret, fmt.Sprintf(line, prefix))
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	// Dry run only lists the files, and the agent itself is not among them.
+	assert.Equal(t, withPrefix("file", wantFiles), runCleanup("--dry-run"))
+	assert.FileExists(t, filepath.Join(workDir, "nerdlog_agent_index_me_abc"))
+
+	// Now actually delete them; the agent itself and the unrelated file are
+	// still there.
+	assert.Equal(t, withPrefix("deleted", wantFiles), runCleanup())
+	for _, line := range wantFiles {
+		assert.NoFileExists(t, line[strings.LastIndex(line, ":")+1:])
+	}
+	assert.FileExists(t, agentPath)
+	assert.FileExists(t, filepath.Join(workDir, "unrelated"))
+
+	// With --all, the agent is deleted too.
+	agentSize := fmt.Sprintf("%d", len(nerdlogAgentSh))
+	assert.Equal(t, []string{"deleted:" + agentSize + ":" + agentPath}, runCleanup("--all"))
+	assert.NoFileExists(t, agentPath)
+	assert.FileExists(t, filepath.Join(workDir, "unrelated"))
+}
+
+func TestNerdlogAgentLogstreamInfo(t *testing.T) {
+	if _, err := exec.LookPath("gawk"); err != nil {
+		t.Skip("gawk is not available")
+	}
+
+	workDir := t.TempDir()
+
+	agentPath := filepath.Join(workDir, "nerdlog_agent.sh")
+	assert.NoError(t, os.WriteFile(agentPath, []byte(nerdlogAgentSh), 0644))
+
+	logfileLast := filepath.Join(workDir, "syslog")
+	logfilePrev := filepath.Join(workDir, "syslog.1")
+	assert.NoError(t, os.WriteFile(logfileLast, []byte("Mar 10 10:00:00 myhost foo: last\n"), 0644))
+	assert.NoError(t, os.WriteFile(logfilePrev, []byte("Mar  9 10:00:00 myhost foo: prev\n"), 0644))
+
+	mtime := time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(logfileLast, mtime, mtime))
+	assert.NoError(t, os.Chtimes(logfilePrev, mtime.Add(-time.Hour), mtime.Add(-time.Hour)))
+
+	cmd := exec.Command(
+		"/bin/bash", agentPath, "logstream_info",
+		"--work-dir", workDir,
+		"--logfile", logfileLast,
+		"--logfile", logfilePrev,
+	)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+
+	caps := map[string]string{}
+	var logfileLines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		switch {
+		case strings.HasPrefix(line, "cap:"):
+			parts := strings.SplitN(strings.TrimPrefix(line, "cap:"), ":", 2)
+			if assert.Len(t, parts, 2, line) {
+				caps[parts[0]] = parts[1]
+			}
+		case strings.HasPrefix(line, "logfile_info:"):
+			logfileLines = append(logfileLines, line)
+		}
+	}
+
+	assert.True(t, strings.HasPrefix(caps["bash"], "bash "), caps["bash"])
+	assert.True(t, strings.HasPrefix(caps["awk"], "gawk "), caps["awk"])
+	assert.True(t, strings.HasPrefix(caps["gzip"], "gzip "), caps["gzip"])
+	assert.NotEmpty(t, caps["coreutils"])
+	assert.Equal(t, "1", caps["stat_c"])
+	assert.Contains(t, []string{"0", "1"}, caps["timedatectl"])
+	assert.Regexp(t, `^[0-9]+$`, caps["work_dir_free"])
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("logfile_info:33:%d:%s", mtime.Unix(), logfileLast),
+		fmt.Sprintf("logfile_info:33:%d:%s", mtime.Add(-time.Hour).Unix(), logfilePrev),
+	}, logfileLines)
+}
+
+// TestNerdlogAgentMarkerPrefix checks that both the shell and the native
+// agents prepend the --marker-prefix to the "error:" and "exit_code:" lines.
+func TestNerdlogAgentMarkerPrefix(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to get caller info")
+	}
+
+	agentBinFname, err := buildNerdlogAgentBin()
+	if err != nil {
+		t.Fatalf("building nerdlog agent binary: %s", err.Error())
+	}
+
+	logFname := filepath.Join(t.TempDir(), "app.log")
+	assert.NoError(t, os.WriteFile(logFname, nil, 0644))
+
+	const markerPrefix = "nerdlog_0123456789abcdef:"
+
+	for name, cmdArgs := range map[string][]string{
+		"shell":  {"/bin/bash", filepath.Join(filepath.Dir(filename), "nerdlog_agent.sh")},
+		"native": {agentBinFname},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cmdArgs = append(
+				cmdArgs,
+				"--marker-prefix", markerPrefix,
+				"--work-dir", t.TempDir(),
+				"--logfile", logFname,
+				"no_such_command",
+			)
+
+			cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+
+			stdout, err := cmd.Output()
+			assert.Error(t, err)
+
+			assert.Equal(t, markerPrefix+"exit_code:1\n", string(stdout))
+			assert.Regexp(t, "(?m)^"+regexp.QuoteMeta(markerPrefix)+"error:", stderr.String())
+		})
+	}
+}
+
+// TestNerdlogAgentRotation checks that when the logs get rotated, both the
+// shell and the native agents notice it and rebuild the index, so that the
+// "logfile:" and the line numbers are correct for the new set of log files.
+func TestNerdlogAgentRotation(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to get caller info")
+	}
+
+	agentBinFname, err := buildNerdlogAgentBin()
+	if err != nil {
+		t.Fatalf("building nerdlog agent binary: %s", err.Error())
+	}
+
+	for name, cmdArgs := range map[string][]string{
+		"shell":  {"/bin/bash", filepath.Join(filepath.Dir(filename), "nerdlog_agent.sh")},
+		"native": {agentBinFname},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if name == "shell" {
+				if _, err := exec.LookPath("gawk"); err != nil {
+					t.Skip("gawk is not available")
+				}
+			}
+
+			workDir := t.TempDir()
+			logfile := filepath.Join(workDir, "syslog")
+
+			writeLogfile := func(fname string, lines ...string) {
+				t.Helper()
+
+				data := strings.Join(lines, "\n") + "\n"
+				assert.NoError(t, os.WriteFile(fname, []byte(data), 0644))
+			}
+
+			// query runs the agent and returns the "logfile:" and "m:" lines from
+			// the stdout, and the whole stderr.
+			query := func() ([]string, string) {
+				t.Helper()
+
+				args := append(
+					append([]string{}, cmdArgs...),
+					"query",
+					"--work-dir", workDir,
+					"--index-file", filepath.Join(workDir, "index"),
+					"--logfile", logfile,
+					"--logfile", "auto",
+					"--logfile", "auto",
+					"--from", "2025-03-10-09:00",
+				)
+
+				cmd := exec.Command(args[0], args[1:]...)
+				cmd.Env = append(os.Environ(), "TZ=UTC", "CUR_YEAR=2025", "CUR_MONTH=3")
+				var stderr strings.Builder
+				cmd.Stderr = &stderr
+
+				out, err := cmd.Output()
+				assert.NoError(t, err, stderr.String())
+
+				var lines []string
+				for _, line := range strings.Split(string(out), "\n") {
+					if strings.HasPrefix(line, "logfile:") || strings.HasPrefix(line, "m:") {
+						lines = append(lines, line)
+					}
+				}
+
+				return lines, stderr.String()
+			}
+
+			writeLogfile(
+				logfile+".1",
+				"Mar 10 10:00:00 myhost foo: one",
+				"Mar 10 10:01:00 myhost foo: two",
+			)
+			writeLogfile(logfile, "Mar 10 10:02:00 myhost foo: three")
+
+			lines, _ := query()
+			assert.Equal(t, []string{
+				"logfile:" + logfile + ".1:0",
+				"logfile:" + logfile + ":2",
+				"m:1:Mar 10 10:00:00 myhost foo: one",
+				"m:2:Mar 10 10:01:00 myhost foo: two",
+				"m:3:Mar 10 10:02:00 myhost foo: three",
+			}, lines)
+
+			// Rotate the logs, and write a few more lines into the new file.
+			assert.NoError(t, os.Rename(logfile+".1", logfile+".2"))
+			assert.NoError(t, os.Rename(logfile, logfile+".1"))
+			writeLogfile(
+				logfile,
+				"Mar 10 10:03:00 myhost foo: four",
+				"Mar 10 10:04:00 myhost foo: five",
+			)
+
+			lines, stderr := query()
+			assert.Contains(t, stderr, "debug:rotated logfiles have changed, deleting index file")
+			assert.Equal(t, []string{
+				"logfile:" + logfile + ".2:0",
+				"logfile:" + logfile + ".1:2",
+				"logfile:" + logfile + ":3",
+				"m:1:Mar 10 10:00:00 myhost foo: one",
+				"m:2:Mar 10 10:01:00 myhost foo: two",
+				"m:3:Mar 10 10:02:00 myhost foo: three",
+				"m:4:Mar 10 10:03:00 myhost foo: four",
+				"m:5:Mar 10 10:04:00 myhost foo: five",
+			}, lines)
+		})
+	}
+}
+
+// TestNerdlogAgentCompressedRotation checks that both the shell and the native
+// agents pick up the compressed rotated log files given as a glob pattern,
+// and that every compressed file is only decompressed to index it once, even
+// after it's renamed by the next rotation.
+func TestNerdlogAgentCompressedRotation(t *testing.T) {
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to get caller info")
+	}
+
+	agentBinFname, err := buildNerdlogAgentBin()
+	if err != nil {
+		t.Fatalf("building nerdlog agent binary: %s", err.Error())
+	}
+
+	for name, cmdArgs := range map[string][]string{
+		"shell":  {"/bin/bash", filepath.Join(filepath.Dir(filename), "nerdlog_agent.sh")},
+		"native": {agentBinFname},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if name == "shell" {
+				for _, tool := range []string{"gawk", "zcat"} {
+					if _, err := exec.LookPath(tool); err != nil {
+						t.Skipf("%s is not available", tool)
+					}
+				}
+			}
+
+			workDir := t.TempDir()
+			logfile := filepath.Join(workDir, "syslog")
+			indexFile := filepath.Join(workDir, "index")
+
+			writeLogfile := func(fname string, mtime time.Time, lines ...string) {
+				t.Helper()
+
+				data := []byte(strings.Join(lines, "\n") + "\n")
+				if strings.HasSuffix(fname, ".gz") {
+					var buf strings.Builder
+					zw := gzip.NewWriter(&buf)
+					_, err := zw.Write(data)
+					assert.NoError(t, err)
+					assert.NoError(t, zw.Close())
+					data = []byte(buf.String())
+				}
+
+				assert.NoError(t, os.WriteFile(fname, data, 0644))
+				assert.NoError(t, os.Chtimes(fname, mtime, mtime))
+			}
+
+			// compress imitates logrotate compressing a rotated log file: the
+			// modification time is preserved.
+			compress := func(fname string) {
+				t.Helper()
+
+				data, err := os.ReadFile(fname)
+				assert.NoError(t, err)
+				stat, err := os.Stat(fname)
+				assert.NoError(t, err)
+
+				writeLogfile(fname+".gz", stat.ModTime(), strings.TrimSuffix(string(data), "\n"))
+				assert.NoError(t, os.Remove(fname))
+			}
+
+			// query runs the agent and returns the "logfile:" and "m:" lines from
+			// the stdout, and the whole stderr.
+			query := func() ([]string, string) {
+				t.Helper()
+
+				args := append(
+					append([]string{}, cmdArgs...),
+					"query",
+					"--work-dir", workDir,
+					"--index-file", indexFile,
+					"--logfile", logfile,
+					"--logfile", logfile+".1",
+					"--logfile", logfile+".*.gz",
+					"--from", "2025-03-10-09:00",
+				)
+
+				cmd := exec.Command(args[0], args[1:]...)
+				cmd.Env = append(os.Environ(), "TZ=UTC", "CUR_YEAR=2025", "CUR_MONTH=3")
+				var stderr strings.Builder
+				cmd.Stderr = &stderr
+
+				out, err := cmd.Output()
+				assert.NoError(t, err, stderr.String())
+
+				var lines []string
+				for _, line := range strings.Split(string(out), "\n") {
+					if strings.HasPrefix(line, "logfile:") || strings.HasPrefix(line, "m:") {
+						lines = append(lines, line)
+					}
+				}
+
+				return lines, stderr.String()
+			}
+
+			indexingMsg := func(fname string) string {
+				return "debug:indexing compressed logfile " + fname + "\n"
+			}
+
+			mtime := time.Date(2025, 3, 10, 10, 0, 0, 0, time.UTC)
+
+			writeLogfile(logfile+".2.gz", mtime, "Mar 10 10:00:00 myhost foo: one")
+			writeLogfile(logfile+".1", mtime.Add(time.Minute), "Mar 10 10:01:00 myhost foo: two")
+			writeLogfile(logfile, mtime.Add(2*time.Minute), "Mar 10 10:02:00 myhost foo: three")
+
+			lines, stderr := query()
+			assert.Contains(t, stderr, indexingMsg(logfile+".2.gz"))
+			assert.Equal(t, []string{
+				"logfile:" + logfile + ".2.gz:0",
+				"logfile:" + logfile + ".1:1",
+				"logfile:" + logfile + ":2",
+				"m:1:Mar 10 10:00:00 myhost foo: one",
+				"m:2:Mar 10 10:01:00 myhost foo: two",
+				"m:3:Mar 10 10:02:00 myhost foo: three",
+			}, lines)
+
+			// Rotate the logs: the old compressed file is only renamed, so it
+			// doesn't have to be decompressed again; but the newly compressed one
+			// does.
+			assert.NoError(t, os.Rename(logfile+".2.gz", logfile+".3.gz"))
+			assert.NoError(t, os.Rename(logfile+".1", logfile+".2"))
+			compress(logfile + ".2")
+			assert.NoError(t, os.Rename(logfile, logfile+".1"))
+			writeLogfile(logfile, mtime.Add(3*time.Minute), "Mar 10 10:03:00 myhost foo: four")
+
+			lines, stderr = query()
+			assert.Contains(t, stderr, "debug:rotated logfiles have changed, deleting index file")
+			assert.Contains(t, stderr, indexingMsg(logfile+".2.gz"))
+			assert.NotContains(t, stderr, indexingMsg(logfile+".3.gz"))
+			assert.Equal(t, []string{
+				"logfile:" + logfile + ".3.gz:0",
+				"logfile:" + logfile + ".2.gz:1",
+				"logfile:" + logfile + ".1:2",
+				"logfile:" + logfile + ":3",
+				"m:1:Mar 10 10:00:00 myhost foo: one",
+				"m:2:Mar 10 10:01:00 myhost foo: two",
+				"m:3:Mar 10 10:02:00 myhost foo: three",
+				"m:4:Mar 10 10:03:00 myhost foo: four",
+			}, lines)
+
+			// Once logrotate deletes the oldest file, it's forgotten by the member
+			// cache too.
+			assert.NoError(t, os.Remove(logfile+".3.gz"))
+
+			lines, stderr = query()
+			assert.NotContains(t, stderr, "debug:indexing compressed logfile")
+			assert.Equal(t, []string{
+				"logfile:" + logfile + ".2.gz:0",
+				"logfile:" + logfile + ".1:1",
+				"logfile:" + logfile + ":2",
+				"m:1:Mar 10 10:01:00 myhost foo: two",
+				"m:2:Mar 10 10:02:00 myhost foo: three",
+				"m:3:Mar 10 10:03:00 myhost foo: four",
+			}, lines)
+
+			membersData, err := os.ReadFile(indexFile + "_members")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, strings.Count(string(membersData), "member\t"))
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// defaultIdentityFiles are the private key files which are tried after the
+// ones from the IdentityFile options, same as ssh does.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ecdsa_sk",
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ed25519_sk",
+	"~/.ssh/id_dsa",
+}
+
+// maxPassphraseAttempts is how many times we ask for the key passphrase or
+// the password before giving up.
+const maxPassphraseAttempts = 3
+
+// sshAuthCtx contains everything that the auth methods might need.
+type sshAuthCtx struct {
+	logger   *log.Logger
+	host     ConfigHost
+	prompter userPrompter
+}
+
+func (ac *sshAuthCtx) opts() *SSHOptions {
+	if ac.host.SSH == nil {
+		return &SSHOptions{}
+	}
+
+	return ac.host.SSH
+}
+
+// sshSignersSource returns the signers for the public key authentication.
+// Errors are not fatal: the signers from the other sources will still be
+// tried.
+type sshSignersSource func(ac *sshAuthCtx) ([]ssh.Signer, error)
+
+// sshSignersSources are the sources of keys for the public key
+// authentication, in the order in which the keys are offered to the server.
+//
+// They are all combined into a single ssh.PublicKeysCallback, because the ssh
+// package tries every auth method type only once: if we had a separate
+// "publickey" method per source, only the first one would ever be used.
+var sshSignersSources = []struct {
+	name   string
+	source sshSignersSource
+}{
+	{"ssh agent", getAgentSigners},
+	{"identity files", getIdentityFileSigners},
+	{"default key files", getDefaultKeySigners},
+}
+
+// sshInteractiveAuths are the auth methods which are tried after the public
+// key authentication, if the server supports them.
+var sshInteractiveAuths = []func(ac *sshAuthCtx) ssh.AuthMethod{
+	getKeyboardInteractiveAuth,
+	getPasswordAuth,
+}
+
+// getSSHAuthMethods returns the auth methods to try for the given host: keys
+// from the ssh agent, then keys from the IdentityFile options, then the
+// default keys, and then keyboard-interactive and password authentication,
+// both of which ask the user via the prompter.
+func getSSHAuthMethods(
+	logger *log.Logger, host ConfigHost, prompter userPrompter,
+) []ssh.AuthMethod {
+	ac := &sshAuthCtx{
+		logger:   logger,
+		host:     host,
+		prompter: prompter,
+	}
+
+	ret := []ssh.AuthMethod{
+		ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return getAllSigners(ac), nil
+		}),
+	}
+
+	for _, getAuth := range sshInteractiveAuths {
+		ret = append(ret, getAuth(ac))
+	}
+
+	return ret
+}
+
+// getAllSigners collects signers from all sshSignersSources, skipping
+// duplicate keys.
+func getAllSigners(ac *sshAuthCtx) []ssh.Signer {
+	var ret []ssh.Signer
+	seen := map[string]struct{}{}
+
+	for _, src := range sshSignersSources {
+		signers, err := src.source(ac)
+		if err != nil {
+			ac.logger.Infof("Skipping keys from %s: %s", src.name, err.Error())
+			continue
+		}
+
+		for _, signer := range signers {
+			key := string(signer.PublicKey().Marshal())
+			if _, ok := seen[key]; ok {
+				continue
+			}
+
+			seen[key] = struct{}{}
+			ret = append(ret, signer)
+		}
+	}
+
+	return ret
+}
+
+var (
+	sshAgentShared    agent.ExtendedAgent
+	sshAgentSharedMtx sync.Mutex
+)
+
+// getSSHAgent returns the shared ssh agent client, or nil if the agent isn't
+// running (SSH_AUTH_SOCK is not set).
+func getSSHAgent(logger *log.Logger) (agent.ExtendedAgent, error) {
+	sshAgentSharedMtx.Lock()
+	defer sshAgentSharedMtx.Unlock()
+
+	if sshAgentShared == nil {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, nil
+		}
+
+		logger.Infof("Initializing sshAgentShared...")
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			logger.Infof("Failed to initialize sshAgentShared: %s", err.Error())
+			return nil, errors.Trace(err)
+		}
+
+		sshAgentShared = agent.NewClient(conn)
+	}
+
+	return sshAgentShared, nil
+}
+
+func getAgentSigners(ac *sshAuthCtx) ([]ssh.Signer, error) {
+	sshAgent, err := getSSHAgent(ac.logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if sshAgent == nil {
+		return nil, nil
+	}
+
+	signers, err := sshAgent.Signers()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if ac.opts().IdentitiesOnly != "yes" {
+		return signers, nil
+	}
+
+	// With IdentitiesOnly, only use the agent keys which correspond to the
+	// identity files.
+	allowed := map[string]struct{}{}
+	for _, fname := range ac.opts().IdentityFiles {
+		pub, err := readIdentityPublicKey(fname)
+		if err != nil {
+			continue
+		}
+
+		allowed[string(pub.Marshal())] = struct{}{}
+	}
+
+	var ret []ssh.Signer
+	for _, signer := range signers {
+		if _, ok := allowed[string(signer.PublicKey().Marshal())]; ok {
+			ret = append(ret, signer)
+		}
+	}
+
+	return ret, nil
+}
+
+func getIdentityFileSigners(ac *sshAuthCtx) ([]ssh.Signer, error) {
+	return loadKeyFileSigners(ac, ac.opts().IdentityFiles), nil
+}
+
+func getDefaultKeySigners(ac *sshAuthCtx) ([]ssh.Signer, error) {
+	return loadKeyFileSigners(ac, defaultIdentityFiles), nil
+}
+
+// loadKeyFileSigners returns signers for all the given key files which exist
+// and can be parsed; the problematic ones are logged and skipped.
+func loadKeyFileSigners(ac *sshAuthCtx, fnames []string) []ssh.Signer {
+	var ret []ssh.Signer
+	for _, fname := range fnames {
+		signer, err := loadKeyFileSigner(ac, fname)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				ac.logger.Infof("Skipping key %s: %s", fname, err.Error())
+			}
+			continue
+		}
+
+		ret = append(ret, signer)
+	}
+
+	return ret
+}
+
+// loadKeyFileSigner reads the private key from the given file. If the key is
+// encrypted, the returned signer only asks for the passphrase when the server
+// has accepted the key and it's actually needed to sign something.
+func loadKeyFileSigner(ac *sshAuthCtx, fname string) (ssh.Signer, error) {
+	path, err := expandSSHPath(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if signer := getDecryptedKey(path); signer != nil {
+		return signer, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer, nil
+	}
+
+	missingErr, ok := err.(*ssh.PassphraseMissingError)
+	if !ok {
+		return nil, errors.Trace(err)
+	}
+
+	// The key is encrypted; we need its public part to offer it to the server
+	// without decrypting. The new OpenSSH format contains it, otherwise try
+	// the .pub file.
+	pub := missingErr.PublicKey
+	if pub == nil {
+		pub, err = readPublicKeyFile(path + ".pub")
+		if err != nil {
+			return nil, errors.Annotatef(err, "key is encrypted, and its public key is not available")
+		}
+	}
+
+	return &encryptedKeySigner{
+		path:     path,
+		pub:      pub,
+		pemBytes: data,
+		prompter: ac.prompter,
+	}, nil
+}
+
+// readIdentityPublicKey returns the public key for the given identity file,
+// without decrypting the private key.
+func readIdentityPublicKey(fname string) (ssh.PublicKey, error) {
+	path, err := expandSSHPath(fname)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if pub, err := readPublicKeyFile(path + ".pub"); err == nil {
+		return pub, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		if missingErr, ok := err.(*ssh.PassphraseMissingError); ok && missingErr.PublicKey != nil {
+			return missingErr.PublicKey, nil
+		}
+
+		return nil, errors.Trace(err)
+	}
+
+	return signer.PublicKey(), nil
+}
+
+func readPublicKeyFile(path string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return pub, nil
+}
+
+var (
+	// decryptedKeys contains signers for the encrypted keys which were already
+	// decrypted, so that we don't ask for the same passphrase every time we
+	// connect somewhere. Keyed by the key file path.
+	decryptedKeys = map[string]ssh.Signer{}
+
+	// decryptKeyMtxs contains a mutex per key file path, which is held while
+	// we're asking for the passphrase of that key, so that when multiple
+	// logstreams need the same key, the passphrase is only asked once. The
+	// logstreams which need other keys don't have to wait though.
+	decryptKeyMtxs = map[string]*sync.Mutex{}
+
+	// decryptedKeysMtx protects decryptedKeys and decryptKeyMtxs.
+	decryptedKeysMtx sync.Mutex
+)
+
+func getDecryptedKey(path string) ssh.Signer {
+	decryptedKeysMtx.Lock()
+	defer decryptedKeysMtx.Unlock()
+
+	return decryptedKeys[path]
+}
+
+func setDecryptedKey(path string, signer ssh.Signer) {
+	decryptedKeysMtx.Lock()
+	defer decryptedKeysMtx.Unlock()
+
+	decryptedKeys[path] = signer
+}
+
+// getDecryptKeyMtx returns the mutex to hold while decrypting the given key.
+func getDecryptKeyMtx(path string) *sync.Mutex {
+	decryptedKeysMtx.Lock()
+	defer decryptedKeysMtx.Unlock()
+
+	mtx := decryptKeyMtxs[path]
+	if mtx == nil {
+		mtx = &sync.Mutex{}
+		decryptKeyMtxs[path] = mtx
+	}
+
+	return mtx
+}
+
+// encryptedKeySigner is an ssh.Signer for a passphrase-protected key, which
+// asks the user for the passphrase on the first signing.
+//
+// NOTE: it implements ssh.AlgorithmSigner, since otherwise the ssh package
+// would only use the ssh-rsa signature algorithm for RSA keys, which is
+// rejected by the modern servers.
+type encryptedKeySigner struct {
+	path     string
+	pub      ssh.PublicKey
+	pemBytes []byte
+	prompter userPrompter
+}
+
+var _ ssh.AlgorithmSigner = &encryptedKeySigner{}
+
+func (s *encryptedKeySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return signer.Sign(rand, data)
+}
+
+func (s *encryptedKeySigner) SignWithAlgorithm(
+	rand io.Reader, data []byte, algorithm string,
+) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+
+	if algorithm != "" && algorithm != s.pub.Type() {
+		return nil, errors.Errorf("key %s doesn't support signature algorithm %s", s.path, algorithm)
+	}
+
+	return signer.Sign(rand, data)
+}
+
+// decrypt asks the user for the passphrase and decrypts the key, or returns
+// the already decrypted one.
+func (s *encryptedKeySigner) decrypt() (ssh.Signer, error) {
+	mtx := getDecryptKeyMtx(s.path)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if signer := getDecryptedKey(s.path); signer != nil {
+		return signer, nil
+	}
+
+	msg := fmt.Sprintf("Enter passphrase for key %s:", s.path)
+	for i := 0; i < maxPassphraseAttempts; i++ {
+		resp, err := s.prompter(newUserPrompt("", UserPromptKindSecret, "Key passphrase", msg))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if !resp.Yes {
+			return nil, errors.Errorf("passphrase for key %s was not provided", s.path)
+		}
+
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(s.pemBytes, []byte(resp.Text))
+		if err != nil {
+			msg = fmt.Sprintf("Wrong passphrase (%s), try again.\nEnter passphrase for key %s:", err.Error(), s.path)
+			continue
+		}
+
+		setDecryptedKey(s.path, signer)
+		return signer, nil
+	}
+
+	return nil, errors.Errorf("failed to decrypt key %s: wrong passphrase", s.path)
+}
+
+func getKeyboardInteractiveAuth(ac *sshAuthCtx) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(
+		func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+
+			for i, question := range questions {
+				kind := UserPromptKindSecret
+				if echos[i] {
+					kind = UserPromptKindText
+				}
+
+				var sb strings.Builder
+				if instruction != "" {
+					sb.WriteString(instruction)
+					sb.WriteString("\n")
+				}
+				sb.WriteString(fmt.Sprintf("%s@%s: %s", ac.host.User, ac.host.Addr, strings.TrimSpace(question)))
+
+				title := name
+				if title == "" {
+					title = "Authentication"
+				}
+
+				resp, err := ac.prompter(newUserPrompt("", kind, title, sb.String()))
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+
+				if !resp.Yes {
+					return nil, errors.New("authentication cancelled")
+				}
+
+				answers[i] = resp.Text
+			}
+
+			return answers, nil
+		},
+	)
+}
+
+func getPasswordAuth(ac *sshAuthCtx) ssh.AuthMethod {
+	return ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		resp, err := ac.prompter(newUserPrompt(
+			"", UserPromptKindSecret, "Password",
+			fmt.Sprintf("Password for %s@%s:", ac.host.User, ac.host.Addr),
+		))
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+
+		if !resp.Yes {
+			return "", errors.New("authentication cancelled")
+		}
+
+		return resp.Text, nil
+	}), maxPassphraseAttempts)
+}
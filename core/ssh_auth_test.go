@@ -0,0 +1,308 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// testSSHServer accepts a single connection, and reports the auth result
+// via resCh.
+type testSSHServer struct {
+	addr  string
+	resCh chan error
+}
+
+func newTestSSHServer(t *testing.T, config *ssh.ServerConfig) *testSSHServer {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %s", err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("creating host signer: %s", err)
+	}
+
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	srv := &testSSHServer{
+		addr:  listener.Addr().String(),
+		resCh: make(chan error, 1),
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			srv.resCh <- err
+			return
+		}
+		defer conn.Close()
+
+		_, _, _, err = ssh.NewServerConn(conn, config)
+		srv.resCh <- err
+	}()
+
+	return srv
+}
+
+// dialTestSSHServer connects to the server using the auth methods returned
+// from getSSHAuthMethods.
+func dialTestSSHServer(
+	t *testing.T, srv *testSSHServer, opts *SSHOptions, prompter userPrompter,
+) error {
+	t.Helper()
+
+	host := ConfigHost{
+		Addr: srv.addr,
+		User: "myuser",
+		SSH:  opts,
+	}
+
+	client, err := ssh.Dial("tcp", srv.addr, &ssh.ClientConfig{
+		User:            host.User,
+		Auth:            getSSHAuthMethods(log.NewLogger(log.Error), host, prompter),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+
+	client.Close()
+	return nil
+}
+
+// setupTestSSHAuthEnv makes sure that neither the ssh agent nor the user's
+// real keys are used by the test.
+func setupTestSSHAuthEnv(t *testing.T) string {
+	t.Helper()
+
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	return homeDir
+}
+
+func TestSSHAuthEncryptedIdentityFile(t *testing.T) {
+	homeDir := setupTestSSHAuthEnv(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	// Legacy encrypted PEM doesn't contain the public key, so it has to be
+	// taken from the .pub file.
+	block, err := x509.EncryptPEMBlock(
+		rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey),
+		[]byte("secret"), x509.PEMCipherAES256,
+	)
+	if err != nil {
+		t.Fatalf("encrypting key: %s", err)
+	}
+
+	pub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatalf("converting key: %s", err)
+	}
+
+	keyFname := filepath.Join(homeDir, "mykey")
+	assert.NoError(t, os.WriteFile(keyFname, pem.EncodeToMemory(block), 0600))
+	assert.NoError(t, os.WriteFile(keyFname+".pub", ssh.MarshalAuthorizedKey(pub), 0644))
+
+	var prompts []*UserPrompt
+	answers := []string{"wrong", "secret"}
+	prompter := func(p *UserPrompt) (UserPromptResp, error) {
+		prompts = append(prompts, p)
+		text := answers[0]
+		answers = answers[1:]
+		return UserPromptResp{Yes: true, Text: text}, nil
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), pub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+
+	opts := &SSHOptions{IdentityFiles: []string{"~/mykey"}}
+
+	// The first passphrase is wrong, so it's asked twice.
+	srv := newTestSSHServer(t, serverConfig)
+	assert.NoError(t, dialTestSSHServer(t, srv, opts, prompter))
+	assert.NoError(t, <-srv.resCh)
+	assert.Equal(t, 2, len(prompts))
+	assert.Equal(t, UserPromptKindSecret, prompts[0].Kind)
+	assert.Contains(t, prompts[0].Message, keyFname)
+
+	// The decrypted key is remembered, so no more prompts.
+	srv = newTestSSHServer(t, serverConfig)
+	assert.NoError(t, dialTestSSHServer(t, srv, opts, prompter))
+	assert.NoError(t, <-srv.resCh)
+	assert.Equal(t, 2, len(prompts))
+}
+
+func TestSSHAuthPassword(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+
+	var prompts []*UserPrompt
+	answers := []UserPromptResp{
+		{Yes: true, Text: "wrong"},
+		{Yes: true, Text: "mypassword"},
+		{Yes: false},
+	}
+	prompter := func(p *UserPrompt) (UserPromptResp, error) {
+		prompts = append(prompts, p)
+		resp := answers[0]
+		answers = answers[1:]
+		return resp, nil
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "mypassword" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+
+	// The password is retried after a failure.
+	srv := newTestSSHServer(t, serverConfig)
+	assert.NoError(t, dialTestSSHServer(t, srv, nil, prompter))
+	assert.NoError(t, <-srv.resCh)
+	assert.Equal(t, 2, len(prompts))
+	assert.Equal(t, UserPromptKindSecret, prompts[1].Kind)
+	assert.Contains(t, prompts[1].Message, "myuser@")
+
+	// Cancelled prompt fails the connection.
+	srv = newTestSSHServer(t, serverConfig)
+	assert.Error(t, dialTestSSHServer(t, srv, nil, prompter))
+	assert.Error(t, <-srv.resCh)
+	assert.Equal(t, 3, len(prompts))
+}
+
+func TestSSHAuthKeyboardInteractive(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+
+	var prompts []*UserPrompt
+	prompter := func(p *UserPrompt) (UserPromptResp, error) {
+		prompts = append(prompts, p)
+		if p.Kind == UserPromptKindText {
+			return UserPromptResp{Yes: true, Text: "foo"}, nil
+		}
+		return UserPromptResp{Yes: true, Text: "123456"}, nil
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(
+			conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge,
+		) (*ssh.Permissions, error) {
+			answers, err := challenge("", "Two questions", []string{"Name: ", "Code: "}, []bool{true, false})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(answers) != 2 || answers[0] != "foo" || answers[1] != "123456" {
+				return nil, errors.New("wrong answers")
+			}
+
+			return nil, nil
+		},
+	}
+
+	srv := newTestSSHServer(t, serverConfig)
+	assert.NoError(t, dialTestSSHServer(t, srv, nil, prompter))
+	assert.NoError(t, <-srv.resCh)
+	assert.Equal(t, 2, len(prompts))
+	assert.Equal(t, UserPromptKindText, prompts[0].Kind)
+	assert.Contains(t, prompts[0].Message, "Two questions")
+	assert.Contains(t, prompts[0].Message, "Name:")
+	assert.Equal(t, UserPromptKindSecret, prompts[1].Kind)
+}
+
+// TestSSHAuthDecryptOtherKeyWhilePrompting checks that while we're waiting for
+// the passphrase of one key, the other keys can still be decrypted.
+func TestSSHAuthDecryptOtherKeyWhilePrompting(t *testing.T) {
+	newSigner := func(path string, prompter userPrompter) *encryptedKeySigner {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatalf("generating key: %s", err)
+		}
+
+		block, err := x509.EncryptPEMBlock(
+			rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey),
+			[]byte("secret"), x509.PEMCipherAES256,
+		)
+		if err != nil {
+			t.Fatalf("encrypting key: %s", err)
+		}
+
+		return &encryptedKeySigner{
+			path:     path,
+			pemBytes: pem.EncodeToMemory(block),
+			prompter: prompter,
+		}
+	}
+
+	dir := t.TempDir()
+
+	// The prompt for the first key is only answered once the second key is
+	// decrypted.
+	secondDecrypted := make(chan struct{})
+	first := newSigner(filepath.Join(dir, "first"), func(p *UserPrompt) (UserPromptResp, error) {
+		<-secondDecrypted
+		return UserPromptResp{Yes: true, Text: "secret"}, nil
+	})
+	second := newSigner(filepath.Join(dir, "second"), func(p *UserPrompt) (UserPromptResp, error) {
+		return UserPromptResp{Yes: true, Text: "secret"}, nil
+	})
+
+	firstErrCh := make(chan error, 1)
+	go func() {
+		_, err := first.decrypt()
+		firstErrCh <- err
+	}()
+
+	secondErrCh := make(chan error, 1)
+	go func() {
+		_, err := second.decrypt()
+		secondErrCh <- err
+	}()
+
+	select {
+	case err := <-secondErrCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the second key wasn't decrypted while prompting for the first one")
+	}
+
+	close(secondDecrypted)
+	assert.NoError(t, <-firstErrCh)
+}
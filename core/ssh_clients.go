@@ -0,0 +1,482 @@
+package core
+
+import (
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// sharedSSHClient is an ssh client connected to some host (a logstream host
+// or a jumphost). It's shared between all the users of this host: logstreams
+// (each of them opens its own session on it) and other hosts for which this
+// one is a jumphost. Once nobody uses it anymore, it's closed.
+type sharedSSHClient struct {
+	logger *log.Logger
+
+	key string
+
+	// ready is closed once the connection attempt is finished; after that,
+	// either client or err is set, and they never change.
+	ready  chan struct{}
+	client *ssh.Client
+	err    error
+
+	// parent is the jumphost through which this host is reached, if any.
+	parent *sharedSSHClient
+
+	// refs is the number of users of this client. Protected by
+	// sshClientsSharedMtx.
+	refs int
+
+	// rttNanos is the round-trip time of the last keepalive, in nanoseconds;
+	// zero if there were no replies yet. Accessed atomically.
+	rttNanos int64
+}
+
+var (
+	// sshClientsShared contains all the connected (or connecting) ssh clients,
+	// keyed by ConfigHost.Key().
+	sshClientsShared = map[string]*sharedSSHClient{}
+
+	// sshClientsSharedMtx protects sshClientsShared and all the refs. It's not
+	// held while connecting, so that different hosts are connected to
+	// concurrently.
+	sshClientsSharedMtx sync.Mutex
+)
+
+// acquireSSHClient returns the shared client for the given host, connecting
+// to it (and all the jumphosts) if needed. If the connection to this host is
+// already being established by someone else, it waits for the result. When
+// the client is not needed anymore, the caller must call releaseSSHClient.
+func acquireSSHClient(
+	logger *log.Logger, host *ConfigHost, prompter userPrompter,
+) (*sharedSSHClient, error) {
+	key := host.Key()
+
+	sshClientsSharedMtx.Lock()
+	if c := sshClientsShared[key]; c != nil {
+		c.refs++
+		sshClientsSharedMtx.Unlock()
+
+		<-c.ready
+		if c.err != nil {
+			releaseSSHClient(c)
+			return nil, errors.Trace(c.err)
+		}
+
+		return c, nil
+	}
+
+	c := &sharedSSHClient{
+		logger: logger,
+		key:    key,
+		ready:  make(chan struct{}),
+		refs:   1,
+	}
+	sshClientsShared[key] = c
+	sshClientsSharedMtx.Unlock()
+
+	c.client, c.err = c.connect(host, prompter)
+	close(c.ready)
+
+	if c.err != nil {
+		// Forget about the failed client right away, so that the next attempt
+		// will connect again.
+		sshClientsSharedMtx.Lock()
+		if sshClientsShared[key] == c {
+			delete(sshClientsShared, key)
+		}
+		sshClientsSharedMtx.Unlock()
+
+		releaseSSHClient(c)
+		return nil, errors.Trace(c.err)
+	}
+
+	closedCh := make(chan struct{})
+	go c.keepalive(host.keepaliveInterval(), host.keepaliveTimeout(), closedCh)
+
+	// If the connection breaks, forget about it as well. The current users
+	// will still release it as usual.
+	go func() {
+		c.client.Wait()
+		close(closedCh)
+
+		sshClientsSharedMtx.Lock()
+		defer sshClientsSharedMtx.Unlock()
+
+		if sshClientsShared[key] == c {
+			logger.Infof("Disconnected from %s", key)
+			delete(sshClientsShared, key)
+		}
+	}()
+
+	return c, nil
+}
+
+// connect connects to the host, through the jumphost if needed. It's only
+// called once per sharedSSHClient, by the one who created it.
+func (c *sharedSSHClient) connect(host *ConfigHost, prompter userPrompter) (*ssh.Client, error) {
+	var via *ssh.Client
+	if host.Jumphost != nil {
+		parent, err := acquireSSHClient(c.logger, host.Jumphost, prompter)
+		if err != nil {
+			return nil, errors.Annotatef(err, "connecting to jumphost %s", host.Jumphost.Addr)
+		}
+
+		c.parent = parent
+		via = parent.client
+	}
+
+	c.logger.Infof("Connecting to %s...", c.key)
+
+	client, err := dialSSH(c.logger, *host, via, prompter)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c.logger.Infof("Connected to %s", c.key)
+
+	return client, nil
+}
+
+// keepalive sends the keepalive@openssh.com requests every interval until the
+// connection is closed, and remembers the round-trip time. If there's no
+// reply in time, the connection is considered dead and gets closed, so that
+// all the sessions on it fail and the users reconnect.
+func (c *sharedSSHClient) keepalive(interval, timeout time.Duration, closedCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-closedCh:
+			return
+		}
+
+		sentAt := time.Now()
+		replyCh := make(chan error, 1)
+		go func() {
+			// The reply itself doesn't matter (OpenSSH replies with a failure),
+			// we only care that there is some.
+			_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+			replyCh <- err
+		}()
+
+		select {
+		case err := <-replyCh:
+			if err != nil {
+				// The connection is closed already.
+				return
+			}
+
+			atomic.StoreInt64(&c.rttNanos, int64(time.Since(sentAt)))
+
+		case <-time.After(timeout):
+			c.logger.Warnf("No keepalive reply from %s in %s, closing the connection", c.key, timeout)
+			c.client.Close()
+			return
+
+		case <-closedCh:
+			return
+		}
+	}
+}
+
+// rtt returns the round-trip time of the last keepalive, or zero if there
+// were no replies yet.
+func (c *sharedSSHClient) rtt() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rttNanos))
+}
+
+// releaseSSHClient decrements the refcount of the client, and if it drops to
+// zero, closes the connection and releases the jumphost.
+func releaseSSHClient(c *sharedSSHClient) {
+	sshClientsSharedMtx.Lock()
+	defer sshClientsSharedMtx.Unlock()
+
+	releaseSSHClientLocked(c)
+}
+
+func releaseSSHClientLocked(c *sharedSSHClient) {
+	c.refs--
+	if c.refs > 0 {
+		return
+	}
+
+	if c.client != nil {
+		c.logger.Infof("Closing connection to %s", c.key)
+		c.client.Close()
+	}
+
+	if sshClientsShared[c.key] == c {
+		delete(sshClientsShared, c.key)
+	}
+
+	if c.parent != nil {
+		releaseSSHClientLocked(c.parent)
+	}
+}
+
+// dialSSH connects to the given host and authenticates. The connection is
+// made through the given client of the jumphost if it's not nil, or via the
+// host's ProxyCommand if it's set, or directly otherwise.
+func dialSSH(
+	logger *log.Logger, host ConfigHost, via *ssh.Client, prompter userPrompter,
+) (*ssh.Client, error) {
+	// The handshake is limited by the dial timeout too, but the time spent
+	// waiting for the user (e.g. to enter the key passphrase) doesn't count.
+	ht := &handshakeTimer{timeout: host.dialTimeout()}
+
+	conf, hkc, err := getClientConfig(logger, host, ht.wrapPrompter(prompter))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var conn net.Conn
+	switch {
+	case via != nil:
+		conn, err = dialWithTimeout(via, "tcp", host.Addr, host.dialTimeout())
+	case host.ProxyCommand != "":
+		conn, err = newProxyCommandConn(logger, host)
+	default:
+		conn, err = net.DialTimeout("tcp", host.Addr, host.dialTimeout())
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ht.start(conn)
+	authConn, chans, reqs, err := ssh.NewClientConn(conn, host.Addr, conf)
+	timedOut := ht.stop()
+	if err != nil {
+		conn.Close()
+		if timedOut {
+			return nil, errors.Errorf("ssh handshake timed out after %s", ht.timeout)
+		}
+
+		return nil, hostKeyErrOr(hkc, err)
+	}
+
+	return ssh.NewClient(authConn, chans, reqs), nil
+}
+
+// handshakeTimer closes the connection if the ssh handshake takes longer than
+// the timeout. It's done by closing the connection instead of setting the
+// deadline on it, since the ProxyCommand connection doesn't support deadlines.
+//
+// The timer is paused while the user is being prompted for something.
+type handshakeTimer struct {
+	timeout time.Duration
+
+	mtx       sync.Mutex
+	conn      net.Conn
+	timer     *time.Timer
+	remaining time.Duration
+	deadline  time.Time
+	paused    bool
+	stopped   bool
+	timedOut  bool
+}
+
+// start starts the timer for the given connection.
+func (ht *handshakeTimer) start(conn net.Conn) {
+	ht.mtx.Lock()
+	defer ht.mtx.Unlock()
+
+	ht.conn = conn
+	ht.remaining = ht.timeout
+	ht.resumeLocked()
+}
+
+// stop stops the timer, and returns whether the connection was closed since
+// the handshake has timed out.
+func (ht *handshakeTimer) stop() bool {
+	ht.mtx.Lock()
+	defer ht.mtx.Unlock()
+
+	ht.stopped = true
+	if ht.timer != nil {
+		ht.timer.Stop()
+	}
+
+	return ht.timedOut
+}
+
+// wrapPrompter returns the prompter which pauses the timer while the given
+// prompter is waiting for the user.
+func (ht *handshakeTimer) wrapPrompter(prompter userPrompter) userPrompter {
+	return func(p *UserPrompt) (UserPromptResp, error) {
+		ht.pause()
+		defer ht.resume()
+
+		return prompter(p)
+	}
+}
+
+func (ht *handshakeTimer) pause() {
+	ht.mtx.Lock()
+	defer ht.mtx.Unlock()
+
+	if ht.timer == nil || ht.stopped || ht.paused {
+		return
+	}
+
+	// If Stop returns false, the timer has already fired, and the connection
+	// is closed.
+	if ht.timer.Stop() {
+		ht.paused = true
+		ht.remaining = time.Until(ht.deadline)
+	}
+}
+
+func (ht *handshakeTimer) resume() {
+	ht.mtx.Lock()
+	defer ht.mtx.Unlock()
+
+	if !ht.paused || ht.stopped {
+		return
+	}
+
+	ht.paused = false
+	ht.resumeLocked()
+}
+
+func (ht *handshakeTimer) resumeLocked() {
+	ht.deadline = time.Now().Add(ht.remaining)
+	ht.timer = time.AfterFunc(ht.remaining, func() {
+		ht.mtx.Lock()
+		defer ht.mtx.Unlock()
+
+		if ht.stopped {
+			return
+		}
+
+		ht.timedOut = true
+		ht.conn.Close()
+	})
+}
+
+// proxyCommandConn is a net.Conn which talks to the stdin and stdout of the
+// ProxyCommand process.
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	// closeOnce makes sure that the process is killed and reaped only once,
+	// even though Close is called from multiple places.
+	closeOnce sync.Once
+}
+
+var _ net.Conn = &proxyCommandConn{}
+
+// newProxyCommandConn starts the ProxyCommand of the given host, and returns
+// the connection over its stdin and stdout.
+func newProxyCommandConn(logger *log.Logger, host ConfigHost) (*proxyCommandConn, error) {
+	cmdStr, err := expandProxyCommand(host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	logger.Infof("Running ProxyCommand: %s", cmdStr)
+
+	cmd := exec.Command("sh", "-c", "exec "+cmdStr)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Annotatef(err, "starting ProxyCommand %q", cmdStr)
+	}
+
+	go func() {
+		data, _ := io.ReadAll(stderr)
+		if len(data) > 0 {
+			logger.Errorf("ProxyCommand stderr: %s", strings.TrimSpace(string(data)))
+		}
+	}()
+
+	return &proxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+	}, nil
+}
+
+// expandProxyCommand expands the tokens in the host's ProxyCommand: %h is the
+// hostname, %p is the port, %r is the user, and %% is a literal %.
+func expandProxyCommand(host ConfigHost) (string, error) {
+	addr, err := parseAddr(host.Addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	replacer := strings.NewReplacer(
+		"%h", addr.host,
+		"%p", addr.port,
+		"%r", host.User,
+		"%%", "%",
+	)
+
+	return replacer.Replace(host.ProxyCommand), nil
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+
+		// Wait in the background, to reap the process and close the pipes.
+		go c.cmd.Wait()
+	})
+
+	return nil
+}
+
+// proxyCommandAddr is a dummy address for both ends of the proxyCommandConn.
+// It has to be in the host:port form, since e.g. knownhosts parses it.
+var proxyCommandAddr = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr
+}
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// testForwardingServer is an ssh server which doesn't require auth, and
+// supports "direct-tcpip" channels, so it can be used as a jumphost.
+type testForwardingServer struct {
+	addr string
+
+	// numConns is the number of accepted connections.
+	numConns int32
+
+	// If ignoreRequests is non-zero, the global requests (like keepalives) are
+	// never replied to, as if the connection is dead. Accessed atomically.
+	ignoreRequests int32
+}
+
+func newTestForwardingServer(t *testing.T) *testForwardingServer {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating host key: %s", err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("creating host signer: %s", err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	srv := &testForwardingServer{
+		addr: listener.Addr().String(),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&srv.numConns, 1)
+			go srv.serve(conn, config)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *testForwardingServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		for req := range reqs {
+			if req.WantReply && atomic.LoadInt32(&srv.ignoreRequests) == 0 {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "direct-tcpip" {
+			newCh.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+
+		var payload struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			newCh.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			io.Copy(ch, target)
+			ch.Close()
+		}()
+		go func() {
+			io.Copy(target, ch)
+			target.Close()
+		}()
+	}
+}
+
+// newTestHopHost returns the ConfigHost for the given test server, which
+// trusts any host key without asking.
+func newTestHopHost(t *testing.T, srv *testForwardingServer, jumphost *ConfigHost) *ConfigHost {
+	return &ConfigHost{
+		Addr: srv.addr,
+		User: "myuser",
+		SSH: &SSHOptions{
+			StrictHostKeyChecking: "no",
+			UserKnownHostsFiles:   []string{filepath.Join(t.TempDir(), "known_hosts")},
+		},
+		Jumphost: jumphost,
+	}
+}
+
+func numSharedSSHClients() int {
+	sshClientsSharedMtx.Lock()
+	defer sshClientsSharedMtx.Unlock()
+
+	return len(sshClientsShared)
+}
+
+func TestSSHClientsSharedAndReleased(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	hop1Srv := newTestForwardingServer(t)
+	hop2Srv := newTestForwardingServer(t)
+	targetSrv := newTestForwardingServer(t)
+
+	hop1 := newTestHopHost(t, hop1Srv, nil)
+	hop2 := newTestHopHost(t, hop2Srv, hop1)
+	target := newTestHopHost(t, targetSrv, hop2)
+
+	// Two logstreams on the same host behind a 2-hop chain.
+	clientA, err := acquireSSHClient(logger, target, nil)
+	assert.NoError(t, err)
+
+	clientB, err := acquireSSHClient(logger, target, nil)
+	assert.NoError(t, err)
+
+	assert.True(t, clientA == clientB, "client should be shared")
+	assert.Equal(t, 2, clientA.refs)
+	assert.Equal(t, 1, clientA.parent.refs)
+	assert.Equal(t, 1, clientA.parent.parent.refs)
+	assert.Equal(t, 3, numSharedSSHClients())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hop1Srv.numConns))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hop2Srv.numConns))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&targetSrv.numConns))
+
+	// Another host behind the same jumphosts reuses them.
+	target2Srv := newTestForwardingServer(t)
+	target2 := newTestHopHost(t, target2Srv, hop2)
+
+	clientC, err := acquireSSHClient(logger, target2, nil)
+	assert.NoError(t, err)
+	assert.True(t, clientC.parent == clientA.parent, "jumphost should be shared")
+	assert.Equal(t, 2, clientA.parent.refs)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hop2Srv.numConns))
+
+	releaseSSHClient(clientC)
+	assert.Equal(t, 3, numSharedSSHClients())
+
+	// After the first release, everything is still there.
+	releaseSSHClient(clientA)
+	assert.Equal(t, 3, numSharedSSHClients())
+
+	// After the last one, the client and all the jumphosts are closed.
+	releaseSSHClient(clientB)
+	assert.Equal(t, 0, numSharedSSHClients())
+
+	// Connecting again makes new connections.
+	clientD, err := acquireSSHClient(logger, target, nil)
+	assert.NoError(t, err)
+	assert.False(t, clientD == clientA, "client should be new")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hop1Srv.numConns))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&targetSrv.numConns))
+
+	releaseSSHClient(clientD)
+	assert.Equal(t, 0, numSharedSSHClients())
+}
+
+func TestSSHClientsConcurrentAcquire(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	targetSrv := newTestForwardingServer(t)
+	target := newTestHopHost(t, targetSrv, nil)
+
+	const numClients = 10
+
+	clientsCh := make(chan *sharedSSHClient, numClients)
+	for i := 0; i < numClients; i++ {
+		go func() {
+			c, err := acquireSSHClient(logger, target, nil)
+			assert.NoError(t, err)
+			clientsCh <- c
+		}()
+	}
+
+	var clients []*sharedSSHClient
+	for i := 0; i < numClients; i++ {
+		clients = append(clients, <-clientsCh)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&targetSrv.numConns))
+	for _, c := range clients {
+		assert.True(t, c == clients[0], "client should be shared")
+		releaseSSHClient(c)
+	}
+
+	assert.Equal(t, 0, numSharedSSHClients())
+}
+
+func TestSSHClientsFailedConnection(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	// Grab some free port, and close the listener, so that nothing is there.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	hopSrv := newTestForwardingServer(t)
+	hop := newTestHopHost(t, hopSrv, nil)
+
+	target := newTestHopHost(t, hopSrv, hop)
+	target.Addr = addr
+
+	_, err = acquireSSHClient(logger, target, nil)
+	assert.Error(t, err)
+
+	// Neither the failed client nor the jumphost is kept.
+	assert.Equal(t, 0, numSharedSSHClients())
+}
+
+func TestSSHClientsKeepalive(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	targetSrv := newTestForwardingServer(t)
+	target := newTestHopHost(t, targetSrv, nil)
+	target.KeepaliveInterval = 50 * time.Millisecond
+	target.KeepaliveTimeout = 300 * time.Millisecond
+
+	c, err := acquireSSHClient(logger, target, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer releaseSSHClient(c)
+
+	// While the server replies, we get the round-trip time.
+	assert.Eventually(t, func() bool {
+		return c.rtt() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Once it stops replying, the connection is closed.
+	atomic.StoreInt32(&targetSrv.ignoreRequests, 1)
+
+	closedCh := make(chan struct{})
+	go func() {
+		c.client.Wait()
+		close(closedCh)
+	}()
+
+	select {
+	case <-closedCh:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the connection wasn't closed after the keepalives stopped")
+	}
+
+	// And it's not shared anymore, so that the next acquire reconnects.
+	assert.Eventually(t, func() bool {
+		return numSharedSSHClients() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSSHProxyCommand(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	targetSrv := newTestForwardingServer(t)
+	target := newTestHopHost(t, targetSrv, nil)
+	target.ProxyCommand = `bash -c 'exec 3<>/dev/tcp/%h/%p; cat <&3 & exec cat >&3'`
+
+	client, err := dialSSH(logger, *target, nil, nil)
+	assert.NoError(t, err)
+	if client != nil {
+		client.Close()
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&targetSrv.numConns))
+}
+
+func TestSSHHandshakeTimeout(t *testing.T) {
+	setupTestSSHAuthEnv(t)
+	logger := log.NewLogger(log.Error)
+
+	// The server accepts the connections, but never says anything.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host := &ConfigHost{
+		Addr: listener.Addr().String(),
+		User: "myuser",
+		SSH: &SSHOptions{
+			StrictHostKeyChecking: "no",
+			UserKnownHostsFiles:   []string{filepath.Join(t.TempDir(), "known_hosts")},
+		},
+	}
+	host.DialTimeout = 200 * time.Millisecond
+
+	_, err = dialSSH(logger, *host, nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ssh handshake timed out")
+	}
+
+	// Same with a ProxyCommand which never says anything.
+	host.ProxyCommand = "sleep 60"
+
+	_, err = dialSSH(logger, *host, nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ssh handshake timed out")
+	}
+}
@@ -0,0 +1,346 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// knownHostsMtx serializes the handling of unknown host keys, so that when
+// multiple logstreams connect to the same new host, the user is asked only
+// once, and we don't write to known_hosts concurrently.
+var knownHostsMtx sync.Mutex
+
+// hostKeyError is returned when the host key can't be trusted: either it
+// doesn't match the one from known_hosts, or it's unknown and it was rejected
+// (by the user, or due to StrictHostKeyChecking). We don't reconnect
+// automatically after this error, since it won't go away by itself.
+type hostKeyError struct {
+	msg string
+}
+
+func (e *hostKeyError) Error() string {
+	return e.msg
+}
+
+func isHostKeyError(err error) bool {
+	_, ok := errors.Cause(err).(*hostKeyError)
+	return ok
+}
+
+// hostKeyChecker verifies ssh host keys against the known_hosts files,
+// honoring the ssh options of the host (StrictHostKeyChecking etc), and asking
+// the user about unknown keys.
+type hostKeyChecker struct {
+	logger   *log.Logger
+	host     ConfigHost
+	prompter userPrompter
+
+	// userFiles and globalFiles are the known_hosts files, with all the "~" and
+	// tokens expanded. New keys are added to userFiles[0].
+	userFiles   []string
+	globalFiles []string
+
+	// err is the error returned from the last check, if any. We need it because
+	// the ssh package doesn't wrap the errors returned from the HostKeyCallback,
+	// so it's the only way to find out that connection failed due to the host
+	// key.
+	err error
+}
+
+func newHostKeyChecker(
+	logger *log.Logger, host ConfigHost, prompter userPrompter,
+) (*hostKeyChecker, error) {
+	opts := host.SSH
+	if opts == nil {
+		opts = &SSHOptions{}
+	}
+
+	userFiles := opts.UserKnownHostsFiles
+	if len(userFiles) == 0 {
+		userFiles = []string{"~/.ssh/known_hosts", "~/.ssh/known_hosts2"}
+	}
+
+	globalFiles := opts.GlobalKnownHostsFiles
+	if len(globalFiles) == 0 {
+		globalFiles = []string{"/etc/ssh/ssh_known_hosts", "/etc/ssh/ssh_known_hosts2"}
+	}
+
+	hkc := &hostKeyChecker{
+		logger:   logger,
+		host:     host,
+		prompter: prompter,
+	}
+
+	for _, f := range userFiles {
+		expanded, err := expandSSHPath(f)
+		if err != nil {
+			return nil, errors.Annotatef(err, "expanding %q", f)
+		}
+
+		hkc.userFiles = append(hkc.userFiles, expanded)
+	}
+
+	for _, f := range globalFiles {
+		expanded, err := expandSSHPath(f)
+		if err != nil {
+			return nil, errors.Annotatef(err, "expanding %q", f)
+		}
+
+		hkc.globalFiles = append(hkc.globalFiles, expanded)
+	}
+
+	return hkc, nil
+}
+
+// getCallback reads all existing known_hosts files and returns the callback
+// which checks keys against them.
+func (hkc *hostKeyChecker) getCallback() (ssh.HostKeyCallback, error) {
+	var existing []string
+	for _, f := range append(hkc.userFiles, hkc.globalFiles...) {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+
+	cb, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return cb, nil
+}
+
+// hostKeyAlgorithms returns the host key algorithms to use for the
+// connection: if there are some keys for the host in known_hosts, then only
+// algorithms for those key types are returned (otherwise the server might
+// choose some other key type, and we'd consider it a mismatch). If the host
+// is unknown, it returns nil, meaning the default algorithms.
+func (hkc *hostKeyChecker) hostKeyAlgorithms() ([]string, error) {
+	cb, err := hkc.getCallback()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// There is no API to get the known keys for a host, so we check some
+	// random key, and see what we get in the KeyError.
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	dummyKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = cb(hkc.host.Addr, &net.TCPAddr{IP: net.IPv4zero, Port: 22}, dummyKey)
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil, nil
+	}
+
+	var algos []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, known.Key.Type())
+		}
+	}
+
+	sort.Strings(algos)
+
+	return algos, nil
+}
+
+// check implements ssh.HostKeyCallback.
+func (hkc *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	hkc.err = hkc.checkInternal(hostname, remote, key)
+	return hkc.err
+}
+
+func (hkc *hostKeyChecker) checkInternal(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	cb, err := hkc.getCallback()
+	if err != nil {
+		return errors.Annotatef(err, "reading known_hosts")
+	}
+
+	err = cb(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	if err := hkc.checkKnownHostsErr(hostname, key, err); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The host is unknown. Take the lock and check again, since the key might
+	// have been added while we were waiting for the lock.
+	knownHostsMtx.Lock()
+	defer knownHostsMtx.Unlock()
+
+	cb, err = hkc.getCallback()
+	if err != nil {
+		return errors.Annotatef(err, "reading known_hosts")
+	}
+
+	err = cb(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	if err := hkc.checkKnownHostsErr(hostname, key, err); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Still unknown, so act according to StrictHostKeyChecking.
+	strict := ""
+	if hkc.host.SSH != nil {
+		strict = hkc.host.SSH.StrictHostKeyChecking
+	}
+
+	switch strict {
+	case "yes":
+		return &hostKeyError{
+			msg: fmt.Sprintf(
+				"host key for %s is unknown, and StrictHostKeyChecking is yes; add the key to %s and reconnect",
+				hostname, hkc.userFiles[0],
+			),
+		}
+
+	case "accept-new", "no", "off":
+		hkc.logger.Infof("Adding unknown host key for %s to %s", hostname, hkc.userFiles[0])
+
+	default:
+		msg := fmt.Sprintf(
+			"The authenticity of host %s can't be established.\n"+
+				"%s key fingerprint is %s.\n\n"+
+				"Are you sure you want to continue connecting?\n"+
+				"The key will be added to %s.",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), hkc.userFiles[0],
+		)
+
+		resp, err := hkc.prompter(newUserPrompt("", UserPromptKindConfirm, "Unknown host key", msg))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !resp.Yes {
+			return &hostKeyError{
+				msg: fmt.Sprintf("host key for %s is unknown, and it was rejected", hostname),
+			}
+		}
+	}
+
+	hashKnownHosts := hkc.host.SSH != nil && hkc.host.SSH.HashKnownHosts == "yes"
+	if err := appendKnownHost(hkc.userFiles[0], hostname, key, hashKnownHosts); err != nil {
+		return errors.Annotatef(err, "adding host key to %s", hkc.userFiles[0])
+	}
+
+	return nil
+}
+
+// checkKnownHostsErr takes the error returned from the knownhosts callback,
+// and if the host is just unknown, returns nil; otherwise returns the error
+// which should fail the connection.
+func (hkc *hostKeyChecker) checkKnownHostsErr(hostname string, key ssh.PublicKey, err error) error {
+	switch v := err.(type) {
+	case *knownhosts.KeyError:
+		if len(v.Want) == 0 {
+			return nil
+		}
+
+		var wantStrs []string
+		for _, known := range v.Want {
+			wantStrs = append(wantStrs, fmt.Sprintf("%s:%d", known.Filename, known.Line))
+		}
+
+		return &hostKeyError{
+			msg: fmt.Sprintf(
+				"HOST KEY FOR %s HAS CHANGED: the server offered %s key %s, which doesn't match the key(s) at %s. "+
+					"Someone could be doing a man-in-the-middle attack, or the host key has just been changed. "+
+					"If the change is expected, remove the old key (e.g. ssh-keygen -R %s) and reconnect",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(wantStrs, ", "),
+				knownhosts.Normalize(hostname),
+			),
+		}
+
+	case *knownhosts.RevokedError:
+		return &hostKeyError{
+			msg: fmt.Sprintf(
+				"host key for %s is revoked (%s:%d)",
+				hostname, v.Revoked.Filename, v.Revoked.Line,
+			),
+		}
+	}
+
+	return errors.Trace(err)
+}
+
+// appendKnownHost adds a line for the given host and key to the known_hosts
+// file, creating the file if needed.
+func appendKnownHost(filename, hostname string, key ssh.PublicKey, hash bool) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return errors.Trace(err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	var line string
+	if hash {
+		line = knownhosts.HashHostname(knownhosts.Normalize(hostname)) + " " +
+			strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	} else {
+		line = knownhosts.Line([]string{hostname}, key)
+	}
+
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// expandSSHPath expands the leading "~" and the tokens "%d" (home dir), "%u"
+// (local username) and "%%" in the paths from the ssh config.
+func expandSSHPath(p string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = homeDir + p[1:]
+	}
+
+	if !strings.Contains(p, "%") {
+		return p, nil
+	}
+
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	replacer := strings.NewReplacer("%d", homeDir, "%u", username, "%%", "%")
+	return replacer.Replace(p), nil
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("converting key: %s", err)
+	}
+
+	return key
+}
+
+func newTestHostKeyChecker(
+	t *testing.T, knownHostsFname string, opts SSHOptions, prompter userPrompter,
+) *hostKeyChecker {
+	t.Helper()
+
+	opts.UserKnownHostsFiles = []string{knownHostsFname}
+	opts.GlobalKnownHostsFiles = []string{knownHostsFname + "_global"}
+
+	hkc, err := newHostKeyChecker(log.NewLogger(log.Error), ConfigHost{
+		Addr: "myhost.com:22",
+		User: "myuser",
+		SSH:  &opts,
+	}, prompter)
+	if err != nil {
+		t.Fatalf("creating host key checker: %s", err)
+	}
+
+	return hkc
+}
+
+var testRemoteAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+
+func TestHostKeyCheckerAcceptNew(t *testing.T) {
+	knownHostsFname := filepath.Join(t.TempDir(), "known_hosts")
+	key := newTestHostKey(t)
+
+	hkc := newTestHostKeyChecker(t, knownHostsFname, SSHOptions{
+		StrictHostKeyChecking: "accept-new",
+	}, nil)
+
+	// No known keys yet, so default algorithms.
+	algos, err := hkc.hostKeyAlgorithms()
+	assert.NoError(t, err)
+	assert.Nil(t, algos)
+
+	// Unknown key gets added.
+	assert.NoError(t, hkc.check("myhost.com:22", testRemoteAddr, key))
+
+	data, err := os.ReadFile(knownHostsFname)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "myhost.com ssh-ed25519 "), "got %q", string(data))
+
+	// Now it's known, and only the ed25519 algo should be used.
+	assert.NoError(t, hkc.check("myhost.com:22", testRemoteAddr, key))
+
+	algos, err = hkc.hostKeyAlgorithms()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ssh.KeyAlgoED25519}, algos)
+
+	// A different key for the same host is a hard error.
+	err = hkc.check("myhost.com:22", testRemoteAddr, newTestHostKey(t))
+	assert.True(t, isHostKeyError(err), "unexpected error %v", err)
+	assert.Contains(t, err.Error(), "HAS CHANGED")
+}
+
+func TestHostKeyCheckerStrict(t *testing.T) {
+	knownHostsFname := filepath.Join(t.TempDir(), "known_hosts")
+
+	hkc := newTestHostKeyChecker(t, knownHostsFname, SSHOptions{
+		StrictHostKeyChecking: "yes",
+	}, nil)
+
+	err := hkc.check("myhost.com:22", testRemoteAddr, newTestHostKey(t))
+	assert.True(t, isHostKeyError(err), "unexpected error %v", err)
+
+	_, err = os.Stat(knownHostsFname)
+	assert.True(t, os.IsNotExist(err), "known_hosts should not be created")
+}
+
+func TestHostKeyCheckerAsk(t *testing.T) {
+	knownHostsFname := filepath.Join(t.TempDir(), "known_hosts")
+	key := newTestHostKey(t)
+
+	var prompts []*UserPrompt
+	answer := false
+	prompter := func(p *UserPrompt) (UserPromptResp, error) {
+		prompts = append(prompts, p)
+		return UserPromptResp{Yes: answer}, nil
+	}
+
+	hkc := newTestHostKeyChecker(t, knownHostsFname, SSHOptions{
+		HashKnownHosts: "yes",
+	}, prompter)
+
+	// Rejected by the user.
+	err := hkc.check("myhost.com:22", testRemoteAddr, key)
+	assert.True(t, isHostKeyError(err), "unexpected error %v", err)
+	assert.Equal(t, 1, len(prompts))
+	assert.Equal(t, UserPromptKindConfirm, prompts[0].Kind)
+	assert.Contains(t, prompts[0].Message, ssh.FingerprintSHA256(key))
+
+	// Accepted by the user, and the hostname is hashed.
+	answer = true
+	assert.NoError(t, hkc.check("myhost.com:22", testRemoteAddr, key))
+	assert.Equal(t, 2, len(prompts))
+
+	data, err := os.ReadFile(knownHostsFname)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "|1|"), "got %q", string(data))
+
+	// Now it's known, so no more prompts.
+	assert.NoError(t, hkc.check("myhost.com:22", testRemoteAddr, key))
+	assert.Equal(t, 2, len(prompts))
+}
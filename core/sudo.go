@@ -0,0 +1,112 @@
+package core
+
+import (
+	"path"
+	"strings"
+)
+
+const defaultSudoCmd = "sudo"
+
+// cmd returns the privilege escalation command, like "sudo" or "doas".
+func (s *LogStreamSudo) cmd() string {
+	if s.Cmd == "" {
+		return defaultSudoCmd
+	}
+
+	return s.Cmd
+}
+
+// supportsPassword returns whether the escalation command can read the
+// password from stdin; only sudo can do that (with -S).
+func (s *LogStreamSudo) supportsPassword() bool {
+	fields := strings.Fields(s.cmd())
+	return len(fields) > 0 && path.Base(fields[0]) == defaultSudoCmd
+}
+
+// shellPrefix returns the prefix for a shell command (like
+// "bash nerdlog_agent.sh query ...") to run it as the sudo user.
+//
+// If password is empty, the command runs non-interactively (with -n), and
+// fails if the password is required; otherwise the password is fed to sudo
+// via stdin, so the command itself gets an empty stdin. The password is
+// printed by the shell builtin printf, so it doesn't show up in the process
+// list.
+//
+// If s is nil, the prefix is empty.
+func (s *LogStreamSudo) shellPrefix(password string) string {
+	if s == nil {
+		return ""
+	}
+
+	if password == "" {
+		return s.escalationCmd(false)
+	}
+
+	return "printf '%s\\n' " + shellQuote(password) + " | " + s.escalationCmd(true)
+}
+
+// shellPrefixWithStdin is like shellPrefix, but the command gets the output of
+// the given shell command stdinCmd as its stdin.
+//
+// With the password, it's fed to sudo right before the output of stdinCmd;
+// sudo reads it one byte at a time up to the newline, so it doesn't consume
+// anything past it. The cached credentials are ignored (with -k) to make sure
+// that sudo does read the password. NOTE that if the password is wrong, sudo
+// is going to try the following lines as passwords too, so the password
+// should be checked by the time this prefix is used.
+//
+// If s is nil, the prefix is empty, and the stdin isn't redirected.
+func (s *LogStreamSudo) shellPrefixWithStdin(password, stdinCmd string) string {
+	if s == nil {
+		return ""
+	}
+
+	if password == "" {
+		return stdinCmd + " | " + s.escalationCmd(false)
+	}
+
+	return "{ printf '%s\\n' " + shellQuote(password) + "; " + stdinCmd + "; } | " +
+		s.escalationCmd(true, "-k")
+}
+
+// escalationCmd returns the escalation command with the flags, followed by
+// a space. If withPassword is true, the password is read from stdin,
+// otherwise the command runs non-interactively.
+func (s *LogStreamSudo) escalationCmd(withPassword bool, extraFlags ...string) string {
+	parts := []string{s.cmd()}
+
+	if withPassword {
+		parts = append(parts, "-S", "-p", "''")
+	} else {
+		parts = append(parts, "-n")
+	}
+
+	parts = append(parts, extraFlags...)
+
+	if s.User != "" {
+		parts = append(parts, "-u", shellQuote(s.User))
+	}
+
+	return strings.Join(parts, " ") + " "
+}
+
+// redactSudoPassword returns a copy of the shell command cmd, built using
+// shellPrefix(password), with the password replaced by asterisks, so that the
+// command can be logged.
+func redactSudoPassword(cmd, password string) string {
+	if password == "" {
+		return cmd
+	}
+
+	return strings.ReplaceAll(cmd, shellQuote(password), "'***'")
+}
+
+// isSudoPasswordLine returns whether the given stderr line from the escalation
+// command means that it needs a password (or that the one we've provided is
+// wrong).
+func isSudoPasswordLine(line string) bool {
+	return strings.Contains(line, "a password is required") ||
+		strings.Contains(line, "a terminal is required") ||
+		strings.Contains(line, "incorrect password") ||
+		strings.Contains(line, "no password was provided")
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogStreamSudoShellPrefix(t *testing.T) {
+	var none *LogStreamSudo
+	assert.Equal(t, "", none.shellPrefix(""))
+
+	sudo := &LogStreamSudo{}
+	assert.True(t, sudo.supportsPassword())
+	assert.Equal(t, "sudo -n ", sudo.shellPrefix(""))
+	assert.Equal(t, `printf '%s\n' 'it'"'"'s secret' | sudo -S -p '' `, sudo.shellPrefix("it's secret"))
+
+	sudoUser := &LogStreamSudo{User: "postgres", Cmd: "/usr/bin/sudo"}
+	assert.True(t, sudoUser.supportsPassword())
+	assert.Equal(t, "/usr/bin/sudo -n -u 'postgres' ", sudoUser.shellPrefix(""))
+
+	doas := &LogStreamSudo{Cmd: "doas"}
+	assert.False(t, doas.supportsPassword())
+	assert.Equal(t, "doas -n ", doas.shellPrefix(""))
+}
+
+func TestLogStreamSudoShellPrefixWithStdin(t *testing.T) {
+	var none *LogStreamSudo
+	assert.Equal(t, "", none.shellPrefixWithStdin("", "cat foo"))
+
+	sudo := &LogStreamSudo{User: "postgres"}
+	assert.Equal(t, "cat foo | sudo -n -u 'postgres' ", sudo.shellPrefixWithStdin("", "cat foo"))
+	assert.Equal(
+		t,
+		`{ printf '%s\n' 'secret'; cat foo; } | sudo -S -p '' -k -u 'postgres' `,
+		sudo.shellPrefixWithStdin("secret", "cat foo"),
+	)
+}
+
+func TestRedactSudoPassword(t *testing.T) {
+	sudo := &LogStreamSudo{User: "postgres"}
+
+	cmd := sudo.shellPrefix("it's secret") + "bash agent.sh query"
+	assert.Equal(
+		t,
+		`printf '%s\n' '***' | sudo -S -p '' -u 'postgres' bash agent.sh query`,
+		redactSudoPassword(cmd, "it's secret"),
+	)
+
+	cmd = sudo.shellPrefix("") + "bash agent.sh query"
+	assert.Equal(t, cmd, redactSudoPassword(cmd, ""))
+}
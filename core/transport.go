@@ -0,0 +1,128 @@
+package core
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// TransportKind specifies how nerdlog gets to the shell on the logstream
+// host.
+type TransportKind string
+
+const (
+	// TransportSSH uses the ssh client built into nerdlog. It's the default.
+	TransportSSH TransportKind = "ssh"
+
+	// TransportSSHBin runs the system ssh binary, as "ssh -T host bash", so
+	// that all of its features are available: ControlMaster, FIDO keys,
+	// GSSAPI, certificates, Match blocks in the ssh config, etc. Since there is
+	// no terminal, ssh can't ask for anything, so e.g. the keys must be in the
+	// ssh agent, and the host keys must be known already.
+	TransportSSHBin TransportKind = "ssh-bin"
+
+	// TransportLocal runs bash on the local machine, so no ssh is needed at
+	// all. The host of such logstreams is ignored.
+	TransportLocal TransportKind = "local"
+)
+
+func (k TransportKind) isValid() bool {
+	_, err := getTransport(k)
+	return err == nil
+}
+
+// lstreamTransport starts the shell (bash) on the logstream host, and
+// provides its stdio. The rest of the protocol (bootstrap, commands and their
+// markers) is the same for all the transports.
+type lstreamTransport interface {
+	connect(logger *log.Logger, logStream LogStream, prompter userPrompter) (*connCtx, error)
+}
+
+func getTransport(kind TransportKind) (lstreamTransport, error) {
+	switch kind {
+	case "", TransportSSH:
+		return &sshTransport{}, nil
+	case TransportSSHBin:
+		return &sshBinTransport{binary: "ssh"}, nil
+	case TransportLocal:
+		return &localTransport{}, nil
+	}
+
+	return nil, errors.Errorf("unknown transport %q", kind)
+}
+
+// shellCmdStr returns the given command as a string for the shell to run,
+// with every arg quoted.
+func shellCmdStr(cmd []string) string {
+	quoted := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// shellReadyTimeout is how long we wait for the shell to respond after the
+// transport has started it. It's larger than the default dial timeout, since
+// for some transports (like TransportSSHBin) the actual connection happens
+// during this time.
+const shellReadyTimeout = 30 * time.Second
+
+// shellReadyMarker is echoed by the shell once it's ready.
+const shellReadyMarker = "shell_ready"
+
+// waitShellReady makes sure that the shell is actually running and responding
+// to commands, by echoing a marker and waiting for it. Anything which the
+// shell prints before that (e.g. some welcome messages) is discarded. If the
+// shell exits instead (e.g. the ssh binary failed to connect), the error
+// contains whatever it has printed to stderr.
+func waitShellReady(conn *connCtx) error {
+	// If the shell has already exited, writing fails, but we still want to
+	// know what it printed to stderr, so only remember the error for now.
+	_, writeErr := conn.stdinBuf.Write([]byte("echo " + shellReadyMarker + "\n"))
+
+	var stderrLines []string
+	stdoutLinesCh := conn.stdoutLinesCh
+	stderrLinesCh := conn.stderrLinesCh
+
+	timeout := time.After(shellReadyTimeout)
+
+	for {
+		select {
+		case line, ok := <-stdoutLinesCh:
+			if !ok {
+				stdoutLinesCh = nil
+				break
+			}
+
+			if line == shellReadyMarker {
+				return nil
+			}
+
+		case line, ok := <-stderrLinesCh:
+			if !ok {
+				stderrLinesCh = nil
+				break
+			}
+
+			stderrLines = append(stderrLines, line)
+
+		case <-timeout:
+			return errors.Errorf("timed out waiting for the shell to start")
+		}
+
+		if stdoutLinesCh == nil && stderrLinesCh == nil {
+			if len(stderrLines) == 0 {
+				if writeErr != nil {
+					return errors.Annotatef(writeErr, "shell exited")
+				}
+				return errors.Errorf("shell exited")
+			}
+
+			return errors.Errorf("shell exited: %s", strings.Join(stderrLines, "; "))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/juju/errors"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// startExecConn starts the given command (which is expected to eventually
+// run bash, maybe on some other machine), and returns the connCtx to talk to
+// it via its stdio. It's used by all the transports which shell out to some
+// binary, like the ssh binary or just bash for the local logstreams.
+func startExecConn(logger *log.Logger, cmd *exec.Cmd) (*connCtx, error) {
+	stdinBuf, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Not using cmd.StdoutPipe and cmd.StderrPipe here, because then we'd have
+	// to wait until everything is read before calling cmd.Wait; with our own
+	// pipes, we can wait for the process right away, and the readers just get
+	// EOF once it exits.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinBuf.Close()
+		return nil, errors.Trace(err)
+	}
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinBuf.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, errors.Trace(err)
+	}
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+
+	// The write ends now belong to the child process.
+	stdoutW.Close()
+	stderrW.Close()
+
+	if err != nil {
+		stdinBuf.Close()
+		stdoutR.Close()
+		stderrR.Close()
+		return nil, errors.Annotatef(err, "running %s", cmd.Path)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		logger.Verbose1f("%s exited: %v", cmd.Path, err)
+	}()
+
+	return newConnCtx(stdinBuf, stdoutR, stderrR, func() {
+		stdinBuf.Close()
+		cmd.Process.Kill()
+	}), nil
+}
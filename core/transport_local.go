@@ -0,0 +1,35 @@
+package core
+
+import (
+	"os/exec"
+
+	"github.com/juju/errors"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// localLStreamPrefix is the logstream spec for the local logstreams: either
+// just "local", or with the log files like "local:/var/log/app.log".
+const localLStreamPrefix = "local"
+
+// localTransport is the TransportLocal: it just runs bash on the local
+// machine, no ssh involved at all.
+type localTransport struct{}
+
+var _ lstreamTransport = &localTransport{}
+
+func (t *localTransport) connect(
+	logger *log.Logger, logStream LogStream, prompter userPrompter,
+) (*connCtx, error) {
+	shellCmd := logStream.ShellCmd
+	if len(shellCmd) == 0 {
+		shellCmd = []string{"bash"}
+	}
+
+	conn, err := startExecConn(logger, exec.Command(shellCmd[0], shellCmd[1:]...))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return conn, nil
+}
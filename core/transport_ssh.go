@@ -0,0 +1,89 @@
+package core
+
+import (
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// sshTransport is the TransportSSH: it uses the ssh client built into
+// nerdlog. The ssh connection is shared between all the logstreams on the
+// same host, and every logstream has its own session on it.
+type sshTransport struct{}
+
+var _ lstreamTransport = &sshTransport{}
+
+func (t *sshTransport) connect(
+	logger *log.Logger, logStream LogStream, prompter userPrompter,
+) (ret *connCtx, err error) {
+	var sshClient *sharedSSHClient
+	var sshSession *ssh.Session
+
+	// If we fail halfway, close whatever we've opened so far.
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if sshSession != nil {
+			sshSession.Close()
+		}
+
+		if sshClient != nil {
+			releaseSSHClient(sshClient)
+		}
+	}()
+
+	// The ssh client is shared between all the logstreams on the same host
+	// (and behind the same jumphosts), so include the jumphost into the host.
+	host := logStream.Host
+	host.Jumphost = logStream.Jumphost
+
+	sshClient, err = acquireSSHClient(logger, &host, prompter)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Every logstream has its own session on the shared client.
+	sshSession, err = sshClient.client.NewSession()
+	if err != nil {
+		if _, ok := err.(*ssh.OpenChannelError); ok {
+			err = errors.Annotatef(err, "server refused to open one more session (check MaxSessions in sshd_config)")
+		}
+		return nil, errors.Trace(err)
+	}
+
+	stdinBuf, err := sshSession.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stdoutBuf, err := sshSession.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	stderrBuf, err := sshSession.StderrPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(logStream.ShellCmd) > 0 {
+		err = sshSession.Start(shellCmdStr(logStream.ShellCmd))
+	} else {
+		err = sshSession.Shell()
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn := newConnCtx(stdinBuf, stdoutBuf, stderrBuf, func() {
+		stdinBuf.Close()
+		sshSession.Close()
+		releaseSSHClient(sshClient)
+	})
+	conn.rttFunc = sshClient.rtt
+
+	return conn, nil
+}
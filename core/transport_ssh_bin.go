@@ -0,0 +1,121 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+// sshBinTransport is the TransportSSHBin: it runs the system ssh binary as
+// "ssh -T host bash", and talks to the remote bash via the stdio of the ssh
+// process.
+type sshBinTransport struct {
+	// binary is the ssh binary to run; normally it's just "ssh", but tests
+	// override it.
+	binary string
+}
+
+var _ lstreamTransport = &sshBinTransport{}
+
+func (t *sshBinTransport) connect(
+	logger *log.Logger, logStream LogStream, prompter userPrompter,
+) (*connCtx, error) {
+	args := sshBinArgs(logStream)
+	logger.Verbose1f("Running %s %s", t.binary, strings.Join(args, " "))
+
+	conn, err := startExecConn(logger, exec.Command(t.binary, args...))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return conn, nil
+}
+
+// sshBinArgs returns the arguments for the ssh binary to get the shell on the
+// logstream host.
+func sshBinArgs(logStream LogStream) []string {
+	// There is no terminal, so ssh must not try to ask anything.
+	args := []string{"-T", "-o", "BatchMode=yes"}
+
+	// The hostname, port and user are always given explicitly, since they might
+	// come from the nerdlog config and override the ssh config. But if the host
+	// is in the ssh config, we still use its alias as the destination, so that
+	// the rest of the ssh config is applied as well.
+	hostname, port := splitHostPort(logStream.Host.Addr)
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if logStream.Host.User != "" {
+		args = append(args, "-l", logStream.Host.User)
+	}
+
+	// ConnectTimeout is in seconds, so round it up.
+	if dt := logStream.Host.DialTimeout; dt > 0 {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", (dt+time.Second-1)/time.Second))
+	}
+
+	dest := hostname
+	if logStream.Host.Alias != "" {
+		dest = logStream.Host.Alias
+		args = append(args, "-o", "HostName="+hostname)
+	}
+
+	if logStream.Jumphost != nil {
+		// The chain goes from the last hop back to the first one, but ssh wants
+		// it from the first one.
+		var hops []string
+		for hop := logStream.Jumphost; hop != nil; hop = hop.Jumphost {
+			hops = append([]string{sshBinHop(hop)}, hops...)
+		}
+
+		args = append(args, "-J", strings.Join(hops, ","))
+	}
+
+	// The "--" makes sure that the destination is never parsed as an option,
+	// even if it starts with a dash.
+	args = append(args, "--", dest)
+
+	// The remote command is interpreted by the remote shell.
+	if len(logStream.ShellCmd) > 0 {
+		return append(args, shellCmdStr(logStream.ShellCmd))
+	}
+
+	return append(args, "bash")
+}
+
+// sshBinHop returns the jumphost in the format of ssh's -J option.
+func sshBinHop(hop *ConfigHost) string {
+	if hop.Alias != "" {
+		return hop.Alias
+	}
+
+	hostname, port := splitHostPort(hop.Addr)
+
+	ret := hostname
+	if port != "" {
+		ret = net.JoinHostPort(hostname, port)
+	}
+
+	if hop.User != "" {
+		ret = hop.User + "@" + ret
+	}
+
+	return ret
+}
+
+// splitHostPort is like net.SplitHostPort, but if addr doesn't have a port,
+// it's returned as the hostname as is.
+func splitHostPort(addr string) (hostname, port string) {
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+
+	return hostname, port
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dimonomid/nerdlog/log"
+)
+
+func TestSSHBinArgs(t *testing.T) {
+	type testCase struct {
+		name      string
+		logStream LogStream
+		wantArgs  string
+	}
+
+	testCases := []testCase{
+		{
+			name: "no alias",
+			logStream: LogStream{
+				Host: ConfigHost{Addr: "myhost.com:2222", User: "myuser"},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 2222 -l myuser -- myhost.com bash",
+		},
+		{
+			name: "alias from the ssh config",
+			logStream: LogStream{
+				Host: ConfigHost{Addr: "myhost.com:22", User: "myuser", Alias: "myhost"},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 22 -l myuser -o HostName=myhost.com -- myhost bash",
+		},
+		{
+			name: "dial timeout",
+			logStream: LogStream{
+				Host: ConfigHost{Addr: "myhost.com:22", User: "myuser", DialTimeout: 2500 * time.Millisecond},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 22 -l myuser -o ConnectTimeout=3 -- myhost.com bash",
+		},
+		{
+			name: "multi-hop jumphost",
+			logStream: LogStream{
+				Host: ConfigHost{Addr: "inner.internal:22", User: "myuser"},
+				Jumphost: &ConfigHost{
+					Addr: "hop.internal:22",
+					User: "hopuser",
+					Jumphost: &ConfigHost{
+						Addr:  "bastion.com:2222",
+						User:  "jumpuser",
+						Alias: "bastion",
+					},
+				},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 22 -l myuser -J bastion,hopuser@hop.internal:22 -- inner.internal bash",
+		},
+		{
+			name: "hostname starting with a dash",
+			logStream: LogStream{
+				Host: ConfigHost{Addr: "-oProxyCommand=evil:22", User: "myuser"},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 22 -l myuser -- -oProxyCommand=evil bash",
+		},
+		{
+			name: "custom shell command",
+			logStream: LogStream{
+				Host:     ConfigHost{Addr: "myhost.com:22", User: "myuser"},
+				ShellCmd: []string{"docker", "exec", "-i", "my ctr", "bash"},
+			},
+			wantArgs: "-T -o BatchMode=yes -p 22 -l myuser -- myhost.com 'docker' 'exec' '-i' 'my ctr' 'bash'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantArgs, strings.Join(sshBinArgs(tc.logStream), " "))
+		})
+	}
+}
+
+// writeFakeSSH writes a shell script which pretends to be the ssh binary, and
+// returns its path.
+func writeFakeSSH(t *testing.T, script string) string {
+	t.Helper()
+
+	fname := filepath.Join(t.TempDir(), "ssh")
+	if err := os.WriteFile(fname, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("writing fake ssh: %s", err)
+	}
+
+	return fname
+}
+
+func TestSSHBinTransport(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+
+	logger := log.NewLogger(log.Error)
+	logStream := LogStream{
+		Name: "myhost",
+		Host: ConfigHost{Addr: "myhost.com:22", User: "myuser"},
+	}
+
+	t.Run("shell is running", func(t *testing.T) {
+		// Instead of connecting anywhere, just run the last arg (which is bash).
+		transport := &sshBinTransport{
+			binary: writeFakeSSH(t, `for last; do :; done; exec "$last"`),
+		}
+
+		conn, err := transport.connect(logger, logStream, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.close()
+
+		assert.NoError(t, waitShellReady(conn))
+
+		_, err = conn.stdinBuf.Write([]byte("echo hello $((1+2))\n"))
+		assert.NoError(t, err)
+
+		select {
+		case line := <-conn.stdoutLinesCh:
+			assert.Equal(t, "hello 3", line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the output")
+		}
+	})
+
+	t.Run("ssh fails to connect", func(t *testing.T) {
+		transport := &sshBinTransport{
+			binary: writeFakeSSH(t, `echo "ssh: connect to host myhost.com port 22: Connection refused" >&2; exit 255`),
+		}
+
+		conn, err := transport.connect(logger, logStream, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.close()
+
+		err = waitShellReady(conn)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "Connection refused")
+		}
+	})
+}
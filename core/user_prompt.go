@@ -0,0 +1,102 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// UserPromptKind specifies what kind of answer is expected from the user.
+type UserPromptKind string
+
+const (
+	// UserPromptKindConfirm is a yes/no question.
+	UserPromptKindConfirm UserPromptKind = "confirm"
+
+	// UserPromptKindSecret asks for some secret text like a password or a key
+	// passphrase; the input should not be echoed.
+	UserPromptKindSecret UserPromptKind = "secret"
+
+	// UserPromptKindText asks for some non-secret text, e.g. a username asked
+	// by the server during keyboard-interactive authentication.
+	UserPromptKindText UserPromptKind = "text"
+)
+
+// UserPrompt is a question which some LStreamClient needs the user to answer
+// before it can proceed; e.g. whether an unknown host key should be trusted.
+//
+// It's delivered to the client code as part of LStreamsManagerUpdate, and the
+// client code must eventually call Respond, otherwise the LStreamClient will
+// keep waiting.
+type UserPrompt struct {
+	// LStreamName is the name of the logstream which needs the answer.
+	LStreamName string
+
+	Kind    UserPromptKind
+	Title   string
+	Message string
+
+	respCh chan UserPromptResp
+
+	doneCh   chan struct{}
+	doneOnce sync.Once
+}
+
+// UserPromptResp is the user's answer to the UserPrompt.
+type UserPromptResp struct {
+	// Yes is the answer to a UserPromptKindConfirm prompt. For the text and
+	// secret prompts, Yes is true if the user has submitted the text, and false
+	// if the prompt was cancelled.
+	Yes bool
+
+	// Text is the answer to a UserPromptKindSecret or UserPromptKindText prompt.
+	Text string
+}
+
+func newUserPrompt(lstreamName string, kind UserPromptKind, title, message string) *UserPrompt {
+	return &UserPrompt{
+		LStreamName: lstreamName,
+
+		Kind:    kind,
+		Title:   title,
+		Message: message,
+
+		respCh: make(chan UserPromptResp, 1),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// Respond delivers the user's answer to the LStreamClient which is waiting for
+// it. Only the first call has any effect, the subsequent ones are no-op.
+func (p *UserPrompt) Respond(resp UserPromptResp) {
+	select {
+	case p.respCh <- resp:
+	default:
+	}
+
+	p.done()
+}
+
+// Done returns a channel which is closed once the prompt doesn't need an
+// answer anymore: either it was answered, or it was abandoned (e.g. because
+// the connection attempt was aborted). In the latter case, the client code
+// should stop showing the prompt to the user.
+func (p *UserPrompt) Done() <-chan struct{} {
+	return p.doneCh
+}
+
+func (p *UserPrompt) done() {
+	p.doneOnce.Do(func() {
+		close(p.doneCh)
+	})
+}
+
+// errPromptAborted is returned by userPrompter if the prompt was abandoned
+// before the user answered it, e.g. because the connection attempt was
+// aborted.
+var errPromptAborted = errors.New("prompt aborted")
+
+// userPrompter is used by the code which needs to ask the user something
+// while connecting to a logstream (e.g. whether to trust an unknown host key):
+// it delivers the prompt to the user and blocks until the answer is received.
+type userPrompter func(p *UserPrompt) (UserPromptResp, error)
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserPromptDone(t *testing.T) {
+	isDone := func(p *UserPrompt) bool {
+		select {
+		case <-p.Done():
+			return true
+		default:
+			return false
+		}
+	}
+
+	updatesCh := make(chan *LStreamClientUpdate, 2)
+	lsc := &LStreamClient{
+		params: LStreamClientParams{
+			LogStream: LogStream{Name: "mylstream"},
+			UpdatesCh: updatesCh,
+		},
+	}
+
+	// Answered prompt.
+	prompter := lsc.makeUserPrompter(nil)
+	p := newUserPrompt("", UserPromptKindConfirm, "Title", "Message")
+	assert.False(t, isDone(p))
+
+	p.Respond(UserPromptResp{Yes: true})
+	resp, err := prompter(p)
+	assert.NoError(t, err)
+	assert.True(t, resp.Yes)
+	assert.True(t, isDone(p))
+	assert.Equal(t, p, (<-updatesCh).UserPrompt)
+
+	// Abandoned prompt.
+	abortCh := make(chan struct{})
+	close(abortCh)
+
+	prompter = lsc.makeUserPrompter(abortCh)
+	p = newUserPrompt("", UserPromptKindConfirm, "Title", "Message")
+
+	_, err = prompter(p)
+	assert.Equal(t, errPromptAborted, errors.Cause(err))
+	assert.True(t, isDone(p))
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"strings"
+)
+
+// workDirShellVar is the name of the shell variable which is set by the
+// script returned from workDirShellScript.
+const workDirShellVar = "nerdlog_work_dir"
+
+// workDirShellScript returns the shell script which figures out the directory
+// on the logstream host to keep the nerdlog files in, creates it if needed,
+// and sets the nerdlog_work_dir shell variable to its path. If no usable dir
+// could be found, it prints an "error:..." line (prefixed with
+// $nerdlog_marker_prefix, if set) and exits with the code 1, so it's supposed
+// to run in a subshell.
+//
+// If configured is not empty, only that dir is tried. Otherwise the first
+// usable one from the following list is used: $XDG_RUNTIME_DIR/nerdlog,
+// ~/.cache/nerdlog, and a private dir with a random name in /tmp (which is
+// reused on the subsequent runs).
+//
+// The dir is only considered usable if it's a real directory (not a symlink)
+// owned by the current user, and its permissions are set to 0700, so that
+// the other users can't mess with the files in it.
+func workDirShellScript(configured string) string {
+	var sb strings.Builder
+
+	sb.WriteString(`  nerdlog_try_work_dir() {
+    mkdir -p "$1" 2>/dev/null && [ -d "$1" ] && [ ! -L "$1" ] && [ -O "$1" ] && chmod 0700 "$1" 2>/dev/null
+  }
+`)
+
+	if configured != "" {
+		sb.WriteString("  " + workDirShellVar + "=" + workDirShellExpr(configured) + "\n")
+		sb.WriteString(`  if ! nerdlog_try_work_dir "$nerdlog_work_dir"; then
+    echo "${nerdlog_marker_prefix}error:work dir $nerdlog_work_dir can't be used: it must be a directory owned by $(id -un)"
+    exit 1
+  fi
+`)
+
+		return sb.String()
+	}
+
+	sb.WriteString(`  if [ -n "$XDG_RUNTIME_DIR" ] && nerdlog_try_work_dir "$XDG_RUNTIME_DIR/nerdlog"; then
+    nerdlog_work_dir="$XDG_RUNTIME_DIR/nerdlog"
+  elif [ -n "$HOME" ] && nerdlog_try_work_dir "$HOME/.cache/nerdlog"; then
+    nerdlog_work_dir="$HOME/.cache/nerdlog"
+  else
+    nerdlog_work_dir="$(find /tmp -maxdepth 1 -type d -name "nerdlog-$(id -u)-*" -user "$(id -u)" -perm 0700 2>/dev/null | head -n 1)"
+    if [ -z "$nerdlog_work_dir" ]; then
+      nerdlog_work_dir="$(mktemp -d "/tmp/nerdlog-$(id -u)-XXXXXXXXXX")"
+      if [ $? != 0 ]; then
+        echo "${nerdlog_marker_prefix}error:failed to create the work dir in /tmp"
+        exit 1
+      fi
+    fi
+  fi
+`)
+
+	return sb.String()
+}
+
+// workDirShellExpr returns the shell expression for the configured work dir:
+// it's quoted, except for the "~" at the beginning, which is replaced with
+// $HOME.
+func workDirShellExpr(dir string) string {
+	switch {
+	case dir == "~":
+		return `"$HOME"`
+	case strings.HasPrefix(dir, "~/"):
+		return `"$HOME"/` + shellQuote(strings.TrimPrefix(dir, "~/"))
+	default:
+		return shellQuote(dir)
+	}
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runWorkDirShellScript runs the script returned by workDirShellScript with
+// the given env vars, and returns the resulting work dir and the output.
+func runWorkDirShellScript(
+	t *testing.T, configured string, env ...string,
+) (workDir string, output string, err error) {
+	t.Helper()
+
+	script := "(\n" + workDirShellScript(configured) + "  echo \"work_dir:$nerdlog_work_dir\"\n)\n"
+
+	cmd := exec.Command("/bin/bash", "-c", script)
+	cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, env...)
+
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "work_dir:") {
+			workDir = strings.TrimPrefix(line, "work_dir:")
+		}
+	}
+
+	return workDir, string(out), err
+}
+
+func TestWorkDirShellScript(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	xdgDir := filepath.Join(tmpDir, "xdg")
+	homeDir := filepath.Join(tmpDir, "home")
+	assert.NoError(t, os.Mkdir(xdgDir, 0700))
+	assert.NoError(t, os.Mkdir(homeDir, 0755))
+
+	checkDir := func(dir string) {
+		t.Helper()
+
+		fi, err := os.Lstat(dir)
+		if assert.NoError(t, err) {
+			assert.True(t, fi.IsDir())
+			assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+		}
+	}
+
+	// $XDG_RUNTIME_DIR is preferred.
+	workDir, out, err := runWorkDirShellScript(t, "", "XDG_RUNTIME_DIR="+xdgDir, "HOME="+homeDir)
+	assert.NoError(t, err, out)
+	assert.Equal(t, filepath.Join(xdgDir, "nerdlog"), workDir)
+	checkDir(workDir)
+
+	// Then, ~/.cache/nerdlog.
+	workDir, out, err = runWorkDirShellScript(t, "", "HOME="+homeDir)
+	assert.NoError(t, err, out)
+	assert.Equal(t, filepath.Join(homeDir, ".cache", "nerdlog"), workDir)
+	checkDir(workDir)
+
+	// If the dir is there but with wrong permissions, they're fixed.
+	assert.NoError(t, os.Chmod(workDir, 0777))
+	workDir, out, err = runWorkDirShellScript(t, "", "HOME="+homeDir)
+	assert.NoError(t, err, out)
+	checkDir(workDir)
+
+	// The configured one, with "~" expanded.
+	workDir, out, err = runWorkDirShellScript(t, "~/my nerdlog", "XDG_RUNTIME_DIR="+xdgDir, "HOME="+homeDir)
+	assert.NoError(t, err, out)
+	assert.Equal(t, filepath.Join(homeDir, "my nerdlog"), workDir)
+	checkDir(workDir)
+
+	// A symlink is not accepted, since it might point to somebody else's dir.
+	symlinkDir := filepath.Join(tmpDir, "symlink")
+	assert.NoError(t, os.Symlink(xdgDir, symlinkDir))
+	_, out, err = runWorkDirShellScript(t, symlinkDir, "HOME="+homeDir)
+	assert.Error(t, err)
+	assert.Contains(t, out, "error:work dir "+symlinkDir+" can't be used")
+
+	// As a last resort, a private dir in /tmp with a random name is created,
+	// and then reused. Make HOME unusable by putting it under a regular file.
+	regularFile := filepath.Join(tmpDir, "regular_file")
+	assert.NoError(t, os.WriteFile(regularFile, nil, 0644))
+
+	workDir, out, err = runWorkDirShellScript(t, "", "HOME="+filepath.Join(regularFile, "home"))
+	assert.NoError(t, err, out)
+	assert.True(t, strings.HasPrefix(workDir, "/tmp/nerdlog-"), workDir)
+	checkDir(workDir)
+
+	workDir2, out, err := runWorkDirShellScript(t, "", "HOME="+filepath.Join(regularFile, "home"))
+	assert.NoError(t, err, out)
+	assert.Equal(t, workDir, workDir2)
+}